@@ -20,6 +20,7 @@ import (
 	"encoding/json"
 	"errors"
 	"fmt"
+	"hash/fnv"
 	"math/rand"
 	"strconv"
 	"strings"
@@ -33,6 +34,9 @@ import (
 // JetStream allows persistent messaging through JetStream.
 type JetStream interface {
 	// Publish publishes a message to JetStream.
+	// If the message is rejected by the stream, the returned error is the
+	// *APIError of the response, which can be matched with errors.Is() against
+	// errors such as ErrWrongLastSequence or ErrStreamStoreFailed.
 	Publish(subj string, data []byte, opts ...PubOpt) (*PubAck, error)
 
 	// PublishMsg publishes a Msg to JetStream.
@@ -102,6 +106,66 @@ type JetStream interface {
 	// See important note in Subscribe(). Additionally, for an ephemeral pull consumer, the "durable" value must be
 	// set to an empty string.
 	PullSubscribe(subj, durable string, opts ...SubOpt) (*Subscription, error)
+
+	// EphemeralPullSubscribe creates a pull Subscription on a new ephemeral
+	// consumer of the given stream, delivering the messages matching filter.
+	// The consumer is removed by the server once inactive, see InactiveThreshold().
+	// Options such as ConsumerMemoryStorage() and ConsumerReplicas() can be
+	// used to configure it, but it can not be durable or bound.
+	EphemeralPullSubscribe(stream, filter string, opts ...SubOpt) (*Subscription, error)
+
+	// ReplayFrom creates a pull Subscription on a consumer of the given stream
+	// delivering the messages matching filter stored since start, see StartTime().
+	// The consumer is ephemeral unless Durable() is given.
+	ReplayFrom(stream string, start time.Time, filter string, opts ...SubOpt) (*Subscription, error)
+
+	// ConsumeMulti delivers the messages of several existing consumers, possibly
+	// of different streams, to a single handler, which is not called concurrently.
+	// Push consumers are bound with Subscribe() and pull consumers are fetched
+	// from in the background. The options are applied to each subscription.
+	// Messages are acknowledged once the handler returns, unless ManualAck()
+	// is given.
+	ConsumeMulti(refs []ConsumerRef, cb MsgHandler, opts ...SubOpt) (*MultiSubscription, error)
+
+	// Consume binds to an existing pull consumer and passes its messages to
+	// the handler, fetching them in the background until the subscription is
+	// closed. By default no stream or consumer info is requested (see
+	// SkipConsumerLookup()), so only the consumer's next message and ack
+	// subjects need to be allowed. ConsumeAckBatch() and ConsumeRefreshConfig()
+	// do look the consumer up, as does a refresh of the pull parameters when
+	// the server rejects a pull request with a 409 status.
+	// Messages are acknowledged once the handler returns, unless ManualAck() is
+	// given. Fetch errors are reported by Subscription.LastError(). See
+	// ConsumeRecreateOnDelete() to recreate the consumer if it is deleted,
+	// ConsumeRefreshConfig() to apply consumer updates while consuming, and
+	// ConsumeWaitForReady() to fail if the consumer can not deliver messages.
+	Consume(stream, consumer string, cb MsgHandler, opts ...SubOpt) (*Subscription, error)
+
+	// Tail delivers the messages published on the subject from now on to the
+	// handler, through an ordered consumer (see OrderedConsumer()), which is
+	// removed once the subscription is closed. Use DeliverLastN() to also
+	// receive the last messages of the stream, and nats.Context() to close the
+	// subscription when the context is done.
+	Tail(subj string, cb MsgHandler, opts ...SubOpt) (*Subscription, error)
+
+	// AckBySubject acknowledges a message using its ack subject, as returned
+	// by Msg.AckSubject(). This allows a message to be acknowledged out-of-band,
+	// from another goroutine, connection or process.
+	// If nats.AckWait(), nats.Context() or nats.AckSyncRetries() options are provided, the ack is sent
+	// synchronously and waits for the server confirmation.
+	AckBySubject(ackSubject string, opts ...AckOpt) error
+
+	// Drain gracefully stops all subscriptions created through this context
+	// and waits until they are closed and all outstanding async publishes
+	// have completed. The underlying connection is not closed.
+	// The wait is bounded by nats.MaxWait() or nats.Context() options,
+	// defaulting to the context's request timeout.
+	Drain(opts ...JSOpt) error
+
+	// Stats returns a snapshot of the counters of the operations done
+	// through this context, including its subscriptions, key value and
+	// object stores.
+	Stats() JetStreamStats
 }
 
 // JetStreamContext allows JetStream messaging and stream management.
@@ -148,9 +212,15 @@ const (
 	// apiRequestNextT is the prefix for the request next message(s) for a consumer in worker/pull mode.
 	apiRequestNextT = "CONSUMER.MSG.NEXT.%s.%s"
 
+	// jsAckSampleT is the subject of the ack samples of a consumer.
+	jsAckSampleT = "$JS.EVENT.METRIC.CONSUMER.ACK.%s.%s"
+
 	// apiConsumerDeleteT is used to delete consumers.
 	apiConsumerDeleteT = "CONSUMER.DELETE.%s.%s"
 
+	// apiConsumerResetT is used to rewind consumers to a new starting sequence.
+	apiConsumerResetT = "CONSUMER.RESET.%s.%s"
+
 	// apiConsumerListT is used to return all detailed consumer information
 	apiConsumerListT = "CONSUMER.LIST.%s"
 
@@ -212,6 +282,15 @@ const (
 
 	// defaultAsyncPubAckInflight is the number of async pub acks inflight.
 	defaultAsyncPubAckInflight = 4000
+
+	// defaultEphemeralInactiveThreshold is the inactivity threshold set on
+	// the ephemeral consumers created by the library, such as the ones
+	// recreated by Consume(), if not provided.
+	defaultEphemeralInactiveThreshold = 5 * time.Second
+
+	// defaultAckWait is the ack wait of consumers not setting one, as
+	// applied by the server.
+	defaultAckWait = 30 * time.Second
 )
 
 // Types of control messages, so far heartbeat and flow control
@@ -233,6 +312,77 @@ type js struct {
 	stc  chan struct{}
 	dch  chan struct{}
 	rr   *rand.Rand
+
+	// Subscriptions created through this context, used by Drain().
+	subs map[*Subscription]struct{}
+
+	// Configurations of the streams as last reported by the server
+	// through this context, by stream name.
+	configs map[string]*StreamConfig
+
+	// Counters returned by Stats().
+	stats *jsStats
+}
+
+// JetStreamStats are the counters of the operations done through a
+// JetStream context, as returned by Stats().
+type JetStreamStats struct {
+	// APIRequests is the number of JetStream API requests sent.
+	APIRequests uint64
+	// APIErrors is the number of API requests that failed, and of API
+	// responses, including publish acks, carrying an error.
+	APIErrors uint64
+	// Published is the number of messages acknowledged by a stream.
+	Published uint64
+	// Consumed is the number of messages received by subscriptions.
+	Consumed uint64
+	// Acks is the number of acknowledgements sent, including naks,
+	// terms and in progress acks.
+	Acks uint64
+	// Reconnects is the number of reconnects of the connection since
+	// the context was created.
+	Reconnects uint64
+}
+
+type jsStats struct {
+	apiRequests uint64
+	apiErrors   uint64
+	published   uint64
+	consumed    uint64
+	acks        uint64
+	// Reconnects of the connection when the context was created.
+	reconnects uint64
+}
+
+// count atomically increments one of the counters, if stats are kept.
+func (js *js) count(counter func(*jsStats) *uint64) {
+	if js == nil || js.stats == nil {
+		return
+	}
+	atomic.AddUint64(counter(js.stats), 1)
+}
+
+func apiRequestsCounter(s *jsStats) *uint64 { return &s.apiRequests }
+func apiErrorsCounter(s *jsStats) *uint64   { return &s.apiErrors }
+func publishedCounter(s *jsStats) *uint64   { return &s.published }
+func consumedCounter(s *jsStats) *uint64    { return &s.consumed }
+func acksCounter(s *jsStats) *uint64        { return &s.acks }
+
+// Stats returns a snapshot of the counters of this context.
+func (js *js) Stats() JetStreamStats {
+	var stats JetStreamStats
+	if js.stats == nil {
+		return stats
+	}
+	stats.APIRequests = atomic.LoadUint64(&js.stats.apiRequests)
+	stats.APIErrors = atomic.LoadUint64(&js.stats.apiErrors)
+	stats.Published = atomic.LoadUint64(&js.stats.published)
+	stats.Consumed = atomic.LoadUint64(&js.stats.consumed)
+	stats.Acks = atomic.LoadUint64(&js.stats.acks)
+	if reconnects := js.nc.Stats().Reconnects; reconnects > js.stats.reconnects {
+		stats.Reconnects = reconnects - js.stats.reconnects
+	}
+	return stats
 }
 
 type jsOpts struct {
@@ -261,8 +411,18 @@ type jsOpts struct {
 	// For direct get next message
 	directNextFor string
 
+	// Codec used for API requests and responses, encoding/json if nil.
+	codec APICodec
+
 	// featureFlags are used to enable/disable specific JetStream features
 	featureFlags featureFlags
+
+	// Source of time for heartbeat checks, pull expiration and retries,
+	// the real clock if nil.
+	clock clock
+
+	// Cache of resolved streams and consumers, see ResourceCache().
+	cache *resourceCache
 }
 
 const (
@@ -280,6 +440,7 @@ func (nc *Conn) JetStream(opts ...JSOpt) (JetStreamContext, error) {
 			wait:  defaultRequestWait,
 			maxpa: defaultAsyncPubAckInflight,
 		},
+		stats: &jsStats{reconnects: nc.Stats().Reconnects},
 	}
 
 	for _, opt := range opts {
@@ -290,6 +451,23 @@ func (nc *Conn) JetStream(opts ...JSOpt) (JetStreamContext, error) {
 	return js, nil
 }
 
+// withClock sets the clock of the JetStream context, used in tests to
+// control the passing of time.
+func withClock(c clock) JSOpt {
+	return jsOptFn(func(opts *jsOpts) error {
+		opts.clock = c
+		return nil
+	})
+}
+
+// clock returns the source of time of the JetStream context.
+func (js *js) clock() clock {
+	if js != nil && js.opts.clock != nil {
+		return js.opts.clock
+	}
+	return realClock{}
+}
+
 // JSOpt configures a JetStreamContext.
 type JSOpt interface {
 	configureJSContext(opts *jsOpts) error
@@ -302,6 +480,46 @@ func (opt jsOptFn) configureJSContext(opts *jsOpts) error {
 	return opt(opts)
 }
 
+// APICodec marshals JetStream API requests and unmarshals their responses.
+type APICodec interface {
+	Marshal(v interface{}) ([]byte, error)
+	Unmarshal(data []byte, v interface{}) error
+}
+
+// UseAPICodec sets the codec used to marshal JetStream API requests and
+// unmarshal their responses, e.g. to use a faster JSON implementation.
+// The codec must be compatible with encoding/json, since the API types rely
+// on json struct tags and custom JSON marshalers. Defaults to encoding/json.
+func UseAPICodec(codec APICodec) JSOpt {
+	return jsOptFn(func(opts *jsOpts) error {
+		if codec == nil {
+			return fmt.Errorf("%w: codec cannot be nil", ErrInvalidArg)
+		}
+		opts.codec = codec
+		return nil
+	})
+}
+
+func (js *js) marshal(v interface{}) ([]byte, error) {
+	if js.opts.codec == nil {
+		return json.Marshal(v)
+	}
+	return js.opts.codec.Marshal(v)
+}
+
+func (js *js) unmarshal(data []byte, v interface{}) error {
+	var err error
+	if js.opts.codec == nil {
+		err = json.Unmarshal(data, v)
+	} else {
+		err = js.opts.codec.Unmarshal(data, v)
+	}
+	if r, ok := v.(interface{ apiError() *APIError }); ok && err == nil && r.apiError() != nil {
+		js.count(apiErrorsCounter)
+	}
+	return err
+}
+
 type featureFlags struct {
 	useDurableConsumerCreate bool
 }
@@ -316,6 +534,22 @@ func UseLegacyDurableConsumers() JSOpt {
 	})
 }
 
+// ResourceCache caches the results of StreamExists(), ConsumerExists() and
+// StreamNameBySubject() for ttl, keeping at most size entries, the least
+// recently used being evicted first. Only successful lookups are cached.
+// Entries are invalidated when the stream or consumer is deleted or found
+// to be missing, when the stream is updated, and when a publish fails.
+// This option is only valid when creating the JetStream context.
+func ResourceCache(ttl time.Duration, size int) JSOpt {
+	return jsOptFn(func(opts *jsOpts) error {
+		if ttl <= 0 || size <= 0 {
+			return fmt.Errorf("%w: cache ttl and size must be greater than 0", ErrInvalidArg)
+		}
+		opts.cache = newResourceCache(ttl, size)
+		return nil
+	})
+}
+
 // ClientTrace can be used to trace API interactions for the JetStream Context.
 type ClientTrace struct {
 	RequestSent      func(subj string, payload []byte)
@@ -353,6 +587,46 @@ func (s *StreamInfoRequest) configureJSContext(js *jsOpts) error {
 	return nil
 }
 
+// StreamInfoSubjects makes StreamInfo() report the number of messages of
+// each subject matching the filter in StreamState.Subjects. The filter can
+// contain wildcards. On streams with many subjects, the report is large and
+// costly for the server to build, so the filter should be as narrow as
+// possible.
+func StreamInfoSubjects(filter string) JSOpt {
+	return jsOptFn(func(opts *jsOpts) error {
+		if filter == _EMPTY_ {
+			return fmt.Errorf("%w: subjects filter is required", ErrInvalidArg)
+		}
+		var req StreamInfoRequest
+		if opts.streamInfoOpts != nil {
+			req = *opts.streamInfoOpts
+		}
+		req.SubjectsFilter = filter
+		opts.streamInfoOpts = &req
+		return nil
+	})
+}
+
+// StreamInfoNoSubjects makes StreamInfo() not report the subjects of the
+// stream. This is the default, the option makes it explicit and overrides
+// the subjects filter set by a previous option, such as StreamInfoSubjects()
+// or a StreamInfoRequest.
+func StreamInfoNoSubjects() JSOpt {
+	return jsOptFn(func(opts *jsOpts) error {
+		if opts.streamInfoOpts == nil {
+			return nil
+		}
+		req := *opts.streamInfoOpts
+		req.SubjectsFilter = _EMPTY_
+		if req.DeletedDetails {
+			opts.streamInfoOpts = &req
+		} else {
+			opts.streamInfoOpts = nil
+		}
+		return nil
+	})
+}
+
 // APIPrefix changes the default prefix used for the JetStream API.
 func APIPrefix(pre string) JSOpt {
 	return jsOptFn(func(js *jsOpts) error {
@@ -441,6 +715,12 @@ type pubOpts struct {
 
 	// stallWait is the max wait of a async pub ack.
 	stallWait time.Duration
+
+	// To verify that the ack reports where the message was stored.
+	verify bool
+
+	// To look up the stream of the subject when the ack times out.
+	checkStream bool
 }
 
 // pubAckResponse is the ack response from the JetStream API when publishing a message.
@@ -450,6 +730,10 @@ type pubAckResponse struct {
 }
 
 // PubAck is an ack received after successfully publishing a message.
+// Sequence is the stream sequence at which the message was stored. If the
+// message was deduplicated, Duplicate is true and Sequence is the one of the
+// message originally stored with the same MsgId. The stored message can be
+// read back with GetMsg(Stream, Sequence).
 type PubAck struct {
 	Stream    string `json:"stream"`
 	Sequence  uint64 `json:"seq"`
@@ -540,10 +824,10 @@ func (js *js) PublishMsg(m *Msg, opts ...PubOpt) (*PubAck, error) {
 			if o.ctx != nil {
 				select {
 				case <-o.ctx.Done():
-				case <-time.After(o.rwait):
+				case <-js.clock().After(o.rwait):
 				}
 			} else {
-				time.Sleep(o.rwait)
+				<-js.clock().After(o.rwait)
 			}
 			if o.ttl > 0 {
 				ttl -= o.rwait
@@ -557,15 +841,23 @@ func (js *js) PublishMsg(m *Msg, opts ...PubOpt) (*PubAck, error) {
 			}
 		}
 		if err != nil {
+			// The subject may not be captured by the cached stream anymore.
+			js.uncacheKey(js.cacheKey(cacheSubjectKey, m.Subject))
 			if err == ErrNoResponders {
 				err = ErrNoStreamResponse
+			} else if o.checkStream && (err == ErrTimeout || err == context.DeadlineExceeded) {
+				// A subject with interest other than a stream, such as a plain
+				// subscription, is not answered, so check if a stream captures it.
+				if _, serr := js.StreamNameBySubject(m.Subject); serr == ErrNoMatchingStream {
+					err = ErrNoStreamResponse
+				}
 			}
 			return nil, err
 		}
 	}
 
 	var pa pubAckResponse
-	if err := json.Unmarshal(resp.Data, &pa); err != nil {
+	if err := js.unmarshal(resp.Data, &pa); err != nil {
 		return nil, ErrInvalidJSAck
 	}
 	if pa.Error != nil {
@@ -574,6 +866,15 @@ func (js *js) PublishMsg(m *Msg, opts ...PubOpt) (*PubAck, error) {
 	if pa.PubAck == nil || pa.PubAck.Stream == _EMPTY_ {
 		return nil, ErrInvalidJSAck
 	}
+	if o.verify {
+		if pa.Sequence == 0 {
+			return nil, fmt.Errorf("%w: missing stream sequence", ErrInvalidJSAck)
+		}
+		if o.str != _EMPTY_ && pa.Stream != o.str {
+			return nil, fmt.Errorf("%w: stored in stream %q, expected %q", ErrInvalidJSAck, pa.Stream, o.str)
+		}
+	}
+	js.count(publishedCounter)
 	return pa.PubAck, nil
 }
 
@@ -772,7 +1073,7 @@ func (js *js) handleAsyncReply(m *Msg) {
 	}
 
 	var pa pubAckResponse
-	if err := json.Unmarshal(m.Data, &pa); err != nil {
+	if err := js.unmarshal(m.Data, &pa); err != nil {
 		doErr(ErrInvalidJSAck)
 		return
 	}
@@ -786,6 +1087,7 @@ func (js *js) handleAsyncReply(m *Msg) {
 	}
 
 	// So here we have received a proper puback.
+	js.count(publishedCounter)
 	paf.pa = pa.PubAck
 	if paf.doneCh != nil {
 		paf.doneCh <- paf.pa
@@ -841,6 +1143,9 @@ func (js *js) PublishMsgAsync(m *Msg, opts ...PubOpt) (PubAckFuture, error) {
 	if o.ttl != 0 || o.ctx != nil {
 		return nil, ErrContextAndTimeout
 	}
+	if o.verify {
+		return nil, fmt.Errorf("nats: verify stored cannot be set to async publish")
+	}
 	stallWait := defaultStallWait
 	if o.stallWait > 0 {
 		stallWait = o.stallWait
@@ -919,6 +1224,7 @@ func MsgId(id string) PubOpt {
 }
 
 // ExpectStream sets the expected stream to respond from the publish.
+// If another stream stores the message, ErrStreamNotMatch is returned.
 func ExpectStream(stream string) PubOpt {
 	return pubOptFn(func(opts *pubOpts) error {
 		opts.str = stream
@@ -927,6 +1233,7 @@ func ExpectStream(stream string) PubOpt {
 }
 
 // ExpectLastSequence sets the expected sequence in the response from the publish.
+// If the last sequence of the stream differs, ErrWrongLastSequence is returned.
 func ExpectLastSequence(seq uint64) PubOpt {
 	return pubOptFn(func(opts *pubOpts) error {
 		opts.seq = &seq
@@ -935,6 +1242,7 @@ func ExpectLastSequence(seq uint64) PubOpt {
 }
 
 // ExpectLastSequencePerSubject sets the expected sequence per subject in the response from the publish.
+// If the last sequence of the subject differs, ErrWrongLastSequence is returned.
 func ExpectLastSequencePerSubject(seq uint64) PubOpt {
 	return pubOptFn(func(opts *pubOpts) error {
 		opts.lss = &seq
@@ -943,6 +1251,7 @@ func ExpectLastSequencePerSubject(seq uint64) PubOpt {
 }
 
 // ExpectLastMsgId sets the expected last msgId in the response from the publish.
+// If the ID of the last message differs, ErrWrongLastMsgID is returned.
 func ExpectLastMsgId(id string) PubOpt {
 	return pubOptFn(func(opts *pubOpts) error {
 		opts.lid = id
@@ -966,6 +1275,28 @@ func RetryAttempts(num int) PubOpt {
 	})
 }
 
+// VerifyStored makes a synchronous publish verify that the returned PubAck
+// reports the stream sequence the message was stored at and, if set with
+// ExpectStream(), the expected stream. No additional request is made.
+func VerifyStored() PubOpt {
+	return pubOptFn(func(opts *pubOpts) error {
+		opts.verify = true
+		return nil
+	})
+}
+
+// CheckStreamOnTimeout makes a synchronous publish look up the stream of the
+// subject when no ack is received in time. If no stream captures the subject,
+// which is the case when only plain subscriptions are interested in it, the
+// publish fails with ErrNoStreamResponse instead of the timeout. The lookup
+// is an additional request, made only once the publish timed out.
+func CheckStreamOnTimeout() PubOpt {
+	return pubOptFn(func(opts *pubOpts) error {
+		opts.checkStream = true
+		return nil
+	})
+}
+
 // StallWait sets the max wait when the producer becomes stall producing messages.
 func StallWait(ttl time.Duration) PubOpt {
 	return pubOptFn(func(opts *pubOpts) error {
@@ -981,6 +1312,7 @@ type ackOpts struct {
 	ttl      time.Duration
 	ctx      context.Context
 	nakDelay time.Duration
+	retries  int
 }
 
 // AckOpt are the options that can be passed when acknowledge a message.
@@ -1051,10 +1383,35 @@ func (ctx ContextOpt) configureAck(opts *ackOpts) error {
 
 // Context returns an option that can be used to configure a context for APIs
 // that are context aware such as those part of the JetStream interface.
+// When passed to the Subscribe family of calls, cancelling the context stops
+// the subscription the same way as calling Unsubscribe, so a single parent
+// context can be used to shut down all consumers. NextMsg() and Fetch()
+// then return the error of the context, e.g. context.Canceled.
 func Context(ctx context.Context) ContextOpt {
 	return ContextOpt{ctx}
 }
 
+type ackOptFn func(opts *ackOpts) error
+
+func (opt ackOptFn) configureAck(opts *ackOpts) error {
+	return opt(opts)
+}
+
+// AckSyncRetries sets the number of times a synchronous ack is retried when
+// the server confirmation is not received in time. When used with the
+// Context() option, the time left until the context deadline is spread over
+// the remaining attempts. Acking a message which was already successfully
+// acked is reported as a success instead of returning ErrMsgAlreadyAckd.
+func AckSyncRetries(n int) AckOpt {
+	return ackOptFn(func(opts *ackOpts) error {
+		if n < 0 {
+			return fmt.Errorf("%w: retries cannot be negative", ErrInvalidArg)
+		}
+		opts.retries = n
+		return nil
+	})
+}
+
 type nakDelay time.Duration
 
 func (d nakDelay) configureAck(opts *ackOpts) error {
@@ -1077,6 +1434,7 @@ type ConsumerConfig struct {
 	MaxDeliver      int             `json:"max_deliver,omitempty"`
 	BackOff         []time.Duration `json:"backoff,omitempty"`
 	FilterSubject   string          `json:"filter_subject,omitempty"`
+	FilterSubjects  []string        `json:"filter_subjects,omitempty"`
 	ReplayPolicy    ReplayPolicy    `json:"replay_policy"`
 	RateLimit       uint64          `json:"rate_limit_bps,omitempty"` // Bits per sec
 	SampleFrequency string          `json:"sample_freq,omitempty"`
@@ -1091,7 +1449,9 @@ type ConsumerConfig struct {
 	MaxRequestExpires  time.Duration `json:"max_expires,omitempty"`
 	MaxRequestMaxBytes int           `json:"max_bytes,omitempty"`
 
-	// Push based consumers.
+	// Push based consumers. In a ConsumerInfo, these reflect the subject
+	// and queue group the server delivers messages to, which can be used
+	// to subscribe directly to the consumer's deliveries.
 	DeliverSubject string `json:"deliver_subject,omitempty"`
 	DeliverGroup   string `json:"deliver_group,omitempty"`
 
@@ -1104,6 +1464,48 @@ type ConsumerConfig struct {
 	MemoryStorage bool `json:"mem_storage,omitempty"`
 }
 
+// NewWorkQueueConsumerConfig returns the configuration of a durable pull
+// consumer sharing the work on the messages matching filter. Messages are
+// acknowledged explicitly and redelivered with an increasing delay, up to
+// 5 deliveries. The returned configuration can be changed before use.
+func NewWorkQueueConsumerConfig(durable, filter string) *ConsumerConfig {
+	return &ConsumerConfig{
+		Durable:       durable,
+		DeliverPolicy: DeliverAllPolicy,
+		AckPolicy:     AckExplicitPolicy,
+		MaxDeliver:    5,
+		BackOff:       []time.Duration{time.Second, 5 * time.Second, 30 * time.Second},
+		FilterSubject: filter,
+		ReplayPolicy:  ReplayInstantPolicy,
+	}
+}
+
+// NewDurableReplayConfig returns the configuration of a durable consumer
+// delivering all the messages matching filter from the start of the stream,
+// acknowledged explicitly. The returned configuration can be changed before use.
+func NewDurableReplayConfig(durable, filter string) *ConsumerConfig {
+	return &ConsumerConfig{
+		Durable:       durable,
+		DeliverPolicy: DeliverAllPolicy,
+		AckPolicy:     AckExplicitPolicy,
+		FilterSubject: filter,
+		ReplayPolicy:  ReplayInstantPolicy,
+	}
+}
+
+// NewEphemeralTailConfig returns the configuration of an ephemeral consumer
+// delivering only the messages stored after its creation, without
+// acknowledgements. The server removes it once inactive. The returned
+// configuration can be changed before use, e.g. to set a FilterSubject.
+func NewEphemeralTailConfig() *ConsumerConfig {
+	return &ConsumerConfig{
+		DeliverPolicy:     DeliverNewPolicy,
+		AckPolicy:         AckNonePolicy,
+		ReplayPolicy:      ReplayInstantPolicy,
+		InactiveThreshold: defaultEphemeralInactiveThreshold,
+	}
+}
+
 // ConsumerInfo is the info from a JetStream consumer.
 type ConsumerInfo struct {
 	Stream         string         `json:"stream_name"`
@@ -1118,6 +1520,103 @@ type ConsumerInfo struct {
 	NumPending     uint64         `json:"num_pending"`
 	Cluster        *ClusterInfo   `json:"cluster,omitempty"`
 	PushBound      bool           `json:"push_bound,omitempty"`
+	TimeStamp      time.Time      `json:"ts"`
+}
+
+// IdleFor returns for how long the consumer has neither delivered nor had
+// a message acknowledged, based on the Last activity times of Delivered and
+// AckFloor, or on Created if there was no activity yet. The duration is
+// computed relative to TimeStamp, the time at which the server generated
+// the info, if set by the server, and to the current time otherwise.
+func (ci *ConsumerInfo) IdleFor() time.Duration {
+	last := ci.Created
+	if l := ci.Delivered.Last; l != nil && l.After(last) {
+		last = *l
+	}
+	if l := ci.AckFloor.Last; l != nil && l.After(last) {
+		last = *l
+	}
+	now := ci.TimeStamp
+	if now.IsZero() {
+		now = time.Now()
+	}
+	if idle := now.Sub(last); idle > 0 {
+		return idle
+	}
+	return 0
+}
+
+// StartSequence returns the stream sequence of the first message a consumer
+// that did not deliver any message yet will deliver, e.g. as returned by
+// AddConsumer(). When the messages before the requested start sequence or
+// time were removed from the stream, the server silently starts from the
+// first available message, so this can be after the requested start. The
+// second value is false if the consumer already delivered messages, since
+// its start sequence is then not known anymore.
+func (ci *ConsumerInfo) StartSequence() (uint64, bool) {
+	if ci.Delivered.Consumer > 0 {
+		return 0, false
+	}
+	return ci.Delivered.Stream + 1, true
+}
+
+// StartSkipped returns how many stream sequences were skipped because the
+// consumer was created with DeliverByStartSequencePolicy and a start
+// sequence before the first message of the stream, i.e. the messages which
+// were already removed from the stream, see StartSequence(). It returns 0
+// for the other deliver policies, and once the consumer delivered messages.
+func (ci *ConsumerInfo) StartSkipped() uint64 {
+	if ci.Config.DeliverPolicy != DeliverByStartSequencePolicy {
+		return 0
+	}
+	start, ok := ci.StartSequence()
+	if !ok || start <= ci.Config.OptStartSeq {
+		return 0
+	}
+	return start - ci.Config.OptStartSeq
+}
+
+// ConsumerProgress is a summary of how far a consumer has progressed
+// through its stream.
+type ConsumerProgress struct {
+	// Delivered is the last delivered message.
+	Delivered SequenceInfo
+	// AckFloor is the message below which all messages were acknowledged.
+	AckFloor SequenceInfo
+	// NumAckPending is the number of delivered messages waiting for an ack.
+	NumAckPending int
+	// NumPending is the number of messages not yet delivered.
+	NumPending uint64
+}
+
+// Lag returns the number of messages that were not yet processed by the
+// consumer, either because they were not delivered or not acknowledged.
+func (p *ConsumerProgress) Lag() uint64 {
+	return p.NumPending + uint64(p.NumAckPending)
+}
+
+// FilteredLag returns the number of messages matching the consumer's filter
+// subject(s) which were not yet delivered. The server only accounts for
+// messages matching the filter in NumPending, so for an unfiltered consumer
+// this is the number of messages left in the stream.
+func (p *ConsumerProgress) FilteredLag() uint64 {
+	return p.NumPending
+}
+
+// LagExceeds reports whether the consumer's FilteredLag is above the
+// given threshold. It can be used to alert on consumers falling behind.
+func (p *ConsumerProgress) LagExceeds(threshold uint64) bool {
+	return p.FilteredLag() > threshold
+}
+
+// Progress returns the consumer's progress from its info.
+func (ci *ConsumerInfo) Progress() *ConsumerProgress {
+	return &ConsumerProgress{
+		Delivered:     ci.Delivered,
+		AckFloor:      ci.AckFloor,
+		NumAckPending: ci.NumAckPending,
+		NumPending:    ci.NumPending,
+	}
 }
 
 // SequenceInfo has both the consumer and the stream sequence and last activity.
@@ -1135,10 +1634,11 @@ type SequencePair struct {
 
 // nextRequest is for getting next messages for pull based consumers from JetStream.
 type nextRequest struct {
-	Expires  time.Duration `json:"expires,omitempty"`
-	Batch    int           `json:"batch,omitempty"`
-	NoWait   bool          `json:"no_wait,omitempty"`
-	MaxBytes int           `json:"max_bytes,omitempty"`
+	Expires   time.Duration `json:"expires,omitempty"`
+	Batch     int           `json:"batch,omitempty"`
+	NoWait    bool          `json:"no_wait,omitempty"`
+	MaxBytes  int           `json:"max_bytes,omitempty"`
+	Heartbeat time.Duration `json:"idle_heartbeat,omitempty"`
 }
 
 // jsSub includes JetStream subscription info.
@@ -1155,6 +1655,9 @@ type jsSub struct {
 	pull     bool
 	dc       bool // Delete JS consumer
 	ackNone  bool
+	ackWait  time.Duration
+	backoff  []time.Duration
+	noLookup bool // Consumer lookups are skipped, see SkipConsumerLookup()
 
 	// This is ConsumerInfo's Pending+Consumer.Delivered that we get from the
 	// add consumer response. Note that some versions of the server gather the
@@ -1171,7 +1674,7 @@ type jsSub struct {
 	ccreq   *createConsumerRequest
 
 	// Heartbeats and Flow Control handling from push consumers.
-	hbc    *time.Timer
+	hbc    clockTimer
 	hbi    time.Duration
 	active bool
 	cmeta  string
@@ -1182,6 +1685,163 @@ type jsSub struct {
 
 	// Cancellation function to cancel context on drain/unsubscribe.
 	cancel func()
+	// Context given when subscribing, its error is returned by NextMsg()
+	// and Fetch() once it is done.
+	sctx context.Context
+
+	// Last non-fatal error, cleared when a message is delivered.
+	lerr *SubscriptionError
+	// Number of consecutive errors and the maximum allowed before
+	// the subscription is closed.
+	nerrs   int
+	maxErrs int
+
+	// Cancellation functions of in-flight pull requests, invoked when
+	// the connection is reestablished so that the requests are resent.
+	pullRecs map[context.Context]context.CancelFunc
+	// Invoked when the subscription is re-established after a reconnect.
+	rscb func(sub *Subscription)
+
+	// For pull consumers with an explicit ack policy, the consumer's
+	// MaxAckPending and the stream sequences of fetched messages not yet
+	// acknowledged, with the time after which the server redelivers them.
+	// apch is closed when an ack frees up capacity. See PullAckPendingLimit().
+	maxap      int
+	ackPending map[uint64]time.Time
+	apch       chan struct{}
+
+	// Invoked when the consumer sequence of a delivered message is not
+	// the expected one. gdseq is the next expected consumer sequence.
+	gapcb func(sub *Subscription, expected, actual uint64)
+	gdseq uint64
+
+	// Throttles the delivery of messages to the callback.
+	rl *rateLimiter
+
+	// Margin between the expiration of pull requests and the Fetch()
+	// deadline, grown when requests keep expiring on the client first.
+	expm time.Duration
+
+	// Pending batch of acks, flushed on unsubscribe and drain, see ConsumeAckBatch().
+	acks *ackBatcher
+
+	// Parameters of the pull requests of Consume(), derived from the
+	// consumer configuration, see RefreshConsumerConfig().
+	pullp *pullParams
+
+	// Invoked with the delivery latency of the messages passed to the
+	// handler of Consume(), see ConsumeLatencyHandler().
+	latcb func(m *Msg, l DeliveryLatency)
+}
+
+// watchReconnect returns a child context of ctx which is canceled when the
+// connection is reestablished. Pull requests are lost when the client
+// reconnects, possibly to a different server, so a Fetch waiting on the
+// returned context can resend its request. The returned function must be
+// called once the request is complete.
+func (sub *Subscription) watchReconnect(ctx context.Context) (context.Context, func()) {
+	rctx, cancel := context.WithCancel(ctx)
+	sub.mu.Lock()
+	jsi := sub.jsi
+	if jsi == nil {
+		sub.mu.Unlock()
+		return rctx, cancel
+	}
+	if jsi.pullRecs == nil {
+		jsi.pullRecs = make(map[context.Context]context.CancelFunc)
+	}
+	jsi.pullRecs[rctx] = cancel
+	sub.mu.Unlock()
+	return rctx, func() {
+		sub.mu.Lock()
+		delete(jsi.pullRecs, rctx)
+		sub.mu.Unlock()
+		cancel()
+	}
+}
+
+// consumerProbe checks that the consumer of a pull subscription still exists
+// when a fetch is not answered within the delay given to PullConsumerCheck().
+// Pull requests accepted by a consumer that is deleted afterwards are never
+// answered, so without the probe the fetch would only fail once it expires
+// or, with PullHeartbeat(), once heartbeats are missed.
+type consumerProbe struct {
+	ctx    context.Context
+	cancel context.CancelFunc
+	timer  clockTimer
+	mu     sync.Mutex
+	err    error
+}
+
+// probeConsumer starts a probe for the subscription's consumer if delay is
+// positive. The probe's context, a child of ctx, is canceled if the consumer
+// is not found, in which case Err() returns ErrConsumerNotFound or
+// ErrStreamNotFound. No probe is made for subscriptions created with
+// SkipConsumerLookup().
+func (sub *Subscription) probeConsumer(ctx context.Context, delay time.Duration) *consumerProbe {
+	sub.mu.Lock()
+	js, stream, consumer := sub.jsi.js, sub.jsi.stream, sub.jsi.consumer
+	skip := sub.jsi.noLookup
+	sub.mu.Unlock()
+
+	p := &consumerProbe{}
+	p.ctx, p.cancel = context.WithCancel(ctx)
+	// Do not look up the consumer if not requested or if lookups were to be skipped.
+	if delay <= 0 || skip {
+		return p
+	}
+	p.timer = js.clock().AfterFunc(delay, func() {
+		_, err := js.ConsumerInfo(stream, consumer, Context(p.ctx))
+		if errors.Is(err, ErrConsumerNotFound) || errors.Is(err, ErrStreamNotFound) {
+			p.mu.Lock()
+			p.err = err
+			p.mu.Unlock()
+			p.cancel()
+		}
+	})
+	return p
+}
+
+// Err returns the error if the consumer was found to be gone, nil otherwise.
+func (p *consumerProbe) Err() error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return p.err
+}
+
+func (p *consumerProbe) stop() {
+	if p.timer != nil {
+		p.timer.Stop()
+	}
+	p.cancel()
+}
+
+// reconnected reports whether the wait on a context returned by
+// watchReconnect() was interrupted by a reconnect, and not by ctx.
+func reconnected(ctx context.Context, err error) bool {
+	return err == context.Canceled && ctx.Err() == nil
+}
+
+// notifyJSReconnect signals JetStream subscriptions that the connection
+// has been reestablished. Pull subscriptions with in-flight requests resend
+// them, and resubscribe handlers are queued.
+// Connection lock is held on entry.
+func (nc *Conn) notifyJSReconnect() {
+	nc.subsMu.RLock()
+	defer nc.subsMu.RUnlock()
+	for _, s := range nc.subs {
+		s.mu.Lock()
+		if jsi := s.jsi; jsi != nil {
+			for _, cancel := range jsi.pullRecs {
+				cancel()
+			}
+			if cb := jsi.rscb; cb != nil {
+				sub := s
+				nc.ach.push(func() { cb(sub) })
+			}
+		}
+		s.mu.Unlock()
+	}
 }
 
 // Deletes the JS Consumer.
@@ -1289,98 +1949,727 @@ func (js *js) PullSubscribe(subj, durable string, opts ...SubOpt) (*Subscription
 	return js.subscribe(subj, _EMPTY_, nil, mch, true, true, opts)
 }
 
-func processConsInfo(info *ConsumerInfo, userCfg *ConsumerConfig, isPullMode bool, subj, queue string) (string, error) {
-	ccfg := &info.Config
-
-	// Make sure this new subject matches or is a subset.
-	if ccfg.FilterSubject != _EMPTY_ && subj != ccfg.FilterSubject {
-		return _EMPTY_, ErrSubjectMismatch
-	}
-
-	// Prevent binding a subscription against incompatible consumer types.
-	if isPullMode && ccfg.DeliverSubject != _EMPTY_ {
-		return _EMPTY_, ErrPullSubscribeToPushConsumer
-	} else if !isPullMode && ccfg.DeliverSubject == _EMPTY_ {
-		return _EMPTY_, ErrPullSubscribeRequired
-	}
-
-	// If pull mode, nothing else to check here.
-	if isPullMode {
-		return _EMPTY_, checkConfig(ccfg, userCfg)
+// EphemeralPullSubscribe creates a pull Subscription on a new ephemeral consumer.
+func (js *js) EphemeralPullSubscribe(stream, filter string, opts ...SubOpt) (*Subscription, error) {
+	if err := checkStreamName(stream); err != nil {
+		return nil, err
 	}
-
-	// At this point, we know the user wants push mode, and the JS consumer is
-	// really push mode.
-
-	dg := info.Config.DeliverGroup
-	if dg == _EMPTY_ {
-		// Prevent an user from attempting to create a queue subscription on
-		// a JS consumer that was not created with a deliver group.
-		if queue != _EMPTY_ {
-			return _EMPTY_, fmt.Errorf("cannot create a queue subscription for a consumer without a deliver group")
-		} else if info.PushBound {
-			// Need to reject a non queue subscription to a non queue consumer
-			// if the consumer is already bound.
-			return _EMPTY_, fmt.Errorf("consumer is already bound to a subscription")
-		}
-	} else {
-		// If the JS consumer has a deliver group, we need to fail a non queue
-		// subscription attempt:
-		if queue == _EMPTY_ {
-			return _EMPTY_, fmt.Errorf("cannot create a subscription for a consumer with a deliver group %q", dg)
-		} else if queue != dg {
-			// Here the user's queue group name does not match the one associated
-			// with the JS consumer.
-			return _EMPTY_, fmt.Errorf("cannot create a queue subscription %q for a consumer with a deliver group %q",
-				queue, dg)
+	opts = append([]SubOpt{BindStream(stream)}, opts...)
+	opts = append(opts, subOptFn(func(opts *subOpts) error {
+		if opts.cfg.Durable != _EMPTY_ || opts.consumer != _EMPTY_ {
+			return fmt.Errorf("nats: durable or bound consumer can not be used with an ephemeral subscription")
 		}
+		return nil
+	}))
+	return js.PullSubscribe(filter, _EMPTY_, opts...)
+}
+
+// ReplayFrom creates a pull Subscription replaying the messages of a stream since start.
+func (js *js) ReplayFrom(stream string, start time.Time, filter string, opts ...SubOpt) (*Subscription, error) {
+	if err := checkStreamName(stream); err != nil {
+		return nil, err
 	}
-	if err := checkConfig(ccfg, userCfg); err != nil {
-		return _EMPTY_, err
+	if start.IsZero() {
+		return nil, fmt.Errorf("%w: start time is required", ErrInvalidArg)
 	}
-	return ccfg.DeliverSubject, nil
+	opts = append([]SubOpt{BindStream(stream)}, opts...)
+	// Set last so that the deliver policy is not overridden.
+	opts = append(opts, StartTime(start))
+	return js.PullSubscribe(filter, _EMPTY_, opts...)
 }
 
-func checkConfig(s, u *ConsumerConfig) error {
-	makeErr := func(fieldName string, usrVal, srvVal interface{}) error {
-		return fmt.Errorf("configuration requests %s to be %v, but consumer's value is %v", fieldName, usrVal, srvVal)
+// Consume binds to a pull consumer and passes its messages to cb.
+func (js *js) Consume(stream, consumer string, cb MsgHandler, opts ...SubOpt) (*Subscription, error) {
+	if cb == nil {
+		return nil, fmt.Errorf("%w: callback is required", ErrInvalidArg)
 	}
-
-	if u.Durable != _EMPTY_ && u.Durable != s.Durable {
-		return makeErr("durable", u.Durable, s.Durable)
+	if err := checkStreamName(stream); err != nil {
+		return nil, err
 	}
-	if u.Description != _EMPTY_ && u.Description != s.Description {
-		return makeErr("description", u.Description, s.Description)
+	if err := checkConsumerName(consumer); err != nil {
+		return nil, err
 	}
-	if u.DeliverPolicy != deliverPolicyNotSet && u.DeliverPolicy != s.DeliverPolicy {
-		return makeErr("deliver policy", u.DeliverPolicy, s.DeliverPolicy)
+	o, err := parseSubOpts(opts)
+	if err != nil {
+		return nil, err
 	}
-	if u.OptStartSeq > 0 && u.OptStartSeq != s.OptStartSeq {
-		return makeErr("optional start sequence", u.OptStartSeq, s.OptStartSeq)
+	var recreate func(sub *Subscription) error
+	if o.recreate != nil {
+		cfg := *o.recreate
+		if cfg.Name == _EMPTY_ && cfg.Durable == _EMPTY_ {
+			cfg.Durable = consumer
+		}
+		if (cfg.Name != _EMPTY_ && cfg.Name != consumer) || (cfg.Durable != _EMPTY_ && cfg.Durable != consumer) {
+			return nil, fmt.Errorf("%w: configuration to recreate consumer %q has a different name", ErrInvalidArg, consumer)
+		}
+		// Make sure that an ephemeral consumer is removed by the server if
+		// the application goes away without unsubscribing.
+		if cfg.Durable == _EMPTY_ && cfg.InactiveThreshold == 0 {
+			cfg.InactiveThreshold = defaultEphemeralInactiveThreshold
+		}
+		recreate = func(sub *Subscription) error { return js.recreateConsumer(sub, stream, &cfg) }
 	}
-	if u.OptStartTime != nil && !u.OptStartTime.IsZero() && !(*u.OptStartTime).Equal(*s.OptStartTime) {
-		return makeErr("optional start time", u.OptStartTime, s.OptStartTime)
+	if o.ackBatch > 0 && o.mack {
+		return nil, fmt.Errorf("nats: ConsumeAckBatch can not be used with ManualAck")
 	}
-	if u.AckPolicy != ackPolicyNotSet && u.AckPolicy != s.AckPolicy {
-		return makeErr("ack policy", u.AckPolicy, s.AckPolicy)
+	if o.ackBatch > 0 && o.partitions > 0 {
+		return nil, fmt.Errorf("nats: ConsumeAckBatch can not be used with ConsumePartitionBySubject")
 	}
-	if u.AckWait > 0 && u.AckWait != s.AckWait {
-		return makeErr("ack wait", u.AckWait, s.AckWait)
+	if o.ackBatch > 0 {
+		// Acking the last message of a batch only acknowledges the others
+		// with the AckAll policy.
+		if o.recreate != nil && o.recreate.AckPolicy != AckAllPolicy {
+			return nil, fmt.Errorf("%w: ConsumeAckBatch requires a consumer with the AckAll policy, got %v", ErrInvalidArg, o.recreate.AckPolicy)
+		}
+		info, err := js.ConsumerInfo(stream, consumer)
+		switch {
+		case err == nil:
+			if info.Config.AckPolicy != AckAllPolicy {
+				return nil, fmt.Errorf("%w: ConsumeAckBatch requires a consumer with the AckAll policy, got %v", ErrInvalidArg, info.Config.AckPolicy)
+			}
+		case errors.Is(err, ErrConsumerNotFound) && o.recreate != nil:
+			// The consumer is created again with the checked configuration.
+		default:
+			return nil, err
+		}
 	}
-	if u.MaxDeliver > 0 && u.MaxDeliver != s.MaxDeliver {
-		return makeErr("max deliver", u.MaxDeliver, s.MaxDeliver)
+	if o.transform != nil {
+		cb = o.transform.handler(cb)
 	}
-	if u.ReplayPolicy != replayPolicyNotSet && u.ReplayPolicy != s.ReplayPolicy {
-		return makeErr("replay policy", u.ReplayPolicy, s.ReplayPolicy)
+	opts = append(opts[:len(opts):len(opts)], Bind(stream, consumer), SkipConsumerLookup())
+	sub, err := js.PullSubscribe(_EMPTY_, _EMPTY_, opts...)
+	if err != nil {
+		return nil, err
 	}
-	if u.RateLimit > 0 && u.RateLimit != s.RateLimit {
-		return makeErr("rate limit", u.RateLimit, s.RateLimit)
+	if o.latcb != nil {
+		sub.mu.Lock()
+		sub.jsi.latcb = o.latcb
+		sub.mu.Unlock()
 	}
-	if u.SampleFrequency != _EMPTY_ && u.SampleFrequency != s.SampleFrequency {
-		return makeErr("sample frequency", u.SampleFrequency, s.SampleFrequency)
+	// Messages received while waiting for the consumer to be ready, and
+	// when their pull request was sent.
+	var first []*Msg
+	var firstSent time.Time
+	if o.ready > 0 {
+		if first, firstSent, err = waitPullReady(sub, o.ready, js.clock(), recreate); err != nil {
+			sub.Unsubscribe()
+			return nil, fmt.Errorf("nats: consumer %q of stream %q not ready after %v: %w", consumer, stream, o.ready, err)
+		}
 	}
-	if u.MaxWaiting > 0 && u.MaxWaiting != s.MaxWaiting {
-		return makeErr("max waiting", u.MaxWaiting, s.MaxWaiting)
+	if o.refresh > 0 {
+		// Start with the current limits of the consumer, once it is ready.
+		if err := sub.RefreshConsumerConfig(); err != nil {
+			sub.Unsubscribe()
+			return nil, err
+		}
+	}
+	var ack func(m *Msg)
+	if !o.mack {
+		ack = ackMsg
+	}
+	// Invoked once the subscription is closed and no more messages are fetched.
+	var done func()
+	if o.ackBatch > 0 {
+		acks := &ackBatcher{max: o.ackBatch, wait: o.ackBatchWait, clk: js.clock()}
+		sub.mu.Lock()
+		sub.jsi.acks = acks
+		sub.mu.Unlock()
+		ack, done = acks.add, acks.flush
+	}
+	handler := cb
+	if o.partitions > 0 {
+		// Messages are acknowledged by the workers.
+		handler, done = partitionBySubject(o.partitions, cb, ack)
+		ack = nil
+	}
+	go func() {
+		for _, m := range first {
+			if o.latcb != nil {
+				o.latcb(m, deliveryLatency(m, firstSent, js.clock()))
+			}
+			handler(m)
+			if ack != nil {
+				ack(m)
+			}
+		}
+		pullToHandler(sub, handler, ack, recreate, o.refresh)
+		if done != nil {
+			done()
+		}
+	}()
+	return sub, nil
+}
+
+// waitPullReady sends no wait pull requests until one is answered by the
+// server, which means that the consumer can deliver messages, or timeout
+// elapsed. The messages received are returned, along with the time their
+// request was sent. The error of the last request is returned on timeout.
+// If recreate is set, it is invoked when the consumer is found to be gone.
+func waitPullReady(sub *Subscription, timeout time.Duration, clk clock, recreate func(sub *Subscription) error) ([]*Msg, time.Time, error) {
+	deadline := clk.Now().Add(timeout)
+	for {
+		wait := until(clk, deadline)
+		if wait > readyPullWait {
+			wait = readyPullWait
+		}
+		p := sub.pullParams()
+		fopts := []PullOpt{PullNoWait(), MaxWait(wait)}
+		if p.maxBytes > 0 {
+			fopts = append(fopts, PullMaxBytes(p.maxBytes))
+		}
+		sent := clk.Now()
+		msgs, err := sub.Fetch(p.batch, fopts...)
+		if err == nil {
+			return msgs, sent, nil
+		}
+		if !sub.IsValid() || until(clk, deadline) <= multiPullRetryWait {
+			return nil, time.Time{}, err
+		}
+		if recreate != nil && consumerGone(err) {
+			if err := recreate(sub); err == nil {
+				continue
+			}
+		}
+		<-clk.After(multiPullRetryWait)
+	}
+}
+
+// partitionBySubject starts workers invoking cb, and then ack if set, for
+// the messages passed to the returned handler. The messages of a subject are
+// always passed to the same worker, so they are handled in order. The
+// returned function stops the workers once they handled the messages
+// already passed to them.
+func partitionBySubject(workers int, cb MsgHandler, ack func(m *Msg)) (MsgHandler, func()) {
+	chs := make([]chan *Msg, workers)
+	for i := range chs {
+		chs[i] = make(chan *Msg, multiPullBatch)
+		go func(ch chan *Msg) {
+			for m := range ch {
+				cb(m)
+				if ack != nil {
+					ack(m)
+				}
+			}
+		}(chs[i])
+	}
+	handler := func(m *Msg) {
+		h := fnv.New32a()
+		h.Write([]byte(m.Subject))
+		chs[h.Sum32()%uint32(workers)] <- m
+	}
+	stop := func() {
+		for _, ch := range chs {
+			close(ch)
+		}
+	}
+	return handler, stop
+}
+
+// flushAcks sends the pending batch of acks of the subscription, if any.
+func (sub *Subscription) flushAcks() {
+	sub.mu.Lock()
+	var acks *ackBatcher
+	if sub.jsi != nil {
+		acks = sub.jsi.acks
+	}
+	sub.mu.Unlock()
+	acks.flush()
+}
+
+// ackMsg acknowledges a message, the ack of Consume() and ConsumeMulti().
+func ackMsg(m *Msg) {
+	m.Ack()
+}
+
+// ackBatcher coalesces the acks of the messages of a consumer with the
+// AckAll policy, acknowledging the last message of each batch.
+type ackBatcher struct {
+	mu    sync.Mutex
+	max   int
+	wait  time.Duration
+	clk   clock
+	last  *Msg
+	n     int
+	timer clockTimer
+}
+
+// add records that the message was handled, acknowledging it along with
+// the previous ones once the batch is full. The first message of a batch
+// starts the timer flushing the batch.
+func (b *ackBatcher) add(m *Msg) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.last = m
+	if b.n++; b.n >= b.max {
+		b.flushLocked()
+		return
+	}
+	if b.n > 1 {
+		return
+	}
+	if b.timer == nil {
+		b.timer = b.clk.AfterFunc(b.wait, b.flush)
+	} else {
+		b.timer.Reset(b.wait)
+	}
+}
+
+// flush acknowledges the pending batch, if any.
+func (b *ackBatcher) flush() {
+	if b == nil {
+		return
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.flushLocked()
+}
+
+func (b *ackBatcher) flushLocked() {
+	if b.timer != nil {
+		b.timer.Stop()
+	}
+	if b.last == nil {
+		return
+	}
+	b.last.Ack()
+	b.last, b.n = nil, 0
+}
+
+// recreateConsumer creates the consumer of a Consume() subscription again
+// after it was deleted, and notifies the asynchronous error handler.
+func (js *js) recreateConsumer(sub *Subscription, stream string, cfg *ConsumerConfig) error {
+	if _, err := js.AddConsumer(stream, cfg); err != nil {
+		return err
+	}
+	nc := js.nc
+	nc.mu.Lock()
+	if errCB := nc.Opts.AsyncErrorCB; errCB != nil {
+		nc.ach.push(func() { errCB(nc, sub, ErrConsumerRecreated) })
+	}
+	nc.mu.Unlock()
+	return nil
+}
+
+// Tail delivers the messages published on the subject from now on.
+func (js *js) Tail(subj string, cb MsgHandler, opts ...SubOpt) (*Subscription, error) {
+	if cb == nil {
+		return nil, fmt.Errorf("%w: callback is required", ErrInvalidArg)
+	}
+	opts = append([]SubOpt{OrderedConsumer(), DeliverNew()}, opts...)
+	return js.Subscribe(subj, cb, opts...)
+}
+
+// ConsumerRef identifies a consumer of a stream, see ConsumeMulti().
+type ConsumerRef struct {
+	Stream   string
+	Consumer string
+}
+
+// MultiSubscription delivers the messages of several consumers to a single
+// handler, see ConsumeMulti().
+type MultiSubscription struct {
+	subs []*Subscription
+}
+
+const (
+	// Size and expiration of the fetch requests of ConsumeMulti() for pull consumers.
+	multiPullBatch = 100
+	multiPullWait  = 5 * time.Second
+	// multiPullRetryWait is how long to wait before fetching again after an error.
+	multiPullRetryWait = 250 * time.Millisecond
+	// maxRecreateWait bounds the delay between failed attempts to recreate
+	// a deleted consumer, see ConsumeRecreateOnDelete().
+	maxRecreateWait = 10 * time.Second
+	// readyPullWait bounds the wait for each pull request sent to check
+	// that the consumer is ready, see ConsumeWaitForReady().
+	readyPullWait = time.Second
+)
+
+// ConsumeMulti delivers the messages of several consumers to a single handler.
+func (js *js) ConsumeMulti(refs []ConsumerRef, cb MsgHandler, opts ...SubOpt) (*MultiSubscription, error) {
+	if cb == nil {
+		return nil, fmt.Errorf("%w: callback is required", ErrInvalidArg)
+	}
+	if len(refs) == 0 {
+		return nil, fmt.Errorf("%w: at least one consumer is required", ErrInvalidArg)
+	}
+	o, err := parseSubOpts(opts)
+	if err != nil {
+		return nil, err
+	}
+	if o.recreate != nil {
+		return nil, fmt.Errorf("nats: ConsumeRecreateOnDelete can only be used with Consume()")
+	} else if o.refresh > 0 {
+		return nil, fmt.Errorf("nats: ConsumeRefreshConfig can only be used with Consume()")
+	} else if o.ready > 0 {
+		return nil, fmt.Errorf("nats: ConsumeWaitForReady can only be used with Consume()")
+	} else if o.latcb != nil {
+		return nil, fmt.Errorf("nats: ConsumeLatencyHandler can only be used with Consume()")
+	}
+	if o.transform != nil {
+		cb = o.transform.handler(cb)
+	}
+
+	var mu sync.Mutex
+	handler := func(m *Msg) {
+		mu.Lock()
+		defer mu.Unlock()
+		cb(m)
+	}
+	ms := &MultiSubscription{subs: make([]*Subscription, 0, len(refs))}
+	for _, ref := range refs {
+		sub, err := js.consumeRef(ref, handler, opts)
+		if err != nil {
+			ms.Unsubscribe()
+			return nil, fmt.Errorf("nats: consumer %q of stream %q: %w", ref.Consumer, ref.Stream, err)
+		}
+		ms.subs = append(ms.subs, sub)
+	}
+	return ms, nil
+}
+
+// consumeRef binds a subscription delivering the messages of the consumer to cb.
+func (js *js) consumeRef(ref ConsumerRef, cb MsgHandler, opts []SubOpt) (*Subscription, error) {
+	if err := checkStreamName(ref.Stream); err != nil {
+		return nil, err
+	}
+	if err := checkConsumerName(ref.Consumer); err != nil {
+		return nil, err
+	}
+	info, err := js.ConsumerInfo(ref.Stream, ref.Consumer)
+	if err != nil {
+		return nil, err
+	}
+	opts = append(opts[:len(opts):len(opts)], Bind(ref.Stream, ref.Consumer))
+	if info.Config.DeliverSubject != _EMPTY_ {
+		return js.Subscribe(_EMPTY_, cb, opts...)
+	}
+	o, err := parseSubOpts(opts)
+	if err != nil {
+		return nil, err
+	}
+	sub, err := js.PullSubscribe(_EMPTY_, _EMPTY_, opts...)
+	if err != nil {
+		return nil, err
+	}
+	// Acknowledge like push subscriptions do.
+	var ack func(m *Msg)
+	if !o.mack && info.Config.AckPolicy != AckNonePolicy {
+		ack = ackMsg
+	}
+	go pullToHandler(sub, cb, ack, nil, 0)
+	return sub, nil
+}
+
+// parseSubOpts applies the options to an empty configuration, for the
+// helpers which need to know about them before subscribing.
+func parseSubOpts(opts []SubOpt) (*subOpts, error) {
+	o := &subOpts{cfg: &ConsumerConfig{}}
+	for _, opt := range opts {
+		if opt == nil {
+			continue
+		}
+		if err := opt.configureSubscribe(o); err != nil {
+			return nil, err
+		}
+	}
+	return o, nil
+}
+
+// pullToHandler fetches the messages of a pull subscription and passes
+// them to cb until the subscription is closed, acknowledging them with ack
+// once cb returns if set. The delivery latency of the messages is reported
+// first if the subscription has a latency handler. Errors are recorded as
+// the last error of the subscription. If recreate is set, it is invoked when the consumer is
+// found to be gone, and retried with a growing delay while it fails. If
+// refresh is set, the consumer configuration is looked up again between
+// pull requests once refresh has elapsed since the previous lookup.
+func pullToHandler(sub *Subscription, cb MsgHandler, ack func(m *Msg), recreate func(sub *Subscription) error, refresh time.Duration) {
+	wait := multiPullRetryWait
+	sub.mu.Lock()
+	clk, latcb := sub.jsi.js.clock(), sub.jsi.latcb
+	sub.mu.Unlock()
+	refreshed := clk.Now()
+	for sub.IsValid() {
+		if refresh > 0 && clk.Now().Sub(refreshed) >= refresh {
+			if err := sub.RefreshConsumerConfig(); err != nil {
+				sub.setLastError(err)
+			}
+			refreshed = clk.Now()
+		}
+		p := sub.pullParams()
+		fopts := []PullOpt{MaxWait(p.expires)}
+		if p.maxBytes > 0 {
+			fopts = append(fopts, PullMaxBytes(p.maxBytes))
+		}
+		sent := clk.Now()
+		msgs, err := sub.Fetch(p.batch, fopts...)
+		for _, m := range msgs {
+			if latcb != nil {
+				latcb(m, deliveryLatency(m, sent, clk))
+			}
+			cb(m)
+			if ack != nil {
+				ack(m)
+			}
+		}
+		if err == nil || err == ErrTimeout || !sub.IsValid() {
+			continue
+		}
+		// The error was recorded by Fetch().
+		if pullLimitExceeded(err) {
+			// The consumer limits changed, pick up the new ones.
+			if err := sub.RefreshConsumerConfig(); err != nil {
+				sub.setLastError(err)
+			}
+			refreshed = clk.Now()
+		}
+		if recreate == nil || !consumerGone(err) {
+			time.Sleep(multiPullRetryWait)
+			continue
+		}
+		if err := recreate(sub); err != nil {
+			sub.setLastError(err)
+			time.Sleep(wait)
+			if wait *= 2; wait > maxRecreateWait {
+				wait = maxRecreateWait
+			}
+			continue
+		}
+		wait = multiPullRetryWait
+	}
+}
+
+// DeliveryLatency is the delivery latency of a message passed to the
+// handler of Consume(), see ConsumeLatencyHandler().
+type DeliveryLatency struct {
+	// Pull is the time between the sending of the pull request which
+	// delivered the message and its receipt. It is 0 for messages received
+	// for a previous pull request.
+	Pull time.Duration
+	// Publish is the time between the storage of the message in the stream,
+	// as reported by its metadata, and its receipt. It is affected by the
+	// clock skew between the server and the client.
+	Publish time.Duration
+}
+
+// deliveryLatency returns the latency of a message fetched by a pull request
+// sent at the given time. The receipt time is the delivery time recorded
+// for acks if any, and the current time otherwise.
+func deliveryLatency(m *Msg, sent time.Time, clk clock) DeliveryLatency {
+	recv := clk.Now()
+	if dlvt := atomic.LoadInt64(&m.dlvt); dlvt != 0 {
+		recv = time.Unix(0, dlvt)
+	}
+	var l DeliveryLatency
+	if d := recv.Sub(sent); d > 0 {
+		l.Pull = d
+	}
+	if meta, err := m.Metadata(); err == nil {
+		l.Publish = recv.Sub(meta.Timestamp)
+	}
+	return l
+}
+
+// pullParams are the parameters of the pull requests sent by Consume(), see
+// RefreshConsumerConfig().
+type pullParams struct {
+	batch    int
+	expires  time.Duration
+	maxBytes int
+}
+
+// defaultPullParams are used until the consumer configuration is known.
+var defaultPullParams = pullParams{batch: multiPullBatch, expires: multiPullWait}
+
+// newPullParams returns the parameters of pull requests which comply with
+// the limits of the consumer configuration.
+func newPullParams(cfg *ConsumerConfig) *pullParams {
+	p := defaultPullParams
+	if cfg.MaxAckPending > 0 && cfg.MaxAckPending < p.batch {
+		p.batch = cfg.MaxAckPending
+	}
+	if cfg.MaxRequestBatch > 0 && cfg.MaxRequestBatch < p.batch {
+		p.batch = cfg.MaxRequestBatch
+	}
+	if cfg.MaxRequestExpires > 0 && cfg.MaxRequestExpires < p.expires {
+		p.expires = cfg.MaxRequestExpires
+	}
+	p.maxBytes = cfg.MaxRequestMaxBytes
+	return &p
+}
+
+// pullParams returns the parameters of the next pull request of Consume().
+func (sub *Subscription) pullParams() pullParams {
+	sub.mu.Lock()
+	defer sub.mu.Unlock()
+	if sub.jsi == nil || sub.jsi.pullp == nil {
+		return defaultPullParams
+	}
+	return *sub.jsi.pullp
+}
+
+// pullLimitExceeded reports whether a fetch error means that the pull request
+// exceeded a limit of the consumer configuration.
+func pullLimitExceeded(err error) bool {
+	return errors.Is(err, ErrMaxRequestBatchExceeded) || errors.Is(err, ErrMaxRequestExpiresExceeded) || errors.Is(err, ErrMaxRequestMaxBytesExceeded)
+}
+
+// consumerGone reports whether a fetch error means that the consumer does
+// not exist anymore. Pull requests sent to a missing consumer have no
+// responders.
+func consumerGone(err error) bool {
+	return errors.Is(err, ErrConsumerDeleted) || errors.Is(err, ErrConsumerNotFound) || errors.Is(err, ErrNoResponders)
+}
+
+// Subscriptions returns the subscriptions of the consumers, in the order
+// they were given to ConsumeMulti().
+func (ms *MultiSubscription) Subscriptions() []*Subscription {
+	subs := make([]*Subscription, len(ms.subs))
+	copy(subs, ms.subs)
+	return subs
+}
+
+// Errors returns the last non-fatal error of each subscription that has
+// one, see Subscription.LastError().
+func (ms *MultiSubscription) Errors() []error {
+	var errs []error
+	for _, sub := range ms.subs {
+		if err := sub.LastError(); err != nil {
+			errs = append(errs, err)
+		}
+	}
+	return errs
+}
+
+// Unsubscribe removes the interest in all the consumers, see
+// Subscription.Unsubscribe(). The first error encountered is returned.
+func (ms *MultiSubscription) Unsubscribe() error {
+	return ms.each((*Subscription).Unsubscribe)
+}
+
+// Drain removes the interest in all the consumers but allows pending
+// messages to be processed, see Subscription.Drain(). The first error
+// encountered is returned.
+func (ms *MultiSubscription) Drain() error {
+	return ms.each((*Subscription).Drain)
+}
+
+// IsValid returns true as long as one of the subscriptions is valid.
+func (ms *MultiSubscription) IsValid() bool {
+	for _, sub := range ms.subs {
+		if sub.IsValid() {
+			return true
+		}
+	}
+	return false
+}
+
+func (ms *MultiSubscription) each(f func(sub *Subscription) error) error {
+	var ferr error
+	for _, sub := range ms.subs {
+		if err := f(sub); err != nil && err != ErrBadSubscription && ferr == nil {
+			ferr = err
+		}
+	}
+	return ferr
+}
+
+func processConsInfo(info *ConsumerInfo, userCfg *ConsumerConfig, isPullMode bool, subj, queue string) (string, error) {
+	ccfg := &info.Config
+
+	// Make sure this new subject matches or is a subset.
+	if ccfg.FilterSubject != _EMPTY_ && subj != ccfg.FilterSubject {
+		return _EMPTY_, ErrSubjectMismatch
+	}
+	if len(ccfg.FilterSubjects) > 0 && subj != _EMPTY_ && !containsString(ccfg.FilterSubjects, subj) {
+		return _EMPTY_, ErrSubjectMismatch
+	}
+
+	// Prevent binding a subscription against incompatible consumer types.
+	if isPullMode && ccfg.DeliverSubject != _EMPTY_ {
+		return _EMPTY_, ErrPullSubscribeToPushConsumer
+	} else if !isPullMode && ccfg.DeliverSubject == _EMPTY_ {
+		return _EMPTY_, ErrPullSubscribeRequired
+	}
+
+	// If pull mode, nothing else to check here.
+	if isPullMode {
+		return _EMPTY_, checkConfig(ccfg, userCfg)
+	}
+
+	// At this point, we know the user wants push mode, and the JS consumer is
+	// really push mode.
+
+	dg := info.Config.DeliverGroup
+	if dg == _EMPTY_ {
+		// Prevent an user from attempting to create a queue subscription on
+		// a JS consumer that was not created with a deliver group.
+		if queue != _EMPTY_ {
+			return _EMPTY_, fmt.Errorf("cannot create a queue subscription for a consumer without a deliver group")
+		} else if info.PushBound {
+			// Need to reject a non queue subscription to a non queue consumer
+			// if the consumer is already bound.
+			return _EMPTY_, fmt.Errorf("consumer is already bound to a subscription")
+		}
+	} else {
+		// If the JS consumer has a deliver group, we need to fail a non queue
+		// subscription attempt:
+		if queue == _EMPTY_ {
+			return _EMPTY_, fmt.Errorf("cannot create a subscription for a consumer with a deliver group %q", dg)
+		} else if queue != dg {
+			// Here the user's queue group name does not match the one associated
+			// with the JS consumer.
+			return _EMPTY_, fmt.Errorf("cannot create a queue subscription %q for a consumer with a deliver group %q",
+				queue, dg)
+		}
+	}
+	if err := checkConfig(ccfg, userCfg); err != nil {
+		return _EMPTY_, err
+	}
+	return ccfg.DeliverSubject, nil
+}
+
+func checkConfig(s, u *ConsumerConfig) error {
+	makeErr := func(fieldName string, usrVal, srvVal interface{}) error {
+		return fmt.Errorf("configuration requests %s to be %v, but consumer's value is %v", fieldName, usrVal, srvVal)
+	}
+
+	if u.Durable != _EMPTY_ && u.Durable != s.Durable {
+		return makeErr("durable", u.Durable, s.Durable)
+	}
+	if u.Description != _EMPTY_ && u.Description != s.Description {
+		return makeErr("description", u.Description, s.Description)
+	}
+	if u.DeliverPolicy != deliverPolicyNotSet && u.DeliverPolicy != s.DeliverPolicy {
+		return makeErr("deliver policy", u.DeliverPolicy, s.DeliverPolicy)
+	}
+	if u.OptStartSeq > 0 && u.OptStartSeq != s.OptStartSeq {
+		return makeErr("optional start sequence", u.OptStartSeq, s.OptStartSeq)
+	}
+	if u.OptStartTime != nil && !u.OptStartTime.IsZero() && !(*u.OptStartTime).Equal(*s.OptStartTime) {
+		return makeErr("optional start time", u.OptStartTime, s.OptStartTime)
+	}
+	if u.AckPolicy != ackPolicyNotSet && u.AckPolicy != s.AckPolicy {
+		return makeErr("ack policy", u.AckPolicy, s.AckPolicy)
+	}
+	if u.AckWait > 0 && u.AckWait != s.AckWait {
+		return makeErr("ack wait", u.AckWait, s.AckWait)
+	}
+	if u.MaxDeliver > 0 && u.MaxDeliver != s.MaxDeliver {
+		return makeErr("max deliver", u.MaxDeliver, s.MaxDeliver)
+	}
+	if u.ReplayPolicy != replayPolicyNotSet && u.ReplayPolicy != s.ReplayPolicy {
+		return makeErr("replay policy", u.ReplayPolicy, s.ReplayPolicy)
+	}
+	if u.RateLimit > 0 && u.RateLimit != s.RateLimit {
+		return makeErr("rate limit", u.RateLimit, s.RateLimit)
+	}
+	if u.SampleFrequency != _EMPTY_ && u.SampleFrequency != s.SampleFrequency {
+		return makeErr("sample frequency", u.SampleFrequency, s.SampleFrequency)
+	}
+	if u.MaxWaiting > 0 && u.MaxWaiting != s.MaxWaiting {
+		return makeErr("max waiting", u.MaxWaiting, s.MaxWaiting)
 	}
 	if u.MaxAckPending > 0 && u.MaxAckPending != s.MaxAckPending {
 		return makeErr("max ack pending", u.MaxAckPending, s.MaxAckPending)
@@ -1400,9 +2689,33 @@ func checkConfig(s, u *ConsumerConfig) error {
 	if u.MemoryStorage && !s.MemoryStorage {
 		return makeErr("memory storage", u.MemoryStorage, s.MemoryStorage)
 	}
+	if len(u.FilterSubjects) > 0 && !stringSlicesEqual(u.FilterSubjects, s.FilterSubjects) {
+		return makeErr("filter subjects", u.FilterSubjects, s.FilterSubjects)
+	}
 	return nil
 }
 
+func containsString(list []string, s string) bool {
+	for _, v := range list {
+		if v == s {
+			return true
+		}
+	}
+	return false
+}
+
+func stringSlicesEqual(a, b []string) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if a[i] != b[i] {
+			return false
+		}
+	}
+	return true
+}
+
 func (js *js) subscribe(subj, queue string, cb MsgHandler, ch chan *Msg, isSync, isPullMode bool, opts []SubOpt) (*Subscription, error) {
 	cfg := ConsumerConfig{
 		DeliverPolicy: deliverPolicyNotSet,
@@ -1436,10 +2749,23 @@ func (js *js) subscribe(subj, queue string, cb MsgHandler, ch chan *Msg, isSync,
 		if o.cfg.DeliverSubject != _EMPTY_ {
 			return nil, ErrPullSubscribeToPushConsumer
 		}
+		if o.cfg.RateLimit > 0 {
+			return nil, fmt.Errorf("%w: rate limit is only valid for push consumers", ErrInvalidConsumerConfig)
+		}
+		if o.gapcb != nil {
+			return nil, fmt.Errorf("nats: sequence gap handler is only valid for push consumers")
+		}
+	}
+	if o.rate > 0 && cb == nil {
+		return nil, fmt.Errorf("nats: consume rate limit is only valid for callback subscriptions")
 	}
 
 	// Some check/setting specific to queue subs
 	if queue != _EMPTY_ {
+		// Messages are dispatched to all members, so each one sees gaps.
+		if o.gapcb != nil {
+			return nil, fmt.Errorf("nats: queue subscription doesn't support sequence gap handler")
+		}
 		// Queue subscriber cannot have HB or FC (since messages will be randomly dispatched
 		// to members). We may in the future have a separate NATS subscription that all members
 		// would subscribe to and server would send on.
@@ -1466,6 +2792,7 @@ func (js *js) subscribe(subj, queue string, cb MsgHandler, ch chan *Msg, isSync,
 		stream        = o.stream
 		consumer      = o.consumer
 		isDurable     = o.cfg.Durable != _EMPTY_
+		prefixed      bool // The consumer name was generated from the name prefix.
 		consumerBound = o.bound
 		ctx           = o.ctx
 		notFoundErr   bool
@@ -1475,6 +2802,11 @@ func (js *js) subscribe(subj, queue string, cb MsgHandler, ch chan *Msg, isSync,
 		hbi           time.Duration
 		ccreq         *createConsumerRequest // In case we need to hold onto it for ordered consumers.
 		maxap         int
+		ackExplicit   bool
+		ackWait       time.Duration
+		backoff       []time.Duration
+		maxDeliver    int
+		ackNone       bool
 	)
 
 	// Do some quick checks here for ordered consumers. We do these here instead of spread out
@@ -1508,6 +2840,10 @@ func (js *js) subscribe(subj, queue string, cb MsgHandler, ch chan *Msg, isSync,
 		if isPullMode {
 			return nil, fmt.Errorf("nats: can not use pull mode for an ordered consumer")
 		}
+		// Ordered consumers are recreated with server assigned names.
+		if o.namePrefix != _EMPTY_ {
+			return nil, fmt.Errorf("nats: consumer name prefix can not be set for an ordered consumer")
+		}
 		// Setup how we need it to be here.
 		o.cfg.FlowControl = true
 		o.cfg.AckPolicy = AckNonePolicy
@@ -1539,10 +2875,30 @@ func (js *js) subscribe(subj, queue string, cb MsgHandler, ch chan *Msg, isSync,
 		}
 	}
 
+	if o.rdcb != nil && cb == nil {
+		return nil, fmt.Errorf("nats: redelivery handler requires a message handler")
+	}
+	if o.lacb != nil && cb == nil {
+		return nil, fmt.Errorf("nats: last attempt handler requires a message handler")
+	}
+	if o.filter != nil && cb == nil {
+		return nil, fmt.Errorf("nats: message filter requires a message handler")
+	}
+	if o.extendAck && cb == nil {
+		return nil, fmt.Errorf("nats: auto extend ack requires a message handler")
+	}
+	if o.dedup > 0 && cb == nil {
+		return nil, fmt.Errorf("nats: dedup window requires a message handler")
+	}
+
+	if o.bindDurable && o.skipCInfo {
+		return nil, fmt.Errorf("nats: consumer lookup can not be skipped when binding to a durable")
+	}
+
 	// With an explicit durable name, we can lookup the consumer first
 	// to which it should be attaching to.
 	// If bind to ordered consumer is true, skip the lookup.
-	if consumer != _EMPTY_ {
+	if consumer != _EMPTY_ && !o.skipCInfo {
 		info, err = js.ConsumerInfo(stream, consumer)
 		notFoundErr = errors.Is(err, ErrConsumerNotFound)
 		lookupErr = err == ErrJetStreamNotEnabled || err == ErrTimeout || err == context.DeadlineExceeded
@@ -1550,6 +2906,9 @@ func (js *js) subscribe(subj, queue string, cb MsgHandler, ch chan *Msg, isSync,
 
 	switch {
 	case info != nil:
+		if o.bindDurable && (info.Name != consumer || info.Config.Durable != consumer) {
+			return nil, fmt.Errorf("%w: expected durable %q, got consumer %q", ErrConsumerMismatch, consumer, info.Name)
+		}
 		deliver, err = processConsInfo(info, o.cfg, isPullMode, subj, queue)
 		if err != nil {
 			return nil, err
@@ -1558,11 +2917,26 @@ func (js *js) subscribe(subj, queue string, cb MsgHandler, ch chan *Msg, isSync,
 		hasFC, hbi = icfg.FlowControl, icfg.Heartbeat
 		hasHeartbeats = hbi > 0
 		maxap = icfg.MaxAckPending
+		ackExplicit = icfg.AckPolicy == AckExplicitPolicy
+		ackWait = icfg.AckWait
+		backoff = icfg.BackOff
+		maxDeliver = icfg.MaxDeliver
+		ackNone = icfg.AckPolicy == AckNonePolicy
 	case (err != nil && !notFoundErr) || (notFoundErr && consumerBound):
 		// If the consumer is being bound and we got an error on pull subscribe then allow the error.
 		if !(isPullMode && lookupErr && consumerBound) {
 			return nil, err
 		}
+	case consumerBound && o.skipCInfo:
+		// The lookup was skipped, so trust that the consumer exists. For push
+		// consumers, the deliver subject can not be discovered and needs to be
+		// provided.
+		if !isPullMode {
+			if o.cfg.DeliverSubject == _EMPTY_ {
+				return nil, fmt.Errorf("nats: deliver subject is required when binding to a push consumer without lookup")
+			}
+			deliver = o.cfg.DeliverSubject
+		}
 	default:
 		// Attempt to create consumer if not found nor using Bind.
 		shouldCreate = true
@@ -1576,6 +2950,32 @@ func (js *js) subscribe(subj, queue string, cb MsgHandler, ch chan *Msg, isSync,
 		// Do filtering always, server will clear as needed.
 		cfg.FilterSubject = subj
 
+		// Start after the current last message of the stream, or the given
+		// number of messages before, unless another deliver policy was
+		// given afterwards.
+		if o.afterLast && cfg.DeliverPolicy == DeliverByStartSequencePolicy && cfg.OptStartSeq == 0 {
+			si, err := js.StreamInfo(stream)
+			if err != nil {
+				return nil, err
+			}
+			cfg.OptStartSeq = si.State.LastSeq + 1
+			if o.lastN >= cfg.OptStartSeq {
+				cfg.OptStartSeq = 1
+			} else {
+				cfg.OptStartSeq -= o.lastN
+			}
+		}
+
+		// Name the ephemeral consumer if a prefix was provided.
+		if consumer == _EMPTY_ && o.namePrefix != _EMPTY_ {
+			if !nc.serverMinVersion(2, 9, 0) {
+				return nil, fmt.Errorf("nats: consumer name prefix requires nats-server v2.9.0 or later")
+			}
+			cfg.Name = o.namePrefix + nuid.Next()
+			consumer = cfg.Name
+			prefixed = true
+		}
+
 		// Pass the queue to the consumer config
 		if queue != _EMPTY_ {
 			cfg.DeliverGroup = queue
@@ -1589,6 +2989,14 @@ func (js *js) subscribe(subj, queue string, cb MsgHandler, ch chan *Msg, isSync,
 		if cfg.AckPolicy == ackPolicyNotSet {
 			cfg.AckPolicy = AckExplicitPolicy
 		}
+		// Messages waiting for the rate limiter are not acknowledged, so
+		// only let the server deliver what can be handled within the ack wait.
+		if o.rate > 0 && cfg.MaxAckPending == 0 && cfg.AckPolicy != AckNonePolicy {
+			cfg.MaxAckPending = int(o.rate * cfg.ackWait().Seconds() / 2)
+			if cfg.MaxAckPending < 1 {
+				cfg.MaxAckPending = 1
+			}
+		}
 		// If not set, default to instant
 		if cfg.ReplayPolicy == replayPolicyNotSet {
 			cfg.ReplayPolicy = ReplayInstantPolicy
@@ -1599,12 +3007,41 @@ func (js *js) subscribe(subj, queue string, cb MsgHandler, ch chan *Msg, isSync,
 		if cfg.MaxAckPending == 0 && ch != nil && cfg.AckPolicy != AckNonePolicy {
 			cfg.MaxAckPending = cap(ch)
 		}
+		if err := checkConsumerFlowControl(&cfg); err != nil {
+			return nil, err
+		}
 		// Create request here.
 		ccreq = &createConsumerRequest{
 			Stream: stream,
 			Config: &cfg,
 		}
 		hbi = cfg.Heartbeat
+		maxDeliver = cfg.MaxDeliver
+		ackNone = cfg.AckPolicy == AckNonePolicy
+	}
+
+	// The last delivery attempt can only be detected if the consumer has a
+	// max deliver and messages are redelivered until then.
+	if o.lacb != nil {
+		if maxDeliver < 1 {
+			return nil, fmt.Errorf("nats: last attempt handler requires a consumer with max deliver set")
+		}
+		if ackNone {
+			return nil, fmt.Errorf("nats: last attempt handler can not be used with ack policy none")
+		}
+	}
+	// Without acks there are no redeliveries to detect.
+	if o.dedup > 0 && ackNone {
+		return nil, fmt.Errorf("nats: dedup window can not be used with ack policy none")
+	}
+	// The ack wait is needed to extend the ack deadline in time.
+	if o.extendAck {
+		if ackNone {
+			return nil, fmt.Errorf("nats: auto extend ack can not be used with ack policy none")
+		}
+		if info == nil && !shouldCreate {
+			return nil, fmt.Errorf("nats: auto extend ack can not be used when the consumer lookup is skipped")
+		}
 	}
 
 	if isPullMode {
@@ -1634,14 +3071,101 @@ func (js *js) subscribe(subj, queue string, cb MsgHandler, ch chan *Msg, isSync,
 		nms:      nms,
 		psubj:    subj,
 		cancel:   cancel,
+		sctx:     o.ctx,
 		ackNone:  o.cfg.AckPolicy == AckNonePolicy,
+		ackWait:  ackWait,
+		backoff:  backoff,
+		noLookup: o.skipCInfo,
+		maxErrs:  o.maxErrs,
+		rscb:     o.rscb,
+		gapcb:    o.gapcb,
+		rl:       newRateLimiter(o.rate, js.clock()),
 	}
 
 	// Auto acknowledge unless manual ack is set or policy is set to AckNonePolicy
-	if cb != nil && !o.mack && o.cfg.AckPolicy != AckNonePolicy {
+	autoAck := cb != nil && !o.mack && o.cfg.AckPolicy != AckNonePolicy
+	if autoAck {
 		ocb := cb
 		cb = func(m *Msg) { ocb(m); m.Ack() }
 	}
+
+	// Route redelivered messages to the redelivery handler, which is
+	// responsible for acknowledging them.
+	if rdcb := o.rdcb; rdcb != nil {
+		ocb := cb
+		cb = func(m *Msg) {
+			if meta, err := m.Metadata(); err == nil && meta.NumDelivered > 1 {
+				rdcb(m, int(meta.NumDelivered))
+				return
+			}
+			ocb(m)
+		}
+	}
+
+	// Route messages on their last delivery attempt to the last attempt
+	// handler, which takes precedence over the redelivery handler.
+	if lacb := o.lacb; lacb != nil {
+		ocb := cb
+		cb = func(m *Msg) {
+			if meta, err := m.Metadata(); err == nil && int(meta.NumDelivered) >= maxDeliver {
+				lacb(m)
+				if autoAck {
+					m.Ack()
+				}
+				return
+			}
+			ocb(m)
+		}
+	}
+
+	// Keep messages from being redelivered while the handler runs.
+	if o.extendAck {
+		ocb := cb
+		cb = func(m *Msg) {
+			stop := m.extendAck()
+			defer stop()
+			ocb(m)
+		}
+	}
+
+	// Skip messages rejected by the filter, disposing of them as requested.
+	if keep := o.filter; keep != nil {
+		ocb, action := cb, o.filterAct
+		cb = func(m *Msg) {
+			if keep(m) {
+				ocb(m)
+				return
+			}
+			if ackNone {
+				return
+			}
+			if action == FilterTerm {
+				m.Term()
+			} else {
+				m.Ack()
+			}
+		}
+	}
+
+	// Acknowledge and skip messages already acknowledged within the window.
+	if o.dedup > 0 {
+		ocb, dw := cb, newDedupWindow(o.dedup, js.clock())
+		cb = func(m *Msg) {
+			meta, err := m.Metadata()
+			if err != nil {
+				ocb(m)
+				return
+			}
+			if dw.seen(meta.Sequence.Stream) {
+				m.Ack()
+				return
+			}
+			ocb(m)
+			if atomic.LoadUint32(&m.ackd) == msgAckd {
+				dw.add(meta.Sequence.Stream)
+			}
+		}
+	}
 	sub, err := nc.subscribe(deliver, queue, cb, ch, isSync, jsi)
 	if err != nil {
 		return nil, err
@@ -1660,14 +3184,16 @@ func (js *js) subscribe(subj, queue string, cb MsgHandler, ch chan *Msg, isSync,
 
 	// If we are creating or updating let's process that request.
 	if shouldCreate {
-		info, err := js.upsertConsumer(stream, cfg.Durable, ccreq.Config)
+		info, err := js.upsertConsumer(stream, consumer, ccreq.Config)
 		if err != nil {
 			var apiErr *APIError
 			if ok := errors.As(err, &apiErr); !ok {
 				cleanUpSub()
 				return nil, err
 			}
-			if consumer == _EMPTY_ ||
+			// A consumer already using a generated name is not ours, so
+			// it is not bound.
+			if consumer == _EMPTY_ || prefixed ||
 				(apiErr.ErrorCode != JSErrCodeConsumerAlreadyExists && apiErr.ErrorCode != JSErrCodeConsumerNameExists) {
 				cleanUpSub()
 				if errors.Is(apiErr, ErrStreamNotFound) {
@@ -1732,6 +3258,19 @@ func (js *js) subscribe(subj, queue string, cb MsgHandler, ch chan *Msg, isSync,
 		// Capture max ack pending from the info response here which covers both
 		// success and failure followed by consumer lookup.
 		maxap = info.Config.MaxAckPending
+		ackExplicit = info.Config.AckPolicy == AckExplicitPolicy
+		sub.mu.Lock()
+		sub.jsi.ackWait = info.Config.AckWait
+		sub.jsi.backoff = info.Config.BackOff
+		sub.mu.Unlock()
+	}
+
+	// Pull subscriptions keep the number of fetched messages pending
+	// acknowledgement within the consumer's MaxAckPending if requested.
+	if isPullMode && o.apLimit && ackExplicit && maxap > 0 {
+		sub.mu.Lock()
+		sub.jsi.maxap = maxap
+		sub.mu.Unlock()
 	}
 
 	// If maxap is greater than the default sub's pending limit, use that.
@@ -1763,9 +3302,95 @@ func (js *js) subscribe(subj, queue string, cb MsgHandler, ch chan *Msg, isSync,
 		}()
 	}
 
+	js.trackSub(sub)
+
 	return sub, nil
 }
 
+// trackSub registers a subscription created through this context,
+// removing the ones that have been closed since.
+func (js *js) trackSub(sub *Subscription) {
+	js.mu.Lock()
+	defer js.mu.Unlock()
+	if js.subs == nil {
+		js.subs = make(map[*Subscription]struct{})
+	}
+	for s := range js.subs {
+		if !s.IsValid() {
+			delete(js.subs, s)
+		}
+	}
+	js.subs[sub] = struct{}{}
+}
+
+// rebindSubs moves the push subscriptions of this context bound to the
+// consumer to its current deliver subject, see Subscription.rebind().
+func (js *js) rebindSubs(stream string, info *ConsumerInfo) {
+	js.mu.RLock()
+	subs := make([]*Subscription, 0, len(js.subs))
+	for sub := range js.subs {
+		subs = append(subs, sub)
+	}
+	js.mu.RUnlock()
+
+	for _, sub := range subs {
+		sub.mu.Lock()
+		bound := sub.jsi != nil && sub.jsi.stream == stream && sub.jsi.consumer == info.Name
+		sub.mu.Unlock()
+		if bound {
+			sub.rebind(info)
+		}
+	}
+}
+
+// Drain gracefully stops all subscriptions created through this context
+// and waits for outstanding async publishes to complete.
+func (js *js) Drain(opts ...JSOpt) error {
+	o, cancel, err := getJSContextOpts(js.opts, opts...)
+	if err != nil {
+		return err
+	}
+	if cancel != nil {
+		defer cancel()
+	}
+
+	js.mu.Lock()
+	subs := make([]*Subscription, 0, len(js.subs))
+	for sub := range js.subs {
+		subs = append(subs, sub)
+	}
+	js.subs = nil
+	js.mu.Unlock()
+
+	for _, sub := range subs {
+		if !sub.IsValid() {
+			continue
+		}
+		if err := sub.Drain(); err != nil && err != ErrBadSubscription {
+			return err
+		}
+	}
+
+	ticker := time.NewTicker(10 * time.Millisecond)
+	defer ticker.Stop()
+	for _, sub := range subs {
+		for sub.IsValid() {
+			select {
+			case <-o.ctx.Done():
+				return o.ctx.Err()
+			case <-ticker.C:
+			}
+		}
+	}
+
+	select {
+	case <-js.PublishAsyncComplete():
+	case <-o.ctx.Done():
+		return o.ctx.Err()
+	}
+	return nil
+}
+
 // This long-lived routine is used per ChanSubscription to check
 // on the number of delivered messages and check for flow control response.
 func (sub *Subscription) chanSubcheckForFlowControlResponse() {
@@ -1788,10 +3413,70 @@ func (sub *Subscription) chanSubcheckForFlowControlResponse() {
 		// Do the reset here under the lock, it's ok...
 		jsi.csfct.Reset(chanSubFCCheckInterval)
 	}
-	sub.mu.Unlock()
-	// This call will return an error (which we don't care here)
-	// if nc is nil or fcReply is empty.
-	nc.Publish(fcReply, nil)
+	sub.mu.Unlock()
+	// This call will return an error (which we don't care here)
+	// if nc is nil or fcReply is empty.
+	nc.Publish(fcReply, nil)
+}
+
+// SubscriptionError is a non-fatal error encountered by a JetStream
+// subscription, such as missed heartbeats, along with the time it occurred.
+type SubscriptionError struct {
+	Err  error
+	Time time.Time
+}
+
+func (e *SubscriptionError) Error() string {
+	return e.Err.Error()
+}
+
+func (e *SubscriptionError) Unwrap() error {
+	return e.Err
+}
+
+// LastError returns the most recent non-fatal error encountered by a
+// JetStream subscription, such as missed heartbeats or a failed pull request,
+// as a *SubscriptionError, or nil if there was none. These errors are also passed to the connection's error handler
+// if one is set. The error is cleared when a message is delivered to the
+// subscription, so it can be used as a lightweight health signal.
+func (sub *Subscription) LastError() error {
+	sub.mu.Lock()
+	defer sub.mu.Unlock()
+	if sub.jsi == nil || sub.jsi.lerr == nil {
+		return nil
+	}
+	return sub.jsi.lerr
+}
+
+// setLastError records a non-fatal error for a JetStream subscription,
+// and closes the subscription if too many consecutive errors occurred.
+// Subscription lock must not be held on entry.
+func (sub *Subscription) setLastError(err error) {
+	sub.mu.Lock()
+	jsi := sub.jsi
+	if jsi == nil || sub.closed {
+		sub.mu.Unlock()
+		return
+	}
+	jsi.lerr = &SubscriptionError{Err: err, Time: time.Now()}
+	jsi.nerrs++
+	closeSub := jsi.maxErrs > 0 && jsi.nerrs == jsi.maxErrs
+	nc := sub.conn
+	sub.mu.Unlock()
+
+	if closeSub {
+		nc.unsubscribe(sub, 0, true)
+	}
+}
+
+// pullFailed records the error of a pull request which got no message, so
+// that it counts towards MaxConsecutiveErrors(). Requests expiring without
+// messages, or whose context was canceled, did not fail.
+func (sub *Subscription) pullFailed(err error) {
+	if err == ErrTimeout || err == context.DeadlineExceeded || err == context.Canceled {
+		return
+	}
+	sub.setLastError(err)
 }
 
 // ErrConsumerSequenceMismatch represents an error from a consumer
@@ -1863,6 +3548,7 @@ func (sub *Subscription) checkOrderedMsgs(m *Msg) bool {
 
 	jsi := sub.jsi
 	if dseq != jsi.dseq {
+		sub.notifySequenceGap(jsi.dseq, dseq)
 		sub.resetOrderedConsumer(jsi.sseq + 1)
 		return true
 	}
@@ -1871,6 +3557,90 @@ func (sub *Subscription) checkOrderedMsgs(m *Msg) bool {
 	return false
 }
 
+// checkSequenceGap tracks the consumer sequence of messages delivered to a
+// non-ordered push consumer and reports any gap to the sequence gap handler.
+// Sub lock should be held.
+func (sub *Subscription) checkSequenceGap(m *Msg) {
+	// Ignore msgs with no reply like HBs and flow control.
+	if m.Reply == _EMPTY_ {
+		return
+	}
+	tokens, err := getMetadataFields(m.Reply)
+	if err != nil {
+		return
+	}
+	dseq := uint64(parseNum(tokens[ackConsumerSeqTokenPos]))
+
+	jsi := sub.jsi
+	// The first message sets the base, since a bound consumer
+	// may have delivered messages before.
+	if jsi.gdseq != 0 && dseq != jsi.gdseq {
+		sub.notifySequenceGap(jsi.gdseq, dseq)
+	}
+	jsi.gdseq = dseq + 1
+}
+
+// notifySequenceGap invokes the sequence gap handler, if any, asynchronously.
+// Sub lock should be held.
+func (sub *Subscription) notifySequenceGap(expected, actual uint64) {
+	cb := sub.jsi.gapcb
+	if cb == nil {
+		return
+	}
+	sub.conn.ach.push(func() { cb(sub, expected, actual) })
+}
+
+// rebind moves a push subscription to the deliver subject of the consumer
+// it is bound to, in case it was changed by a consumer update. Otherwise
+// messages would be delivered to a subject without interest.
+func (sub *Subscription) rebind(info *ConsumerInfo) {
+	deliver := info.Config.DeliverSubject
+	if deliver == _EMPTY_ {
+		return
+	}
+	sub.mu.Lock()
+	nc := sub.conn
+	sub.mu.Unlock()
+	if nc == nil {
+		return
+	}
+
+	// Hold both locks, in the same order as the connection does, for the
+	// whole swap so the subscription can not be closed half way through.
+	nc.subsMu.Lock()
+	sub.mu.Lock()
+	jsi := sub.jsi
+	if jsi == nil || jsi.pull || jsi.ordered || sub.closed || deliver == jsi.deliver {
+		sub.mu.Unlock()
+		nc.subsMu.Unlock()
+		return
+	}
+	osid := sub.sid
+	delete(nc.subs, osid)
+	nc.ssid++
+	nsid := nc.ssid
+	nc.subs[nsid] = sub
+	sub.sid = nsid
+	sub.Subject, jsi.deliver = deliver, deliver
+	queue := sub.Queue
+	// If there was an AUTO_UNSUB done, carry over the remaining messages.
+	var maxStr string
+	if sub.max > sub.delivered {
+		maxStr = strconv.FormatUint(sub.max-sub.delivered, 10)
+	}
+	sub.mu.Unlock()
+	nc.subsMu.Unlock()
+
+	nc.mu.Lock()
+	nc.bw.appendString(fmt.Sprintf(unsubProto, osid, _EMPTY_))
+	nc.bw.appendString(fmt.Sprintf(subProto, deliver, queue, nsid))
+	if maxStr != _EMPTY_ {
+		nc.bw.appendString(fmt.Sprintf(unsubProto, nsid, maxStr))
+	}
+	nc.kickFlusher()
+	nc.mu.Unlock()
+}
+
 // Update and replace sid.
 // Lock should be held on entry but will be unlocked to prevent lock inversion.
 func (sub *Subscription) applyNewSID() (osid int64) {
@@ -1964,8 +3734,8 @@ func (sub *Subscription) resetOrderedConsumer(sseq uint64) {
 		cfg.OptStartSeq = sseq
 
 		ccSubj := fmt.Sprintf(apiLegacyConsumerCreateT, jsi.stream)
-		j, err := json.Marshal(jsi.ccreq)
 		js := jsi.js
+		j, err := js.marshal(jsi.ccreq)
 		sub.mu.Unlock()
 
 		if err != nil {
@@ -1984,7 +3754,7 @@ func (sub *Subscription) resetOrderedConsumer(sseq uint64) {
 		}
 
 		var cinfo consumerResponse
-		err = json.Unmarshal(resp.Data, &cinfo)
+		err = js.unmarshal(resp.Data, &cinfo)
 		if err != nil {
 			pushErr(err)
 			return
@@ -2056,6 +3826,12 @@ func (sub *Subscription) activityCheck() {
 
 	if !active {
 		if !jsi.ordered || nc.Status() != CONNECTED {
+			// The consumer's deliver subject may have been changed, in which
+			// case looking it up moves the subscription to the new subject.
+			if !jsi.ordered && !jsi.noLookup && nc.Status() == CONNECTED {
+				go sub.ConsumerInfo()
+			}
+			sub.setLastError(ErrConsumerNotActive)
 			nc.mu.Lock()
 			if errCB := nc.Opts.AsyncErrorCB; errCB != nil {
 				nc.ach.push(func() { errCB(nc, sub, ErrConsumerNotActive) })
@@ -2081,7 +3857,7 @@ func (sub *Subscription) scheduleHeartbeatCheck() {
 	}
 
 	if jsi.hbc == nil {
-		jsi.hbc = time.AfterFunc(jsi.hbi*hbcThresh, sub.activityCheck)
+		jsi.hbc = jsi.js.clock().AfterFunc(jsi.hbi*hbcThresh, sub.activityCheck)
 	} else {
 		jsi.hbc.Reset(jsi.hbi * hbcThresh)
 	}
@@ -2089,6 +3865,7 @@ func (sub *Subscription) scheduleHeartbeatCheck() {
 
 // handleConsumerSequenceMismatch will send an async error that can be used to restart a push based consumer.
 func (nc *Conn) handleConsumerSequenceMismatch(sub *Subscription, err error) {
+	sub.setLastError(err)
 	nc.mu.Lock()
 	errCB := nc.Opts.AsyncErrorCB
 	if errCB != nil {
@@ -2165,6 +3942,52 @@ type subOpts struct {
 	// For an ordered consumer.
 	ordered bool
 	ctx     context.Context
+	// To skip the consumer info lookup.
+	skipCInfo bool
+	// Prefix for the name of a created ephemeral consumer.
+	namePrefix string
+	// Maximum number of consecutive errors before closing the subscription.
+	maxErrs int
+	// To check that the bound consumer is the expected durable.
+	bindDurable bool
+	// Invoked instead of the message handler for redelivered messages.
+	rdcb func(msg *Msg, attempt int)
+	// Callback for messages on their last delivery attempt.
+	lacb func(msg *Msg)
+	// Predicate for messages passed to the callback, see MsgFilter().
+	filter    func(msg *Msg) bool
+	filterAct FilterAction
+	// To mark messages in progress while the callback runs.
+	extendAck bool
+	// Window of the duplicate detection, see DedupWindow().
+	dedup time.Duration
+	// Invoked when the subscription is re-established after a reconnect.
+	rscb func(sub *Subscription)
+	// Invoked when a gap in the consumer sequence is detected.
+	gapcb func(sub *Subscription, expected, actual uint64)
+	// Maximum number of messages per second passed to the callback.
+	rate float64
+	// To start after the last message of the stream, or lastN messages
+	// before, see DeliverAfterLast() and DeliverLastN().
+	afterLast bool
+	lastN     uint64
+	// Configuration to recreate a deleted consumer, see ConsumeRecreateOnDelete().
+	recreate *ConsumerConfig
+	// Size and maximum delay of the batches of acks, see ConsumeAckBatch().
+	ackBatch     int
+	ackBatchWait time.Duration
+	// Number of workers handling messages by subject, see ConsumePartitionBySubject().
+	partitions int
+	// Interval between lookups of the consumer configuration, see ConsumeRefreshConfig().
+	refresh time.Duration
+	// Rewrites the subject of the messages passed to the handler, see ConsumeSubjectTransform().
+	transform *subjectTransform
+	// How long to wait for a first pull request to succeed, see ConsumeWaitForReady().
+	ready time.Duration
+	// Keep pull requests within MaxAckPending, see PullAckPendingLimit().
+	apLimit bool
+	// Invoked with the delivery latency of each message, see ConsumeLatencyHandler().
+	latcb func(m *Msg, l DeliveryLatency)
 }
 
 // OrderedConsumer will create a FIFO direct/ephemeral consumer for in order delivery of messages.
@@ -2249,6 +4072,38 @@ func DeliverNew() SubOpt {
 	})
 }
 
+// DeliverAfterLast configures a Consumer to receive messages stored after
+// the last message of the stream at the time of the subscription. The last
+// sequence of the stream is looked up before the consumer is created, which
+// then starts at the next sequence, see StartSequence().
+//
+// Unlike DeliverNew(), where the starting point is decided by the server
+// when the consumer is created, messages stored between the lookup and the
+// creation are delivered, so that none published after the call is missed.
+// It has no effect when binding to an existing consumer.
+func DeliverAfterLast() SubOpt {
+	return subOptFn(func(opts *subOpts) error {
+		opts.cfg.DeliverPolicy = DeliverByStartSequencePolicy
+		opts.cfg.OptStartSeq = 0
+		opts.afterLast, opts.lastN = true, 0
+		return nil
+	})
+}
+
+// DeliverLastN configures a Consumer to receive the last n messages of the
+// stream and the ones stored afterwards. Like DeliverAfterLast(), the last
+// sequence of the stream is looked up before the consumer is created. The
+// n messages are counted among all the messages of the stream, so fewer may
+// be delivered if the consumer filters on a subject.
+func DeliverLastN(n uint64) SubOpt {
+	return subOptFn(func(opts *subOpts) error {
+		opts.cfg.DeliverPolicy = DeliverByStartSequencePolicy
+		opts.cfg.OptStartSeq = 0
+		opts.afterLast, opts.lastN = true, n
+		return nil
+	})
+}
+
 // StartSequence configures a Consumer to receive
 // messages from a start sequence.
 func StartSequence(seq uint64) SubOpt {
@@ -2294,101 +4149,699 @@ func AckExplicit() SubOpt {
 	})
 }
 
-// MaxDeliver sets the number of redeliveries for a message.
-func MaxDeliver(n int) SubOpt {
+// MaxDeliver sets the number of redeliveries for a message.
+// A value of -1 means unlimited deliveries, and 0 the server's default.
+func MaxDeliver(n int) SubOpt {
+	return subOptFn(func(opts *subOpts) error {
+		if n < -1 {
+			return fmt.Errorf("%w: max deliver must be -1 (unlimited) or greater", ErrInvalidArg)
+		}
+		opts.cfg.MaxDeliver = n
+		return nil
+	})
+}
+
+// MaxAckPending sets the number of outstanding acks that are allowed before
+// message delivery is halted. A value of -1 means no limit, and 0 the
+// server's default. See PullAckPendingLimit() to keep pull requests within
+// this limit.
+func MaxAckPending(n int) SubOpt {
+	return subOptFn(func(opts *subOpts) error {
+		if n < -1 {
+			return fmt.Errorf("%w: max ack pending must be -1 (unlimited) or greater", ErrInvalidArg)
+		}
+		opts.cfg.MaxAckPending = n
+		return nil
+	})
+}
+
+// PullAckPendingLimit makes Fetch() and FetchBatch() of a pull subscription
+// to a consumer with an explicit ack policy never request more messages than
+// the consumer's MaxAckPending allows, waiting for acks to free up capacity
+// instead. Only the messages fetched by this subscription and acknowledged
+// through them are accounted for, and a message stops being accounted for
+// once its AckWait elapsed since the server redelivers it then. The limit is
+// still enforced consumer-wide by the server. See Subscription.AckPending().
+func PullAckPendingLimit() SubOpt {
+	return subOptFn(func(opts *subOpts) error {
+		opts.apLimit = true
+		return nil
+	})
+}
+
+// ReplayOriginal replays the messages at the original speed.
+func ReplayOriginal() SubOpt {
+	return subOptFn(func(opts *subOpts) error {
+		opts.cfg.ReplayPolicy = ReplayOriginalPolicy
+		return nil
+	})
+}
+
+// ReplayInstant replays the messages as fast as possible.
+func ReplayInstant() SubOpt {
+	return subOptFn(func(opts *subOpts) error {
+		opts.cfg.ReplayPolicy = ReplayInstantPolicy
+		return nil
+	})
+}
+
+// RateLimit is the Bits per sec rate limit applied to a push consumer.
+// It can not be used with pull subscriptions.
+func RateLimit(n uint64) SubOpt {
+	return subOptFn(func(opts *subOpts) error {
+		opts.cfg.RateLimit = n
+		return nil
+	})
+}
+
+// SampleFrequency sets the percentage of acknowledgements, such as "100%"
+// or "50", for which the server emits an ack sample. See AckSamples().
+func SampleFrequency(freq string) SubOpt {
+	return subOptFn(func(opts *subOpts) error {
+		n, err := strconv.Atoi(strings.TrimSuffix(freq, "%"))
+		if err != nil || n < 0 || n > 100 {
+			return fmt.Errorf("invalid SampleFrequency value (%q), needs to be a percentage between 0 and 100", freq)
+		}
+		opts.cfg.SampleFrequency = freq
+		return nil
+	})
+}
+
+// BackOff is an array of time durations that represent the time to delay based on delivery count.
+// The server uses the first value as the ack wait, an AckWait() smaller than the largest value
+// is reported to the asynchronous error handler with ErrAckWaitBelowBackOff.
+func BackOff(backOff []time.Duration) SubOpt {
+	return subOptFn(func(opts *subOpts) error {
+		opts.cfg.BackOff = backOff
+		return nil
+	})
+}
+
+// BindStream binds a consumer to a stream explicitly based on a name.
+// When a stream name is not specified, the library uses the subscribe
+// subject as a way to find the stream name. It is done by making a request
+// to the server to get list of stream names that have a filter for this
+// subject. If the returned list contains a single stream, then this
+// stream name will be used, otherwise the `ErrNoMatchingStream` is returned.
+// To avoid the stream lookup, provide the stream name with this function.
+// See also `Bind()`.
+func BindStream(stream string) SubOpt {
+	return subOptFn(func(opts *subOpts) error {
+		if opts.stream != _EMPTY_ && opts.stream != stream {
+			return fmt.Errorf("nats: duplicate stream name (%s and %s)", opts.stream, stream)
+		}
+
+		opts.stream = stream
+		return nil
+	})
+}
+
+// Bind binds a subscription to an existing consumer from a stream without attempting to create.
+// The first argument is the stream name and the second argument will be the consumer name.
+func Bind(stream, consumer string) SubOpt {
+	return subOptFn(func(opts *subOpts) error {
+		if stream == _EMPTY_ {
+			return ErrStreamNameRequired
+		}
+		if consumer == _EMPTY_ {
+			return ErrConsumerNameRequired
+		}
+
+		// In case of pull subscribers, the durable name is a required parameter
+		// so check that they are not different.
+		if opts.cfg.Durable != _EMPTY_ && opts.cfg.Durable != consumer {
+			return fmt.Errorf("nats: duplicate consumer names (%s and %s)", opts.cfg.Durable, consumer)
+		}
+		if opts.stream != _EMPTY_ && opts.stream != stream {
+			return fmt.Errorf("nats: duplicate stream name (%s and %s)", opts.stream, stream)
+		}
+		opts.stream = stream
+		opts.consumer = consumer
+		opts.bound = true
+		return nil
+	})
+}
+
+// RedeliveryHandler sets a callback invoked instead of the message handler
+// for messages which were delivered more than once. The attempt is the
+// delivery count tracked by the server, so it remains accurate across
+// reconnects. It can be used to centralize the handling of redeliveries,
+// e.g. to terminate or forward messages after a number of attempts.
+// Messages passed to the callback are not acknowledged automatically, the
+// callback is responsible for acknowledging, nacking or terminating them.
+// This option can only be used with Subscribe() and QueueSubscribe().
+func RedeliveryHandler(cb func(msg *Msg, attempt int)) SubOpt {
+	return subOptFn(func(opts *subOpts) error {
+		opts.rdcb = cb
+		return nil
+	})
+}
+
+// AutoExtendAck marks messages as in progress (see Msg.InProgress()) while
+// the message handler is running, so that they are not redelivered when the
+// handler takes longer than the consumer's AckWait. A message is marked when
+// half of the AckWait is left before its ack deadline (see Msg.AckDeadline()),
+// until the handler returns or the message is acknowledged.
+// The consumer's AckWait is taken from the consumer info obtained when
+// subscribing, so it can not be used with SkipConsumerLookup() on an
+// existing consumer. This option can only be used with Subscribe() and
+// QueueSubscribe().
+func AutoExtendAck() SubOpt {
+	return subOptFn(func(opts *subOpts) error {
+		opts.extendAck = true
+		return nil
+	})
+}
+
+// DedupWindow makes the subscription remember the stream sequences of the
+// messages acknowledged in the last window, and acknowledge without passing
+// them to the message handler the messages redelivered with one of these
+// sequences. This happens when an ack is lost, e.g. on reconnect, and the
+// server redelivers a message that was already processed.
+// The detection is best-effort: it is local to the subscription, so it does
+// not survive restarts and is not shared by the members of a queue group.
+// It keeps one entry per message acknowledged within the window, which needs
+// to be sized according to the message rate.
+// This option can only be used with Subscribe() and QueueSubscribe().
+func DedupWindow(window time.Duration) SubOpt {
+	return subOptFn(func(opts *subOpts) error {
+		if window <= 0 {
+			return fmt.Errorf("%w: dedup window must be positive", ErrInvalidArg)
+		}
+		opts.dedup = window
+		return nil
+	})
+}
+
+// dedupWindow tracks the stream sequences of recently acknowledged messages.
+type dedupWindow struct {
+	mu     sync.Mutex
+	window time.Duration
+	seqs   map[uint64]time.Time
+	pruned time.Time
+	clk    clock
+}
+
+func newDedupWindow(window time.Duration, clk clock) *dedupWindow {
+	return &dedupWindow{window: window, seqs: make(map[uint64]time.Time), pruned: clk.Now(), clk: clk}
+}
+
+// seen reports whether a message with this sequence was acknowledged within the window.
+func (d *dedupWindow) seen(seq uint64) bool {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	t, ok := d.seqs[seq]
+	return ok && d.clk.Now().Sub(t) < d.window
+}
+
+// add records the acknowledgement of a message, removing the expired
+// entries at most once per window.
+func (d *dedupWindow) add(seq uint64) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	now := d.clk.Now()
+	d.seqs[seq] = now
+	if now.Sub(d.pruned) < d.window {
+		return
+	}
+	for s, t := range d.seqs {
+		if now.Sub(t) >= d.window {
+			delete(d.seqs, s)
+		}
+	}
+	d.pruned = now
+}
+
+// FilterAction is how messages rejected by the predicate of MsgFilter() are
+// disposed of.
+type FilterAction int
+
+const (
+	// FilterAck acknowledges rejected messages, so they are not redelivered.
+	FilterAck FilterAction = iota
+	// FilterTerm terminates rejected messages, see Msg.Term().
+	FilterTerm
+)
+
+// MsgFilter sets a predicate invoked before the message handler, which is
+// only called for the messages it keeps. The other messages are acknowledged
+// or terminated according to action, unless the consumer's ack policy is
+// none. It can be used to filter messages on their headers, which the
+// consumer's filter subject can not express. Rejected messages are still
+// delivered by the server, so they count towards AutoUnsubscribe() limits.
+// This option can only be used with Subscribe() and QueueSubscribe().
+func MsgFilter(keep func(msg *Msg) bool, action FilterAction) SubOpt {
+	return subOptFn(func(opts *subOpts) error {
+		if keep == nil {
+			return fmt.Errorf("%w: filter predicate is required", ErrInvalidArg)
+		}
+		if action != FilterAck && action != FilterTerm {
+			return fmt.Errorf("%w: unknown filter action %d", ErrInvalidArg, action)
+		}
+		opts.filter = keep
+		opts.filterAct = action
+		return nil
+	})
+}
+
+// LastAttemptHandler sets a callback invoked instead of the message handler
+// for messages delivered for the last time, that is when the delivery count
+// tracked by the server reaches the consumer's MaxDeliver. The server does
+// not redeliver the message after this attempt, so this is the last chance
+// to e.g. forward it to a dead letter queue. Unless ManualAck() is
+// set, the message is acknowledged when the callback returns.
+// The consumer must have MaxDeliver set and an ack policy other than none.
+// This option can only be used with Subscribe() and QueueSubscribe().
+func LastAttemptHandler(cb func(msg *Msg)) SubOpt {
+	return subOptFn(func(opts *subOpts) error {
+		if cb == nil {
+			return fmt.Errorf("%w: callback is required", ErrInvalidArg)
+		}
+		opts.lacb = cb
+		return nil
+	})
+}
+
+// SequenceGapHandler sets a callback invoked when the consumer sequence of a
+// delivered message is not the one following the previously delivered message,
+// which indicates that messages were missed, e.g. because the consumer was
+// recreated. The callback receives the expected and the actual consumer
+// sequence. Ordered consumers detect gaps the same way and reset themselves
+// after the callback is notified.
+// This option can not be used with pull or queue subscriptions.
+func SequenceGapHandler(cb func(sub *Subscription, expected, actual uint64)) SubOpt {
+	return subOptFn(func(opts *subOpts) error {
+		opts.gapcb = cb
+		return nil
+	})
+}
+
+// ConsumeRateLimit limits the rate at which messages are passed to the
+// callback of the subscription, to at most msgsPerSec messages per second.
+// Unlike RateLimit(), the throttling happens in the client, so that a slow
+// downstream service is not overwhelmed while a backlog is processed. Flow
+// control requests are answered as messages are passed to the callback, and
+// unless set, MaxAckPending is derived from the rate and the ack wait, so
+// that messages do not time out while waiting for the rate limiter.
+// This option can only be used with callback subscriptions.
+func ConsumeRateLimit(msgsPerSec float64) SubOpt {
+	return subOptFn(func(opts *subOpts) error {
+		if msgsPerSec <= 0 {
+			return fmt.Errorf("invalid ConsumeRateLimit value (%v), needs to be greater than 0", msgsPerSec)
+		}
+		opts.rate = msgsPerSec
+		return nil
+	})
+}
+
+// rateLimiter spaces out events so that they do not exceed a rate,
+// a token bucket holding a single token. It is not safe for concurrent use.
+type rateLimiter struct {
+	interval time.Duration
+	next     time.Time
+	clk      clock
+}
+
+func newRateLimiter(rate float64, clk clock) *rateLimiter {
+	if rate <= 0 {
+		return nil
+	}
+	return &rateLimiter{interval: time.Duration(float64(time.Second) / rate), clk: clk}
+}
+
+// wait blocks until the next event is allowed, or the subscription is closed.
+func (r *rateLimiter) wait(sub *Subscription) {
+	for {
+		d := until(r.clk, r.next)
+		if d <= 0 {
+			break
+		}
+		if d > 100*time.Millisecond {
+			d = 100 * time.Millisecond
+		}
+		<-r.clk.After(d)
+		sub.mu.Lock()
+		closed := sub.closed
+		sub.mu.Unlock()
+		if closed {
+			return
+		}
+	}
+	if now := r.clk.Now(); r.next.Before(now) {
+		r.next = now
+	}
+	r.next = r.next.Add(r.interval)
+}
+
+// BindDurable binds a subscription to an existing durable consumer, like
+// Bind(), and additionally checks that the consumer found is a durable
+// with the given name. It fails with ErrConsumerMismatch otherwise, which
+// guards against consuming from the wrong consumer.
+func BindDurable(stream, durable string) SubOpt {
+	return subOptFn(func(opts *subOpts) error {
+		if err := Bind(stream, durable).configureSubscribe(opts); err != nil {
+			return err
+		}
+		opts.bindDurable = true
+		return nil
+	})
+}
+
+// MaxConsecutiveErrors sets the number of consecutive non-fatal errors, such
+// as missed heartbeats, after which a subscription gives up and is drained.
+// For pull subscriptions, each Fetch() or FetchBatch() failing without any
+// message counts as an error, not the ones expiring with no message. The
+// counter is reset whenever a message is delivered. Once closed, the
+// subscription is no longer valid and LastError() returns the last error.
+func MaxConsecutiveErrors(n int) SubOpt {
+	return subOptFn(func(opts *subOpts) error {
+		if n < 1 {
+			return fmt.Errorf("nats: invalid MaxConsecutiveErrors value (%v), needs to be greater than 0", n)
+		}
+		opts.maxErrs = n
+		return nil
+	})
+}
+
+// ResubscribeHandler sets a callback invoked when the subscription has been
+// re-established after the connection to the server was lost and restored,
+// possibly to a different server. Messages that were delivered but not yet
+// acknowledged before the reconnect may be redelivered, so the callback can
+// be used to reset any in-flight processing state.
+func ResubscribeHandler(cb func(sub *Subscription)) SubOpt {
 	return subOptFn(func(opts *subOpts) error {
-		opts.cfg.MaxDeliver = n
+		opts.rscb = cb
 		return nil
 	})
 }
 
-// MaxAckPending sets the number of outstanding acks that are allowed before
-// message delivery is halted.
-func MaxAckPending(n int) SubOpt {
+// ConsumeRecreateOnDelete makes Consume() recreate the consumer from cfg when
+// it finds that the consumer was deleted, and resume fetching its messages.
+// If cfg has no name, the consumer is recreated as a durable with the name
+// given to Consume(). An ephemeral consumer, with a name but not durable, is
+// removed by the server after 5 seconds of inactivity, unless cfg has another
+// InactiveThreshold. Each recreation is notified to the asynchronous error
+// handler with ErrConsumerRecreated. Failed attempts are recorded as the last
+// error of the subscription and retried with a growing delay. This requires
+// the permissions to create consumers on the stream.
+// This option can only be used with Consume().
+func ConsumeRecreateOnDelete(cfg ConsumerConfig) SubOpt {
 	return subOptFn(func(opts *subOpts) error {
-		opts.cfg.MaxAckPending = n
+		if cfg.DeliverSubject != _EMPTY_ {
+			return fmt.Errorf("%w: consumer to recreate must be a pull consumer", ErrInvalidArg)
+		}
+		if err := checkConsumerConfig(&cfg); err != nil {
+			return err
+		}
+		opts.recreate = &cfg
 		return nil
 	})
 }
 
-// ReplayOriginal replays the messages at the original speed.
-func ReplayOriginal() SubOpt {
+// ConsumeAckBatch makes Consume() acknowledge messages in batches, instead of
+// one by one once the handler returns. The last message of a batch is
+// acknowledged when maxMsgs messages were handled, or maxWait after the first
+// one was, which with the AckAll policy acknowledges all the messages of the
+// batch. The consumer must have the AckAll policy, which Consume() checks by
+// looking it up. Pending acks are sent when the subscription is unsubscribed
+// or drained.
+// Acks are delayed by up to maxWait, which must be well below the consumer's
+// AckWait. If the client stops before a batch is acknowledged, e.g. because
+// it crashed, all the messages of the batch are redelivered, including those
+// already handled. Handlers should then be idempotent.
+// This option can only be used with Consume().
+func ConsumeAckBatch(maxMsgs int, maxWait time.Duration) SubOpt {
 	return subOptFn(func(opts *subOpts) error {
-		opts.cfg.ReplayPolicy = ReplayOriginalPolicy
+		if maxMsgs < 1 {
+			return fmt.Errorf("%w: ack batch size must be at least 1", ErrInvalidArg)
+		}
+		if maxWait <= 0 {
+			return fmt.Errorf("%w: ack batch wait must be greater than 0", ErrInvalidArg)
+		}
+		opts.ackBatch, opts.ackBatchWait = maxMsgs, maxWait
 		return nil
 	})
 }
 
-// ReplayInstant replays the messages as fast as possible.
-func ReplayInstant() SubOpt {
+// ConsumePartitionBySubject makes Consume() pass messages to the handler from
+// the given number of workers, so that up to that many messages are handled
+// concurrently. Messages are assigned to a worker by a hash of their subject,
+// so the messages of a subject are always handled by the same worker, in the
+// order of the stream, while messages of different subjects are handled in
+// parallel. Messages are acknowledged by the worker once the handler returns,
+// unless ManualAck() is set. It can not be used with ConsumeAckBatch(), since
+// the AckAll policy would acknowledge messages not handled yet by the other
+// workers.
+// This option can only be used with Consume().
+func ConsumePartitionBySubject(workers int) SubOpt {
 	return subOptFn(func(opts *subOpts) error {
-		opts.cfg.ReplayPolicy = ReplayInstantPolicy
+		if workers < 1 {
+			return fmt.Errorf("%w: number of workers must be at least 1", ErrInvalidArg)
+		}
+		opts.partitions = workers
 		return nil
 	})
 }
 
-// RateLimit is the Bits per sec rate limit applied to a push consumer.
-func RateLimit(n uint64) SubOpt {
+// ConsumeLatencyHandler sets a callback invoked by Consume() with the
+// delivery latency of each message, before the message is passed to the
+// handler, e.g. to track latency objectives. Both the latency since the pull
+// request was sent and since the message was stored in the stream are
+// reported, see DeliveryLatency. The callback is invoked from the goroutine
+// fetching the messages, so it should return quickly.
+// This option can only be used with Consume().
+func ConsumeLatencyHandler(cb func(m *Msg, l DeliveryLatency)) SubOpt {
 	return subOptFn(func(opts *subOpts) error {
-		opts.cfg.RateLimit = n
+		if cb == nil {
+			return fmt.Errorf("%w: latency handler is required", ErrInvalidArg)
+		}
+		opts.latcb = cb
 		return nil
 	})
 }
 
-// BackOff is an array of time durations that represent the time to delay based on delivery count.
-func BackOff(backOff []time.Duration) SubOpt {
+// ConsumeWaitForReady makes Consume() check that the consumer can deliver
+// messages before returning, by sending pull requests until one is answered
+// by the server. Transient failures, e.g. while the consumer is electing a
+// leader in a cluster, are retried until the timeout elapses, after which
+// Consume() returns the last error instead of a subscription that would
+// deliver nothing.
+// This option can only be used with Consume().
+func ConsumeWaitForReady(timeout time.Duration) SubOpt {
 	return subOptFn(func(opts *subOpts) error {
-		opts.cfg.BackOff = backOff
+		if timeout <= 0 {
+			return fmt.Errorf("%w: ready timeout must be greater than 0", ErrInvalidArg)
+		}
+		opts.ready = timeout
 		return nil
 	})
 }
 
-// BindStream binds a consumer to a stream explicitly based on a name.
-// When a stream name is not specified, the library uses the subscribe
-// subject as a way to find the stream name. It is done by making a request
-// to the server to get list of stream names that have a filter for this
-// subject. If the returned list contains a single stream, then this
-// stream name will be used, otherwise the `ErrNoMatchingStream` is returned.
-// To avoid the stream lookup, provide the stream name with this function.
-// See also `Bind()`.
-func BindStream(stream string) SubOpt {
+// ConsumeSubjectTransform makes Consume() and ConsumeMulti() rewrite the
+// subject of the messages matching src before passing them to the handler,
+// like the server's subject transforms. Wildcard tokens of src are mapped to
+// dst either in order, with "*" tokens in dst, or by position, with "$N" or
+// "{{wildcard(N)}}" tokens referencing the Nth "*" of src. A ">" in dst is
+// replaced by the tokens matched by the ">" of src. Without references, the
+// number of "*" tokens in dst must match the one in src, and references must
+// exist in src. Otherwise ErrInvalidArg is returned.
+// Messages not matching src are passed unchanged. Acks are not affected,
+// since they are sent to the reply subject.
+func ConsumeSubjectTransform(src, dst string) SubOpt {
 	return subOptFn(func(opts *subOpts) error {
-		if opts.stream != _EMPTY_ && opts.stream != stream {
-			return fmt.Errorf("nats: duplicate stream name (%s and %s)", opts.stream, stream)
+		tr, err := newSubjectTransform(src, dst)
+		if err != nil {
+			return err
 		}
-
-		opts.stream = stream
+		opts.transform = tr
 		return nil
 	})
 }
 
-// Bind binds a subscription to an existing consumer from a stream without attempting to create.
-// The first argument is the stream name and the second argument will be the consumer name.
-func Bind(stream, consumer string) SubOpt {
-	return subOptFn(func(opts *subOpts) error {
-		if stream == _EMPTY_ {
-			return ErrStreamNameRequired
+// subjectTransform maps subjects matching src to dst, see ConsumeSubjectTransform().
+type subjectTransform struct {
+	src string
+	// Tokens of the destination, with the index of the wildcard of src
+	// they are replaced by, or -1 for literal tokens.
+	dst  []string
+	refs []int
+}
+
+// fwcRef references the full wildcard of the source in subjectTransform.refs.
+const fwcRef = -2
+
+func newSubjectTransform(src, dst string) (*subjectTransform, error) {
+	if badSubject(src) || badSubject(dst) {
+		return nil, fmt.Errorf("%w: invalid subject transform from %q to %q", ErrInvalidArg, src, dst)
+	}
+	stokens := strings.Split(src, ".")
+	var pwcs int
+	var fwc bool
+	for i, tok := range stokens {
+		switch tok {
+		case "*":
+			pwcs++
+		case ">":
+			if i != len(stokens)-1 {
+				return nil, fmt.Errorf("%w: full wildcard must be the last token of %q", ErrInvalidArg, src)
+			}
+			fwc = true
 		}
-		if consumer == _EMPTY_ {
-			return ErrConsumerNameRequired
+	}
+
+	tr := &subjectTransform{src: src, dst: strings.Split(dst, ".")}
+	tr.refs = make([]int, len(tr.dst))
+	var ordered, referenced int
+	var dstFwc bool
+	for i, tok := range tr.dst {
+		tr.refs[i] = -1
+		switch {
+		case tok == "*":
+			tr.refs[i] = ordered
+			ordered++
+		case tok == ">":
+			if i != len(tr.dst)-1 {
+				return nil, fmt.Errorf("%w: full wildcard must be the last token of %q", ErrInvalidArg, dst)
+			}
+			tr.refs[i] = fwcRef
+			dstFwc = true
+		default:
+			n, ok := wildcardRef(tok)
+			if !ok {
+				continue
+			}
+			if n < 1 || n > pwcs {
+				return nil, fmt.Errorf("%w: %q references wildcard %d, but %q has %d", ErrInvalidArg, dst, n, src, pwcs)
+			}
+			tr.refs[i] = n - 1
+			referenced++
 		}
+	}
+	if ordered > 0 && referenced > 0 {
+		return nil, fmt.Errorf("%w: %q can not mix \"*\" and wildcard references", ErrInvalidArg, dst)
+	}
+	if referenced == 0 && ordered != pwcs {
+		return nil, fmt.Errorf("%w: %q has %d wildcards, but %q has %d", ErrInvalidArg, dst, ordered, src, pwcs)
+	}
+	if dstFwc != fwc {
+		return nil, fmt.Errorf("%w: full wildcard must be in both %q and %q, or in none", ErrInvalidArg, src, dst)
+	}
+	return tr, nil
+}
 
-		// In case of pull subscribers, the durable name is a required parameter
-		// so check that they are not different.
-		if opts.cfg.Durable != _EMPTY_ && opts.cfg.Durable != consumer {
-			return fmt.Errorf("nats: duplicate consumer names (%s and %s)", opts.cfg.Durable, consumer)
+// wildcardRef parses a "$N" or "{{wildcard(N)}}" destination token.
+func wildcardRef(tok string) (int, bool) {
+	var ref string
+	switch {
+	case strings.HasPrefix(tok, "$"):
+		ref = tok[1:]
+	case strings.HasPrefix(tok, "{{") && strings.HasSuffix(tok, "}}"):
+		fn := tok[2 : len(tok)-2]
+		if !strings.HasPrefix(fn, "wildcard(") || !strings.HasSuffix(fn, ")") {
+			return 0, false
 		}
-		if opts.stream != _EMPTY_ && opts.stream != stream {
-			return fmt.Errorf("nats: duplicate stream name (%s and %s)", opts.stream, stream)
+		ref = fn[len("wildcard(") : len(fn)-1]
+	default:
+		return 0, false
+	}
+	n, err := strconv.Atoi(ref)
+	if err != nil {
+		return 0, false
+	}
+	return n, true
+}
+
+// apply returns the transformed subject, or subj if it does not match the source.
+func (tr *subjectTransform) apply(subj string) string {
+	if !SubjectMatch(tr.src, subj) {
+		return subj
+	}
+	var wcs []string
+	var rest string
+	stokens := strings.Split(subj, ".")
+	for i, tok := range strings.Split(tr.src, ".") {
+		if tok == "*" {
+			wcs = append(wcs, stokens[i])
+		} else if tok == ">" {
+			rest = strings.Join(stokens[i:], ".")
 		}
-		opts.stream = stream
-		opts.consumer = consumer
-		opts.bound = true
+	}
+	tokens := make([]string, len(tr.dst))
+	for i, tok := range tr.dst {
+		switch ref := tr.refs[i]; {
+		case ref == fwcRef:
+			tokens[i] = rest
+		case ref >= 0:
+			tokens[i] = wcs[ref]
+		default:
+			tokens[i] = tok
+		}
+	}
+	return strings.Join(tokens, ".")
+}
+
+// handler returns a handler invoking cb with the subject of the messages transformed.
+func (tr *subjectTransform) handler(cb MsgHandler) MsgHandler {
+	return func(m *Msg) {
+		m.Subject = tr.apply(m.Subject)
+		cb(m)
+	}
+}
+
+// ConsumeRefreshConfig makes Consume() look up the consumer configuration when
+// it starts, and then again between pull requests once the interval elapsed,
+// so that changes made with UpdateConsumer() apply without restarting it.
+// The batch size of the pull requests is bounded by MaxAckPending and
+// MaxRequestBatch, their expiration by MaxRequestExpires and their size by
+// MaxRequestMaxBytes. Since Consume() waits up to 5s for each pull request,
+// changes may take that long to apply after the interval. See
+// Subscription.RefreshConsumerConfig() to apply them immediately.
+// This option can only be used with Consume().
+func ConsumeRefreshConfig(interval time.Duration) SubOpt {
+	return subOptFn(func(opts *subOpts) error {
+		if interval <= 0 {
+			return fmt.Errorf("%w: refresh interval must be greater than 0", ErrInvalidArg)
+		}
+		opts.refresh = interval
+		return nil
+	})
+}
+
+// ConsumerNamePrefix sets a prefix for the name of the ephemeral consumer
+// created by the subscription. A unique suffix is appended to the prefix,
+// so that consumers are identifiable while remaining unique across instances.
+// This option has no effect for durable or bound consumers and requires
+// nats-server v2.9.0 or later.
+func ConsumerNamePrefix(prefix string) SubOpt {
+	return subOptFn(func(opts *subOpts) error {
+		if strings.ContainsAny(prefix, ". *>") {
+			return ErrInvalidConsumerName
+		}
+		opts.namePrefix = prefix
+		return nil
+	})
+}
+
+// SkipConsumerLookup will omit looking up the consumer when Bind() or Durable()
+// are provided. This is useful when the user is not permitted to retrieve
+// the consumer info.
+//
+// When used with Bind(), the consumer is expected to exist. For push consumers,
+// the deliver subject needs to be provided with DeliverSubject().
+// When used with Durable() only, the consumer will be created or updated
+// using the provided options, which may overwrite an existing consumer's
+// configuration.
+func SkipConsumerLookup() SubOpt {
+	return subOptFn(func(opts *subOpts) error {
+		opts.skipCInfo = true
 		return nil
 	})
 }
 
 // EnableFlowControl enables flow control for a push based consumer.
+// It requires IdleHeartbeat() to be set as well. Flow control requests
+// sent by the server are answered by the subscription once the messages
+// delivered before them have been received.
 func EnableFlowControl() SubOpt {
 	return subOptFn(func(opts *subOpts) error {
 		opts.cfg.FlowControl = true
@@ -2488,6 +4941,19 @@ func ConsumerMemoryStorage() SubOpt {
 	})
 }
 
+// ConsumerName returns the name of the JetStream consumer the subscription is
+// bound to. The name of ephemeral consumers, which is generated by the server,
+// is known as soon as the subscription is created. Unlike ConsumerInfo(), no
+// request is sent to the server.
+func (sub *Subscription) ConsumerName() (string, error) {
+	sub.mu.Lock()
+	defer sub.mu.Unlock()
+	if sub.jsi == nil || sub.jsi.consumer == _EMPTY_ {
+		return _EMPTY_, ErrTypeSubscription
+	}
+	return sub.jsi.consumer, nil
+}
+
 func (sub *Subscription) ConsumerInfo() (*ConsumerInfo, error) {
 	sub.mu.Lock()
 	// TODO(dlc) - Better way to mark especially if we attach.
@@ -2501,13 +4967,52 @@ func (sub *Subscription) ConsumerInfo() (*ConsumerInfo, error) {
 	stream, consumer := sub.jsi.stream, sub.jsi.consumer
 	sub.mu.Unlock()
 
-	return js.getConsumerInfo(stream, consumer)
+	info, err := js.getConsumerInfo(stream, consumer)
+	if err != nil {
+		return nil, err
+	}
+	sub.rebind(info)
+	return info, nil
+}
+
+// RefreshConsumerConfig looks up the configuration of the consumer and sizes
+// the next pull requests of Consume() according to its limits, so that a
+// consumer update applies without restarting it. Consume() also does so when
+// a pull request exceeds the limits, and periodically with
+// ConsumeRefreshConfig().
+func (sub *Subscription) RefreshConsumerConfig() error {
+	info, err := sub.ConsumerInfo()
+	if err != nil {
+		return err
+	}
+	sub.mu.Lock()
+	if sub.jsi != nil {
+		sub.jsi.pullp = newPullParams(&info.Config)
+	}
+	sub.mu.Unlock()
+	return nil
+}
+
+// ConsumerProgress returns the progress of the JetStream consumer
+// the subscription is bound to.
+func (sub *Subscription) ConsumerProgress() (*ConsumerProgress, error) {
+	info, err := sub.ConsumerInfo()
+	if err != nil {
+		return nil, err
+	}
+	return info.Progress(), nil
 }
 
 type pullOpts struct {
 	maxBytes int
 	ttl      time.Duration
 	ctx      context.Context
+	noWait   bool
+	hb       time.Duration
+	// Return as soon as a message was received, see FetchFirst().
+	first bool
+	// Check that the consumer exists after this delay, see PullConsumerCheck().
+	probe time.Duration
 }
 
 // PullOpt are the options that can be passed when pulling a batch of messages.
@@ -2515,9 +5020,48 @@ type PullOpt interface {
 	configurePull(opts *pullOpts) error
 }
 
-// PullMaxWaiting defines the max inflight pull requests.
+type pullOptFn func(opts *pullOpts) error
+
+func (opt pullOptFn) configurePull(opts *pullOpts) error {
+	return opt(opts)
+}
+
+// PullNoWait makes Fetch() and FetchBatch() return only the messages that
+// are available when the request reaches the server, without waiting for
+// more to arrive. If there are none, no messages and no error are returned.
+// It can be combined with the other pull options, such as PullMaxBytes.
+func PullNoWait() PullOpt {
+	return pullOptFn(func(opts *pullOpts) error {
+		opts.noWait = true
+		return nil
+	})
+}
+
+// PullConsumerCheck makes Fetch() and FetchBatch() look up the consumer
+// when no response was received within the given delay. If the consumer or
+// its stream no longer exists, the fetch fails right away with
+// ErrConsumerNotFound or ErrStreamNotFound instead of waiting for the request
+// to expire. The lookup is a consumer info request, so it adds API load for
+// every fetch that waits longer than the delay. It is ignored for
+// subscriptions created with SkipConsumerLookup().
+func PullConsumerCheck(delay time.Duration) PullOpt {
+	return pullOptFn(func(opts *pullOpts) error {
+		if delay <= 0 {
+			return fmt.Errorf("%w: consumer check delay must be positive", ErrInvalidArg)
+		}
+		opts.probe = delay
+		return nil
+	})
+}
+
+// PullMaxWaiting defines the max inflight pull requests. Pull requests
+// exceeding this limit are rejected by the server and Fetch() returns
+// ErrMaxWaitingExceeded.
 func PullMaxWaiting(n int) SubOpt {
 	return subOptFn(func(opts *subOpts) error {
+		if n < 1 {
+			return fmt.Errorf("%w: max waiting must be positive", ErrInvalidArg)
+		}
 		opts.cfg.MaxWaiting = n
 		return nil
 	})
@@ -2531,6 +5075,102 @@ func (n PullMaxBytes) configurePull(opts *pullOpts) error {
 	return nil
 }
 
+// PullHeartbeat makes the server send idle heartbeats every interval while
+// a Fetch() or FetchBatch() request is waiting for messages. If neither a
+// message nor a heartbeat is received for twice the interval, the request
+// fails with ErrNoHeartbeat instead of waiting for its expiration.
+//
+// On high latency links this allows a generous expiration (see MaxWait()
+// and Context()) to be used, so that requests are not expiring before the
+// messages reach the client, while a lost request or server is still
+// detected early. The interval must be at most half of the expiration.
+// Pull heartbeats are independent of IdleHeartbeat(), which only applies
+// to push consumers.
+func PullHeartbeat(interval time.Duration) PullOpt {
+	return pullOptFn(func(opts *pullOpts) error {
+		if interval <= 0 {
+			return fmt.Errorf("%w: heartbeat interval must be positive", ErrInvalidArg)
+		}
+		opts.hb = interval
+		return nil
+	})
+}
+
+const (
+	// defaultPullExpiryMargin is how much earlier than the Fetch() deadline
+	// pull requests expire, so that the server's timeout status arrives
+	// before the client gives up.
+	defaultPullExpiryMargin = 10 * time.Millisecond
+	// maxPullExpiryMargin bounds the growth of the expiry margin.
+	maxPullExpiryMargin = time.Second
+)
+
+// pullExpires returns the expiration of a pull request sent ttl before the
+// Fetch() deadline. The margin never exceeds half of ttl.
+func (sub *Subscription) pullExpires(ttl time.Duration) time.Duration {
+	sub.mu.Lock()
+	margin := defaultPullExpiryMargin
+	if sub.jsi != nil && sub.jsi.expm > 0 {
+		margin = sub.jsi.expm
+	}
+	sub.mu.Unlock()
+	if margin > ttl/2 {
+		margin = ttl / 2
+	}
+	return ttl - margin
+}
+
+// growPullExpiryMargin doubles the margin between the expiration of pull
+// requests and the Fetch() deadline. It is called when a request that was
+// served messages did not expire on the server in time for the client to be
+// notified, which is the case on high latency links, so that later requests
+// do not churn.
+func (sub *Subscription) growPullExpiryMargin() {
+	sub.mu.Lock()
+	defer sub.mu.Unlock()
+	if sub.jsi == nil {
+		return
+	}
+	margin := sub.jsi.expm
+	if margin == 0 {
+		margin = defaultPullExpiryMargin
+	}
+	if margin *= 2; margin > maxPullExpiryMargin {
+		margin = maxPullExpiryMargin
+	}
+	sub.jsi.expm = margin
+}
+
+// shrinkPullExpiryMargin halves the margin grown by growPullExpiryMargin()
+// once the server notified the expiration of a request in time, down to
+// the default margin.
+func (sub *Subscription) shrinkPullExpiryMargin() {
+	sub.mu.Lock()
+	defer sub.mu.Unlock()
+	if sub.jsi == nil {
+		return
+	}
+	if sub.jsi.expm /= 2; sub.jsi.expm < defaultPullExpiryMargin {
+		sub.jsi.expm = 0
+	}
+}
+
+// nextPullMsg waits for the next message of a pull request. If heartbeats
+// were requested, ErrNoHeartbeat is returned when nothing is received for
+// twice the heartbeat interval.
+func (sub *Subscription) nextPullMsg(ctx context.Context, hb time.Duration) (*Msg, error) {
+	if hb <= 0 {
+		return sub.nextMsgWithContext(ctx, true, true)
+	}
+	hctx, cancel := withTimeout(ctx, sub.jsi.js.clock(), 2*hb)
+	defer cancel()
+	msg, err := sub.nextMsgWithContext(hctx, true, true)
+	if err == context.DeadlineExceeded && ctx.Err() == nil {
+		err = ErrNoHeartbeat
+	}
+	return msg, err
+}
+
 var (
 	// errNoMessages is an error that a Fetch request using no_wait can receive to signal
 	// that there are no more messages available.
@@ -2567,6 +5207,8 @@ func checkMsg(msg *Msg, checkSts, isNoWait bool) (usrMsg bool, err error) {
 		return
 	}
 	switch val {
+	case controlMsg:
+		// Idle heartbeat of a pull request, see PullHeartbeat().
 	case noResponders:
 		err = ErrNoResponders
 	case noMessagesSts:
@@ -2594,13 +5236,40 @@ func checkMsg(msg *Msg, checkSts, isNoWait bool) (usrMsg bool, err error) {
 			err = ErrConsumerLeadershipChanged
 			break
 		}
+
 		fallthrough
 	default:
-		err = fmt.Errorf("nats: %s", msg.Header.Get(descrHdr))
+		err = newPullStatusError(val, msg.Header.Get(descrHdr))
 	}
 	return
 }
 
+// pullStatusErrors are the errors of the known statuses ending pull requests,
+// by the lower case prefix of their description.
+var pullStatusErrors = []struct {
+	prefix string
+	err    error
+}{
+	{"exceeded maxwaiting", ErrMaxWaitingExceeded},
+	{"exceeded maxrequestbatch", ErrMaxRequestBatchExceeded},
+	{"exceeded maxrequestexpires", ErrMaxRequestExpiresExceeded},
+	{"exceeded maxrequestmaxbytes", ErrMaxRequestMaxBytesExceeded},
+	{"message size exceeds maxbytes", ErrMsgSizeExceedsMaxBytes},
+}
+
+func newPullStatusError(status, descr string) *PullStatusError {
+	code, _ := strconv.Atoi(status)
+	perr := &PullStatusError{Code: code, Description: descr}
+	ldescr := strings.ToLower(descr)
+	for _, se := range pullStatusErrors {
+		if strings.HasPrefix(ldescr, se.prefix) {
+			perr.err = se.err
+			break
+		}
+	}
+	return perr
+}
+
 // Fetch pulls a batch of messages from a stream for a pull consumer.
 func (sub *Subscription) Fetch(batch int, opts ...PullOpt) ([]*Msg, error) {
 	if sub == nil {
@@ -2651,7 +5320,7 @@ func (sub *Subscription) Fetch(batch int, opts ...PullOpt) ([]*Msg, error) {
 		cancel context.CancelFunc
 	)
 	if ctx == nil {
-		ctx, cancel = context.WithTimeout(context.Background(), ttl)
+		ctx, cancel = withTimeout(context.Background(), js.clock(), ttl)
 		defer cancel()
 	} else if _, hasDeadline := ctx.Deadline(); !hasDeadline {
 		// Prevent from passing the background context which will just block
@@ -2662,7 +5331,7 @@ func (sub *Subscription) Fetch(batch int, opts ...PullOpt) ([]*Msg, error) {
 
 		// If the context did not have a deadline, then create a new child context
 		// that will use the default timeout from the JS context.
-		ctx, cancel = context.WithTimeout(ctx, ttl)
+		ctx, cancel = withTimeout(ctx, js.clock(), ttl)
 		defer cancel()
 	}
 
@@ -2679,6 +5348,15 @@ func (sub *Subscription) Fetch(batch int, opts ...PullOpt) ([]*Msg, error) {
 	if err != nil {
 		return nil, err
 	}
+	if err = o.checkHeartbeat(ctx, js.clock()); err != nil {
+		return nil, err
+	}
+
+	// Do not request more messages than the consumer's MaxAckPending
+	// allows, waiting for acks to free up capacity if needed.
+	if batch, err = sub.waitAckCapacity(ctx, batch); err != nil {
+		return nil, o.checkCtxErr(err)
+	}
 
 	var (
 		msgs = make([]*Msg, 0, batch)
@@ -2703,18 +5381,25 @@ func (sub *Subscription) Fetch(batch int, opts ...PullOpt) ([]*Msg, error) {
 			msgs = append(msgs, msg)
 		}
 	}
-	if err == nil && len(msgs) < batch {
+	if err == nil && len(msgs) < batch && !(o.first && len(msgs) > 0) {
 		// For batch real size of 1, it does not make sense to set no_wait in
-		// the request.
-		noWait := batch-len(msgs) > 1
-
-		var nr nextRequest
+		// the request, unless explicitly requested.
+		noWait := o.noWait || batch-len(msgs) > 1
+
+		var (
+			nr nextRequest
+			// Heartbeat interval to watch for, cleared once the request
+			// expired on the server.
+			hb = o.hb
+			// Set when the server notified the request expiration.
+			expired bool
+		)
 
 		sendReq := func() error {
 			// The current deadline for the context will be used
 			// to set the expires TTL for a fetch request.
 			deadline, _ := ctx.Deadline()
-			ttl = time.Until(deadline)
+			ttl = until(js.clock(), deadline)
 
 			// Check if context has already been canceled or expired.
 			select {
@@ -2724,48 +5409,251 @@ func (sub *Subscription) Fetch(batch int, opts ...PullOpt) ([]*Msg, error) {
 			}
 
 			// Make our request expiration a bit shorter than the current timeout.
-			expires := ttl
-			if ttl >= 20*time.Millisecond {
-				expires = ttl - 10*time.Millisecond
-			}
-
 			nr.Batch = batch - len(msgs)
-			nr.Expires = expires
+			if o.first && !noWait {
+				// The server ends the request with the first message,
+				// so that it is not left open once FetchFirst() returns.
+				nr.Batch = 1
+			}
+			nr.Expires = sub.pullExpires(ttl)
 			nr.NoWait = noWait
 			nr.MaxBytes = o.maxBytes
-			req, _ := json.Marshal(nr)
+			nr.Heartbeat = 0
+			if !noWait {
+				nr.Heartbeat = o.hb
+			}
+			req, err := js.marshal(nr)
+			if err != nil {
+				return err
+			}
 			return nc.PublishRequest(nms, rply, req)
 		}
 
-		err = sendReq()
-		for err == nil && len(msgs) < batch {
-			// Ask for next message and wait if there are no messages
-			msg, err = sub.nextMsgWithContext(ctx, true, true)
-			if err == nil {
-				var usrMsg bool
+		probe := sub.probeConsumer(ctx, o.probe)
+		defer probe.stop()
+		rctx, done := sub.watchReconnect(probe.ctx)
+		defer func() { done() }()
+
+		err = sendReq()
+		for err == nil && len(msgs) < batch {
+			// Ask for next message and wait if there are no messages
+			msg, err = sub.nextPullMsg(rctx, hb)
+			if perr := probe.Err(); err != nil && perr != nil {
+				err = perr
+				break
+			}
+			if reconnected(ctx, err) {
+				// The pull request was lost on reconnect, send a new
+				// one for the remaining messages.
+				done()
+				rctx, done = sub.watchReconnect(probe.ctx)
+				err = sendReq()
+				continue
+			}
+			if err == nil {
+				var usrMsg bool
+
+				usrMsg, err = checkMsg(msg, true, noWait)
+				if err == ErrTimeout {
+					expired = true
+				}
+				if err == nil && usrMsg {
+					msgs = append(msgs, msg)
+					if o.first {
+						// Only take the messages already received.
+						msgs = sub.appendBufferedMsgs(ctx, msgs, batch)
+						break
+					}
+				} else if o.noWait && (err == errNoMessages || err == errRequestsPending) {
+					// No more messages available right now, we are done.
+					err = nil
+					break
+				} else if noWait && (err == errNoMessages || err == errRequestsPending) && len(msgs) == 0 {
+					// If we have a 404/408 for our "no_wait" request and have
+					// not collected any message, then resend request to
+					// wait this time.
+					noWait = false
+					err = sendReq()
+				} else if err == ErrTimeout && len(msgs) == 0 {
+					// If we get a 408, we will bail if we already collected some
+					// messages, otherwise ignore and go back calling nextMsg.
+					// No more heartbeats are sent for the expired request.
+					err, hb = nil, 0
+				}
+			}
+		}
+		if expired {
+			sub.shrinkPullExpiryMargin()
+		} else if err == context.DeadlineExceeded && len(msgs) > 0 {
+			// The deadline was reached before the server notified the
+			// expiration of the request, leave more room for next ones.
+			// Requests that got no message at all are not considered,
+			// the stream may simply be empty.
+			sub.growPullExpiryMargin()
+		}
+	}
+	// If there is at least a message added to msgs, then need to return OK and no error
+	if err != nil && len(msgs) == 0 {
+		err = o.checkCtxErr(err)
+		sub.pullFailed(err)
+		return nil, err
+	}
+	sub.trackAckPending(msgs...)
+	return msgs, nil
+}
+
+// FetchFirst pulls up to batch messages like Fetch(), but returns as soon as
+// a message is received, along with the messages already received at that
+// time, instead of waiting for the batch to be complete. This trades batching
+// for latency. The messages available right away are requested with no_wait,
+// and if there are none, a single message is waited for, so no pull request
+// is left open once FetchFirst() returns. Messages of the no_wait request
+// received after FetchFirst() returned are returned by the next Fetch() or
+// FetchFirst() call.
+func (sub *Subscription) FetchFirst(batch int, opts ...PullOpt) ([]*Msg, error) {
+	opts = append(opts[:len(opts):len(opts)], pullOptFn(func(opts *pullOpts) error {
+		opts.first = true
+		return nil
+	}))
+	return sub.Fetch(batch, opts...)
+}
+
+// appendBufferedMsgs appends to msgs the user messages pending in the
+// subscription, up to batch, without waiting for more.
+func (sub *Subscription) appendBufferedMsgs(ctx context.Context, msgs []*Msg, batch int) []*Msg {
+	for len(msgs) < batch {
+		msg, err := sub.nextMsgWithContext(ctx, true, false)
+		if err != nil {
+			break
+		}
+		if usrMsg, _ := checkMsg(msg, false, false); usrMsg {
+			msgs = append(msgs, msg)
+		}
+	}
+	return msgs
+}
+
+// waitAckCapacity returns the number of messages, up to batch, that can be
+// fetched without exceeding the consumer's MaxAckPending. If there is no
+// capacity left, it waits for acks or ack wait expirations to free some up,
+// or for ctx to be done.
+func (sub *Subscription) waitAckCapacity(ctx context.Context, batch int) (int, error) {
+	for {
+		sub.mu.Lock()
+		jsi := sub.jsi
+		if jsi == nil || jsi.maxap <= 0 {
+			sub.mu.Unlock()
+			return batch, nil
+		}
+		clk := jsi.js.clock()
+		next := jsi.pruneAckPending(clk.Now())
+		if avail := jsi.maxap - len(jsi.ackPending); avail > 0 {
+			sub.mu.Unlock()
+			if avail < batch {
+				return avail, nil
+			}
+			return batch, nil
+		}
+		if jsi.apch == nil {
+			jsi.apch = make(chan struct{})
+		}
+		apch := jsi.apch
+		sub.mu.Unlock()
+
+		t := clk.NewTimer(until(clk, next))
+		select {
+		case <-apch:
+		case <-t.C():
+		case <-ctx.Done():
+			t.Stop()
+			return 0, ctx.Err()
+		}
+		t.Stop()
+	}
+}
+
+// pruneAckPending forgets the messages whose ack wait elapsed, which the
+// server redelivers, and returns the earliest expiration of the others.
+// Must be called with the subscription lock held.
+func (jsi *jsSub) pruneAckPending(now time.Time) time.Time {
+	var next time.Time
+	for seq, exp := range jsi.ackPending {
+		if !now.Before(exp) {
+			delete(jsi.ackPending, seq)
+		} else if next.IsZero() || exp.Before(next) {
+			next = exp
+		}
+	}
+	return next
+}
 
-				usrMsg, err = checkMsg(msg, true, noWait)
-				if err == nil && usrMsg {
-					msgs = append(msgs, msg)
-				} else if noWait && (err == errNoMessages || err == errRequestsPending) && len(msgs) == 0 {
-					// If we have a 404/408 for our "no_wait" request and have
-					// not collected any message, then resend request to
-					// wait this time.
-					noWait = false
-					err = sendReq()
-				} else if err == ErrTimeout && len(msgs) == 0 {
-					// If we get a 408, we will bail if we already collected some
-					// messages, otherwise ignore and go back calling nextMsg.
-					err = nil
-				}
-			}
+// trackAckPending records fetched messages as pending acknowledgement,
+// keyed by stream sequence so that redeliveries are counted once, until
+// their ack wait elapses.
+func (sub *Subscription) trackAckPending(msgs ...*Msg) {
+	sub.mu.Lock()
+	defer sub.mu.Unlock()
+	jsi := sub.jsi
+	if jsi == nil || jsi.maxap <= 0 {
+		return
+	}
+	wait := jsi.ackWait
+	if wait <= 0 {
+		wait = defaultAckWait
+	}
+	exp := jsi.js.clock().Now().Add(wait)
+	for _, m := range msgs {
+		tokens, err := getMetadataFields(m.Reply)
+		if err != nil {
+			continue
 		}
+		if jsi.ackPending == nil {
+			jsi.ackPending = make(map[uint64]time.Time)
+		}
+		jsi.ackPending[uint64(parseNum(tokens[ackStreamSeqTokenPos]))] = exp
 	}
-	// If there is at least a message added to msgs, then need to return OK and no error
-	if err != nil && len(msgs) == 0 {
-		return nil, o.checkCtxErr(err)
+}
+
+// clearAckPending removes an acknowledged message from the pending set,
+// waking up fetch requests waiting for capacity.
+func (sub *Subscription) clearAckPending(m *Msg) {
+	sub.mu.Lock()
+	defer sub.mu.Unlock()
+	jsi := sub.jsi
+	if jsi == nil || len(jsi.ackPending) == 0 {
+		return
 	}
-	return msgs, nil
+	tokens, err := getMetadataFields(m.Reply)
+	if err != nil {
+		return
+	}
+	delete(jsi.ackPending, uint64(parseNum(tokens[ackStreamSeqTokenPos])))
+	if jsi.apch != nil {
+		close(jsi.apch)
+		jsi.apch = nil
+	}
+}
+
+// AckPending returns the number of messages fetched by a pull subscription
+// which have not been acknowledged yet, and whose ack wait did not elapse.
+// It is only tracked for subscriptions created with PullAckPendingLimit() to
+// consumers with an explicit ack policy and a MaxAckPending limit.
+func (sub *Subscription) AckPending() (int, error) {
+	if sub == nil {
+		return -1, ErrBadSubscription
+	}
+	sub.mu.Lock()
+	defer sub.mu.Unlock()
+	if sub.conn == nil || sub.closed {
+		return -1, ErrBadSubscription
+	}
+	if sub.jsi == nil || !sub.jsi.pull {
+		return -1, ErrTypeSubscription
+	}
+	if sub.jsi.maxap > 0 {
+		sub.jsi.pruneAckPending(sub.jsi.js.clock().Now())
+	}
+	return len(sub.jsi.ackPending), nil
 }
 
 // newFetchInbox returns subject used as reply subject when sending pull requests
@@ -2796,6 +5684,9 @@ type MessageBatch interface {
 	Messages() <-chan *Msg
 
 	// Error returns an error encountered when fetching messages.
+	// If the context passed to FetchBatch is canceled, messages received
+	// up to that point are still delivered on the Messages() channel, and
+	// Error returns the context error once the channel is closed.
 	Error() error
 
 	// Done signals end of execution.
@@ -2803,6 +5694,7 @@ type MessageBatch interface {
 }
 
 type messageBatch struct {
+	sync.Mutex
 	msgs chan *Msg
 	err  error
 	done chan struct{}
@@ -2813,9 +5705,17 @@ func (mb *messageBatch) Messages() <-chan *Msg {
 }
 
 func (mb *messageBatch) Error() error {
+	mb.Lock()
+	defer mb.Unlock()
 	return mb.err
 }
 
+func (mb *messageBatch) setErr(err error) {
+	mb.Lock()
+	mb.err = err
+	mb.Unlock()
+}
+
 func (mb *messageBatch) Done() <-chan struct{} {
 	return mb.done
 }
@@ -2879,7 +5779,7 @@ func (sub *Subscription) FetchBatch(batch int, opts ...PullOpt) (MessageBatch, e
 		cancelContext = true
 	)
 	if ctx == nil {
-		ctx, cancel = context.WithTimeout(context.Background(), ttl)
+		ctx, cancel = withTimeout(context.Background(), js.clock(), ttl)
 	} else if _, hasDeadline := ctx.Deadline(); !hasDeadline {
 		// Prevent from passing the background context which will just block
 		// and cannot be canceled either.
@@ -2889,7 +5789,7 @@ func (sub *Subscription) FetchBatch(batch int, opts ...PullOpt) (MessageBatch, e
 
 		// If the context did not have a deadline, then create a new child context
 		// that will use the default timeout from the JS context.
-		ctx, cancel = context.WithTimeout(ctx, ttl)
+		ctx, cancel = withTimeout(ctx, js.clock(), ttl)
 	}
 	defer func() {
 		// only cancel the context here if we are sure the fetching goroutine has not been started yet
@@ -2908,6 +5808,16 @@ func (sub *Subscription) FetchBatch(batch int, opts ...PullOpt) (MessageBatch, e
 		}
 	default:
 	}
+	if err := o.checkHeartbeat(ctx, js.clock()); err != nil {
+		return nil, err
+	}
+
+	// Do not request more messages than the consumer's MaxAckPending
+	// allows, waiting for acks to free up capacity if needed.
+	batch, err := sub.waitAckCapacity(ctx, batch)
+	if err != nil {
+		return nil, o.checkCtxErr(err)
+	}
 
 	result := &messageBatch{
 		msgs: make(chan *Msg, batch),
@@ -2923,7 +5833,7 @@ func (sub *Subscription) FetchBatch(batch int, opts ...PullOpt) (MessageBatch, e
 			if err == errNoMessages {
 				err = nil
 			}
-			result.err = err
+			result.setErr(err)
 			break
 		}
 		// Check msg but just to determine if this is a user message
@@ -2931,44 +5841,52 @@ func (sub *Subscription) FetchBatch(batch int, opts ...PullOpt) (MessageBatch, e
 		// messages at this point in the Fetch() call, so checkMsg can't
 		// return an error.
 		if usrMsg, _ := checkMsg(msg, false, false); usrMsg {
+			sub.trackAckPending(msg)
 			result.msgs <- msg
 		}
 	}
-	if len(result.msgs) == batch || result.err != nil {
+	if len(result.msgs) == batch || result.Error() != nil {
 		close(result.msgs)
 		result.done <- struct{}{}
 		return result, nil
 	}
 
 	deadline, _ := ctx.Deadline()
-	ttl = time.Until(deadline)
+	ttl = until(js.clock(), deadline)
 
 	// Make our request expiration a bit shorter than the current timeout.
-	expires := ttl
-	if ttl >= 20*time.Millisecond {
-		expires = ttl - 10*time.Millisecond
-	}
+	expires := sub.pullExpires(ttl)
 
 	requestBatch := batch - len(result.msgs)
-	req := nextRequest{
-		Expires:  expires,
-		Batch:    requestBatch,
-		MaxBytes: o.maxBytes,
+	sendReq := func(n int) error {
+		req := nextRequest{
+			Expires:  expires,
+			Batch:    n,
+			NoWait:   o.noWait,
+			MaxBytes: o.maxBytes,
+		}
+		if !o.noWait {
+			req.Heartbeat = o.hb
+		}
+		reqJSON, err := js.marshal(req)
+		if err != nil {
+			return err
+		}
+		return nc.PublishRequest(nms, rply, reqJSON)
 	}
-	reqJSON, err := json.Marshal(req)
+	probe := sub.probeConsumer(ctx, o.probe)
+	rctx, done := sub.watchReconnect(probe.ctx)
+	err = sendReq(requestBatch)
 	if err != nil {
-		close(result.msgs)
-		result.done <- struct{}{}
-		result.err = err
-		return result, nil
-	}
-	if err := nc.PublishRequest(nms, rply, reqJSON); err != nil {
+		done()
+		probe.stop()
 		if len(result.msgs) == 0 {
+			sub.pullFailed(err)
 			return nil, err
 		}
+		result.setErr(err)
 		close(result.msgs)
 		result.done <- struct{}{}
-		result.err = err
 		return result, nil
 	}
 	cancelContext = false
@@ -2976,10 +5894,30 @@ func (sub *Subscription) FetchBatch(batch int, opts ...PullOpt) (MessageBatch, e
 		if cancel != nil {
 			defer cancel()
 		}
-		var requestMsgs int
+		defer probe.stop()
+		defer func() { done() }()
+		var (
+			requestMsgs int
+			expired     bool
+		)
 		for requestMsgs < requestBatch {
 			// Ask for next message and wait if there are no messages
-			msg, err = sub.nextMsgWithContext(ctx, true, true)
+			msg, err = sub.nextPullMsg(rctx, o.hb)
+			if perr := probe.Err(); err != nil && perr != nil {
+				err = perr
+				break
+			}
+			if reconnected(ctx, err) {
+				// The pull request was lost on reconnect, send a new
+				// one for the remaining messages.
+				done()
+				rctx, done = sub.watchReconnect(probe.ctx)
+				expires = sub.pullExpires(until(js.clock(), deadline))
+				if err = sendReq(requestBatch - requestMsgs); err != nil {
+					break
+				}
+				continue
+			}
 			if err != nil {
 				break
 			}
@@ -2987,22 +5925,41 @@ func (sub *Subscription) FetchBatch(batch int, opts ...PullOpt) (MessageBatch, e
 
 			usrMsg, err = checkMsg(msg, true, false)
 			if err != nil {
-				if err == ErrTimeout {
+				if o.noWait && err == errNoMessages {
+					// No more messages available right now.
+					err = nil
+				} else if err == ErrTimeout {
 					if reqID != "" && !subjectMatchesReqID(msg.Subject, reqID) {
 						// ignore timeout message from server if it comes from a different pull request
 						continue
 					}
-					err = nil
+					err, expired = nil, true
 				}
 				break
 			}
 			if usrMsg {
+				sub.trackAckPending(msg)
 				result.msgs <- msg
 				requestMsgs++
 			}
 		}
+		if expired {
+			sub.shrinkPullExpiryMargin()
+		} else if err == context.DeadlineExceeded && requestMsgs > 0 {
+			// The deadline was reached before the server notified the
+			// expiration of the request, leave more room for next ones.
+			// Requests that got no message at all are not considered,
+			// the stream may simply be empty.
+			sub.growPullExpiryMargin()
+		}
 		if err != nil {
-			result.err = o.checkCtxErr(err)
+			// Messages received so far are kept in the channel, the
+			// error (including a canceled context) is reported after them.
+			err = o.checkCtxErr(err)
+			if requestMsgs == 0 {
+				sub.pullFailed(err)
+			}
+			result.setErr(err)
 		}
 		close(result.msgs)
 		result.done <- struct{}{}
@@ -3010,6 +5967,18 @@ func (sub *Subscription) FetchBatch(batch int, opts ...PullOpt) (MessageBatch, e
 	return result, nil
 }
 
+// checkHeartbeat validates the pull heartbeat interval against the time
+// left until the deadline of ctx.
+func (o *pullOpts) checkHeartbeat(ctx context.Context, clk clock) error {
+	if o.hb == 0 {
+		return nil
+	}
+	if deadline, _ := ctx.Deadline(); 2*o.hb > until(clk, deadline) {
+		return fmt.Errorf("%w: heartbeat interval must be at most half of the request expiration", ErrInvalidArg)
+	}
+	return nil
+}
+
 // checkCtxErr is used to determine whether ErrTimeout should be returned in case of context timeout
 func (o *pullOpts) checkCtxErr(err error) error {
 	if o.ctx == nil && err == context.DeadlineExceeded {
@@ -3019,7 +5988,7 @@ func (o *pullOpts) checkCtxErr(err error) error {
 }
 
 func (js *js) getConsumerInfo(stream, consumer string) (*ConsumerInfo, error) {
-	ctx, cancel := context.WithTimeout(context.Background(), js.opts.wait)
+	ctx, cancel := withTimeout(context.Background(), js.clock(), js.opts.wait)
 	defer cancel()
 	return js.getConsumerInfoContext(ctx, stream, consumer)
 }
@@ -3035,16 +6004,21 @@ func (js *js) getConsumerInfoContext(ctx context.Context, stream, consumer strin
 	}
 
 	var info consumerResponse
-	if err := json.Unmarshal(resp.Data, &info); err != nil {
+	if err := js.unmarshal(resp.Data, &info); err != nil {
 		return nil, err
 	}
 	if info.Error != nil {
 		if errors.Is(info.Error, ErrConsumerNotFound) {
+			js.uncacheKey(js.cacheKey(cacheConsumerKey, stream+"."+consumer))
 			return nil, ErrConsumerNotFound
 		}
 		if errors.Is(info.Error, ErrStreamNotFound) {
+			js.uncacheStream(stream)
 			return nil, ErrStreamNotFound
 		}
+		if errors.Is(info.Error, ErrStreamOffline) {
+			return nil, ErrStreamOffline
+		}
 		return nil, info.Error
 	}
 	return info.ConsumerInfo, nil
@@ -3058,8 +6032,10 @@ func (js *js) apiRequestWithContext(ctx context.Context, subj string, data []byt
 			ctrace.RequestSent(subj, data)
 		}
 	}
+	js.count(apiRequestsCounter)
 	resp, err := js.nc.RequestWithContext(ctx, subj, data)
 	if err != nil {
+		js.count(apiErrorsCounter)
 		return nil, err
 	}
 	if js.opts.shouldTrace {
@@ -3082,6 +6058,13 @@ func (m *Msg) checkReply() error {
 	return nil
 }
 
+// Values of Msg.ackd, tracking whether the message was acknowledged.
+const (
+	msgNotAckd = iota
+	msgAckd
+	msgNakdOrTermd
+)
+
 // ackReply handles all acks. Will do the right thing for pull and sync mode.
 // It ensures that an ack is only sent a single time, regardless of
 // how many times it is being called to avoid duplicated acks.
@@ -3109,8 +6092,12 @@ func (m *Msg) ackReply(ackType []byte, sync bool, opts ...AckOpt) error {
 	}
 	sub.mu.Unlock()
 
-	// Skip if already acked.
-	if atomic.LoadUint32(&m.ackd) == 1 {
+	// Skip if already acked. A retried ack of a message that was already
+	// successfully acked is reported as a success.
+	if ackd := atomic.LoadUint32(&m.ackd); ackd != msgNotAckd {
+		if o.retries > 0 && ackd == msgAckd && bytes.Equal(ackType, ackAck) {
+			return nil
+		}
 		return ErrMsgAlreadyAckd
 	}
 	if ackNone {
@@ -3125,7 +6112,7 @@ func (m *Msg) ackReply(ackType []byte, sync bool, opts ...AckOpt) error {
 		return ErrContextAndTimeout
 	}
 
-	sync = sync || usesCtx || usesWait
+	sync = sync || usesCtx || usesWait || o.retries > 0
 	ctx := o.ctx
 	wait := defaultRequestWait
 	if usesWait {
@@ -3144,24 +6131,64 @@ func (m *Msg) ackReply(ackType []byte, sync bool, opts ...AckOpt) error {
 	}
 
 	if sync {
-		if usesCtx {
-			_, err = nc.RequestWithContext(ctx, m.Reply, body)
-		} else {
-			_, err = nc.Request(m.Reply, body, wait)
-		}
+		err = ackSyncRequest(nc, js.clock(), ctx, m.Reply, body, wait, o.retries)
 	} else {
 		err = nc.Publish(m.Reply, body)
 	}
+	if err == nil {
+		js.count(acksCounter)
+	}
 
 	// Mark that the message has been acked unless it is ackProgress
-	// which can be sent many times.
-	if err == nil && !bytes.Equal(ackType, ackProgress) {
-		atomic.StoreUint32(&m.ackd, 1)
+	// which can be sent many times, in which case the ack wait timer
+	// was reset by the server.
+	if err == nil {
+		switch {
+		case bytes.Equal(ackType, ackProgress):
+			atomic.StoreInt64(&m.dlvt, js.clock().Now().UnixNano())
+		case bytes.Equal(ackType, ackAck):
+			atomic.StoreUint32(&m.ackd, msgAckd)
+			sub.clearAckPending(m)
+		default:
+			atomic.StoreUint32(&m.ackd, msgNakdOrTermd)
+			sub.clearAckPending(m)
+		}
 	}
 
 	return err
 }
 
+// ackSyncRequest sends an ack and waits for the server confirmation. If the
+// confirmation is not received in time, the ack is retried up to retries
+// times. When ctx is set, retries are bounded by the context deadline.
+func ackSyncRequest(nc *Conn, clk clock, ctx context.Context, subj string, body []byte, wait time.Duration, retries int) error {
+	var err error
+	for attempt := 0; attempt <= retries; attempt++ {
+		if ctx == nil {
+			_, err = nc.Request(subj, body, wait)
+			if err != ErrTimeout {
+				return err
+			}
+			continue
+		}
+		actx, cancel := ctx, context.CancelFunc(func() {})
+		if retries > 0 {
+			timeout := wait
+			if deadline, ok := ctx.Deadline(); ok {
+				timeout = until(clk, deadline) / time.Duration(retries-attempt+1)
+			}
+			actx, cancel = withTimeout(ctx, clk, timeout)
+		}
+		_, err = nc.RequestWithContext(actx, subj, body)
+		cancel()
+		// Only retry if this attempt timed out, not the parent context.
+		if err != context.DeadlineExceeded || ctx.Err() != nil {
+			return err
+		}
+	}
+	return err
+}
+
 // Ack acknowledges a message. This tells the server that the message was
 // successfully processed and it can move on to the next message.
 func (m *Msg) Ack(opts ...AckOpt) error {
@@ -3192,18 +6219,327 @@ func (m *Msg) NakWithDelay(delay time.Duration, opts ...AckOpt) error {
 	return m.ackReply(ackNak, false, opts...)
 }
 
+// NakWithBackoff negatively acknowledges a message, delaying its redelivery
+// by the consumer's BackOff value for the current delivery attempt, the same
+// delay the server applies when the ack wait expires. The last BackOff value
+// is used once the attempts exceed it. If the consumer has no BackOff, the
+// message is redelivered immediately, as with Nak().
+func (m *Msg) NakWithBackoff(opts ...AckOpt) error {
+	if err := m.checkReply(); err != nil {
+		return err
+	}
+	sub := m.Sub
+	sub.mu.Lock()
+	jsi := sub.jsi
+	if jsi == nil {
+		sub.mu.Unlock()
+		return ErrNotJSMessage
+	}
+	backoff := jsi.backoff
+	sub.mu.Unlock()
+
+	var delay time.Duration
+	if len(backoff) > 0 {
+		meta, err := m.Metadata()
+		if err != nil {
+			return err
+		}
+		i := int(meta.NumDelivered) - 1
+		if i >= len(backoff) {
+			i = len(backoff) - 1
+		} else if i < 0 {
+			i = 0
+		}
+		delay = backoff[i]
+	}
+	return m.NakWithDelay(delay, opts...)
+}
+
 // Term tells the server to not redeliver this message, regardless of the value
 // of nats.MaxDeliver.
 func (m *Msg) Term(opts ...AckOpt) error {
 	return m.ackReply(ackTerm, false, opts...)
 }
 
+// NakBatch negatively acknowledges the messages, so that they are redelivered
+// after the given delay, or right away if it is 0. The naks are published
+// without waiting for each confirmation and the connections are then flushed
+// once, so that a batch costs a single round trip. If some messages could not
+// be nak'ed, the returned error is an *AckBatchError reporting the error of
+// each message.
+func NakBatch(msgs []*Msg, delay time.Duration) error {
+	return ackBatch(msgs, func(m *Msg) error {
+		if delay > 0 {
+			return m.NakWithDelay(delay)
+		}
+		return m.Nak()
+	})
+}
+
+// TermBatch tells the server to not redeliver the messages, like NakBatch()
+// for Term().
+func TermBatch(msgs []*Msg) error {
+	return ackBatch(msgs, func(m *Msg) error { return m.Term() })
+}
+
+// AckBatchError is returned by NakBatch() and TermBatch() when some of the
+// messages could not be acknowledged.
+type AckBatchError struct {
+	// Errs holds the error of each message, in the order of the batch,
+	// nil for the messages that were acknowledged.
+	Errs []error
+}
+
+func (e *AckBatchError) Error() string {
+	var n int
+	var first error
+	for _, err := range e.Errs {
+		if err != nil {
+			if first == nil {
+				first = err
+			}
+			n++
+		}
+	}
+	return fmt.Sprintf("nats: %d of %d messages could not be acknowledged, first error: %v", n, len(e.Errs), first)
+}
+
+// Unwrap returns the first error of the batch.
+func (e *AckBatchError) Unwrap() error {
+	for _, err := range e.Errs {
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// ackBatch sends the acks of the messages with ack, which must not wait for
+// a confirmation, and then flushes the connections of the messages so that
+// the acks are known to be received by the server.
+func ackBatch(msgs []*Msg, ack func(m *Msg) error) error {
+	errs := make([]error, len(msgs))
+	var failed bool
+	// Messages sent on each connection, and the time to wait for the flush.
+	sent := make(map[*Conn][]int)
+	waits := make(map[*Conn]time.Duration)
+	for i, m := range msgs {
+		if m == nil {
+			errs[i], failed = ErrMsgNotBound, true
+			continue
+		}
+		if errs[i] = ack(m); errs[i] != nil {
+			failed = true
+			continue
+		}
+		m.Sub.mu.Lock()
+		nc, wait := m.Sub.conn, defaultRequestWait
+		if m.Sub.jsi != nil {
+			wait = m.Sub.jsi.js.opts.wait
+		}
+		m.Sub.mu.Unlock()
+		sent[nc] = append(sent[nc], i)
+		waits[nc] = wait
+	}
+	for nc, idxs := range sent {
+		if err := nc.FlushTimeout(waits[nc]); err != nil {
+			for _, i := range idxs {
+				errs[i] = err
+			}
+			failed = true
+		}
+	}
+	if failed {
+		return &AckBatchError{Errs: errs}
+	}
+	return nil
+}
+
 // InProgress tells the server that this message is being worked on. It resets
 // the redelivery timer on the server.
 func (m *Msg) InProgress(opts ...AckOpt) error {
 	return m.ackReply(ackProgress, false, opts...)
 }
 
+// DecodeOpt are the options that can be passed to Msg.DecodeJSON().
+type DecodeOpt interface {
+	configureDecode(opts *decodeOpts) error
+}
+
+type decodeOpts struct {
+	term  bool
+	errCb func(m *Msg, err error)
+}
+
+type decodeOptFn func(opts *decodeOpts) error
+
+func (opt decodeOptFn) configureDecode(opts *decodeOpts) error {
+	return opt(opts)
+}
+
+// TermOnDecodeError makes Msg.DecodeJSON() terminate the message when its
+// data can not be decoded, so that it is not redelivered since decoding it
+// would fail again.
+func TermOnDecodeError() DecodeOpt {
+	return decodeOptFn(func(opts *decodeOpts) error {
+		opts.term = true
+		return nil
+	})
+}
+
+// DecodeErrorHandler sets a callback invoked by Msg.DecodeJSON() when the
+// message data can not be decoded, before the message is terminated if
+// TermOnDecodeError() is set. It can be used to log the message or publish
+// it to a dead letter subject.
+func DecodeErrorHandler(cb func(m *Msg, err error)) DecodeOpt {
+	return decodeOptFn(func(opts *decodeOpts) error {
+		opts.errCb = cb
+		return nil
+	})
+}
+
+// DecodeJSON unmarshals the message data into v. If the data can not be
+// decoded, the returned error wraps ErrMsgDecodeFailed, and the message is
+// handled as set with TermOnDecodeError() and DecodeErrorHandler().
+func (m *Msg) DecodeJSON(v interface{}, opts ...DecodeOpt) error {
+	var o decodeOpts
+	for _, opt := range opts {
+		if err := opt.configureDecode(&o); err != nil {
+			return err
+		}
+	}
+	err := json.Unmarshal(m.Data, v)
+	if err == nil {
+		return nil
+	}
+	err = fmt.Errorf("%w: %v", ErrMsgDecodeFailed, err)
+	if o.errCb != nil {
+		o.errCb(m, err)
+	}
+	if o.term {
+		if terr := m.Term(); terr != nil {
+			return fmt.Errorf("%w, and terminating the message failed: %v", err, terr)
+		}
+	}
+	return err
+}
+
+// AckDeadline returns the time after which the server will consider the
+// message as not acknowledged and redeliver it. It is based on the consumer's
+// AckWait and the time the message was received, or last marked as in
+// progress with InProgress(). It can be used to schedule an InProgress()
+// call for long running message processing.
+func (m *Msg) AckDeadline() (time.Time, error) {
+	if err := m.checkReply(); err != nil {
+		return time.Time{}, err
+	}
+	sub := m.Sub
+	sub.mu.Lock()
+	jsi := sub.jsi
+	if jsi == nil {
+		sub.mu.Unlock()
+		return time.Time{}, ErrNotJSMessage
+	}
+	ackNone, ackWait := jsi.ackNone, jsi.ackWait
+	sub.mu.Unlock()
+
+	if ackNone {
+		return time.Time{}, ErrCantAckIfConsumerAckNone
+	}
+	if atomic.LoadUint32(&m.ackd) != msgNotAckd {
+		return time.Time{}, ErrMsgAlreadyAckd
+	}
+	dlvt := atomic.LoadInt64(&m.dlvt)
+	if ackWait <= 0 || dlvt == 0 {
+		return time.Time{}, ErrAckWaitUnknown
+	}
+	return time.Unix(0, dlvt).Add(ackWait), nil
+}
+
+// extendAck marks the message as in progress whenever half of the consumer's
+// AckWait is left before its ack deadline, until the returned function is
+// called or the message is acknowledged.
+func (m *Msg) extendAck() func() {
+	done := make(chan struct{})
+	go func() {
+		for {
+			deadline, err := m.AckDeadline()
+			if err != nil {
+				return
+			}
+			m.Sub.mu.Lock()
+			ackWait, clk := m.Sub.jsi.ackWait, m.Sub.jsi.js.clock()
+			m.Sub.mu.Unlock()
+			if wait := until(clk, deadline) - ackWait/2; wait > 0 {
+				timer := clk.NewTimer(wait)
+				select {
+				case <-timer.C():
+				case <-done:
+					timer.Stop()
+					return
+				}
+				continue
+			}
+			select {
+			case <-done:
+				return
+			default:
+			}
+			if err := m.InProgress(); err != nil {
+				return
+			}
+		}
+	}()
+	return func() { close(done) }
+}
+
+// AckSubject returns the subject used to acknowledge a JetStream message.
+// It can be stored and later used with JetStream.AckBySubject() to
+// acknowledge the message independently of this Msg.
+func (m *Msg) AckSubject() (string, error) {
+	if err := m.checkReply(); err != nil {
+		return _EMPTY_, err
+	}
+	if _, err := getMetadataFields(m.Reply); err != nil {
+		return _EMPTY_, err
+	}
+	return m.Reply, nil
+}
+
+// AckBySubject acknowledges a message using its ack subject.
+func (js *js) AckBySubject(ackSubject string, opts ...AckOpt) error {
+	var o ackOpts
+	for _, opt := range opts {
+		if err := opt.configureAck(&o); err != nil {
+			return err
+		}
+	}
+	if _, err := getMetadataFields(ackSubject); err != nil {
+		return err
+	}
+
+	usesCtx := o.ctx != nil
+	usesWait := o.ttl > 0
+	if usesWait && usesCtx {
+		return ErrContextAndTimeout
+	}
+
+	var err error
+	if !usesCtx && !usesWait && o.retries == 0 {
+		err = js.nc.Publish(ackSubject, ackAck)
+	} else {
+		wait := js.opts.wait
+		if usesWait {
+			wait = o.ttl
+		}
+		err = ackSyncRequest(js.nc, js.clock(), o.ctx, ackSubject, ackAck, wait, o.retries)
+	}
+	if err == nil {
+		js.count(acksCounter)
+	}
+	return err
+}
+
 // MsgMetadata is the JetStream metadata associated with received messages.
 type MsgMetadata struct {
 	Sequence     SequencePair
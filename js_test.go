@@ -18,14 +18,17 @@ package nats
 ////////////////////////////////////////////////////////////////////////////////
 
 import (
+	"context"
 	"crypto/sha256"
 	"encoding/base64"
 	"encoding/json"
 	"errors"
 	"fmt"
+	"hash/fnv"
 	"math/rand"
 	"os"
 	"reflect"
+	"strconv"
 	"strings"
 	"sync"
 	"sync/atomic"
@@ -1271,3 +1274,607 @@ func TestStreamNameBySubject(t *testing.T) {
 		}
 	}
 }
+
+func TestJetStreamServerVersionFeatureGating(t *testing.T) {
+	nc := &Conn{status: CONNECTED, info: serverInfo{Version: "2.8.4"}}
+	js := &js{nc: nc, opts: &jsOpts{wait: defaultRequestWait}}
+
+	v, err := js.ServerVersion()
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	if v != "2.8.4" {
+		t.Fatalf("Unexpected server version: %q", v)
+	}
+
+	_, err = js.UpdateConsumer("TEST", &ConsumerConfig{
+		Durable:        "dlc",
+		FilterSubjects: []string{"foo.A", "foo.B"},
+	})
+	if !errors.Is(err, ErrFeatureNotSupported) || !strings.Contains(err.Error(), "v2.10.0") {
+		t.Fatalf("Expected error %v naming the minimum version, got %v", ErrFeatureNotSupported, err)
+	}
+
+	// Direct get is available from v2.9.0.
+	if _, err = js.GetMsg("TEST", 1, DirectGet()); !errors.Is(err, ErrFeatureNotSupported) {
+		t.Fatalf("Expected error %v, got %v", ErrFeatureNotSupported, err)
+	}
+	nc.info.Version = "2.9.0"
+	if err := js.checkServerVersion("direct get", 2, 9, 0); err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+
+	// Unknown version while not connected.
+	nc.status = RECONNECTING
+	if _, err := js.ServerVersion(); err != ErrConnectionReconnecting {
+		t.Fatalf("Expected error %v, got %v", ErrConnectionReconnecting, err)
+	}
+	if err := js.checkServerVersion("multiple filter subjects", 2, 10, 0); err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+}
+
+func TestJetStreamPullExpiryMargin(t *testing.T) {
+	sub := &Subscription{jsi: &jsSub{pull: true}}
+
+	if exp := sub.pullExpires(time.Second); exp != time.Second-defaultPullExpiryMargin {
+		t.Fatalf("Unexpected expiration: %v", exp)
+	}
+	// The margin is clamped to half of the ttl.
+	if exp := sub.pullExpires(15 * time.Millisecond); exp != 15*time.Millisecond/2 {
+		t.Fatalf("Unexpected expiration: %v", exp)
+	}
+
+	sub.growPullExpiryMargin()
+	sub.growPullExpiryMargin()
+	if exp := sub.pullExpires(time.Second); exp != time.Second-4*defaultPullExpiryMargin {
+		t.Fatalf("Unexpected expiration: %v", exp)
+	}
+	for i := 0; i < 20; i++ {
+		sub.growPullExpiryMargin()
+	}
+	if sub.jsi.expm != maxPullExpiryMargin {
+		t.Fatalf("Expected margin to be capped to %v, got %v", maxPullExpiryMargin, sub.jsi.expm)
+	}
+	if exp := sub.pullExpires(5 * time.Second); exp != 5*time.Second-maxPullExpiryMargin {
+		t.Fatalf("Unexpected expiration: %v", exp)
+	}
+	if exp := sub.pullExpires(time.Second); exp != time.Second/2 {
+		t.Fatalf("Unexpected expiration: %v", exp)
+	}
+
+	// Requests expiring in time on the server shrink the margin back.
+	for i := 0; i < 20; i++ {
+		sub.shrinkPullExpiryMargin()
+	}
+	if sub.jsi.expm != 0 {
+		t.Fatalf("Expected margin to be reset, got %v", sub.jsi.expm)
+	}
+	if exp := sub.pullExpires(time.Second); exp != time.Second-defaultPullExpiryMargin {
+		t.Fatalf("Unexpected expiration: %v", exp)
+	}
+}
+
+func TestJetStreamDedupWindow(t *testing.T) {
+	clk := newFakeClock()
+	dw := newDedupWindow(50*time.Millisecond, clk)
+	if dw.seen(1) {
+		t.Fatalf("Did not expect sequence to be seen")
+	}
+	dw.add(1)
+	dw.add(2)
+	if !dw.seen(1) || !dw.seen(2) || dw.seen(3) {
+		t.Fatalf("Unexpected seen sequences")
+	}
+
+	clk.Advance(49 * time.Millisecond)
+	if !dw.seen(1) {
+		t.Fatalf("Expected sequence to be in the window")
+	}
+	clk.Advance(time.Millisecond)
+	if dw.seen(1) {
+		t.Fatalf("Expected sequence to be out of the window")
+	}
+	// Expired entries are removed on the next addition.
+	dw.add(3)
+	dw.mu.Lock()
+	n := len(dw.seqs)
+	dw.mu.Unlock()
+	if n != 1 || !dw.seen(3) {
+		t.Fatalf("Expected only the last sequence to be kept, got %d entries", n)
+	}
+}
+
+// fakeClock is a clock which only moves forward when advanced.
+type fakeClock struct {
+	mu     sync.Mutex
+	now    time.Time
+	timers []*fakeTimer
+}
+
+type fakeTimer struct {
+	clk    *fakeClock
+	when   time.Time
+	active bool
+	c      chan time.Time
+	f      func()
+}
+
+func newFakeClock() *fakeClock {
+	return &fakeClock{now: time.Now()}
+}
+
+func (c *fakeClock) Now() time.Time {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.now
+}
+
+func (c *fakeClock) After(d time.Duration) <-chan time.Time {
+	return c.NewTimer(d).C()
+}
+
+func (c *fakeClock) NewTimer(d time.Duration) clockTimer {
+	return c.newTimer(d, nil)
+}
+
+func (c *fakeClock) AfterFunc(d time.Duration, f func()) clockTimer {
+	return c.newTimer(d, f)
+}
+
+func (c *fakeClock) newTimer(d time.Duration, f func()) *fakeTimer {
+	t := &fakeTimer{clk: c, f: f}
+	if f == nil {
+		t.c = make(chan time.Time, 1)
+	}
+	c.mu.Lock()
+	c.timers = append(c.timers, t)
+	c.mu.Unlock()
+	t.Reset(d)
+	return t
+}
+
+// Advance moves the clock forward by d, firing the timers which expire.
+func (c *fakeClock) Advance(d time.Duration) {
+	c.mu.Lock()
+	c.now = c.now.Add(d)
+	now := c.now
+	var fired []*fakeTimer
+	for _, t := range c.timers {
+		if t.active && !t.when.After(now) {
+			t.active = false
+			fired = append(fired, t)
+		}
+	}
+	c.mu.Unlock()
+	for _, t := range fired {
+		if t.f != nil {
+			go t.f()
+			continue
+		}
+		select {
+		case t.c <- now:
+		default:
+		}
+	}
+}
+
+// pending returns the number of timers which did not fire yet.
+func (c *fakeClock) pending() int {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	var n int
+	for _, t := range c.timers {
+		if t.active {
+			n++
+		}
+	}
+	return n
+}
+
+func (t *fakeTimer) C() <-chan time.Time {
+	return t.c
+}
+
+func (t *fakeTimer) Stop() bool {
+	t.clk.mu.Lock()
+	defer t.clk.mu.Unlock()
+	active := t.active
+	t.active = false
+	return active
+}
+
+func (t *fakeTimer) Reset(d time.Duration) bool {
+	t.clk.mu.Lock()
+	defer t.clk.mu.Unlock()
+	active := t.active
+	t.when, t.active = t.clk.now.Add(d), true
+	return active
+}
+
+func TestJetStreamFakeClockPullExpires(t *testing.T) {
+	s := RunBasicJetStreamServer()
+	defer shutdownJSServerAndRemoveStorage(t, s)
+
+	nc := client(t, s)
+	defer nc.Close()
+	clk := newFakeClock()
+	js, err := nc.JetStream(withClock(clk))
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	if _, err := js.AddStream(&StreamConfig{Name: "TEST", Subjects: []string{"foo"}}); err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	sub, err := js.PullSubscribe("foo", "dur")
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	reqs, err := nc.SubscribeSync("$JS.API.CONSUMER.MSG.NEXT.TEST.dur")
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+
+	// The expiration is computed against the fake clock, so that it does
+	// not depend on the time spent before the request is sent.
+	ctx, cancel := context.WithDeadline(context.Background(), clk.Now().Add(time.Second))
+	defer cancel()
+	if _, err := sub.Fetch(1, Context(ctx), PullHeartbeat(500*time.Millisecond)); err == nil {
+		t.Fatal("Expected error, got none")
+	}
+	msg, err := reqs.NextMsg(time.Second)
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	var nr nextRequest
+	if err := json.Unmarshal(msg.Data, &nr); err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	if nr.Expires != time.Second-defaultPullExpiryMargin || nr.Heartbeat != 500*time.Millisecond {
+		t.Fatalf("Unexpected request: %+v", nr)
+	}
+
+	// The heartbeat interval is checked against the fake clock too.
+	clk.Advance(500 * time.Millisecond)
+	ctx, cancel = context.WithDeadline(context.Background(), clk.Now().Add(time.Second))
+	defer cancel()
+	if _, err := sub.Fetch(1, Context(ctx), PullHeartbeat(600*time.Millisecond)); !errors.Is(err, ErrInvalidArg) {
+		t.Fatalf("Expected error %v, got %v", ErrInvalidArg, err)
+	}
+}
+
+func TestJetStreamFakeClockHeartbeatCheck(t *testing.T) {
+	s := RunBasicJetStreamServer()
+	defer shutdownJSServerAndRemoveStorage(t, s)
+
+	errCh := make(chan error, 10)
+	nc := client(t, s, ErrorHandler(func(_ *Conn, _ *Subscription, err error) {
+		errCh <- err
+	}))
+	defer nc.Close()
+	clk := newFakeClock()
+	js, err := nc.JetStream(withClock(clk))
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	if _, err := js.AddStream(&StreamConfig{Name: "TEST", Subjects: []string{"foo"}}); err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	// The server would only send heartbeats after a minute, the fake clock
+	// makes the client give up on the consumer without waiting for it.
+	sub, err := js.SubscribeSync("foo", IdleHeartbeat(time.Minute))
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	defer sub.Unsubscribe()
+	if n := clk.pending(); n != 1 {
+		t.Fatalf("Expected a heartbeat check timer, got %d", n)
+	}
+
+	clk.Advance(time.Minute)
+	select {
+	case err := <-errCh:
+		t.Fatalf("Unexpected error: %v", err)
+	case <-time.After(50 * time.Millisecond):
+	}
+	clk.Advance(time.Minute)
+	select {
+	case err := <-errCh:
+		if err != ErrConsumerNotActive {
+			t.Fatalf("Expected error %v, got %v", ErrConsumerNotActive, err)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("Did not get the inactivity error")
+	}
+}
+
+func TestJetStreamResourceCache(t *testing.T) {
+	clk := newFakeClock()
+	c := newResourceCache(time.Minute, 2)
+
+	c.put(cacheStreamKey+"A", "A", clk.Now())
+	c.put(cacheSubjectKey+"foo", "A", clk.Now())
+	if stream, ok := c.get(cacheSubjectKey+"foo", clk.Now()); !ok || stream != "A" {
+		t.Fatalf("Unexpected entry: %q, %v", stream, ok)
+	}
+
+	// The least recently used entry is evicted.
+	c.get(cacheStreamKey+"A", clk.Now())
+	c.put(cacheStreamKey+"B", "B", clk.Now())
+	if _, ok := c.get(cacheSubjectKey+"foo", clk.Now()); ok {
+		t.Fatal("Expected entry to be evicted")
+	}
+	if _, ok := c.get(cacheStreamKey+"A", clk.Now()); !ok {
+		t.Fatal("Expected entry to be cached")
+	}
+
+	// Entries expire after the ttl.
+	clk.Advance(30 * time.Second)
+	c.put(cacheStreamKey+"B", "B", clk.Now())
+	clk.Advance(30 * time.Second)
+	if _, ok := c.get(cacheStreamKey+"A", clk.Now()); ok {
+		t.Fatal("Expected entry to be expired")
+	}
+	if _, ok := c.get(cacheStreamKey+"B", clk.Now()); !ok {
+		t.Fatal("Expected refreshed entry to be cached")
+	}
+
+	c.remove(func(e *cacheEntry) bool { return e.stream == "B" })
+	if n := c.lru.Len(); n != 0 || len(c.entries) != 0 {
+		t.Fatalf("Expected empty cache, got %d entries", n)
+	}
+
+	// A nil cache caches nothing.
+	var nc *resourceCache
+	nc.put(cacheStreamKey+"A", "A", clk.Now())
+	if _, ok := nc.get(cacheStreamKey+"A", clk.Now()); ok {
+		t.Fatal("Unexpected entry in nil cache")
+	}
+
+	// Keys are scoped to the API prefix of the context.
+	jsc := &js{opts: &jsOpts{pre: defaultAPIPrefix}}
+	djs := &js{opts: &jsOpts{pre: fmt.Sprintf(jsDomainT, "hub")}}
+	if k, dk := jsc.cacheKey(cacheSubjectKey, "foo"), djs.cacheKey(cacheSubjectKey, "foo"); k == dk {
+		t.Fatalf("Expected different keys, got %q", k)
+	}
+}
+
+func TestJetStreamPullStatusError(t *testing.T) {
+	for _, test := range []struct {
+		status string
+		descr  string
+		err    error
+	}{
+		{"409", "Exceeded MaxWaiting", ErrMaxWaitingExceeded},
+		{"409", "Exceeded MaxRequestBatch of 10", ErrMaxRequestBatchExceeded},
+		{"409", "Exceeded MaxRequestExpires of 1s", ErrMaxRequestExpiresExceeded},
+		{"409", "Exceeded MaxRequestMaxBytes of 1024", ErrMaxRequestMaxBytesExceeded},
+		{"409", "Message Size Exceeds MaxBytes", ErrMsgSizeExceedsMaxBytes},
+		{"400", "Bad Request", nil},
+	} {
+		t.Run(test.descr, func(t *testing.T) {
+			msg := NewMsg("inbox")
+			msg.Header.Set(statusHdr, test.status)
+			msg.Header.Set(descrHdr, test.descr)
+			usrMsg, err := checkMsg(msg, true, false)
+			if usrMsg {
+				t.Fatal("Expected a status message")
+			}
+			var perr *PullStatusError
+			if !errors.As(err, &perr) {
+				t.Fatalf("Expected a status error, got %v", err)
+			}
+			if code := fmt.Sprint(perr.Code); code != test.status || perr.Description != test.descr {
+				t.Fatalf("Unexpected status error: %+v", perr)
+			}
+			if err.Error() != "nats: "+test.descr {
+				t.Fatalf("Unexpected error message: %q", err.Error())
+			}
+			if test.err != nil && !errors.Is(err, test.err) {
+				t.Fatalf("Expected error %v, got %v", test.err, err)
+			}
+			if test.err == nil && errors.Unwrap(err) != nil {
+				t.Fatalf("Unexpected wrapped error: %v", errors.Unwrap(err))
+			}
+		})
+	}
+}
+
+func TestJetStreamPartitionBySubject(t *testing.T) {
+	worker := func(subj string) uint32 {
+		h := fnv.New32a()
+		h.Write([]byte(subj))
+		return h.Sum32() % 2
+	}
+	// Find two subjects handled by different workers.
+	a, b := "ev.0", _EMPTY_
+	for i := 1; b == _EMPTY_; i++ {
+		if subj := fmt.Sprintf("ev.%d", i); worker(subj) != worker(a) {
+			b = subj
+		}
+	}
+
+	var mu sync.Mutex
+	handled := make(map[string][]int)
+	bHandled := make(chan struct{})
+	var acks int32
+	handler, stop := partitionBySubject(2, func(m *Msg) {
+		// The first message of a can only be handled once b was, by another worker.
+		if m.Subject == a && string(m.Data) == "0" {
+			select {
+			case <-bHandled:
+			case <-time.After(2 * time.Second):
+				t.Errorf("Messages of different subjects were not handled concurrently")
+			}
+		}
+		n, _ := strconv.Atoi(string(m.Data))
+		mu.Lock()
+		handled[m.Subject] = append(handled[m.Subject], n)
+		mu.Unlock()
+		if m.Subject == b && n == 0 {
+			close(bHandled)
+		}
+	}, func(m *Msg) { atomic.AddInt32(&acks, 1) })
+
+	for i := 0; i < 10; i++ {
+		handler(&Msg{Subject: a, Data: []byte(strconv.Itoa(i))})
+		handler(&Msg{Subject: b, Data: []byte(strconv.Itoa(i))})
+	}
+	stop()
+	for deadline := time.Now().Add(2 * time.Second); atomic.LoadInt32(&acks) != 20; {
+		if time.Now().After(deadline) {
+			t.Fatalf("Expected 20 acks, got %d", atomic.LoadInt32(&acks))
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	mu.Lock()
+	defer mu.Unlock()
+	for _, subj := range []string{a, b} {
+		for i, n := range handled[subj] {
+			if n != i {
+				t.Fatalf("Messages of %q handled out of order: %v", subj, handled[subj])
+			}
+		}
+	}
+}
+
+func TestJetStreamPullParams(t *testing.T) {
+	for _, test := range []struct {
+		name     string
+		cfg      ConsumerConfig
+		expected pullParams
+	}{
+		{"no limits", ConsumerConfig{}, defaultPullParams},
+		{"max ack pending", ConsumerConfig{MaxAckPending: 10}, pullParams{batch: 10, expires: multiPullWait}},
+		{"large max ack pending", ConsumerConfig{MaxAckPending: 1000}, defaultPullParams},
+		{"max request batch", ConsumerConfig{MaxAckPending: 10, MaxRequestBatch: 5}, pullParams{batch: 5, expires: multiPullWait}},
+		{"max request expires", ConsumerConfig{MaxRequestExpires: time.Second}, pullParams{batch: multiPullBatch, expires: time.Second}},
+		{"max request bytes", ConsumerConfig{MaxRequestMaxBytes: 1024}, pullParams{batch: multiPullBatch, expires: multiPullWait, maxBytes: 1024}},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			if p := newPullParams(&test.cfg); *p != test.expected {
+				t.Fatalf("Expected %+v, got %+v", test.expected, *p)
+			}
+		})
+	}
+}
+
+func TestJetStreamSubjectTransform(t *testing.T) {
+	for _, test := range []struct {
+		src, dst string
+		subj     string
+		expected string
+	}{
+		{"foo", "bar", "foo", "bar"},
+		{"foo", "bar", "baz", "baz"},
+		{"orders.*", "bridge.orders.*", "orders.1", "bridge.orders.1"},
+		{"orders.*.*", "bridge.*.*", "orders.eu.1", "bridge.eu.1"},
+		{"orders.*.*", "bridge.$2.$1", "orders.eu.1", "bridge.1.eu"},
+		{"orders.*.*", "bridge.{{wildcard(2)}}.{{wildcard(1)}}", "orders.eu.1", "bridge.1.eu"},
+		{"orders.*.>", "bridge.$1.>", "orders.eu.1.2", "bridge.eu.1.2"},
+		{"orders.>", "bridge.>", "orders.eu.1", "bridge.eu.1"},
+		{"orders.*.*", "bridge.$1", "orders.eu.1", "bridge.eu"},
+	} {
+		t.Run(test.src+"->"+test.dst, func(t *testing.T) {
+			tr, err := newSubjectTransform(test.src, test.dst)
+			if err != nil {
+				t.Fatalf("Unexpected error: %v", err)
+			}
+			if subj := tr.apply(test.subj); subj != test.expected {
+				t.Fatalf("Expected %q, got %q", test.expected, subj)
+			}
+		})
+	}
+
+	for _, test := range []struct{ src, dst string }{
+		{"orders.*", "bridge"},
+		{"orders", "bridge.*"},
+		{"orders.*.*", "bridge.*"},
+		{"orders.*", "bridge.$2"},
+		{"orders.*", "bridge.$0"},
+		{"orders.*.*", "bridge.*.$1"},
+		{"orders.>", "bridge"},
+		{"orders", "bridge.>"},
+		{"orders.>.x", "bridge.>"},
+		{"orders..x", "bridge"},
+	} {
+		t.Run(test.src+"->"+test.dst, func(t *testing.T) {
+			if _, err := newSubjectTransform(test.src, test.dst); !errors.Is(err, ErrInvalidArg) {
+				t.Fatalf("Expected error %v, got %v", ErrInvalidArg, err)
+			}
+		})
+	}
+}
+
+func TestJetStreamConsumerInfoStartSkipped(t *testing.T) {
+	for _, test := range []struct {
+		name    string
+		info    ConsumerInfo
+		start   uint64
+		known   bool
+		skipped uint64
+	}{
+		{"deliver all", ConsumerInfo{Config: ConsumerConfig{DeliverPolicy: DeliverAllPolicy}, Delivered: SequenceInfo{Stream: 4}}, 5, true, 0},
+		{"start sequence", ConsumerInfo{Config: ConsumerConfig{DeliverPolicy: DeliverByStartSequencePolicy, OptStartSeq: 5}, Delivered: SequenceInfo{Stream: 4}}, 5, true, 0},
+		{"purged start sequence", ConsumerInfo{Config: ConsumerConfig{DeliverPolicy: DeliverByStartSequencePolicy, OptStartSeq: 2}, Delivered: SequenceInfo{Stream: 4}}, 5, true, 3},
+		{"delivered", ConsumerInfo{Config: ConsumerConfig{DeliverPolicy: DeliverByStartSequencePolicy, OptStartSeq: 2}, Delivered: SequenceInfo{Consumer: 1, Stream: 5}}, 0, false, 0},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			if start, known := test.info.StartSequence(); start != test.start || known != test.known {
+				t.Fatalf("Expected start %d (%v), got %d (%v)", test.start, test.known, start, known)
+			}
+			if skipped := test.info.StartSkipped(); skipped != test.skipped {
+				t.Fatalf("Expected %d skipped, got %d", test.skipped, skipped)
+			}
+		})
+	}
+}
+
+func TestJetStreamDeliveryLatency(t *testing.T) {
+	clk := newFakeClock()
+	sent := clk.Now()
+	stored := sent.Add(-time.Second)
+
+	msg := NewMsg("foo")
+	msg.Sub = &Subscription{}
+	msg.Reply = fmt.Sprintf("$JS.ACK.TEST.cons.1.2.3.%v.4", stored.UnixNano())
+
+	// Without a recorded delivery time, the message is received now.
+	clk.Advance(50 * time.Millisecond)
+	if l := deliveryLatency(msg, sent, clk); l.Pull != 50*time.Millisecond || l.Publish != 1050*time.Millisecond {
+		t.Fatalf("Unexpected latency: %+v", l)
+	}
+
+	msg.dlvt = sent.Add(20 * time.Millisecond).UnixNano()
+	if l := deliveryLatency(msg, sent, clk); l.Pull != 20*time.Millisecond || l.Publish != 1020*time.Millisecond {
+		t.Fatalf("Unexpected latency: %+v", l)
+	}
+
+	// Messages received for a previous request have no pull latency.
+	if l := deliveryLatency(msg, sent.Add(time.Second), clk); l.Pull != 0 {
+		t.Fatalf("Unexpected latency: %+v", l)
+	}
+
+	// Messages without metadata have no publish latency.
+	msg.Reply = "reply"
+	if l := deliveryLatency(msg, sent, clk); l.Pull != 20*time.Millisecond || l.Publish != 0 {
+		t.Fatalf("Unexpected latency: %+v", l)
+	}
+}
+
+func TestJetStreamIsMsgMissing(t *testing.T) {
+	for _, test := range []struct {
+		err      error
+		expected bool
+	}{
+		{&APIError{Code: 404, ErrorCode: JSErrCodeMessageNotFound, Description: "no message found"}, true},
+		{&APIError{Code: 400, ErrorCode: JSErrCodeSequenceNotFound, Description: "sequence 5 not found"}, true},
+		{&APIError{Code: 500, ErrorCode: JSErrCodeMessageDeleteFailed, Description: "no message found"}, false},
+		{&APIError{Code: 500, ErrorCode: JSErrCodeMessageDeleteFailed, Description: "message delete not permitted"}, false},
+		{ErrTimeout, false},
+	} {
+		if missing := isMsgMissing(test.err); missing != test.expected {
+			t.Fatalf("Expected %v for %v, got %v", test.expected, test.err, missing)
+		}
+	}
+}
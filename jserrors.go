@@ -30,6 +30,10 @@ var (
 	// ErrStreamNotFound is an error returned when stream with given name does not exist.
 	ErrStreamNotFound JetStreamError = &jsError{apiErr: &APIError{ErrorCode: JSErrCodeStreamNotFound, Description: "stream not found", Code: 404}}
 
+	// ErrStreamOffline is an error returned when a stream exists but its assets are currently offline
+	// (e.g. all replicas are unavailable). Unlike ErrStreamNotFound, the operation may succeed if retried later.
+	ErrStreamOffline JetStreamError = &jsError{apiErr: &APIError{ErrorCode: JSErrCodeStreamOffline, Description: "stream is offline", Code: 500}}
+
 	// ErrStreamNameAlreadyInUse is returned when a stream with given name already exists and has a different configuration.
 	ErrStreamNameAlreadyInUse JetStreamError = &jsError{apiErr: &APIError{ErrorCode: JSErrCodeStreamNameInUse, Description: "stream name already in use", Code: 400}}
 
@@ -42,11 +46,44 @@ var (
 	// ErrBadRequest is returned when invalid request is sent to JetStream API.
 	ErrBadRequest JetStreamError = &jsError{apiErr: &APIError{ErrorCode: JSErrCodeBadRequest, Description: "bad request", Code: 400}}
 
+	// ErrWrongLastSequence is returned when a message is rejected because the last sequence of the stream,
+	// or of the subject, is not the one expected by the publisher (see ExpectLastSequence()).
+	ErrWrongLastSequence JetStreamError = &jsError{apiErr: &APIError{ErrorCode: JSErrCodeStreamWrongLastSequence, Description: "wrong last sequence", Code: 400}}
+
+	// ErrWrongLastMsgID is returned when a message is rejected because the ID of the last message of the
+	// stream is not the one expected by the publisher (see ExpectLastMsgId()).
+	ErrWrongLastMsgID JetStreamError = &jsError{apiErr: &APIError{ErrorCode: JSErrCodeStreamWrongLastMsgID, Description: "wrong last msg ID", Code: 400}}
+
+	// ErrStreamNotMatch is returned when a message is rejected because it is not stored in the stream
+	// expected by the publisher (see ExpectStream()).
+	ErrStreamNotMatch JetStreamError = &jsError{apiErr: &APIError{ErrorCode: JSErrCodeStreamNotMatch, Description: "expected stream does not match", Code: 400}}
+
+	// ErrStreamWrongSubject is returned when a message is rejected because its subject is captured by
+	// another stream than the one expected by the publisher. It is the same error as ErrStreamNotMatch.
+	ErrStreamWrongSubject = ErrStreamNotMatch
+
+	// ErrStreamSubjectsOverlap is returned when the subjects of a stream overlap with the subjects of another stream.
+	ErrStreamSubjectsOverlap JetStreamError = &jsError{apiErr: &APIError{ErrorCode: JSErrCodeStreamSubjectOverlap, Description: "subjects overlap with an existing stream", Code: 400}}
+
+	// ErrStreamStoreFailed is returned when a message could not be stored, e.g. when a limit of a stream
+	// with DiscardNew policy is reached.
+	ErrStreamStoreFailed JetStreamError = &jsError{apiErr: &APIError{ErrorCode: JSErrCodeStreamStoreFailed, Description: "stream store failed", Code: 503}}
+
+	// ErrMaxConsumersReached is returned when a consumer can not be created because the stream or account reached its maximum number of consumers.
+	ErrMaxConsumersReached JetStreamError = &jsError{apiErr: &APIError{ErrorCode: JSErrCodeMaximumConsumersLimit, Description: "maximum consumers limit reached", Code: 400}}
+
 	// Client errors
 
 	// ErrConsumerNameAlreadyInUse is an error returned when consumer with given name already exists.
 	ErrConsumerNameAlreadyInUse JetStreamError = &jsError{message: "consumer name already in use"}
 
+	// ErrConsumerExists is returned by AddConsumer when the consumer already exists with a
+	// different configuration. It is the same error as ErrConsumerNameAlreadyInUse.
+	ErrConsumerExists = ErrConsumerNameAlreadyInUse
+
+	// ErrConsumerFilterOverlap is returned when the filter of a consumer overlaps with the one of another consumer of a work queue stream.
+	ErrConsumerFilterOverlap JetStreamError = &jsError{message: "consumer filter overlaps with another consumer of the work queue stream"}
+
 	// ErrConsumerNotActive is an error returned when consumer is not active.
 	ErrConsumerNotActive JetStreamError = &jsError{message: "consumer not active"}
 
@@ -74,9 +111,14 @@ var (
 	// ErrMsgAlreadyAckd is returned when attempting to acknowledge message more than once.
 	ErrMsgAlreadyAckd JetStreamError = &jsError{message: "message was already acknowledged"}
 
-	// ErrNoStreamResponse is returned when there is no response from stream (e.g. no responders error).
+	// ErrNoStreamResponse is returned when there is no response from stream (e.g. no responders error),
+	// which is the case when no stream captures the subject of a publish, see also CheckStreamOnTimeout().
 	ErrNoStreamResponse JetStreamError = &jsError{message: "no response from stream"}
 
+	// ErrStreamNotFoundOnPublish is returned when a publish gets no responders because no stream
+	// captures the subject. It is the same error as ErrNoStreamResponse.
+	ErrStreamNotFoundOnPublish = ErrNoStreamResponse
+
 	// ErrNotJSMessage is returned when attempting to get metadata from non JetStream message .
 	ErrNotJSMessage JetStreamError = &jsError{message: "not a jetstream message"}
 
@@ -86,9 +128,27 @@ var (
 	// ErrInvalidConsumerName is returned when the provided consumer name is invalid (contains '.' or ' ').
 	ErrInvalidConsumerName JetStreamError = &jsError{message: "invalid consumer name"}
 
+	// ErrInvalidConsumerConfig is returned when the provided consumer configuration is invalid.
+	ErrInvalidConsumerConfig JetStreamError = &jsError{message: "invalid consumer configuration"}
+
+	// ErrInvalidStreamConfig is returned when the provided stream configuration is invalid.
+	ErrInvalidStreamConfig JetStreamError = &jsError{message: "invalid stream configuration"}
+
+	// ErrInvalidPlacement is returned when the placement in the stream configuration is invalid.
+	ErrInvalidPlacement JetStreamError = &jsError{message: "invalid stream placement"}
+
+	// ErrInvalidStartPosition is returned when a consumer is reset to a position outside of the messages retained by the stream.
+	ErrInvalidStartPosition JetStreamError = &jsError{message: "start position is outside of the stream"}
+
+	// ErrFeatureNotSupported is returned when a feature requires a newer version of the connected server.
+	ErrFeatureNotSupported JetStreamError = &jsError{message: "feature not supported by the server"}
+
 	// ErrNoMatchingStream is returned when stream lookup by subject is unsuccessful.
 	ErrNoMatchingStream JetStreamError = &jsError{message: "no stream matches subject"}
 
+	// ErrConsumerMismatch is returned when the consumer bound with BindDurable() is not the expected durable consumer.
+	ErrConsumerMismatch JetStreamError = &jsError{message: "consumer does not match the expected durable"}
+
 	// ErrSubjectMismatch is returned when the provided subject does not match consumer's filter subject.
 	ErrSubjectMismatch JetStreamError = &jsError{message: "subject does not match consumer"}
 
@@ -98,12 +158,52 @@ var (
 	// ErrCantAckIfConsumerAckNone is returned when attempting to ack a message for consumer with AckNone policy set.
 	ErrCantAckIfConsumerAckNone JetStreamError = &jsError{message: "cannot acknowledge a message for a consumer with AckNone policy"}
 
+	// ErrConsumerRecreated is passed to the asynchronous error handler when
+	// Consume() recreated a deleted consumer, see ConsumeRecreateOnDelete().
+	ErrConsumerRecreated JetStreamError = &jsError{message: "consumer recreated"}
+
+	// ErrAckWaitBelowBackOff is passed to the asynchronous error handler when
+	// a consumer is created or updated with an ack wait smaller than its largest
+	// backoff value. The server then uses the first backoff value as ack wait.
+	ErrAckWaitBelowBackOff JetStreamError = &jsError{message: "ack wait is smaller than the largest backoff value"}
+
 	// ErrConsumerDeleted is returned when attempting to send pull request to a consumer which does not exist
 	ErrConsumerDeleted JetStreamError = &jsError{message: "consumer deleted"}
 
+	// ErrAckWaitUnknown is returned when the ack deadline of a message cannot be determined
+	// because the consumer's AckWait is not known to the subscription.
+	ErrAckWaitUnknown JetStreamError = &jsError{message: "consumer ack wait is unknown"}
+
+	// ErrMaxWaitingExceeded is returned when a pull request is rejected because the
+	// consumer already has the maximum number of outstanding pull requests (MaxWaiting).
+	ErrMaxWaitingExceeded JetStreamError = &jsError{message: "exceeded MaxWaiting"}
+
 	// ErrConsumerLeadershipChanged is returned when pending requests are no longer valid after leadership has changed
 	ErrConsumerLeadershipChanged JetStreamError = &jsError{message: "Leadership Changed"}
 
+	// ErrMaxRequestBatchExceeded is returned when a pull request asks for more messages than the
+	// consumer's MaxRequestBatch. The error is a *PullStatusError with the server's description.
+	ErrMaxRequestBatchExceeded JetStreamError = &jsError{message: "exceeded MaxRequestBatch"}
+
+	// ErrMaxRequestExpiresExceeded is returned when the expiration of a pull request is longer than
+	// the consumer's MaxRequestExpires. The error is a *PullStatusError with the server's description.
+	ErrMaxRequestExpiresExceeded JetStreamError = &jsError{message: "exceeded MaxRequestExpires"}
+
+	// ErrMaxRequestMaxBytesExceeded is returned when the MaxBytes of a pull request is larger than the
+	// consumer's MaxRequestMaxBytes. The error is a *PullStatusError with the server's description.
+	ErrMaxRequestMaxBytesExceeded JetStreamError = &jsError{message: "exceeded MaxRequestMaxBytes"}
+
+	// ErrMsgSizeExceedsMaxBytes is returned when the next message is larger than the MaxBytes of the
+	// pull request. The error is a *PullStatusError with the server's description.
+	ErrMsgSizeExceedsMaxBytes JetStreamError = &jsError{message: "message size exceeds MaxBytes"}
+
+	// ErrNoHeartbeat is returned by Fetch() and FetchBatch() when neither a message nor an idle
+	// heartbeat was received for twice the interval set with PullHeartbeat().
+	ErrNoHeartbeat JetStreamError = &jsError{message: "no heartbeat received"}
+
+	// ErrMsgDecodeFailed is returned by Msg.DecodeJSON() when the message data can not be decoded.
+	ErrMsgDecodeFailed JetStreamError = &jsError{message: "message data could not be decoded"}
+
 	// DEPRECATED: ErrInvalidDurableName is no longer returned and will be removed in future releases.
 	// Use ErrInvalidConsumerName instead.
 	ErrInvalidDurableName = errors.New("nats: invalid durable name")
@@ -119,18 +219,50 @@ const (
 
 	JSErrCodeStreamNotFound  ErrorCode = 10059
 	JSErrCodeStreamNameInUse ErrorCode = 10058
+	JSErrCodeStreamOffline   ErrorCode = 10118
+
+	JSErrCodeStreamSubjectOverlap ErrorCode = 10065
 
 	JSErrCodeConsumerNotFound      ErrorCode = 10014
 	JSErrCodeConsumerNameExists    ErrorCode = 10013
 	JSErrCodeConsumerAlreadyExists ErrorCode = 10105
+	JSErrCodeMaximumConsumersLimit ErrorCode = 10026
+	JSErrCodeConsumerWQNotUnique   ErrorCode = 10100
+	JSErrCodeConsumerWQUnfiltered  ErrorCode = 10099
 
-	JSErrCodeMessageNotFound ErrorCode = 10037
+	JSErrCodeMessageNotFound     ErrorCode = 10037
+	JSErrCodeSequenceNotFound    ErrorCode = 10043
+	JSErrCodeMessageDeleteFailed ErrorCode = 10057
 
 	JSErrCodeBadRequest ErrorCode = 10003
 
 	JSErrCodeStreamWrongLastSequence ErrorCode = 10071
+	JSErrCodeStreamWrongLastMsgID    ErrorCode = 10070
+	JSErrCodeStreamNotMatch          ErrorCode = 10060
+	JSErrCodeStreamStoreFailed       ErrorCode = 10077
 )
 
+// PullStatusError is returned when the server ends a pull request with a
+// status message, e.g. because the request exceeds the limits of the consumer.
+// Known statuses unwrap to an error such as ErrMaxRequestBatchExceeded, which
+// can be matched with errors.Is().
+type PullStatusError struct {
+	// Code is the status code, e.g. 409.
+	Code int
+	// Description is the description of the status given by the server.
+	Description string
+
+	err error
+}
+
+func (e *PullStatusError) Error() string {
+	return fmt.Sprintf("nats: %s", e.Description)
+}
+
+func (e *PullStatusError) Unwrap() error {
+	return e.err
+}
+
 // APIError is included in all API responses if there was an error.
 type APIError struct {
 	Code        int       `json:"code"`
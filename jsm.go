@@ -14,18 +14,24 @@
 package nats
 
 import (
+	"container/list"
 	"context"
 	"encoding/json"
 	"errors"
 	"fmt"
+	"reflect"
 	"strconv"
 	"strings"
+	"sync"
 	"time"
+
+	"github.com/nats-io/nuid"
 )
 
 // JetStreamManager manages JetStream Streams and Consumers.
 type JetStreamManager interface {
-	// AddStream creates a stream.
+	// AddStream creates a stream. The configuration of the returned info is
+	// the one stored by the server, with its defaults filled in.
 	AddStream(cfg *StreamConfig, opts ...JSOpt) (*StreamInfo, error)
 
 	// UpdateStream updates a stream.
@@ -37,9 +43,48 @@ type JetStreamManager interface {
 	// StreamInfo retrieves information from a stream.
 	StreamInfo(stream string, opts ...JSOpt) (*StreamInfo, error)
 
+	// CachedStreamConfig returns the configuration of a stream as last reported
+	// by the server when the stream was created, updated or looked up through
+	// this context, without sending a request. Unlike the configuration given
+	// to AddStream(), it has the defaults filled in by the server, such as the
+	// duplicates window, so it can be compared with the desired configuration.
+	CachedStreamConfig(name string) (*StreamConfig, bool)
+
+	// StreamExists reports whether a stream with the given name exists.
+	StreamExists(stream string, opts ...JSOpt) (bool, error)
+
+	// StreamSequenceRange retrieves the range of messages currently retained
+	// by a stream, e.g. to bound a replay to it.
+	StreamSequenceRange(stream string, opts ...JSOpt) (*SequenceRange, error)
+
 	// PurgeStream purges a stream messages.
 	PurgeStream(name string, opts ...JSOpt) error
 
+	// RecreateStream deletes a stream and creates it again using its current
+	// configuration, removing all messages and consumers and resetting the
+	// stream sequence. If the stream can not be created again once deleted,
+	// a *StreamRecreateError holding its configuration is returned.
+	RecreateStream(name string, opts ...JSOpt) (*StreamInfo, error)
+
+	// AddStreamSubjects adds subjects to the configuration of a stream,
+	// failing with ErrStreamSubjectsOverlap if one of them overlaps with the
+	// subjects of another stream. Subjects already part of the stream are
+	// ignored. The configuration is read and updated in two requests, so
+	// concurrent changes to the stream made in between are overwritten.
+	AddStreamSubjects(stream string, subjects []string, opts ...JSOpt) (*StreamInfo, error)
+
+	// RemoveStreamSubjects removes subjects from the configuration of a
+	// stream. The subjects must be part of the stream, and at least one must
+	// remain. See AddStreamSubjects() regarding concurrent changes.
+	RemoveStreamSubjects(stream string, subjects []string, opts ...JSOpt) (*StreamInfo, error)
+
+	// ApplyStreamConfigs creates or updates a set of streams, returning the
+	// outcome for each configuration, in the same order. Streams are
+	// configured concurrently and the whole operation is bound to the
+	// nats.Context() or nats.MaxWait() options, which may need to be larger
+	// than the default request timeout for large sets.
+	ApplyStreamConfigs(cfgs []*StreamConfig, opts ...JSOpt) []ApplyResult
+
 	// StreamsInfo can be used to retrieve a list of StreamInfo objects.
 	// DEPRECATED: Use Streams() instead.
 	StreamsInfo(opts ...JSOpt) <-chan *StreamInfo
@@ -47,6 +92,11 @@ type JetStreamManager interface {
 	// Streams can be used to retrieve a list of StreamInfo objects.
 	Streams(opts ...JSOpt) <-chan *StreamInfo
 
+	// StreamsPage retrieves a single page of StreamInfo objects, starting at
+	// the given offset, along with the total number of streams. Unlike
+	// Streams(), it does not fetch the following pages.
+	StreamsPage(offset int, opts ...JSOpt) (*StreamInfoPage, error)
+
 	// StreamNames is used to retrieve a list of Stream names.
 	StreamNames(opts ...JSOpt) <-chan string
 
@@ -62,6 +112,13 @@ type JetStreamManager interface {
 	// The stream must have been created/updated with the AllowDirect boolean.
 	GetLastMsg(name, subject string, opts ...JSOpt) (*RawStreamMsg, error)
 
+	// GetLastMsgsForSubjects retrieves the last raw stream messages stored in JetStream
+	// for each of the given subjects in a single request, keyed by subject.
+	// Subjects without messages are omitted from the result.
+	// The stream must have been created/updated with the AllowDirect boolean and
+	// the server must support batched direct gets.
+	GetLastMsgsForSubjects(name string, subjects []string, opts ...JSOpt) (map[string]*RawStreamMsg, error)
+
 	// DeleteMsg deletes a message from a stream. The message is marked as erased, but its value is not overwritten.
 	DeleteMsg(name string, seq uint64, opts ...JSOpt) error
 
@@ -69,18 +126,115 @@ type JetStreamManager interface {
 	// As a result, this operation is slower than DeleteMsg()
 	SecureDeleteMsg(name string, seq uint64, opts ...JSOpt) error
 
+	// DeleteMsgRange deletes the messages with sequences from first to last
+	// (inclusive) from a stream, issuing concurrent delete requests. Sequences
+	// without a message are skipped, the stream info is requested first to
+	// limit the range to the sequences of the stream. It returns the number
+	// of deleted messages.
+	// If some messages could not be deleted, a *DeleteMsgRangeError is returned.
+	// Deletion stops when the context (see nats.Context()) is done.
+	DeleteMsgRange(name string, first, last uint64, opts ...JSOpt) (uint64, error)
+
+	// CountMessages returns the number of messages in a stream matching the
+	// subject filter, starting at the given sequence. The count is obtained
+	// from a short-lived ephemeral consumer, no message is fetched. An empty
+	// subject counts all messages, a sequence of 0 counts from the start.
+	CountMessages(name, subject string, since uint64, opts ...JSOpt) (uint64, error)
+
 	// AddConsumer adds a consumer to a stream.
+	// If the consumer already exists with the same configuration, its info is
+	// returned. If the configuration differs, ErrConsumerExists is returned.
+	// The returned info always has the consumer name set, including the name
+	// generated by the server for ephemeral consumers, so that the consumer
+	// can be bound to or looked up without another request. Use
+	// ConsumerInfo.StartSequence() and StartSkipped() to check whether the
+	// consumer starts after the requested start sequence or time, when the
+	// older messages were already removed from the stream.
 	AddConsumer(stream string, cfg *ConsumerConfig, opts ...JSOpt) (*ConsumerInfo, error)
 
 	// UpdateConsumer updates an existing consumer.
+	// If the deliver subject of a push consumer is changed, subscriptions
+	// bound to it are moved to the new subject.
+	// Starting with nats-server v2.10.0, the FilterSubject or FilterSubjects
+	// of a consumer can be changed. The server does not reset the delivery:
+	// the consumer keeps its current position and delivered sequences, and
+	// continues with the messages matching the new filter after it. Only
+	// NumPending of the returned info is computed again for the new filter.
+	// Use ResetConsumer() to also deliver the earlier messages.
 	UpdateConsumer(stream string, cfg *ConsumerConfig, opts ...JSOpt) (*ConsumerInfo, error)
 
+	// ResetConsumer makes an existing consumer deliver again starting at the
+	// given stream sequence. The consumer is rewound by the server, keeping
+	// its name and configuration. The sequence must be within the messages
+	// retained by the stream, otherwise ErrInvalidStartPosition is returned.
+	// The server only allows to rewind consumers delivering all messages, or
+	// from a start sequence or time, not before that start. Consumer resets
+	// require nats-server v2.14.0 or later, ErrFeatureNotSupported is returned
+	// otherwise.
+	ResetConsumer(stream, consumer string, seq uint64, opts ...JSOpt) (*ConsumerInfo, error)
+
+	// ResetConsumerToTime is like ResetConsumer, but starts at the first
+	// message stored at or after the given time.
+	ResetConsumerToTime(stream, consumer string, start time.Time, opts ...JSOpt) (*ConsumerInfo, error)
+
+	// WorkQueueConsumer returns the consumer of a work queue stream claiming
+	// the messages matching filter, creating a durable consumer if none exists.
+	// Work queue streams allow a single consumer per subject, so if another
+	// consumer has a filter overlapping with filter, ErrConsumerFilterOverlap
+	// is returned. An empty filter claims all the subjects of the stream.
+	WorkQueueConsumer(stream, filter string, opts ...JSOpt) (*ConsumerInfo, error)
+
+	// ApplyConsumerConfigs creates or updates a set of consumers of a
+	// stream, like ApplyStreamConfigs(). Consumers are identified by their
+	// Durable or Name.
+	ApplyConsumerConfigs(stream string, cfgs []*ConsumerConfig, opts ...JSOpt) []ApplyResult
+
 	// DeleteConsumer deletes a consumer.
 	DeleteConsumer(stream, consumer string, opts ...JSOpt) error
 
+	// DeleteAllConsumers deletes all the consumers of a stream, with a
+	// bounded concurrency, reporting ApplyDeleted or the error of each
+	// consumer. An error is returned if the consumers could not be listed.
+	// Consumers not deleted before the context given as option is done are
+	// reported as failed. Consumers already gone are reported as deleted.
+	DeleteAllConsumers(stream string, opts ...JSOpt) ([]ApplyResult, error)
+
 	// ConsumerInfo retrieves information of a consumer from a stream.
 	ConsumerInfo(stream, name string, opts ...JSOpt) (*ConsumerInfo, error)
 
+	// ConsumerExists reports whether a consumer with the given name exists on a stream.
+	ConsumerExists(stream, name string, opts ...JSOpt) (bool, error)
+
+	// WaitForConsumerLag polls the info of a consumer until its number of
+	// pending messages is below threshold, and returns that number. Polling
+	// stops when the context or timeout given as option (by default the one
+	// of the JetStream context) expires, in which case the last known number
+	// of pending messages is returned along with the error.
+	WaitForConsumerLag(stream, name string, threshold uint64, opts ...JSOpt) (uint64, error)
+
+	// AckSamples subscribes to the ack samples emitted by the server for a
+	// consumer configured with a SampleFrequency, invoking cb for each.
+	// Samples which can not be decoded are skipped. The returned
+	// subscription can be used to stop receiving samples.
+	AckSamples(stream, consumer string, cb func(*ConsumerAckSample)) (*Subscription, error)
+
+	// Advisories subscribes to the advisories emitted by JetStream, invoking
+	// cb for each. The filter restricts the advisories to the subjects
+	// matching it after the $JS.EVENT.ADVISORY. prefix, e.g.
+	// "CONSUMER.MAX_DELIVERIES.>". An empty filter receives all advisories.
+	Advisories(filter string, cb func(*Advisory)) (*Subscription, error)
+
+	// OnMaxDeliveries subscribes to the advisories emitted when a message of
+	// a consumer reached its maximum number of deliveries, invoking cb with
+	// each. The message can then be retrieved with GetMsg() using the
+	// stream sequence of the advisory, e.g. to move it to a dead letter stream.
+	OnMaxDeliveries(stream, consumer string, cb func(*MaxDeliveriesAdvisory)) (*Subscription, error)
+
+	// ConsumerNextSubject returns the subject to which pull requests for a
+	// consumer are sent, taking the API prefix or domain of the context
+	// into account.
+	ConsumerNextSubject(stream, name string) (string, error)
+
 	// ConsumersInfo is used to retrieve a list of ConsumerInfo objects.
 	// DEPRECATED: Use Consumers() instead.
 	ConsumersInfo(stream string, opts ...JSOpt) <-chan *ConsumerInfo
@@ -88,6 +242,17 @@ type JetStreamManager interface {
 	// Consumers is used to retrieve a list of ConsumerInfo objects.
 	Consumers(stream string, opts ...JSOpt) <-chan *ConsumerInfo
 
+	// AllConsumers retrieves the ConsumerInfo objects of all the consumers of
+	// a stream, fetching all the pages of the consumer list. Unlike Consumers(),
+	// it reports the errors, and all the requests share the context or timeout
+	// given as option.
+	AllConsumers(stream string, opts ...JSOpt) ([]*ConsumerInfo, error)
+
+	// ConsumersPage retrieves a single page of ConsumerInfo objects, starting
+	// at the given offset, along with the total number of consumers. Unlike
+	// Consumers(), it does not fetch the following pages.
+	ConsumersPage(stream string, offset int, opts ...JSOpt) (*ConsumerInfoPage, error)
+
 	// ConsumerNames is used to retrieve a list of Consumer names.
 	ConsumerNames(stream string, opts ...JSOpt) <-chan string
 
@@ -96,6 +261,10 @@ type JetStreamManager interface {
 
 	// StreamNameBySubject returns a stream matching given subject.
 	StreamNameBySubject(string, ...JSOpt) (string, error)
+
+	// ServerVersion returns the version of the connected server. APIs
+	// requiring a newer server return ErrFeatureNotSupported.
+	ServerVersion() (string, error)
 }
 
 // StreamConfig will determine the properties for a stream.
@@ -136,6 +305,92 @@ type StreamConfig struct {
 	MirrorDirect bool `json:"mirror_direct"`
 }
 
+// Validate runs the checks done by AddStream() and UpdateStream() before
+// sending the configuration to the server.
+func (cfg *StreamConfig) Validate() error {
+	if cfg == nil {
+		return ErrStreamConfigRequired
+	}
+	if err := checkStreamName(cfg.Name); err != nil {
+		return err
+	}
+	if err := cfg.checkOrigins(); err != nil {
+		return err
+	}
+	return cfg.Placement.validate()
+}
+
+// checkOrigins checks the mirror and the sources of the stream, which the
+// server would reject with less context.
+func (cfg *StreamConfig) checkOrigins() error {
+	if cfg.Mirror != nil {
+		if cfg.Mirror.Name == _EMPTY_ {
+			return fmt.Errorf("%w: mirror requires a stream name", ErrInvalidStreamConfig)
+		}
+		if len(cfg.Sources) > 0 {
+			return fmt.Errorf("%w: a mirror can not also have sources", ErrInvalidStreamConfig)
+		}
+		if len(cfg.Subjects) > 0 {
+			return fmt.Errorf("%w: a mirror can not have subjects", ErrInvalidStreamConfig)
+		}
+	}
+	for i, src := range cfg.Sources {
+		if src == nil || src.Name == _EMPTY_ {
+			return fmt.Errorf("%w: source %d requires a stream name", ErrInvalidStreamConfig, i)
+		}
+	}
+	return nil
+}
+
+// MarshalRequest validates the configuration and returns the JSON payload
+// sent by AddStream() when no custom codec is set. The payload can be
+// decoded back into a StreamConfig with json.Unmarshal().
+func (cfg *StreamConfig) MarshalRequest() ([]byte, error) {
+	ncfg, err := cfg.createRequest()
+	if err != nil {
+		return nil, err
+	}
+	return json.Marshal(ncfg)
+}
+
+// createRequest validates the configuration and returns the one sent to
+// create the stream, with the domains of the mirror and sources converted
+// to API prefixes. The caller's configuration is not modified.
+func (cfg *StreamConfig) createRequest() (*StreamConfig, error) {
+	if err := cfg.Validate(); err != nil {
+		return nil, err
+	}
+	// In case we need to change anything, copy so we do not change the caller's version.
+	ncfg := *cfg
+
+	// An empty placement is not sent.
+	if ncfg.Placement.isEmpty() {
+		ncfg.Placement = nil
+	}
+
+	// If we have a mirror and an external domain, convert to ext.APIPrefix.
+	if cfg.Mirror != nil && cfg.Mirror.Domain != _EMPTY_ {
+		// Copy so we do not change the caller's version.
+		ncfg.Mirror = ncfg.Mirror.copy()
+		if err := ncfg.Mirror.convertDomain(); err != nil {
+			return nil, err
+		}
+	}
+	// Check sources for the same.
+	if len(ncfg.Sources) > 0 {
+		ncfg.Sources = append([]*StreamSource(nil), ncfg.Sources...)
+		for i, ss := range ncfg.Sources {
+			if ss.Domain != _EMPTY_ {
+				ncfg.Sources[i] = ss.copy()
+				if err := ncfg.Sources[i].convertDomain(); err != nil {
+					return nil, err
+				}
+			}
+		}
+	}
+	return &ncfg, nil
+}
+
 // RePublish is for republishing messages once committed to a stream. The original
 // subject cis remapped from the subject pattern to the destination pattern.
 type RePublish struct {
@@ -144,12 +399,99 @@ type RePublish struct {
 	HeadersOnly bool   `json:"headers_only,omitempty"`
 }
 
+// RePublishMeta holds the information the server adds to the headers of a
+// republished message.
+type RePublishMeta struct {
+	// Stream is the name of the stream the message was stored in.
+	Stream string
+	// Subject is the original subject of the message.
+	Subject string
+	// Sequence is the stream sequence of the message.
+	Sequence uint64
+	// LastSequence is the stream sequence of the previous message on the
+	// same subject, 0 if there is none.
+	LastSequence uint64
+	// Size is the size of the message payload when the stream republishes
+	// headers only, -1 otherwise.
+	Size int
+}
+
+// ParseRePublishHeaders extracts the RePublishMeta from the headers of a
+// message received on the destination of a stream RePublish.
+func ParseRePublishHeaders(m *Msg) (*RePublishMeta, error) {
+	if m == nil || len(m.Header) == 0 {
+		return nil, fmt.Errorf("nats: message should have headers")
+	}
+	meta := &RePublishMeta{
+		Stream:  m.Header.Get(JSStream),
+		Subject: m.Header.Get(JSSubject),
+		Size:    -1,
+	}
+	if meta.Stream == _EMPTY_ {
+		return nil, fmt.Errorf("nats: missing stream header")
+	}
+	if meta.Subject == _EMPTY_ {
+		return nil, fmt.Errorf("nats: missing subject header")
+	}
+	var err error
+	if meta.Sequence, err = parseSeqHeader(m.Header, JSSequence); err != nil {
+		return nil, err
+	}
+	if meta.LastSequence, err = parseSeqHeader(m.Header, JSLastSequence); err != nil {
+		return nil, err
+	}
+	if sizeStr := m.Header.Get(MsgSize); sizeStr != _EMPTY_ {
+		if meta.Size, err = strconv.Atoi(sizeStr); err != nil {
+			return nil, fmt.Errorf("nats: invalid size header '%s': %v", sizeStr, err)
+		}
+	}
+	return meta, nil
+}
+
+// parseSeqHeader parses the sequence held in the given header.
+func parseSeqHeader(h Header, key string) (uint64, error) {
+	seqStr := h.Get(key)
+	if seqStr == _EMPTY_ {
+		return 0, fmt.Errorf("nats: missing %s header", key)
+	}
+	seq, err := strconv.ParseUint(seqStr, 10, 64)
+	if err != nil {
+		return 0, fmt.Errorf("nats: invalid %s header '%s': %v", key, seqStr, err)
+	}
+	return seq, nil
+}
+
 // Placement is used to guide placement of streams in clustered JetStream.
+// At least one of Cluster or Tags must be set. The placement that was
+// actually resolved by the server is reported in StreamInfo.Cluster.
 type Placement struct {
 	Cluster string   `json:"cluster"`
 	Tags    []string `json:"tags,omitempty"`
 }
 
+// isEmpty reports whether the placement has neither a cluster nor tags,
+// which is the same as no placement.
+func (p *Placement) isEmpty() bool {
+	return p == nil || (p.Cluster == _EMPTY_ && p.Tags == nil)
+}
+
+// validate checks that the placement, if any, targets a cluster or a
+// non-empty set of tags.
+func (p *Placement) validate() error {
+	if p.isEmpty() {
+		return nil
+	}
+	if p.Tags != nil && len(p.Tags) == 0 {
+		return fmt.Errorf("%w: tags can not be empty when set", ErrInvalidPlacement)
+	}
+	for _, tag := range p.Tags {
+		if tag == _EMPTY_ {
+			return fmt.Errorf("%w: tags can not contain an empty tag", ErrInvalidPlacement)
+		}
+	}
+	return nil
+}
+
 // StreamSource dictates how streams can source from other streams.
 type StreamSource struct {
 	Name          string          `json:"name"`
@@ -203,6 +545,10 @@ type apiResponse struct {
 	Error *APIError `json:"error,omitempty"`
 }
 
+func (r *apiResponse) apiError() *APIError {
+	return r.Error
+}
+
 // apiPaged includes variables used to create paged responses from the JSON API
 type apiPaged struct {
 	Total  int `json:"total"`
@@ -210,6 +556,28 @@ type apiPaged struct {
 	Limit  int `json:"limit"`
 }
 
+// ListPage describes a page of results of a list request.
+type ListPage struct {
+	// Total is the total number of items.
+	Total int
+	// Offset is the offset of the first item of the page.
+	Offset int
+	// Limit is the maximum number of items returned in a page.
+	Limit int
+}
+
+// StreamInfoPage is a page of StreamInfo objects returned by StreamsPage().
+type StreamInfoPage struct {
+	ListPage
+	Streams []*StreamInfo
+}
+
+// ConsumerInfoPage is a page of ConsumerInfo objects returned by ConsumersPage().
+type ConsumerInfoPage struct {
+	ListPage
+	Consumers []*ConsumerInfo
+}
+
 // apiPagedRequest includes parameters allowing specific pages to be requested
 // from APIs responding with apiPaged.
 type apiPagedRequest struct {
@@ -276,7 +644,7 @@ func (js *js) AccountInfo(opts ...JSOpt) (*AccountInfo, error) {
 		return nil, err
 	}
 	var info accountInfoResponse
-	if err := json.Unmarshal(resp.Data, &info); err != nil {
+	if err := js.unmarshal(resp.Data, &info); err != nil {
 		return nil, err
 	}
 	if info.Error != nil {
@@ -290,11 +658,57 @@ func (js *js) AccountInfo(opts ...JSOpt) (*AccountInfo, error) {
 	return &info.AccountInfo, nil
 }
 
+// ServerVersion returns the version of the connected server, as reported
+// when the connection was established.
+func (js *js) ServerVersion() (string, error) {
+	if js.nc.IsClosed() {
+		return _EMPTY_, ErrConnectionClosed
+	}
+	v := js.nc.ConnectedServerVersion()
+	if v == _EMPTY_ {
+		return _EMPTY_, ErrConnectionReconnecting
+	}
+	return v, nil
+}
+
+// checkServerVersion returns ErrFeatureNotSupported, naming the minimum
+// version, if the connected server is older than the one required by the
+// feature. The check is skipped if the version is unknown, e.g. while
+// reconnecting, leaving it to the server.
+func (js *js) checkServerVersion(feature string, major, minor, patch int) error {
+	if js.nc.ConnectedServerVersion() == _EMPTY_ || js.nc.serverMinVersion(major, minor, patch) {
+		return nil
+	}
+	return fmt.Errorf("%w: %s requires nats-server v%d.%d.%d or later", ErrFeatureNotSupported, feature, major, minor, patch)
+}
+
 type createConsumerRequest struct {
 	Stream string          `json:"stream_name"`
 	Config *ConsumerConfig `json:"config"`
 }
 
+// Validate runs the checks done by AddConsumer() and UpdateConsumer() before
+// sending the configuration to the server.
+func (cfg *ConsumerConfig) Validate() error {
+	if cfg == nil {
+		return ErrConsumerConfigRequired
+	}
+	return checkConsumerConfig(cfg)
+}
+
+// MarshalRequest validates the configuration and returns the JSON payload
+// sent by AddConsumer() to create the consumer on the given stream when no
+// custom codec is set.
+func (cfg *ConsumerConfig) MarshalRequest(stream string) ([]byte, error) {
+	if err := checkStreamName(stream); err != nil {
+		return nil, err
+	}
+	if err := cfg.Validate(); err != nil {
+		return nil, err
+	}
+	return json.Marshal(&createConsumerRequest{Stream: stream, Config: cfg})
+}
+
 type consumerResponse struct {
 	apiResponse
 	*ConsumerInfo
@@ -305,6 +719,9 @@ func (js *js) AddConsumer(stream string, cfg *ConsumerConfig, opts ...JSOpt) (*C
 	if cfg == nil {
 		cfg = &ConsumerConfig{}
 	}
+	if err := checkConsumerConfig(cfg); err != nil {
+		return nil, err
+	}
 	consumerName := cfg.Name
 	if consumerName == _EMPTY_ {
 		consumerName = cfg.Durable
@@ -318,20 +735,30 @@ func (js *js) AddConsumer(stream string, cfg *ConsumerConfig, opts ...JSOpt) (*C
 		if consInfo != nil {
 			sameConfig := checkConfig(&consInfo.Config, cfg)
 			if sameConfig != nil {
-				return nil, fmt.Errorf("%w: creating consumer %q on stream %q", ErrConsumerNameAlreadyInUse, consumerName, stream)
+				return nil, fmt.Errorf("%w: creating consumer %q on stream %q: %v", ErrConsumerExists, consumerName, stream, sameConfig)
 			} else {
 				return consInfo, nil
 			}
 		}
 	}
 
-	return js.upsertConsumer(stream, consumerName, cfg, opts...)
+	info, err := js.upsertConsumer(stream, consumerName, cfg, opts...)
+	// The consumer may have been created with a different configuration
+	// after it was looked up.
+	var apiErr *APIError
+	if errors.As(err, &apiErr) && (apiErr.ErrorCode == JSErrCodeConsumerNameExists || apiErr.ErrorCode == JSErrCodeConsumerAlreadyExists) {
+		return nil, fmt.Errorf("%w: creating consumer %q on stream %q: %v", ErrConsumerExists, consumerName, stream, apiErr.Description)
+	}
+	return info, err
 }
 
 func (js *js) UpdateConsumer(stream string, cfg *ConsumerConfig, opts ...JSOpt) (*ConsumerInfo, error) {
 	if cfg == nil {
 		return nil, ErrConsumerConfigRequired
 	}
+	if err := checkConsumerConfig(cfg); err != nil {
+		return nil, err
+	}
 	consumerName := cfg.Name
 	if consumerName == _EMPTY_ {
 		consumerName = cfg.Durable
@@ -339,13 +766,24 @@ func (js *js) UpdateConsumer(stream string, cfg *ConsumerConfig, opts ...JSOpt)
 	if consumerName == _EMPTY_ {
 		return nil, ErrConsumerNameRequired
 	}
-	return js.upsertConsumer(stream, consumerName, cfg, opts...)
+	info, err := js.upsertConsumer(stream, consumerName, cfg, opts...)
+	if err != nil {
+		return nil, err
+	}
+	// Keep push subscriptions receiving if the deliver subject changed.
+	js.rebindSubs(stream, info)
+	return info, nil
 }
 
 func (js *js) upsertConsumer(stream, consumerName string, cfg *ConsumerConfig, opts ...JSOpt) (*ConsumerInfo, error) {
 	if err := checkStreamName(stream); err != nil {
 		return nil, err
 	}
+	if len(cfg.FilterSubjects) > 0 {
+		if err := js.checkServerVersion("multiple filter subjects", 2, 10, 0); err != nil {
+			return nil, err
+		}
+	}
 	o, cancel, err := getJSContextOpts(js.opts, opts...)
 	if err != nil {
 		return nil, err
@@ -354,7 +792,7 @@ func (js *js) upsertConsumer(stream, consumerName string, cfg *ConsumerConfig, o
 		defer cancel()
 	}
 
-	req, err := json.Marshal(&createConsumerRequest{Stream: stream, Config: cfg})
+	req, err := js.marshal(&createConsumerRequest{Stream: stream, Config: cfg})
 	if err != nil {
 		return nil, err
 	}
@@ -385,7 +823,7 @@ func (js *js) upsertConsumer(stream, consumerName string, cfg *ConsumerConfig, o
 		return nil, err
 	}
 	var info consumerResponse
-	err = json.Unmarshal(resp.Data, &info)
+	err = js.unmarshal(resp.Data, &info)
 	if err != nil {
 		return nil, err
 	}
@@ -396,8 +834,30 @@ func (js *js) upsertConsumer(stream, consumerName string, cfg *ConsumerConfig, o
 		if errors.Is(info.Error, ErrConsumerNotFound) {
 			return nil, ErrConsumerNotFound
 		}
+		if errors.Is(info.Error, ErrMaxConsumersReached) {
+			// The limit is not part of the error, report the one
+			// of the stream if it can be looked up.
+			if si, err := js.StreamInfo(stream, Context(o.ctx)); err == nil && si.Config.MaxConsumers > 0 {
+				return nil, fmt.Errorf("%w: stream %q allows %d consumers", ErrMaxConsumersReached, stream, si.Config.MaxConsumers)
+			}
+			return nil, ErrMaxConsumersReached
+		}
 		return nil, info.Error
 	}
+	if info.ConsumerInfo == nil {
+		return nil, fmt.Errorf("nats: empty response creating consumer on stream %q", stream)
+	}
+	// Servers always report the name, fill it from the request to be safe.
+	if info.Name == _EMPTY_ {
+		if consumerName == _EMPTY_ {
+			return nil, fmt.Errorf("nats: no consumer name in response creating consumer on stream %q", stream)
+		}
+		info.Name = consumerName
+	}
+	if info.Stream == _EMPTY_ {
+		info.Stream = stream
+	}
+	js.warnConsumerBackOff(cfg)
 	return info.ConsumerInfo, nil
 }
 
@@ -430,6 +890,143 @@ func checkConsumerName(consumer string) error {
 	return nil
 }
 
+// Check that the consumer configuration is consistent before sending it to the server.
+// Returns ErrInvalidConsumerConfig wrapped with a description of the issue.
+func checkConsumerConfig(cfg *ConsumerConfig) error {
+	if cfg.Name != _EMPTY_ && cfg.Durable != _EMPTY_ && cfg.Name != cfg.Durable {
+		return fmt.Errorf("%w: name %q and durable name %q must match when both are set", ErrInvalidConsumerConfig, cfg.Name, cfg.Durable)
+	}
+	if cfg.DeliverGroup != _EMPTY_ && cfg.DeliverSubject == _EMPTY_ {
+		return fmt.Errorf("%w: deliver group %q requires a deliver subject (push consumer)", ErrInvalidConsumerConfig, cfg.DeliverGroup)
+	}
+	if cfg.MaxAckPending < -1 {
+		return fmt.Errorf("%w: max ack pending must be -1 (unlimited) or greater", ErrInvalidConsumerConfig)
+	}
+	if cfg.MaxWaiting < 0 {
+		return fmt.Errorf("%w: max waiting can not be negative", ErrInvalidConsumerConfig)
+	}
+	if cfg.MaxDeliver < -1 {
+		return fmt.Errorf("%w: max deliver must be -1 (unlimited) or greater", ErrInvalidConsumerConfig)
+	}
+	if cfg.RateLimit > 0 && cfg.DeliverSubject == _EMPTY_ {
+		return fmt.Errorf("%w: rate limit is only valid for push consumers", ErrInvalidConsumerConfig)
+	}
+	if cfg.MaxWaiting > 0 && cfg.DeliverSubject != _EMPTY_ {
+		return fmt.Errorf("%w: max waiting is only valid for pull consumers", ErrInvalidConsumerConfig)
+	}
+	if cfg.FilterSubject != _EMPTY_ && len(cfg.FilterSubjects) > 0 {
+		return fmt.Errorf("%w: filter subject and filter subjects can not both be set", ErrInvalidConsumerConfig)
+	}
+	for _, subj := range cfg.FilterSubjects {
+		if subj == _EMPTY_ {
+			return fmt.Errorf("%w: filter subjects can not contain an empty subject", ErrInvalidConsumerConfig)
+		}
+	}
+	if cfg.DeliverPolicy == DeliverLastPerSubjectPolicy && cfg.FilterSubject == _EMPTY_ && len(cfg.FilterSubjects) == 0 {
+		return fmt.Errorf("%w: deliver policy last per subject requires a filter subject", ErrInvalidConsumerConfig)
+	}
+	if err := checkConsumerFlowControl(cfg); err != nil {
+		return err
+	}
+	if err := checkConsumerBackOff(cfg); err != nil {
+		return err
+	}
+	return checkConsumerAckPolicy(cfg)
+}
+
+// Check that the backoff values are not negative, as the server does.
+func checkConsumerBackOff(cfg *ConsumerConfig) error {
+	for _, d := range cfg.BackOff {
+		if d < 0 {
+			return fmt.Errorf("%w: backoff values can not be negative, got %v", ErrInvalidConsumerConfig, d)
+		}
+	}
+	return nil
+}
+
+// warnConsumerBackOff notifies the asynchronous error handler with
+// ErrAckWaitBelowBackOff if the ack wait of the configuration is smaller
+// than its largest backoff value. The server accepts such configurations,
+// but replaces the ack wait with the first backoff value.
+func (js *js) warnConsumerBackOff(cfg *ConsumerConfig) {
+	if cfg.AckWait <= 0 || len(cfg.BackOff) == 0 {
+		return
+	}
+	largest := cfg.BackOff[0]
+	for _, d := range cfg.BackOff[1:] {
+		if d > largest {
+			largest = d
+		}
+	}
+	if cfg.AckWait >= largest {
+		return
+	}
+	err := fmt.Errorf("%w: ack wait of %v is below backoff of %v and replaced by %v", ErrAckWaitBelowBackOff, cfg.AckWait, largest, cfg.BackOff[0])
+	nc := js.nc
+	nc.mu.Lock()
+	if errCB := nc.Opts.AsyncErrorCB; errCB != nil {
+		nc.ach.push(func() { errCB(nc, nil, err) })
+	}
+	nc.mu.Unlock()
+}
+
+// ackWait returns the ack wait the server applies for the configuration:
+// the first backoff value if any, else the ack wait if set, else the
+// server's default.
+func (cfg *ConsumerConfig) ackWait() time.Duration {
+	switch {
+	case len(cfg.BackOff) > 0:
+		return cfg.BackOff[0]
+	case cfg.AckWait > 0:
+		return cfg.AckWait
+	default:
+		return defaultAckWait
+	}
+}
+
+// Check that flow control and idle heartbeats are only used with push
+// consumers, and that flow control is used with idle heartbeats, which
+// the server relies on to resend stalled flow control requests.
+func checkConsumerFlowControl(cfg *ConsumerConfig) error {
+	if cfg.DeliverSubject == _EMPTY_ {
+		if cfg.FlowControl {
+			return fmt.Errorf("%w: flow control is only valid for push consumers", ErrInvalidConsumerConfig)
+		}
+		if cfg.Heartbeat > 0 {
+			return fmt.Errorf("%w: idle heartbeat is only valid for push consumers", ErrInvalidConsumerConfig)
+		}
+	}
+	if cfg.FlowControl && cfg.Heartbeat <= 0 {
+		return fmt.Errorf("%w: flow control requires an idle heartbeat", ErrInvalidConsumerConfig)
+	}
+	return nil
+}
+
+// Check that the ack policy is compatible with the rest of the consumer configuration.
+// The server rejects or silently ignores most of these, so describe the conflict here.
+func checkConsumerAckPolicy(cfg *ConsumerConfig) error {
+	switch cfg.AckPolicy {
+	case AckNonePolicy:
+		// Messages are considered acknowledged once delivered, so they are never redelivered.
+		if cfg.MaxDeliver > 1 {
+			return fmt.Errorf("%w: max deliver of %d has no effect with ack policy none, messages are never redelivered", ErrInvalidConsumerConfig, cfg.MaxDeliver)
+		}
+		if len(cfg.BackOff) > 0 {
+			return fmt.Errorf("%w: backoff has no effect with ack policy none, messages are never redelivered", ErrInvalidConsumerConfig)
+		}
+		if cfg.MaxAckPending > 0 {
+			return fmt.Errorf("%w: max ack pending has no effect with ack policy none, there are no pending acks", ErrInvalidConsumerConfig)
+		}
+	case AckAllPolicy:
+		// Members of the group receive interleaved sequences, so an ack from one
+		// member would acknowledge messages still being processed by others.
+		if cfg.DeliverGroup != _EMPTY_ {
+			return fmt.Errorf("%w: ack policy all can not be used with deliver group %q, acks from one member would acknowledge messages delivered to others", ErrInvalidConsumerConfig, cfg.DeliverGroup)
+		}
+	}
+	return nil
+}
+
 // DeleteConsumer deletes a Consumer.
 func (js *js) DeleteConsumer(stream, consumer string, opts ...JSOpt) error {
 	if err := checkStreamName(stream); err != nil {
@@ -451,8 +1048,9 @@ func (js *js) DeleteConsumer(stream, consumer string, opts ...JSOpt) error {
 	if err != nil {
 		return err
 	}
+	js.uncacheKey(js.cacheKey(cacheConsumerKey, stream+"."+consumer))
 	var resp consumerDeleteResponse
-	if err := json.Unmarshal(r.Data, &resp); err != nil {
+	if err := js.unmarshal(r.Data, &resp); err != nil {
 		return err
 	}
 
@@ -465,73 +1063,527 @@ func (js *js) DeleteConsumer(stream, consumer string, opts ...JSOpt) error {
 	return nil
 }
 
-// ConsumerInfo returns information about a Consumer.
-func (js *js) ConsumerInfo(stream, consumer string, opts ...JSOpt) (*ConsumerInfo, error) {
+type consumerResetRequest struct {
+	Seq uint64 `json:"seq,omitempty"`
+}
+
+type consumerResetResponse struct {
+	apiResponse
+	*ConsumerInfo
+}
+
+// ResetConsumer rewinds a Consumer on the server, delivering again from the
+// given stream sequence.
+func (jsc *js) ResetConsumer(stream, consumer string, seq uint64, opts ...JSOpt) (*ConsumerInfo, error) {
+	return jsc.resetConsumer(stream, consumer, func(js *js, ctx context.Context, si *StreamInfo) (uint64, error) {
+		if seq == 0 || seq < si.State.FirstSeq || seq > si.State.LastSeq+1 {
+			return 0, fmt.Errorf("%w: sequence %d is not in range [%d, %d]", ErrInvalidStartPosition, seq, si.State.FirstSeq, si.State.LastSeq+1)
+		}
+		return seq, nil
+	}, opts...)
+}
+
+// ResetConsumerToTime rewinds a Consumer on the server, delivering again
+// from the first message stored at or after the given start time.
+func (jsc *js) ResetConsumerToTime(stream, consumer string, start time.Time, opts ...JSOpt) (*ConsumerInfo, error) {
+	return jsc.resetConsumer(stream, consumer, func(js *js, ctx context.Context, si *StreamInfo) (uint64, error) {
+		if start.Before(si.State.FirstTime) || start.After(js.clock().Now()) {
+			return 0, fmt.Errorf("%w: time %v is before the first message or in the future", ErrInvalidStartPosition, start)
+		}
+		m, err := js.getMsg(stream, &apiMsgGetRequest{StartTime: &start}, Context(ctx))
+		if errors.Is(err, ErrMsgNotFound) {
+			// Nothing was stored since then.
+			return si.State.LastSeq + 1, nil
+		}
+		if err != nil {
+			return 0, err
+		}
+		return m.Sequence, nil
+	}, opts...)
+}
+
+func (jsc *js) resetConsumer(stream, consumer string, startSeq func(*js, context.Context, *StreamInfo) (uint64, error), opts ...JSOpt) (*ConsumerInfo, error) {
 	if err := checkStreamName(stream); err != nil {
 		return nil, err
 	}
 	if err := checkConsumerName(consumer); err != nil {
 		return nil, err
 	}
-	o, cancel, err := getJSContextOpts(js.opts, opts...)
+	if err := jsc.checkServerVersion("consumer reset", 2, 14, 0); err != nil {
+		return nil, err
+	}
+	o, cancel, err := getJSContextOpts(jsc.opts, opts...)
 	if err != nil {
 		return nil, err
 	}
 	if cancel != nil {
 		defer cancel()
 	}
-	return js.getConsumerInfoContext(o.ctx, stream, consumer)
-}
-
-// consumerLister fetches pages of ConsumerInfo objects. This object is not
-// safe to use for multiple threads.
-type consumerLister struct {
-	stream string
-	js     *js
-
-	err      error
-	offset   int
-	page     []*ConsumerInfo
-	pageInfo *apiPaged
-}
-
-// consumersRequest is the type used for Consumers requests.
-type consumersRequest struct {
-	apiPagedRequest
-}
-
-// consumerListResponse is the response for a Consumers List request.
-type consumerListResponse struct {
-	apiResponse
-	apiPaged
-	Consumers []*ConsumerInfo `json:"consumers"`
-}
 
-// Next fetches the next ConsumerInfo page.
-func (c *consumerLister) Next() bool {
-	if c.err != nil {
-		return false
-	}
-	if err := checkStreamName(c.stream); err != nil {
-		c.err = err
-		return false
+	js := jsc.withPrefix(o)
+	si, err := js.StreamInfo(stream, Context(o.ctx))
+	if err != nil {
+		return nil, err
 	}
-	if c.pageInfo != nil && c.offset >= c.pageInfo.Total {
-		return false
+	seq, err := startSeq(js, o.ctx, si)
+	if err != nil {
+		return nil, err
 	}
-
-	req, err := json.Marshal(consumersRequest{
-		apiPagedRequest: apiPagedRequest{Offset: c.offset},
-	})
+	req, err := js.marshal(&consumerResetRequest{Seq: seq})
 	if err != nil {
-		c.err = err
-		return false
+		return nil, err
 	}
 
-	var cancel context.CancelFunc
-	ctx := c.js.opts.ctx
+	// The consumer is only answering reset requests on servers supporting them.
+	rsSubj := js.apiSubj(fmt.Sprintf(apiConsumerResetT, stream, consumer))
+	r, err := js.apiRequestWithContext(o.ctx, rsSubj, req)
+	if err != nil {
+		if err == ErrNoResponders {
+			if _, err := js.ConsumerInfo(stream, consumer, Context(o.ctx)); err != nil {
+				return nil, err
+			}
+			err = fmt.Errorf("%w: consumer reset is not supported", ErrFeatureNotSupported)
+		}
+		return nil, err
+	}
+	var resp consumerResetResponse
+	if err := js.unmarshal(r.Data, &resp); err != nil {
+		return nil, err
+	}
+	if resp.Error != nil {
+		if errors.Is(resp.Error, ErrConsumerNotFound) {
+			return nil, ErrConsumerNotFound
+		}
+		return nil, resp.Error
+	}
+	return resp.ConsumerInfo, nil
+}
+
+// WorkQueueConsumer looks up the consumer of a work queue stream claiming
+// filter, or creates it.
+func (jsc *js) WorkQueueConsumer(stream, filter string, opts ...JSOpt) (*ConsumerInfo, error) {
+	if err := checkStreamName(stream); err != nil {
+		return nil, err
+	}
+	o, cancel, err := getJSContextOpts(jsc.opts, opts...)
+	if err != nil {
+		return nil, err
+	}
+	if cancel != nil {
+		defer cancel()
+	}
+
+	ctx := Context(o.ctx)
+	si, err := jsc.StreamInfo(stream, ctx)
+	if err != nil {
+		return nil, err
+	}
+	if si.Config.Retention != WorkQueuePolicy {
+		return nil, fmt.Errorf("%w: stream %q does not use the work queue retention policy", ErrInvalidArg, stream)
+	}
+
+	claim := filter
+	if claim == _EMPTY_ {
+		claim = ">"
+	}
+	lookup := func() (*ConsumerInfo, error) {
+		l := &consumerLister{js: &js{nc: jsc.nc, opts: o, stats: jsc.stats}, stream: stream}
+		for l.Next() {
+			for _, info := range l.Page() {
+				filters := info.Config.filters()
+				if len(filters) == 1 && filters[0] == claim {
+					return info, nil
+				}
+				for _, f := range filters {
+					if subjectsCollide(f, claim) {
+						return nil, fmt.Errorf("%w: consumer %q filters on %q", ErrConsumerFilterOverlap, info.Name, f)
+					}
+				}
+			}
+		}
+		return nil, l.Err()
+	}
+
+	info, err := lookup()
+	if err != nil || info != nil {
+		return info, err
+	}
+	info, err = jsc.AddConsumer(stream, &ConsumerConfig{
+		Durable:       "wq_" + nuid.Next(),
+		AckPolicy:     AckExplicitPolicy,
+		FilterSubject: filter,
+	}, ctx)
+	var apiErr *APIError
+	if errors.As(err, &apiErr) && (apiErr.ErrorCode == JSErrCodeConsumerWQNotUnique || apiErr.ErrorCode == JSErrCodeConsumerWQUnfiltered) {
+		// Another consumer was created concurrently, bind to it if it
+		// claims the same subjects.
+		info, err = lookup()
+		if err == nil && info == nil {
+			err = ErrConsumerFilterOverlap
+		}
+	}
+	return info, err
+}
+
+// filters returns the filter subjects of the consumer, or the full
+// wildcard if it is not filtered.
+func (cfg *ConsumerConfig) filters() []string {
+	if cfg.FilterSubject != _EMPTY_ {
+		return []string{cfg.FilterSubject}
+	}
+	if len(cfg.FilterSubjects) > 0 {
+		return cfg.FilterSubjects
+	}
+	return []string{">"}
+}
+
+// Matches reports whether messages on the given subject are delivered by
+// a consumer with this configuration, according to its filter subjects.
+// A consumer without filter subjects matches all subjects.
+func (cfg *ConsumerConfig) Matches(subject string) bool {
+	for _, filter := range cfg.filters() {
+		if SubjectMatch(filter, subject) {
+			return true
+		}
+	}
+	return false
+}
+
+// ConsumerInfo returns information about a Consumer.
+func (js *js) ConsumerInfo(stream, consumer string, opts ...JSOpt) (*ConsumerInfo, error) {
+	if err := checkStreamName(stream); err != nil {
+		return nil, err
+	}
+	if err := checkConsumerName(consumer); err != nil {
+		return nil, err
+	}
+	o, cancel, err := getJSContextOpts(js.opts, opts...)
+	if err != nil {
+		return nil, err
+	}
+	if cancel != nil {
+		defer cancel()
+	}
+	return js.getConsumerInfoContext(o.ctx, stream, consumer)
+}
+
+// ConsumerExists reports whether a Consumer exists on a Stream.
+// An error is returned only if the lookup itself failed, not if
+// the consumer or the stream were not found.
+func (js *js) ConsumerExists(stream, consumer string, opts ...JSOpt) (bool, error) {
+	o, cancel, err := getJSContextOpts(js.opts, opts...)
+	if err != nil {
+		return false, err
+	}
+	if cancel != nil {
+		defer cancel()
+	}
+	pjs := js.withPrefix(o)
+	key := pjs.cacheKey(cacheConsumerKey, stream+"."+consumer)
+	if _, ok := js.opts.cache.get(key, js.clock().Now()); ok {
+		return true, nil
+	}
+	_, err = pjs.ConsumerInfo(stream, consumer, Context(o.ctx))
+	if err != nil {
+		if errors.Is(err, ErrConsumerNotFound) || errors.Is(err, ErrStreamNotFound) {
+			return false, nil
+		}
+		return false, err
+	}
+	js.opts.cache.put(key, stream, js.clock().Now())
+	return true, nil
+}
+
+const (
+	// Delays between the polls of WaitForConsumerLag(), doubled after
+	// each poll up to the maximum.
+	lagPollInitialWait = 100 * time.Millisecond
+	lagPollMaxWait     = 2 * time.Second
+)
+
+func (js *js) WaitForConsumerLag(stream, consumer string, threshold uint64, opts ...JSOpt) (uint64, error) {
+	if threshold == 0 {
+		return 0, fmt.Errorf("%w: lag threshold must be greater than 0", ErrInvalidArg)
+	}
+	o, cancel, err := getJSContextOpts(js.opts, opts...)
+	if err != nil {
+		return 0, err
+	}
+	if cancel != nil {
+		defer cancel()
+	}
+	ctx, pjs := Context(o.ctx), js.withPrefix(o)
+
+	var pending uint64
+	for wait := lagPollInitialWait; ; {
+		info, err := pjs.ConsumerInfo(stream, consumer, ctx)
+		if err != nil {
+			return pending, err
+		}
+		if pending = info.NumPending; pending < threshold {
+			return pending, nil
+		}
+		select {
+		case <-ctx.Done():
+			return pending, ctx.Err()
+		case <-js.clock().After(wait):
+		}
+		if wait *= 2; wait > lagPollMaxWait {
+			wait = lagPollMaxWait
+		}
+	}
+}
+
+// ConsumerNextSubject returns the pull request subject of a Consumer.
+func (js *js) ConsumerNextSubject(stream, consumer string) (string, error) {
+	if err := checkStreamName(stream); err != nil {
+		return _EMPTY_, err
+	}
+	if err := checkConsumerName(consumer); err != nil {
+		return _EMPTY_, err
+	}
+	return js.apiSubj(fmt.Sprintf(apiRequestNextT, stream, consumer)), nil
+}
+
+// ConsumerAckSample is an ack sample emitted by the server for a consumer
+// with a SampleFrequency, measuring the time a message took to be acknowledged.
+type ConsumerAckSample struct {
+	ID          string    `json:"id"`
+	Time        time.Time `json:"timestamp"`
+	Stream      string    `json:"stream"`
+	Consumer    string    `json:"consumer"`
+	ConsumerSeq uint64    `json:"consumer_seq"`
+	StreamSeq   uint64    `json:"stream_seq"`
+	// Delay is the time between the delivery of the message and its ack.
+	Delay      time.Duration `json:"ack_time"`
+	Deliveries uint64        `json:"deliveries"`
+	Domain     string        `json:"domain,omitempty"`
+}
+
+// AckSamples subscribes to the ack samples of a Consumer.
+func (js *js) AckSamples(stream, consumer string, cb func(*ConsumerAckSample)) (*Subscription, error) {
+	if err := checkStreamName(stream); err != nil {
+		return nil, err
+	}
+	if err := checkConsumerName(consumer); err != nil {
+		return nil, err
+	}
+	if cb == nil {
+		return nil, fmt.Errorf("%w: callback is required", ErrInvalidArg)
+	}
+	return js.nc.Subscribe(fmt.Sprintf(jsAckSampleT, stream, consumer), func(m *Msg) {
+		var sample ConsumerAckSample
+		if err := json.Unmarshal(m.Data, &sample); err != nil {
+			return
+		}
+		cb(&sample)
+	})
+}
+
+// Types of the advisories decoded by Advisories().
+const (
+	StreamActionAdvisoryType          = "io.nats.jetstream.advisory.v1.stream_action"
+	ConsumerActionAdvisoryType        = "io.nats.jetstream.advisory.v1.consumer_action"
+	MaxDeliveriesAdvisoryType         = "io.nats.jetstream.advisory.v1.max_deliver"
+	MsgTerminatedAdvisoryType         = "io.nats.jetstream.advisory.v1.terminated"
+	StreamLeaderElectedAdvisoryType   = "io.nats.jetstream.advisory.v1.stream_leader_elected"
+	ConsumerLeaderElectedAdvisoryType = "io.nats.jetstream.advisory.v1.consumer_leader_elected"
+
+	jsAdvisoryPre = "$JS.EVENT.ADVISORY."
+	// jsMaxDeliveriesT is the subject of the max deliveries advisories of
+	// a consumer, after jsAdvisoryPre.
+	jsMaxDeliveriesT = "CONSUMER.MAX_DELIVERIES.%s.%s"
+)
+
+// Advisory is an advisory emitted by JetStream.
+type Advisory struct {
+	Type    string
+	ID      string
+	Time    time.Time
+	Subject string
+	// Data is the JSON encoding of the advisory.
+	Data []byte
+	// Event is the decoded advisory, one of *StreamActionAdvisory,
+	// *ConsumerActionAdvisory, *MaxDeliveriesAdvisory, *MsgTerminatedAdvisory,
+	// *StreamLeaderElectedAdvisory or *ConsumerLeaderElectedAdvisory. It is
+	// nil for other types of advisories, which can be decoded from Data.
+	Event interface{}
+}
+
+// StreamActionAdvisory is emitted when a stream is created, updated or deleted.
+type StreamActionAdvisory struct {
+	Stream string `json:"stream"`
+	Action string `json:"action"`
+	Domain string `json:"domain,omitempty"`
+}
+
+// ConsumerActionAdvisory is emitted when a consumer is created or deleted.
+type ConsumerActionAdvisory struct {
+	Stream   string `json:"stream"`
+	Consumer string `json:"consumer"`
+	Action   string `json:"action"`
+	Domain   string `json:"domain,omitempty"`
+}
+
+// MaxDeliveriesAdvisory is emitted when a message reached the maximum
+// number of deliveries of a consumer.
+type MaxDeliveriesAdvisory struct {
+	Stream     string `json:"stream"`
+	Consumer   string `json:"consumer"`
+	StreamSeq  uint64 `json:"stream_seq"`
+	Deliveries uint64 `json:"deliveries"`
+	Domain     string `json:"domain,omitempty"`
+}
+
+// MsgTerminatedAdvisory is emitted when a message is terminated with AckTerm.
+type MsgTerminatedAdvisory struct {
+	Stream      string `json:"stream"`
+	Consumer    string `json:"consumer"`
+	ConsumerSeq uint64 `json:"consumer_seq"`
+	StreamSeq   uint64 `json:"stream_seq"`
+	Deliveries  uint64 `json:"deliveries"`
+	Domain      string `json:"domain,omitempty"`
+}
+
+// StreamLeaderElectedAdvisory is emitted when a clustered stream elects a leader.
+type StreamLeaderElectedAdvisory struct {
+	Stream   string      `json:"stream"`
+	Leader   string      `json:"leader"`
+	Replicas []*PeerInfo `json:"replicas"`
+	Domain   string      `json:"domain,omitempty"`
+}
+
+// ConsumerLeaderElectedAdvisory is emitted when a clustered consumer elects a leader.
+type ConsumerLeaderElectedAdvisory struct {
+	Stream   string      `json:"stream"`
+	Consumer string      `json:"consumer"`
+	Leader   string      `json:"leader"`
+	Replicas []*PeerInfo `json:"replicas"`
+	Domain   string      `json:"domain,omitempty"`
+}
+
+// Advisories subscribes to JetStream advisories.
+func (js *js) Advisories(filter string, cb func(*Advisory)) (*Subscription, error) {
+	if cb == nil {
+		return nil, fmt.Errorf("%w: callback is required", ErrInvalidArg)
+	}
+	if filter == _EMPTY_ {
+		filter = ">"
+	}
+	return js.nc.Subscribe(jsAdvisoryPre+filter, func(m *Msg) {
+		var hdr struct {
+			Type string    `json:"type"`
+			ID   string    `json:"id"`
+			Time time.Time `json:"timestamp"`
+		}
+		if err := json.Unmarshal(m.Data, &hdr); err != nil {
+			return
+		}
+		adv := &Advisory{Type: hdr.Type, ID: hdr.ID, Time: hdr.Time, Subject: m.Subject, Data: m.Data}
+		switch hdr.Type {
+		case StreamActionAdvisoryType:
+			adv.Event = &StreamActionAdvisory{}
+		case ConsumerActionAdvisoryType:
+			adv.Event = &ConsumerActionAdvisory{}
+		case MaxDeliveriesAdvisoryType:
+			adv.Event = &MaxDeliveriesAdvisory{}
+		case MsgTerminatedAdvisoryType:
+			adv.Event = &MsgTerminatedAdvisory{}
+		case StreamLeaderElectedAdvisoryType:
+			adv.Event = &StreamLeaderElectedAdvisory{}
+		case ConsumerLeaderElectedAdvisoryType:
+			adv.Event = &ConsumerLeaderElectedAdvisory{}
+		}
+		if adv.Event != nil {
+			if err := json.Unmarshal(m.Data, adv.Event); err != nil {
+				adv.Event = nil
+			}
+		}
+		cb(adv)
+	})
+}
+
+// OnMaxDeliveries subscribes to the max deliveries advisories of a Consumer.
+func (js *js) OnMaxDeliveries(stream, consumer string, cb func(*MaxDeliveriesAdvisory)) (*Subscription, error) {
+	if err := checkStreamName(stream); err != nil {
+		return nil, err
+	}
+	if err := checkConsumerName(consumer); err != nil {
+		return nil, err
+	}
+	if cb == nil {
+		return nil, fmt.Errorf("%w: callback is required", ErrInvalidArg)
+	}
+	return js.Advisories(fmt.Sprintf(jsMaxDeliveriesT, stream, consumer), func(a *Advisory) {
+		md, ok := a.Event.(*MaxDeliveriesAdvisory)
+		if !ok {
+			// Not of the expected type, decode the fields shared by
+			// all the versions of the advisory.
+			md = &MaxDeliveriesAdvisory{}
+			if err := json.Unmarshal(a.Data, md); err != nil || md.StreamSeq == 0 {
+				return
+			}
+		}
+		// The subject identifies the consumer, in case it was not reported.
+		if md.Stream == _EMPTY_ {
+			md.Stream = stream
+		}
+		if md.Consumer == _EMPTY_ {
+			md.Consumer = consumer
+		}
+		cb(md)
+	})
+}
+
+// consumerLister fetches pages of ConsumerInfo objects. This object is not
+// safe to use for multiple threads.
+type consumerLister struct {
+	stream string
+	js     *js
+
+	err      error
+	offset   int
+	page     []*ConsumerInfo
+	pageInfo *apiPaged
+}
+
+// consumersRequest is the type used for Consumers requests.
+type consumersRequest struct {
+	apiPagedRequest
+}
+
+// consumerListResponse is the response for a Consumers List request.
+type consumerListResponse struct {
+	apiResponse
+	apiPaged
+	Consumers []*ConsumerInfo `json:"consumers"`
+}
+
+// Next fetches the next ConsumerInfo page.
+func (c *consumerLister) Next() bool {
+	if c.err != nil {
+		return false
+	}
+	if err := checkStreamName(c.stream); err != nil {
+		c.err = err
+		return false
+	}
+	if c.pageInfo != nil && c.offset >= c.pageInfo.Total {
+		return false
+	}
+
+	req, err := c.js.marshal(consumersRequest{
+		apiPagedRequest: apiPagedRequest{Offset: c.offset},
+	})
+	if err != nil {
+		c.err = err
+		return false
+	}
+
+	var cancel context.CancelFunc
+	ctx := c.js.opts.ctx
 	if ctx == nil {
-		ctx, cancel = context.WithTimeout(context.Background(), c.js.opts.wait)
+		ctx, cancel = withTimeout(context.Background(), c.js.clock(), c.js.opts.wait)
 		defer cancel()
 	}
 
@@ -542,7 +1594,7 @@ func (c *consumerLister) Next() bool {
 		return false
 	}
 	var resp consumerListResponse
-	if err := json.Unmarshal(r.Data, &resp); err != nil {
+	if err := c.js.unmarshal(r.Data, &resp); err != nil {
 		c.err = err
 		return false
 	}
@@ -575,7 +1627,7 @@ func (jsc *js) Consumers(stream string, opts ...JSOpt) <-chan *ConsumerInfo {
 	}
 
 	ch := make(chan *ConsumerInfo)
-	l := &consumerLister{js: &js{nc: jsc.nc, opts: o}, stream: stream}
+	l := &consumerLister{js: &js{nc: jsc.nc, opts: o, stats: jsc.stats}, stream: stream}
 	go func() {
 		if cancel != nil {
 			defer cancel()
@@ -595,6 +1647,54 @@ func (jsc *js) Consumers(stream string, opts ...JSOpt) <-chan *ConsumerInfo {
 	return ch
 }
 
+// AllConsumers retrieves the ConsumerInfo objects of all the consumers of a stream.
+func (jsc *js) AllConsumers(stream string, opts ...JSOpt) ([]*ConsumerInfo, error) {
+	o, cancel, err := getJSContextOpts(jsc.opts, opts...)
+	if err != nil {
+		return nil, err
+	}
+	if cancel != nil {
+		defer cancel()
+	}
+
+	var infos []*ConsumerInfo
+	l := &consumerLister{js: &js{nc: jsc.nc, opts: o, stats: jsc.stats}, stream: stream}
+	for l.Next() {
+		// Stop on an empty page, the offset would not move forward.
+		if len(l.Page()) == 0 {
+			break
+		}
+		infos = append(infos, l.Page()...)
+	}
+	if err := l.Err(); err != nil {
+		return nil, err
+	}
+	return infos, nil
+}
+
+// ConsumersPage retrieves a single page of ConsumerInfo objects.
+func (jsc *js) ConsumersPage(stream string, offset int, opts ...JSOpt) (*ConsumerInfoPage, error) {
+	if offset < 0 {
+		return nil, fmt.Errorf("%w: offset cannot be negative", ErrInvalidArg)
+	}
+	o, cancel, err := getJSContextOpts(jsc.opts, opts...)
+	if err != nil {
+		return nil, err
+	}
+	if cancel != nil {
+		defer cancel()
+	}
+
+	l := &consumerLister{js: &js{nc: jsc.nc, opts: o, stats: jsc.stats}, stream: stream, offset: offset}
+	if !l.Next() {
+		return nil, l.Err()
+	}
+	return &ConsumerInfoPage{
+		ListPage:  ListPage{Total: l.pageInfo.Total, Offset: l.pageInfo.Offset, Limit: l.pageInfo.Limit},
+		Consumers: l.Page(),
+	}, nil
+}
+
 // ConsumersInfo is used to retrieve a list of ConsumerInfo objects.
 // DEPRECATED: Use Consumers() instead.
 func (jsc *js) ConsumersInfo(stream string, opts ...JSOpt) <-chan *ConsumerInfo {
@@ -634,11 +1734,11 @@ func (c *consumerNamesLister) Next() bool {
 	var cancel context.CancelFunc
 	ctx := c.js.opts.ctx
 	if ctx == nil {
-		ctx, cancel = context.WithTimeout(context.Background(), c.js.opts.wait)
+		ctx, cancel = withTimeout(context.Background(), c.js.clock(), c.js.opts.wait)
 		defer cancel()
 	}
 
-	req, err := json.Marshal(consumersRequest{
+	req, err := c.js.marshal(consumersRequest{
 		apiPagedRequest: apiPagedRequest{Offset: c.offset},
 	})
 	if err != nil {
@@ -652,7 +1752,7 @@ func (c *consumerNamesLister) Next() bool {
 		return false
 	}
 	var resp consumerNamesListResponse
-	if err := json.Unmarshal(r.Data, &resp); err != nil {
+	if err := c.js.unmarshal(r.Data, &resp); err != nil {
 		c.err = err
 		return false
 	}
@@ -685,7 +1785,7 @@ func (jsc *js) ConsumerNames(stream string, opts ...JSOpt) <-chan string {
 	}
 
 	ch := make(chan string)
-	l := &consumerNamesLister{stream: stream, js: &js{nc: jsc.nc, opts: o}}
+	l := &consumerNamesLister{stream: stream, js: &js{nc: jsc.nc, opts: o, stats: jsc.stats}}
 	go func() {
 		if cancel != nil {
 			defer cancel()
@@ -712,10 +1812,8 @@ type streamCreateResponse struct {
 }
 
 func (js *js) AddStream(cfg *StreamConfig, opts ...JSOpt) (*StreamInfo, error) {
-	if cfg == nil {
-		return nil, ErrStreamConfigRequired
-	}
-	if err := checkStreamName(cfg.Name); err != nil {
+	ncfg, err := cfg.createRequest()
+	if err != nil {
 		return nil, err
 	}
 	o, cancel, err := getJSContextOpts(js.opts, opts...)
@@ -726,31 +1824,7 @@ func (js *js) AddStream(cfg *StreamConfig, opts ...JSOpt) (*StreamInfo, error) {
 		defer cancel()
 	}
 
-	// In case we need to change anything, copy so we do not change the caller's version.
-	ncfg := *cfg
-
-	// If we have a mirror and an external domain, convert to ext.APIPrefix.
-	if cfg.Mirror != nil && cfg.Mirror.Domain != _EMPTY_ {
-		// Copy so we do not change the caller's version.
-		ncfg.Mirror = ncfg.Mirror.copy()
-		if err := ncfg.Mirror.convertDomain(); err != nil {
-			return nil, err
-		}
-	}
-	// Check sources for the same.
-	if len(ncfg.Sources) > 0 {
-		ncfg.Sources = append([]*StreamSource(nil), ncfg.Sources...)
-		for i, ss := range ncfg.Sources {
-			if ss.Domain != _EMPTY_ {
-				ncfg.Sources[i] = ss.copy()
-				if err := ncfg.Sources[i].convertDomain(); err != nil {
-					return nil, err
-				}
-			}
-		}
-	}
-
-	req, err := json.Marshal(&ncfg)
+	req, err := js.marshal(ncfg)
 	if err != nil {
 		return nil, err
 	}
@@ -761,7 +1835,7 @@ func (js *js) AddStream(cfg *StreamConfig, opts ...JSOpt) (*StreamInfo, error) {
 		return nil, err
 	}
 	var resp streamCreateResponse
-	if err := json.Unmarshal(r.Data, &resp); err != nil {
+	if err := js.unmarshal(r.Data, &resp); err != nil {
 		return nil, err
 	}
 	if resp.Error != nil {
@@ -770,6 +1844,7 @@ func (js *js) AddStream(cfg *StreamConfig, opts ...JSOpt) (*StreamInfo, error) {
 		}
 		return nil, resp.Error
 	}
+	js.cacheStreamConfig(js.opts.pre, resp.StreamInfo)
 
 	return resp.StreamInfo, nil
 }
@@ -816,7 +1891,7 @@ func (js *js) StreamInfo(stream string, opts ...JSOpt) (*StreamInfo, error) {
 	for {
 		if requestPayload {
 			siOpts.Offset = i
-			if req, err = json.Marshal(&siOpts); err != nil {
+			if req, err = js.marshal(&siOpts); err != nil {
 				return nil, err
 			}
 		}
@@ -829,14 +1904,18 @@ func (js *js) StreamInfo(stream string, opts ...JSOpt) (*StreamInfo, error) {
 		}
 
 		var resp streamInfoResponse
-		if err := json.Unmarshal(r.Data, &resp); err != nil {
+		if err := js.unmarshal(r.Data, &resp); err != nil {
 			return nil, err
 		}
 
 		if resp.Error != nil {
 			if errors.Is(resp.Error, ErrStreamNotFound) {
+				js.uncacheStream(stream)
 				return nil, ErrStreamNotFound
 			}
+			if errors.Is(resp.Error, ErrStreamOffline) {
+				return nil, ErrStreamOffline
+			}
 			return nil, resp.Error
 		}
 
@@ -863,11 +1942,64 @@ func (js *js) StreamInfo(stream string, opts ...JSOpt) (*StreamInfo, error) {
 			if requestPayload {
 				resp.StreamInfo.State.Subjects = subjectMessagesMap
 			}
+			js.cacheStreamConfig(js.opts.pre, resp.StreamInfo)
 			return resp.StreamInfo, nil
 		}
 	}
 }
 
+// StreamExists reports whether a Stream exists.
+// An error is returned only if the lookup itself failed, not if
+// the stream was not found.
+func (js *js) StreamExists(stream string, opts ...JSOpt) (bool, error) {
+	o, cancel, err := getJSContextOpts(js.opts, opts...)
+	if err != nil {
+		return false, err
+	}
+	if cancel != nil {
+		defer cancel()
+	}
+	pjs := js.withPrefix(o)
+	key := pjs.cacheKey(cacheStreamKey, stream)
+	if _, ok := js.opts.cache.get(key, js.clock().Now()); ok {
+		return true, nil
+	}
+	_, err = pjs.StreamInfo(stream, Context(o.ctx))
+	if err != nil {
+		if errors.Is(err, ErrStreamNotFound) {
+			return false, nil
+		}
+		return false, err
+	}
+	js.opts.cache.put(key, stream, js.clock().Now())
+	return true, nil
+}
+
+// SequenceRange is the range of messages retained by a stream. For an empty
+// stream, FirstSeq is greater than LastSeq, which is the sequence of the last
+// message that was stored, if any.
+type SequenceRange struct {
+	FirstSeq  uint64
+	LastSeq   uint64
+	FirstTime time.Time
+	LastTime  time.Time
+}
+
+// StreamSequenceRange retrieves the range of messages retained by a stream.
+func (js *js) StreamSequenceRange(stream string, opts ...JSOpt) (*SequenceRange, error) {
+	opts = append(opts[:len(opts):len(opts)], StreamInfoNoSubjects())
+	si, err := js.StreamInfo(stream, opts...)
+	if err != nil {
+		return nil, err
+	}
+	return &SequenceRange{
+		FirstSeq:  si.State.FirstSeq,
+		LastSeq:   si.State.LastSeq,
+		FirstTime: si.State.FirstTime,
+		LastTime:  si.State.LastTime,
+	}, nil
+}
+
 // StreamInfo shows config and current state for this stream.
 type StreamInfo struct {
 	Config     StreamConfig        `json:"config"`
@@ -896,6 +2028,9 @@ type StreamSourceInfo struct {
 }
 
 // StreamState is information about the given stream.
+// NumSubjects, the number of distinct subjects in the stream, is always
+// reported, while Subjects is only populated when requested with
+// StreamInfoSubjects() or a StreamInfoRequest.SubjectsFilter.
 type StreamState struct {
 	Msgs        uint64            `json:"messages"`
 	Bytes       uint64            `json:"bytes"`
@@ -918,22 +2053,277 @@ type ClusterInfo struct {
 	Replicas []*PeerInfo `json:"replicas,omitempty"`
 }
 
-// PeerInfo shows information about all the peers in the cluster that
-// are supporting the stream or consumer.
-type PeerInfo struct {
-	Name    string        `json:"name"`
-	Current bool          `json:"current"`
-	Offline bool          `json:"offline,omitempty"`
-	Active  time.Duration `json:"active"`
-	Lag     uint64        `json:"lag,omitempty"`
+// PeerInfo shows information about all the peers in the cluster that
+// are supporting the stream or consumer.
+type PeerInfo struct {
+	Name    string        `json:"name"`
+	Current bool          `json:"current"`
+	Offline bool          `json:"offline,omitempty"`
+	Active  time.Duration `json:"active"`
+	Lag     uint64        `json:"lag,omitempty"`
+}
+
+// UpdateStream updates a Stream.
+func (js *js) UpdateStream(cfg *StreamConfig, opts ...JSOpt) (*StreamInfo, error) {
+	if err := cfg.Validate(); err != nil {
+		return nil, err
+	}
+	if cfg.Placement != nil && cfg.Placement.isEmpty() {
+		// An empty placement is not sent, copy so we do not change the caller's version.
+		ncfg := *cfg
+		ncfg.Placement = nil
+		cfg = &ncfg
+	}
+	o, cancel, err := getJSContextOpts(js.opts, opts...)
+	if err != nil {
+		return nil, err
+	}
+	if cancel != nil {
+		defer cancel()
+	}
+
+	req, err := js.marshal(cfg)
+	if err != nil {
+		return nil, err
+	}
+
+	usSubj := js.apiSubj(fmt.Sprintf(apiStreamUpdateT, cfg.Name))
+	r, err := js.apiRequestWithContext(o.ctx, usSubj, req)
+	if err != nil {
+		return nil, err
+	}
+	var resp streamInfoResponse
+	if err := js.unmarshal(r.Data, &resp); err != nil {
+		return nil, err
+	}
+	// The subjects of the stream may have changed.
+	js.uncacheStreamSubjects(cfg.Name)
+	if resp.Error != nil {
+		if errors.Is(resp.Error, ErrStreamNotFound) {
+			js.uncacheStream(cfg.Name)
+			return nil, ErrStreamNotFound
+		}
+		return nil, resp.Error
+	}
+	js.cacheStreamConfig(js.opts.pre, resp.StreamInfo)
+	return resp.StreamInfo, nil
+}
+
+// streamDeleteResponse is the response for a Stream delete request.
+type streamDeleteResponse struct {
+	apiResponse
+	Success bool `json:"success,omitempty"`
+}
+
+// DeleteStream deletes a Stream.
+func (js *js) DeleteStream(name string, opts ...JSOpt) error {
+	if err := checkStreamName(name); err != nil {
+		return err
+	}
+	o, cancel, err := getJSContextOpts(js.opts, opts...)
+	if err != nil {
+		return err
+	}
+	if cancel != nil {
+		defer cancel()
+	}
+
+	dsSubj := js.apiSubj(fmt.Sprintf(apiStreamDeleteT, name))
+	r, err := js.apiRequestWithContext(o.ctx, dsSubj, nil)
+	if err != nil {
+		return err
+	}
+	var resp streamDeleteResponse
+	if err := js.unmarshal(r.Data, &resp); err != nil {
+		return err
+	}
+	js.uncacheStreamConfig(js.opts.pre, name)
+	js.uncacheStream(name)
+
+	if resp.Error != nil {
+		if errors.Is(resp.Error, ErrStreamNotFound) {
+			return ErrStreamNotFound
+		}
+		return resp.Error
+	}
+	return nil
+}
+
+// cacheStreamConfig records the configuration of the stream reported by the
+// server for the API prefix pre, since streams of other domains or accounts
+// can have the same name.
+func (js *js) cacheStreamConfig(pre string, info *StreamInfo) {
+	if info == nil {
+		return
+	}
+	cfg := info.Config
+	js.mu.Lock()
+	if js.configs == nil {
+		js.configs = make(map[string]*StreamConfig)
+	}
+	js.configs[pre+" "+cfg.Name] = &cfg
+	js.mu.Unlock()
+}
+
+func (js *js) uncacheStreamConfig(pre, name string) {
+	js.mu.Lock()
+	delete(js.configs, pre+" "+name)
+	js.mu.Unlock()
+}
+
+func (js *js) cachedStreamConfig(pre, name string) (*StreamConfig, bool) {
+	js.mu.RLock()
+	defer js.mu.RUnlock()
+	cfg, ok := js.configs[pre+" "+name]
+	if !ok {
+		return nil, false
+	}
+	ncfg := *cfg
+	return &ncfg, true
+}
+
+// CachedStreamConfig returns the configuration of a stream as last reported
+// by the server to this context, without sending a request.
+func (js *js) CachedStreamConfig(name string) (*StreamConfig, bool) {
+	return js.cachedStreamConfig(js.opts.pre, name)
+}
+
+// allowDirect reports whether the stream allows direct gets, looking up the
+// stream's configuration with the per-call options o the first time. If the
+// lookup fails for any other reason than a missing stream, direct gets are
+// assumed to be allowed.
+func (js *js) allowDirect(o *jsOpts, name string) (bool, error) {
+	if cfg, ok := js.cachedStreamConfig(o.pre, name); ok {
+		return cfg.AllowDirect, nil
+	}
+	si, err := js.withPrefix(o).StreamInfo(name, Context(o.ctx))
+	if err != nil {
+		if errors.Is(err, ErrStreamNotFound) {
+			return false, err
+		}
+		return true, nil
+	}
+	js.cacheStreamConfig(o.pre, si)
+	return si.Config.AllowDirect, nil
+}
+
+// resourceCache is a LRU cache of resolved streams and consumers, whose
+// entries expire after a TTL. Its methods do nothing on a nil cache.
+type resourceCache struct {
+	mu      sync.Mutex
+	ttl     time.Duration
+	size    int
+	entries map[string]*list.Element
+	lru     *list.List
+}
+
+type cacheEntry struct {
+	key string
+	// The stream the stream, consumer or subject resolves to.
+	stream  string
+	expires time.Time
+}
+
+// Prefixes of the cache keys, followed by the API prefix of the context and,
+// after a space, the stream name, the stream and consumer names separated by
+// a dot, or the subject. See cacheKey().
+const (
+	cacheStreamKey   = "stream:"
+	cacheConsumerKey = "consumer:"
+	cacheSubjectKey  = "subject:"
+)
+
+func newResourceCache(ttl time.Duration, size int) *resourceCache {
+	return &resourceCache{ttl: ttl, size: size, entries: make(map[string]*list.Element), lru: list.New()}
+}
+
+// get returns the stream of an entry which did not expire.
+func (c *resourceCache) get(key string, now time.Time) (string, bool) {
+	if c == nil {
+		return _EMPTY_, false
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	el, ok := c.entries[key]
+	if !ok {
+		return _EMPTY_, false
+	}
+	e := el.Value.(*cacheEntry)
+	if !now.Before(e.expires) {
+		c.lru.Remove(el)
+		delete(c.entries, key)
+		return _EMPTY_, false
+	}
+	c.lru.MoveToFront(el)
+	return e.stream, true
+}
+
+// put adds or refreshes an entry, evicting the least recently used
+// entries above the size of the cache.
+func (c *resourceCache) put(key, stream string, now time.Time) {
+	if c == nil {
+		return
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if el, ok := c.entries[key]; ok {
+		e := el.Value.(*cacheEntry)
+		e.stream, e.expires = stream, now.Add(c.ttl)
+		c.lru.MoveToFront(el)
+		return
+	}
+	c.entries[key] = c.lru.PushFront(&cacheEntry{key: key, stream: stream, expires: now.Add(c.ttl)})
+	for c.lru.Len() > c.size {
+		el := c.lru.Back()
+		c.lru.Remove(el)
+		delete(c.entries, el.Value.(*cacheEntry).key)
+	}
+}
+
+// remove removes the entries for which match returns true.
+func (c *resourceCache) remove(match func(e *cacheEntry) bool) {
+	if c == nil {
+		return
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	for key, el := range c.entries {
+		if match(el.Value.(*cacheEntry)) {
+			c.lru.Remove(el)
+			delete(c.entries, key)
+		}
+	}
+}
+
+// uncacheStream removes the cached stream, its consumers and the subjects
+// resolved to it.
+func (js *js) uncacheStream(name string) {
+	js.opts.cache.remove(func(e *cacheEntry) bool { return e.stream == name })
+}
+
+// uncacheStreamSubjects removes the subjects resolved to the stream.
+func (js *js) uncacheStreamSubjects(name string) {
+	js.opts.cache.remove(func(e *cacheEntry) bool {
+		return e.stream == name && strings.HasPrefix(e.key, cacheSubjectKey)
+	})
+}
+
+// cacheKey returns the cache key of a stream, consumer or subject, scoped to
+// the API prefix of the context since the same names resolve differently
+// in other domains or accounts.
+func (js *js) cacheKey(kind, name string) string {
+	return kind + js.opts.pre + " " + name
+}
+
+func (js *js) uncacheKey(key string) {
+	js.opts.cache.remove(func(e *cacheEntry) bool { return e.key == key })
 }
 
-// UpdateStream updates a Stream.
-func (js *js) UpdateStream(cfg *StreamConfig, opts ...JSOpt) (*StreamInfo, error) {
-	if cfg == nil {
-		return nil, ErrStreamConfigRequired
-	}
-	if err := checkStreamName(cfg.Name); err != nil {
+// RecreateStream deletes a Stream and creates it again with the same configuration.
+// All messages and consumers of the stream are removed and the stream sequence
+// starts again from the beginning.
+func (js *js) RecreateStream(name string, opts ...JSOpt) (*StreamInfo, error) {
+	if err := checkStreamName(name); err != nil {
 		return nil, err
 	}
 	o, cancel, err := getJSContextOpts(js.opts, opts...)
@@ -944,71 +2334,336 @@ func (js *js) UpdateStream(cfg *StreamConfig, opts ...JSOpt) (*StreamInfo, error
 		defer cancel()
 	}
 
-	req, err := json.Marshal(cfg)
+	// Use the same context for all requests, so that the whole
+	// operation is bound to the given timeout.
+	ctx, pjs := Context(o.ctx), js.withPrefix(o)
+	si, err := pjs.StreamInfo(name, ctx)
 	if err != nil {
 		return nil, err
 	}
+	cfg := si.Config
+	if err := pjs.DeleteStream(name, ctx); err != nil {
+		return nil, err
+	}
+	si, err = pjs.AddStream(&cfg, ctx)
+	if err != nil {
+		return nil, &StreamRecreateError{Config: cfg, Err: err}
+	}
+	return si, nil
+}
 
-	usSubj := js.apiSubj(fmt.Sprintf(apiStreamUpdateT, cfg.Name))
-	r, err := js.apiRequestWithContext(o.ctx, usSubj, req)
+// StreamRecreateError is returned by RecreateStream() when the stream was
+// deleted but could not be created again. Config holds the configuration of
+// the deleted stream, so that it can be created again.
+type StreamRecreateError struct {
+	Config StreamConfig
+	Err    error
+}
+
+func (e *StreamRecreateError) Error() string {
+	return fmt.Sprintf("nats: stream %q was deleted but could not be created again: %v", e.Config.Name, e.Err)
+}
+
+// Unwrap returns the error of the stream creation.
+func (e *StreamRecreateError) Unwrap() error {
+	return e.Err
+}
+
+// AddStreamSubjects adds subjects to a stream.
+func (jsc *js) AddStreamSubjects(stream string, subjects []string, opts ...JSOpt) (*StreamInfo, error) {
+	return jsc.updateStreamSubjects(stream, subjects, true, opts)
+}
+
+// RemoveStreamSubjects removes subjects from a stream.
+func (jsc *js) RemoveStreamSubjects(stream string, subjects []string, opts ...JSOpt) (*StreamInfo, error) {
+	return jsc.updateStreamSubjects(stream, subjects, false, opts)
+}
+
+func (jsc *js) updateStreamSubjects(stream string, subjects []string, add bool, opts []JSOpt) (*StreamInfo, error) {
+	if err := checkStreamName(stream); err != nil {
+		return nil, err
+	}
+	if len(subjects) == 0 {
+		return nil, fmt.Errorf("%w: at least one subject is required", ErrInvalidArg)
+	}
+	for _, subj := range subjects {
+		if badSubject(subj) {
+			return nil, fmt.Errorf("%w: %q", ErrBadSubject, subj)
+		}
+	}
+	o, cancel, err := getJSContextOpts(jsc.opts, opts...)
 	if err != nil {
 		return nil, err
 	}
-	var resp streamInfoResponse
-	if err := json.Unmarshal(r.Data, &resp); err != nil {
+	if cancel != nil {
+		defer cancel()
+	}
+
+	// Use the same context for all requests, so that the whole
+	// operation is bound to the given timeout.
+	ctx := Context(o.ctx)
+	si, err := jsc.StreamInfo(stream, ctx)
+	if err != nil {
 		return nil, err
 	}
-	if resp.Error != nil {
-		if errors.Is(resp.Error, ErrStreamNotFound) {
-			return nil, ErrStreamNotFound
+	cfg := si.Config
+
+	var updated []string
+	if add {
+		updated = append(updated, cfg.Subjects...)
+		var added []string
+		for _, subj := range subjects {
+			if !containsString(updated, subj) {
+				updated = append(updated, subj)
+				added = append(added, subj)
+			}
+		}
+		if len(added) == 0 {
+			return si, nil
+		}
+		// Check for overlaps here to report the conflicting stream.
+		l := &streamLister{js: &js{nc: jsc.nc, opts: o, stats: jsc.stats}}
+		for l.Next() {
+			for _, info := range l.Page() {
+				if info.Config.Name == stream {
+					continue
+				}
+				for _, existing := range info.Config.Subjects {
+					for _, subj := range added {
+						if subjectsCollide(existing, subj) {
+							return nil, fmt.Errorf("%w: %q overlaps with %q of stream %q", ErrStreamSubjectsOverlap, subj, existing, info.Config.Name)
+						}
+					}
+				}
+			}
+		}
+		if err := l.Err(); err != nil {
+			return nil, err
+		}
+	} else {
+		for _, subj := range subjects {
+			if !containsString(cfg.Subjects, subj) {
+				return nil, fmt.Errorf("%w: subject %q is not part of stream %q", ErrInvalidArg, subj, stream)
+			}
+		}
+		for _, subj := range cfg.Subjects {
+			if !containsString(subjects, subj) {
+				updated = append(updated, subj)
+			}
+		}
+		if len(updated) == 0 {
+			return nil, fmt.Errorf("%w: can not remove all the subjects of stream %q", ErrInvalidArg, stream)
 		}
-		return nil, resp.Error
 	}
-	return resp.StreamInfo, nil
+	cfg.Subjects = updated
+	return jsc.UpdateStream(&cfg, ctx)
 }
 
-// streamDeleteResponse is the response for a Stream delete request.
-type streamDeleteResponse struct {
-	apiResponse
-	Success bool `json:"success,omitempty"`
+// maxApplyConcurrency is the maximum number of resources configured at the
+// same time by ApplyStreamConfigs, ApplyConsumerConfigs and DeleteAllConsumers.
+const maxApplyConcurrency = 8
+
+// ApplyAction is the outcome of applying the configuration of a resource.
+type ApplyAction int
+
+const (
+	// ApplyFailed is reported when the resource could not be configured.
+	ApplyFailed ApplyAction = iota
+	// ApplyCreated is reported when the resource was created.
+	ApplyCreated
+	// ApplyUpdated is reported when the configuration of an existing resource changed.
+	ApplyUpdated
+	// ApplyUnchanged is reported when the resource already had the configuration.
+	ApplyUnchanged
+	// ApplyDeleted is reported when the resource was deleted.
+	ApplyDeleted
+)
+
+func (a ApplyAction) String() string {
+	switch a {
+	case ApplyFailed:
+		return "Failed"
+	case ApplyCreated:
+		return "Created"
+	case ApplyUpdated:
+		return "Updated"
+	case ApplyUnchanged:
+		return "Unchanged"
+	case ApplyDeleted:
+		return "Deleted"
+	default:
+		return "Unknown ApplyAction"
+	}
+}
+
+// ApplyResult is the outcome of applying the configuration of a stream or consumer.
+type ApplyResult struct {
+	Name   string
+	Action ApplyAction
+	// Err is set when Action is ApplyFailed.
+	Err error
+}
+
+// ApplyStreamConfigs creates or updates a set of Streams.
+func (jsc *js) ApplyStreamConfigs(cfgs []*StreamConfig, opts ...JSOpt) []ApplyResult {
+	names := make([]string, len(cfgs))
+	for i, cfg := range cfgs {
+		if cfg != nil {
+			names[i] = cfg.Name
+		}
+	}
+	return jsc.apply(names, func(js *js, ctx context.Context, i int) (ApplyAction, error) {
+		cfg := cfgs[i]
+		if cfg == nil {
+			return ApplyFailed, ErrStreamConfigRequired
+		}
+		info, err := js.StreamInfo(cfg.Name, Context(ctx))
+		if errors.Is(err, ErrStreamNotFound) {
+			if _, err := js.AddStream(cfg, Context(ctx)); err != nil {
+				return ApplyFailed, err
+			}
+			return ApplyCreated, nil
+		}
+		if err != nil {
+			return ApplyFailed, err
+		}
+		updated, err := js.UpdateStream(cfg, Context(ctx))
+		if err != nil {
+			return ApplyFailed, err
+		}
+		if reflect.DeepEqual(info.Config, updated.Config) {
+			return ApplyUnchanged, nil
+		}
+		return ApplyUpdated, nil
+	}, opts...)
 }
 
-// DeleteStream deletes a Stream.
-func (js *js) DeleteStream(name string, opts ...JSOpt) error {
-	if err := checkStreamName(name); err != nil {
-		return err
+// ApplyConsumerConfigs creates or updates a set of Consumers of a Stream.
+func (jsc *js) ApplyConsumerConfigs(stream string, cfgs []*ConsumerConfig, opts ...JSOpt) []ApplyResult {
+	names := make([]string, len(cfgs))
+	for i, cfg := range cfgs {
+		if cfg == nil {
+			continue
+		}
+		names[i] = cfg.Durable
+		if names[i] == _EMPTY_ {
+			names[i] = cfg.Name
+		}
 	}
-	o, cancel, err := getJSContextOpts(js.opts, opts...)
+	return jsc.apply(names, func(js *js, ctx context.Context, i int) (ApplyAction, error) {
+		if cfgs[i] == nil {
+			return ApplyFailed, ErrConsumerConfigRequired
+		}
+		if names[i] == _EMPTY_ {
+			return ApplyFailed, ErrConsumerNameRequired
+		}
+		info, err := js.ConsumerInfo(stream, names[i], Context(ctx))
+		if errors.Is(err, ErrConsumerNotFound) {
+			if _, err := js.AddConsumer(stream, cfgs[i], Context(ctx)); err != nil {
+				return ApplyFailed, err
+			}
+			return ApplyCreated, nil
+		}
+		if err != nil {
+			return ApplyFailed, err
+		}
+		updated, err := js.UpdateConsumer(stream, cfgs[i], Context(ctx))
+		if err != nil {
+			return ApplyFailed, err
+		}
+		if reflect.DeepEqual(info.Config, updated.Config) {
+			return ApplyUnchanged, nil
+		}
+		return ApplyUpdated, nil
+	}, opts...)
+}
+
+// DeleteAllConsumers deletes all the consumers of a stream.
+func (jsc *js) DeleteAllConsumers(stream string, opts ...JSOpt) ([]ApplyResult, error) {
+	if err := checkStreamName(stream); err != nil {
+		return nil, err
+	}
+	o, cancel, err := getJSContextOpts(jsc.opts, opts...)
 	if err != nil {
-		return err
+		return nil, err
 	}
 	if cancel != nil {
 		defer cancel()
 	}
 
-	dsSubj := js.apiSubj(fmt.Sprintf(apiStreamDeleteT, name))
-	r, err := js.apiRequestWithContext(o.ctx, dsSubj, nil)
+	var names []string
+	l := &consumerNamesLister{js: &js{nc: jsc.nc, opts: o, stats: jsc.stats}, stream: stream}
+	for l.Next() {
+		if len(l.Page()) == 0 {
+			break
+		}
+		names = append(names, l.Page()...)
+	}
+	if err := l.Err(); err != nil {
+		return nil, err
+	}
+	// Delete the listed consumers, of the same domain.
+	return jsc.apply(names, func(js *js, ctx context.Context, i int) (ApplyAction, error) {
+		err := js.DeleteConsumer(stream, names[i], Context(ctx))
+		if err != nil && !errors.Is(err, ErrConsumerNotFound) {
+			return ApplyFailed, err
+		}
+		return ApplyDeleted, nil
+	}, Context(o.ctx), APIPrefix(o.pre)), nil
+}
+
+// apply runs fn for each of the named resources, with a bounded concurrency.
+// fn is given the context to make its requests with, honoring the API prefix
+// of opts. Resources not started before the context is done are reported as
+// failed.
+func (jsc *js) apply(names []string, fn func(js *js, ctx context.Context, i int) (ApplyAction, error), opts ...JSOpt) []ApplyResult {
+	results := make([]ApplyResult, len(names))
+	for i, name := range names {
+		results[i].Name = name
+	}
+	o, cancel, err := getJSContextOpts(jsc.opts, opts...)
 	if err != nil {
-		return err
+		for i := range results {
+			results[i].Err = err
+		}
+		return results
 	}
-	var resp streamDeleteResponse
-	if err := json.Unmarshal(r.Data, &resp); err != nil {
-		return err
+	if cancel != nil {
+		defer cancel()
 	}
 
-	if resp.Error != nil {
-		if errors.Is(resp.Error, ErrStreamNotFound) {
-			return ErrStreamNotFound
+	pjs := jsc.withPrefix(o)
+	var wg sync.WaitGroup
+	sem := make(chan struct{}, maxApplyConcurrency)
+	for i := range results {
+		select {
+		case sem <- struct{}{}:
+		case <-o.ctx.Done():
+			for ; i < len(results); i++ {
+				results[i].Err = o.ctx.Err()
+			}
+			wg.Wait()
+			return results
 		}
-		return resp.Error
+		wg.Add(1)
+		go func(i int) {
+			defer func() {
+				<-sem
+				wg.Done()
+			}()
+			results[i].Action, results[i].Err = fn(pjs, o.ctx, i)
+		}(i)
 	}
-	return nil
+	wg.Wait()
+	return results
 }
 
 type apiMsgGetRequest struct {
-	Seq     uint64 `json:"seq,omitempty"`
-	LastFor string `json:"last_by_subj,omitempty"`
-	NextFor string `json:"next_by_subj,omitempty"`
+	Seq          uint64     `json:"seq,omitempty"`
+	LastFor      string     `json:"last_by_subj,omitempty"`
+	NextFor      string     `json:"next_by_subj,omitempty"`
+	StartTime    *time.Time `json:"start_time,omitempty"`
+	MultiLastFor []string   `json:"multi_last,omitempty"`
 }
 
 // RawStreamMsg is a raw message stored in JetStream.
@@ -1058,13 +2713,33 @@ func (js *js) getMsg(name string, mreq *apiMsgGetRequest, opts ...JSOpt) (*RawSt
 	if err := checkStreamName(name); err != nil {
 		return nil, err
 	}
+	if o.directGet {
+		if err := js.checkServerVersion("direct get", 2, 9, 0); err != nil {
+			return nil, err
+		}
+		// Direct gets are not answered for streams without AllowDirect,
+		// use the regular API for those.
+		allow, err := js.allowDirect(o, name)
+		if err != nil {
+			return nil, err
+		}
+		if !allow {
+			o.directGet = false
+			if o.directNextFor != _EMPTY_ {
+				mreq.NextFor = o.directNextFor
+			}
+		}
+	}
 
+	// Get the message from the stream of the domain of the call.
+	pjs := js.withPrefix(o)
 	var apiSubj string
 	if o.directGet && mreq.LastFor != _EMPTY_ {
 		apiSubj = apiDirectMsgGetLastBySubjectT
-		dsSubj := js.apiSubj(fmt.Sprintf(apiSubj, name, mreq.LastFor))
+		dsSubj := pjs.apiSubj(fmt.Sprintf(apiSubj, name, mreq.LastFor))
 		r, err := js.apiRequestWithContext(o.ctx, dsSubj, nil)
 		if err != nil {
+			js.uncacheStreamConfig(o.pre, name)
 			return nil, err
 		}
 		return convertDirectGetMsgResponseToMsg(name, r)
@@ -1077,14 +2752,18 @@ func (js *js) getMsg(name string, mreq *apiMsgGetRequest, opts ...JSOpt) (*RawSt
 		apiSubj = apiMsgGetT
 	}
 
-	req, err := json.Marshal(mreq)
+	req, err := js.marshal(mreq)
 	if err != nil {
 		return nil, err
 	}
 
-	dsSubj := js.apiSubj(fmt.Sprintf(apiSubj, name))
+	dsSubj := pjs.apiSubj(fmt.Sprintf(apiSubj, name))
 	r, err := js.apiRequestWithContext(o.ctx, dsSubj, req)
 	if err != nil {
+		if o.directGet {
+			// The stream may have changed, look it up again next time.
+			js.uncacheStreamConfig(o.pre, name)
+		}
 		return nil, err
 	}
 
@@ -1093,7 +2772,7 @@ func (js *js) getMsg(name string, mreq *apiMsgGetRequest, opts ...JSOpt) (*RawSt
 	}
 
 	var resp apiMsgGetResponse
-	if err := json.Unmarshal(r.Data, &resp); err != nil {
+	if err := js.unmarshal(r.Data, &resp); err != nil {
 		return nil, err
 	}
 	if resp.Error != nil {
@@ -1125,6 +2804,73 @@ func (js *js) getMsg(name string, mreq *apiMsgGetRequest, opts ...JSOpt) (*RawSt
 	}, nil
 }
 
+// GetLastMsgsForSubjects retrieves the last raw stream messages for the given subjects
+// using a single batched direct get request.
+func (js *js) GetLastMsgsForSubjects(name string, subjects []string, opts ...JSOpt) (map[string]*RawStreamMsg, error) {
+	if err := checkStreamName(name); err != nil {
+		return nil, err
+	}
+	if len(subjects) == 0 {
+		return nil, ErrInvalidArg
+	}
+	o, cancel, err := getJSContextOpts(js.opts, opts...)
+	if err != nil {
+		return nil, err
+	}
+	if cancel != nil {
+		defer cancel()
+	}
+
+	req, err := js.marshal(&apiMsgGetRequest{MultiLastFor: subjects})
+	if err != nil {
+		return nil, err
+	}
+
+	// The server responds with one message per subject followed
+	// by an end of batch status message, so we need a subscription.
+	inbox := js.nc.NewInbox()
+	sub, err := js.nc.SubscribeSync(inbox)
+	if err != nil {
+		return nil, err
+	}
+	defer sub.Unsubscribe()
+
+	dsSubj := js.apiSubj(fmt.Sprintf(apiDirectMsgGetT, name))
+	if js.opts.shouldTrace {
+		ctrace := js.opts.ctrace
+		if ctrace.RequestSent != nil {
+			ctrace.RequestSent(dsSubj, req)
+		}
+	}
+	if err := js.nc.PublishRequest(dsSubj, inbox, req); err != nil {
+		return nil, err
+	}
+
+	msgs := make(map[string]*RawStreamMsg, len(subjects))
+	for {
+		r, err := sub.NextMsgWithContext(o.ctx)
+		if err != nil {
+			return nil, err
+		}
+		if len(r.Data) == 0 {
+			switch r.Header.Get(statusHdr) {
+			case eobSts:
+				return msgs, nil
+			case noMessagesSts:
+				// None of the subjects have messages.
+				return msgs, nil
+			case noResponders:
+				return nil, ErrNoResponders
+			}
+		}
+		msg, err := convertDirectGetMsgResponseToMsg(name, r)
+		if err != nil {
+			return nil, err
+		}
+		msgs[msg.Subject] = msg
+	}
+}
+
 func convertDirectGetMsgResponseToMsg(name string, r *Msg) (*RawStreamMsg, error) {
 	// Check for 404/408. We would get a no-payload message and a "Status" header
 	if len(r.Data) == 0 {
@@ -1230,11 +2976,156 @@ func (js *js) SecureDeleteMsg(name string, seq uint64, opts ...JSOpt) error {
 	return js.deleteMsg(o.ctx, name, &msgDeleteRequest{Seq: seq})
 }
 
+// maxDeleteMsgRangeInflight is the maximum number of concurrent
+// delete requests issued by DeleteMsgRange.
+const maxDeleteMsgRangeInflight = 32
+
+// DeleteMsgRangeError is returned by DeleteMsgRange when some of the
+// messages in the range could not be deleted.
+type DeleteMsgRangeError struct {
+	// Errors holds the error for each sequence which could not be deleted.
+	Errors map[uint64]error
+}
+
+func (e *DeleteMsgRangeError) Error() string {
+	return fmt.Sprintf("nats: failed to delete %d messages", len(e.Errors))
+}
+
+// isMsgMissing reports whether a message delete failed because there is no
+// message with the sequence.
+func isMsgMissing(err error) bool {
+	var apiErr *APIError
+	if !errors.As(err, &apiErr) {
+		return false
+	}
+	return apiErr.ErrorCode == JSErrCodeMessageNotFound || apiErr.ErrorCode == JSErrCodeSequenceNotFound
+}
+
+// DeleteMsgRange deletes a range of messages from a stream.
+func (js *js) DeleteMsgRange(name string, first, last uint64, opts ...JSOpt) (uint64, error) {
+	if err := checkStreamName(name); err != nil {
+		return 0, err
+	}
+	if first == 0 || last < first {
+		return 0, fmt.Errorf("%w: invalid sequence range [%d, %d]", ErrInvalidArg, first, last)
+	}
+	o, cancel, err := getJSContextOpts(js.opts, opts...)
+	if err != nil {
+		return 0, err
+	}
+	if cancel != nil {
+		defer cancel()
+	}
+
+	// Sequences before the first or after the last message of the stream
+	// are reported as failed deletes, so they are not requested.
+	info, err := js.StreamInfo(name, Context(o.ctx))
+	if err != nil {
+		return 0, err
+	}
+	if first < info.State.FirstSeq {
+		first = info.State.FirstSeq
+	}
+	if last > info.State.LastSeq {
+		last = info.State.LastSeq
+	}
+	if last < first {
+		return 0, nil
+	}
+
+	var (
+		mu      sync.Mutex
+		wg      sync.WaitGroup
+		deleted uint64
+		errs    map[uint64]error
+		ctxErr  error
+		sem     = make(chan struct{}, maxDeleteMsgRangeInflight)
+	)
+	for seq := first; seq <= last; seq++ {
+		if ctxErr = o.ctx.Err(); ctxErr != nil {
+			break
+		}
+		select {
+		case sem <- struct{}{}:
+		case <-o.ctx.Done():
+			ctxErr = o.ctx.Err()
+		}
+		if ctxErr != nil {
+			break
+		}
+		wg.Add(1)
+		go func(seq uint64) {
+			defer wg.Done()
+			err := js.deleteMsg(o.ctx, name, &msgDeleteRequest{Seq: seq, NoErase: true})
+			<-sem
+			mu.Lock()
+			defer mu.Unlock()
+			switch {
+			case err == nil:
+				deleted++
+			case isMsgMissing(err):
+			default:
+				if errs == nil {
+					errs = make(map[uint64]error)
+				}
+				errs[seq] = err
+			}
+		}(seq)
+		// Prevent overflow when last is the max sequence.
+		if seq == last {
+			break
+		}
+	}
+	wg.Wait()
+
+	if ctxErr != nil {
+		return deleted, ctxErr
+	}
+	if len(errs) > 0 {
+		return deleted, &DeleteMsgRangeError{Errors: errs}
+	}
+	return deleted, nil
+}
+
+// CountMessages returns the number of messages matching subject with a
+// sequence of at least since, using the pending count of an ephemeral consumer.
+func (js *js) CountMessages(name, subject string, since uint64, opts ...JSOpt) (uint64, error) {
+	if err := checkStreamName(name); err != nil {
+		return 0, err
+	}
+	o, cancel, err := getJSContextOpts(js.opts, opts...)
+	if err != nil {
+		return 0, err
+	}
+	if cancel != nil {
+		defer cancel()
+	}
+
+	cfg := &ConsumerConfig{
+		AckPolicy:         AckNonePolicy,
+		DeliverPolicy:     DeliverAllPolicy,
+		FilterSubject:     subject,
+		InactiveThreshold: defaultEphemeralInactiveThreshold,
+	}
+	if since > 0 {
+		cfg.DeliverPolicy = DeliverByStartSequencePolicy
+		cfg.OptStartSeq = since
+	}
+	info, err := js.AddConsumer(name, cfg, Context(o.ctx))
+	if err != nil {
+		return 0, err
+	}
+	// Delete the consumer regardless of the context, in case
+	// this fails the server removes it once inactive.
+	js.DeleteConsumer(name, info.Name)
+	return info.NumPending, nil
+}
+
 func (js *js) deleteMsg(ctx context.Context, stream string, req *msgDeleteRequest) error {
 	if err := checkStreamName(stream); err != nil {
 		return err
 	}
-	reqJSON, err := json.Marshal(req)
+	reqJSON, err := js.marshal(req)
 	if err != nil {
 		return err
 	}
@@ -1245,7 +3136,7 @@ func (js *js) deleteMsg(ctx context.Context, stream string, req *msgDeleteReques
 		return err
 	}
 	var resp msgDeleteResponse
-	if err := json.Unmarshal(r.Data, &resp); err != nil {
+	if err := js.unmarshal(r.Data, &resp); err != nil {
 		return err
 	}
 	if resp.Error != nil {
@@ -1297,7 +3188,7 @@ func (js *js) purgeStream(stream string, req *StreamPurgeRequest, opts ...JSOpt)
 
 	var b []byte
 	if req != nil {
-		if b, err = json.Marshal(req); err != nil {
+		if b, err = js.marshal(req); err != nil {
 			return err
 		}
 	}
@@ -1308,7 +3199,7 @@ func (js *js) purgeStream(stream string, req *StreamPurgeRequest, opts ...JSOpt)
 		return err
 	}
 	var resp streamPurgeResponse
-	if err := json.Unmarshal(r.Data, &resp); err != nil {
+	if err := js.unmarshal(r.Data, &resp); err != nil {
 		return err
 	}
 	if resp.Error != nil {
@@ -1355,7 +3246,7 @@ func (s *streamLister) Next() bool {
 		return false
 	}
 
-	req, err := json.Marshal(streamNamesRequest{
+	req, err := s.js.marshal(streamNamesRequest{
 		apiPagedRequest: apiPagedRequest{Offset: s.offset},
 		Subject:         s.js.opts.streamListSubject,
 	})
@@ -1367,7 +3258,7 @@ func (s *streamLister) Next() bool {
 	var cancel context.CancelFunc
 	ctx := s.js.opts.ctx
 	if ctx == nil {
-		ctx, cancel = context.WithTimeout(context.Background(), s.js.opts.wait)
+		ctx, cancel = withTimeout(context.Background(), s.js.clock(), s.js.opts.wait)
 		defer cancel()
 	}
 
@@ -1378,7 +3269,7 @@ func (s *streamLister) Next() bool {
 		return false
 	}
 	var resp streamListResponse
-	if err := json.Unmarshal(r.Data, &resp); err != nil {
+	if err := s.js.unmarshal(r.Data, &resp); err != nil {
 		s.err = err
 		return false
 	}
@@ -1411,7 +3302,7 @@ func (jsc *js) Streams(opts ...JSOpt) <-chan *StreamInfo {
 	}
 
 	ch := make(chan *StreamInfo)
-	l := &streamLister{js: &js{nc: jsc.nc, opts: o}}
+	l := &streamLister{js: &js{nc: jsc.nc, opts: o, stats: jsc.stats}}
 	go func() {
 		if cancel != nil {
 			defer cancel()
@@ -1431,6 +3322,29 @@ func (jsc *js) Streams(opts ...JSOpt) <-chan *StreamInfo {
 	return ch
 }
 
+// StreamsPage retrieves a single page of StreamInfo objects.
+func (jsc *js) StreamsPage(offset int, opts ...JSOpt) (*StreamInfoPage, error) {
+	if offset < 0 {
+		return nil, fmt.Errorf("%w: offset cannot be negative", ErrInvalidArg)
+	}
+	o, cancel, err := getJSContextOpts(jsc.opts, opts...)
+	if err != nil {
+		return nil, err
+	}
+	if cancel != nil {
+		defer cancel()
+	}
+
+	l := &streamLister{js: &js{nc: jsc.nc, opts: o, stats: jsc.stats}, offset: offset}
+	if !l.Next() {
+		return nil, l.Err()
+	}
+	return &StreamInfoPage{
+		ListPage: ListPage{Total: l.pageInfo.Total, Offset: l.pageInfo.Offset, Limit: l.pageInfo.Limit},
+		Streams:  l.Page(),
+	}, nil
+}
+
 // StreamsInfo can be used to retrieve a list of StreamInfo objects.
 // DEPRECATED: Use Streams() instead.
 func (jsc *js) StreamsInfo(opts ...JSOpt) <-chan *StreamInfo {
@@ -1458,11 +3372,11 @@ func (l *streamNamesLister) Next() bool {
 	var cancel context.CancelFunc
 	ctx := l.js.opts.ctx
 	if ctx == nil {
-		ctx, cancel = context.WithTimeout(context.Background(), l.js.opts.wait)
+		ctx, cancel = withTimeout(context.Background(), l.js.clock(), l.js.opts.wait)
 		defer cancel()
 	}
 
-	req, err := json.Marshal(streamNamesRequest{
+	req, err := l.js.marshal(streamNamesRequest{
 		apiPagedRequest: apiPagedRequest{Offset: l.offset},
 		Subject:         l.js.opts.streamListSubject,
 	})
@@ -1476,7 +3390,7 @@ func (l *streamNamesLister) Next() bool {
 		return false
 	}
 	var resp streamNamesResponse
-	if err := json.Unmarshal(r.Data, &resp); err != nil {
+	if err := l.js.unmarshal(r.Data, &resp); err != nil {
 		l.err = err
 		return false
 	}
@@ -1509,7 +3423,7 @@ func (jsc *js) StreamNames(opts ...JSOpt) <-chan string {
 	}
 
 	ch := make(chan string)
-	l := &streamNamesLister{js: &js{nc: jsc.nc, opts: o}}
+	l := &streamNamesLister{js: &js{nc: jsc.nc, opts: o, stats: jsc.stats}}
 	go func() {
 		if cancel != nil {
 			defer cancel()
@@ -1538,28 +3452,34 @@ func (jsc *js) StreamNameBySubject(subj string, opts ...JSOpt) (string, error) {
 	if cancel != nil {
 		defer cancel()
 	}
+	pjs := jsc.withPrefix(o)
+	key := pjs.cacheKey(cacheSubjectKey, subj)
+	if stream, ok := jsc.opts.cache.get(key, jsc.clock().Now()); ok {
+		return stream, nil
+	}
 
 	var slr streamNamesResponse
 	req := &streamRequest{subj}
-	j, err := json.Marshal(req)
+	j, err := jsc.marshal(req)
 	if err != nil {
 		return _EMPTY_, err
 	}
 
-	resp, err := jsc.apiRequestWithContext(o.ctx, jsc.apiSubj(apiStreams), j)
+	resp, err := jsc.apiRequestWithContext(o.ctx, pjs.apiSubj(apiStreams), j)
 	if err != nil {
 		if err == ErrNoResponders {
 			err = ErrJetStreamNotEnabled
 		}
 		return _EMPTY_, err
 	}
-	if err := json.Unmarshal(resp.Data, &slr); err != nil {
+	if err := jsc.unmarshal(resp.Data, &slr); err != nil {
 		return _EMPTY_, err
 	}
 
 	if slr.Error != nil || len(slr.Streams) != 1 {
 		return _EMPTY_, ErrNoMatchingStream
 	}
+	jsc.opts.cache.put(key, slr.Streams[0], jsc.clock().Now())
 	return slr.Streams[0], nil
 }
 
@@ -1580,11 +3500,32 @@ func getJSContextOpts(defs *jsOpts, opts ...JSOpt) (*jsOpts, context.CancelFunc,
 	}
 	var cancel context.CancelFunc
 	if o.ctx == nil && o.wait > 0 {
-		o.ctx, cancel = context.WithTimeout(context.Background(), o.wait)
+		var clk clock = realClock{}
+		if o.clock != nil {
+			clk = o.clock
+		} else if defs.clock != nil {
+			clk = defs.clock
+		}
+		o.ctx, cancel = withTimeout(context.Background(), clk, o.wait)
 	}
 	if o.pre == _EMPTY_ {
 		o.pre = defs.pre
 	}
+	if o.codec == nil {
+		o.codec = defs.codec
+	}
 
 	return &o, cancel, nil
 }
+
+// withPrefix returns the context to use for the API requests made with the
+// per-call options o, so that a prefix given by Domain() or APIPrefix() is
+// honored. It shares the resource cache and counters of jsc.
+func (jsc *js) withPrefix(o *jsOpts) *js {
+	if o.pre == jsc.opts.pre {
+		return jsc
+	}
+	opts := *jsc.opts
+	opts.pre, opts.domain = o.pre, o.domain
+	return &js{nc: jsc.nc, opts: &opts, stats: jsc.stats}
+}
@@ -1005,6 +1005,10 @@ func (s *KeyValueBucketStatus) StreamInfo() *StreamInfo { return s.nfo }
 // Bytes is the size of the stream
 func (s *KeyValueBucketStatus) Bytes() uint64 { return s.nfo.State.Bytes }
 
+// NumKeys is the number of distinct subjects in the stream, that is the
+// number of keys including those whose last value is a delete or purge marker
+func (s *KeyValueBucketStatus) NumKeys() uint64 { return s.nfo.State.NumSubjects }
+
 // Status retrieves the status and configuration of a bucket
 func (kv *kvs) Status() (KeyValueStatus, error) {
 	nfo, err := kv.js.StreamInfo(kv.stream)
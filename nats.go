@@ -628,6 +628,12 @@ type Subscription struct {
 //
 //	// Signal the server that the message is being worked on and reset redelivery timer.
 //	msg.InProgress()
+//
+// # Headers
+//
+// JetStream messages delivered through Subscribe(), Fetch() or FetchBatch()
+// carry the full Header as stored in the stream, including the headers set
+// by the publisher and JetStream headers such as Nats-Msg-Id.
 type Msg struct {
 	Subject string
 	Reply   string
@@ -639,6 +645,9 @@ type Msg struct {
 	wsz     int
 	barrier *barrierInfo
 	ackd    uint32
+	// Time (in unix nanoseconds) at which a JetStream message was delivered,
+	// or last marked as in progress.
+	dlvt int64
 }
 
 // Compares two msgs, ignores sub but checks all other public fields.
@@ -2720,6 +2729,10 @@ func (nc *Conn) doReconnect(err error) {
 		// initial connect is now complete.
 		nc.initc = false
 
+		// Pull requests in flight were lost, let the JetStream
+		// subscriptions resend them and notify their handlers.
+		nc.notifyJSReconnect()
+
 		// Queue up the reconnect callback.
 		if nc.Opts.ReconnectedCB != nil {
 			nc.ach.push(func() { nc.Opts.ReconnectedCB(nc) })
@@ -2891,7 +2904,18 @@ func (nc *Conn) waitForMsgs(s *Subscription) {
 	// Used to account for adjustments to sub.pBytes when we wrap back around.
 	msgLen := -1
 
+	// Throttle JetStream subscriptions with a consume rate limit.
+	var rl *rateLimiter
+	s.mu.Lock()
+	if s.jsi != nil {
+		rl = s.jsi.rl
+	}
+	s.mu.Unlock()
+
 	for {
+		if rl != nil {
+			rl.wait(s)
+		}
 		s.mu.Lock()
 		// Do accounting for last msg delivered here so we only lock once
 		// and drain state trips after callback has returned.
@@ -3105,6 +3129,21 @@ func (nc *Conn) processMsg(data []byte) {
 			sub.mu.Unlock()
 			return
 		}
+		if !ctrlMsg && !jsi.ordered && jsi.gapcb != nil {
+			sub.checkSequenceGap(m)
+		}
+		if !ctrlMsg {
+			// Status messages of pull requests have no reply subject.
+			if m.Reply != _EMPTY_ {
+				jsi.js.count(consumedCounter)
+				// A delivered message clears any previous non-fatal error.
+				jsi.lerr, jsi.nerrs = nil, 0
+			}
+			// Record the delivery time, used to compute the ack deadline.
+			if !jsi.ackNone {
+				m.dlvt = jsi.js.clock().Now().UnixNano()
+			}
+		}
 	}
 
 	// Skip processing if this is a control message.
@@ -3558,6 +3597,7 @@ const (
 	consumerStalledHdr = "Nats-Consumer-Stalled"
 	noResponders       = "503"
 	noMessagesSts      = "404"
+	eobSts             = "204"
 	reqTimeoutSts      = "408"
 	jetStream409Sts    = "409"
 	controlMsg         = "100"
@@ -4084,6 +4124,46 @@ func (nc *Conn) QueueSubscribeSyncWithChan(subj, queue string, ch chan *Msg) (*S
 	return nc.subscribe(subj, queue, nil, ch, false, nil)
 }
 
+// SubjectMatch reports whether a subject is matched by a pattern, following
+// the semantics of the server. In the pattern, the "*" wildcard matches any
+// single token and the ">" wildcard, only valid as the last token, matches
+// one or more tokens. The subject is compared literally. Invalid patterns
+// or subjects, e.g. with empty tokens, match nothing.
+func SubjectMatch(pattern, subject string) bool {
+	return matchSubject(pattern, subject, false)
+}
+
+// subjectsCollide reports whether two subjects, possibly containing
+// wildcards, can both match a same subject.
+func subjectsCollide(a, b string) bool {
+	return matchSubject(a, b, true)
+}
+
+// matchSubject matches subject against pattern. If wild is true, the
+// wildcards of subject are expanded like those of pattern, so that it
+// reports whether any subject is matched by both.
+func matchSubject(pattern, subject string, wild bool) bool {
+	if badSubject(pattern) || badSubject(subject) {
+		return false
+	}
+	pt, st := strings.Split(pattern, "."), strings.Split(subject, ".")
+	for i, p := range pt {
+		if p == ">" {
+			return i == len(pt)-1 && len(st) > i
+		}
+		if i >= len(st) {
+			return false
+		}
+		if wild && st[i] == ">" {
+			return i == len(st)-1
+		}
+		if p != "*" && p != st[i] && !(wild && st[i] == "*") {
+			return false
+		}
+	}
+	return len(st) == len(pt)
+}
+
 // badSubject will do quick test on whether a subject is acceptable.
 // Spaces are not allowed and all tokens should be > 0 in len.
 func badSubject(subj string) bool {
@@ -4320,6 +4400,10 @@ func (s *Subscription) Unsubscribe() error {
 		return ErrConnectionDraining
 	}
 	err := conn.unsubscribe(s, 0, false)
+	if err == nil {
+		// Send the acks batched by Consume().
+		s.flushAcks()
+	}
 	if err == nil && dc {
 		err = s.deleteConsumer()
 	}
@@ -4359,6 +4443,10 @@ func (nc *Conn) checkDrained(sub *Subscription) {
 		sub.mu.Unlock()
 
 		if conn == nil || closed || pMsgs == 0 {
+			// Send the acks batched by Consume() while the connection
+			// is still open, it is closed once all subscriptions are
+			// removed when the connection is drained.
+			sub.flushAcks()
 			nc.mu.Lock()
 			nc.removeSub(sub)
 			nc.mu.Unlock()
@@ -4521,6 +4609,9 @@ func (s *Subscription) validateNextMsgState(pullSubInternal bool) error {
 	if s.connClosed {
 		return ErrConnectionClosed
 	}
+	if err := s.jsCtxErr(); err != nil {
+		return err
+	}
 	if s.mch == nil {
 		if s.max > 0 && s.delivered >= s.max {
 			return ErrMaxMessages
@@ -4552,9 +4643,21 @@ func (s *Subscription) getNextMsgErr() error {
 	if s.connClosed {
 		return ErrConnectionClosed
 	}
+	if err := s.jsCtxErr(); err != nil {
+		return err
+	}
 	return ErrBadSubscription
 }
 
+// jsCtxErr returns the error of the context given when creating a
+// JetStream subscription, once it is done. Lock should be held.
+func (s *Subscription) jsCtxErr() error {
+	if s.jsi != nil && s.jsi.sctx != nil {
+		return s.jsi.sctx.Err()
+	}
+	return nil
+}
+
 // processNextMsgDelivered takes a message and applies the needed
 // accounting to the stats from the subscription, returning an
 // error in case we have the maximum number of messages have been
@@ -3010,3 +3010,28 @@ func BenchmarkHeaderDecode(b *testing.B) {
 		})
 	}
 }
+
+func TestSubjectsCollide(t *testing.T) {
+	for _, test := range []struct {
+		a, b    string
+		collide bool
+	}{
+		{"foo", "foo", true},
+		{"foo", "bar", false},
+		{"foo.*", "foo.bar", true},
+		{"foo.bar", "foo.*", true},
+		{"foo.*", "*.bar", true},
+		{"foo.*", "foo.bar.baz", false},
+		{"foo.>", "foo.bar.baz", true},
+		{"foo.bar.baz", "foo.>", true},
+		{"foo.>", "foo", false},
+		{"foo", "foo.>", false},
+		{">", "foo.bar", true},
+		{"foo.*.baz", "foo.>", true},
+		{"foo..bar", "foo.*.bar", false},
+	} {
+		if got := subjectsCollide(test.a, test.b); got != test.collide {
+			t.Fatalf("Expected %q and %q colliding to be %v, got %v", test.a, test.b, test.collide, got)
+		}
+	}
+}
@@ -1287,7 +1287,7 @@ func (js *js) ObjectStoreNames(opts ...ObjectOpt) <-chan string {
 	ch := make(chan string)
 	var cancel context.CancelFunc
 	if o.ctx == nil {
-		o.ctx, cancel = context.WithTimeout(context.Background(), defaultRequestWait)
+		o.ctx, cancel = withTimeout(context.Background(), js.clock(), defaultRequestWait)
 	}
 	l := &streamLister{js: js}
 	l.js.opts.streamListSubject = fmt.Sprintf(objAllChunksPreTmpl, "*")
@@ -1327,7 +1327,7 @@ func (js *js) ObjectStores(opts ...ObjectOpt) <-chan ObjectStoreStatus {
 	ch := make(chan ObjectStoreStatus)
 	var cancel context.CancelFunc
 	if o.ctx == nil {
-		o.ctx, cancel = context.WithTimeout(context.Background(), defaultRequestWait)
+		o.ctx, cancel = withTimeout(context.Background(), js.clock(), defaultRequestWait)
 	}
 	l := &streamLister{js: js}
 	l.js.opts.streamListSubject = fmt.Sprintf(objAllChunksPreTmpl, "*")
@@ -909,6 +909,42 @@ func TestBadSubject(t *testing.T) {
 	}
 }
 
+func TestSubjectMatch(t *testing.T) {
+	for _, test := range []struct {
+		pattern string
+		subject string
+		match   bool
+	}{
+		{"foo", "foo", true},
+		{"foo", "bar", false},
+		{"foo.*", "foo.bar", true},
+		{"foo.*", "foo", false},
+		{"foo.*", "foo.bar.baz", false},
+		{"*.*", "foo.bar", true},
+		{"*.bar.*", "foo.bar.baz", true},
+		{"foo.>", "foo.bar", true},
+		{"foo.>", "foo.bar.baz", true},
+		{"foo.>", "foo", false},
+		{">", "foo", true},
+		{"foo.*.>", "foo.bar", false},
+		{"foo.*.>", "foo.bar.baz", true},
+		// The subject is compared literally.
+		{"foo.bar", "foo.*", false},
+		{"foo.*", "foo.*", true},
+		// Invalid patterns and subjects.
+		{"foo.>.bar", "foo.baz.bar", false},
+		{"foo..bar", "foo..bar", false},
+		{"foo.*", "foo.", false},
+		{"", "foo", false},
+		{"foo", "", false},
+		{"foo bar", "foo bar", false},
+	} {
+		if got := nats.SubjectMatch(test.pattern, test.subject); got != test.match {
+			t.Fatalf("Expected pattern %q matching %q to be %v, got %v", test.pattern, test.subject, test.match, got)
+		}
+	}
+}
+
 func TestOptions(t *testing.T) {
 	s := RunDefaultServer()
 	defer s.Shutdown()
@@ -16,6 +16,7 @@ package test
 import (
 	"context"
 	"crypto/rand"
+	"encoding/json"
 	"errors"
 	"fmt"
 	mrand "math/rand"
@@ -1270,6 +1271,42 @@ func TestPullSubscribeFetchBatch(t *testing.T) {
 		}
 	})
 
+	t.Run("cancel context, check error while fetching", func(t *testing.T) {
+		defer js.PurgeStream("TEST")
+		sub, err := js.PullSubscribe("foo", "")
+		if err != nil {
+			t.Fatalf("Unexpected error: %s", err)
+		}
+		for i := 0; i < 3; i++ {
+			if _, err := js.Publish("foo", []byte("msg")); err != nil {
+				t.Fatalf("Unexpected error: %s", err)
+			}
+		}
+		ctx, cancel := context.WithCancel(context.Background())
+		res, err := sub.FetchBatch(10, nats.Context(ctx))
+		if err != nil {
+			t.Fatalf("Unexpected error: %s", err)
+		}
+		msgs := make([]*nats.Msg, 0)
+		for msg := range res.Messages() {
+			// Error is not set until the batch is done.
+			if res.Error() != nil {
+				t.Fatalf("Unexpected error: %s", res.Error())
+			}
+			msgs = append(msgs, msg)
+			if len(msgs) == 3 {
+				cancel()
+			}
+		}
+		<-res.Done()
+		if !errors.Is(res.Error(), context.Canceled) {
+			t.Fatalf("Expected error: %s; got: %s", context.Canceled, res.Error())
+		}
+		if len(msgs) != 3 {
+			t.Fatalf("Expected %d messages; got: %d", 3, len(msgs))
+		}
+	})
+
 	t.Run("remove durable consumer during fetch", func(t *testing.T) {
 		defer js.PurgeStream("TEST")
 		sub, err := js.PullSubscribe("foo", "cons")
@@ -8471,9 +8508,9 @@ func TestJetStreamDirectGetMsg(t *testing.T) {
 	send("bar", "d")
 	send("foo", "e")
 
-	// Without AllowDirect, we should get a timeout (so reduce the timeout for this call)
-	if _, err := js.GetMsg("DGM", 1, nats.DirectGet(), nats.MaxWait(200*time.Millisecond)); err != context.DeadlineExceeded {
-		t.Fatalf("Unexpected error: %v", err)
+	// Without AllowDirect, the regular get message API is used.
+	if r, err := js.GetMsg("DGM", 1, nats.DirectGet(), nats.MaxWait(200*time.Millisecond)); err != nil || string(r.Data) != "a" {
+		t.Fatalf("Unexpected result: %v, %v", r, err)
 	}
 
 	// Update stream:
@@ -8789,3 +8826,5650 @@ func TestJetStreamStreamInfoAlternates(t *testing.T) {
 		}
 	})
 }
+
+func TestJetStreamMsgAckDeadline(t *testing.T) {
+	s := RunBasicJetStreamServer()
+	defer shutdownJSServerAndRemoveStorage(t, s)
+
+	nc, js := jsClient(t, s)
+	defer nc.Close()
+
+	_, err := js.AddStream(&nats.StreamConfig{Name: "TEST", Subjects: []string{"foo"}})
+	expectOk(t, err)
+
+	_, err = js.Publish("foo", []byte("hello"))
+	expectOk(t, err)
+
+	sub, err := js.PullSubscribe("foo", "dlc", nats.AckWait(2*time.Second))
+	expectOk(t, err)
+	defer sub.Unsubscribe()
+
+	start := time.Now()
+	msgs, err := sub.Fetch(1)
+	expectOk(t, err)
+
+	deadline, err := msgs[0].AckDeadline()
+	expectOk(t, err)
+	if deadline.Before(start.Add(2*time.Second)) || deadline.After(time.Now().Add(2*time.Second)) {
+		t.Fatalf("Unexpected ack deadline: %v", deadline)
+	}
+
+	time.Sleep(100 * time.Millisecond)
+	expectOk(t, msgs[0].InProgress())
+	extended, err := msgs[0].AckDeadline()
+	expectOk(t, err)
+	if !extended.After(deadline) {
+		t.Fatalf("Expected ack deadline to be extended after InProgress, got %v (was %v)", extended, deadline)
+	}
+
+	expectOk(t, msgs[0].AckSync())
+	if _, err := msgs[0].AckDeadline(); !errors.Is(err, nats.ErrMsgAlreadyAckd) {
+		t.Fatalf("Expected error %v, got %v", nats.ErrMsgAlreadyAckd, err)
+	}
+
+	// Plain NATS messages do not have an ack deadline.
+	nsub, err := nc.SubscribeSync("bar")
+	expectOk(t, err)
+	expectOk(t, nc.PublishRequest("bar", "reply", nil))
+	msg, err := nsub.NextMsg(time.Second)
+	expectOk(t, err)
+	if _, err := msg.AckDeadline(); !errors.Is(err, nats.ErrNotJSMessage) {
+		t.Fatalf("Expected error %v, got %v", nats.ErrNotJSMessage, err)
+	}
+}
+
+func TestJetStreamConsumerDeliverGroupValidation(t *testing.T) {
+	s := RunBasicJetStreamServer()
+	defer shutdownJSServerAndRemoveStorage(t, s)
+
+	nc, js := jsClient(t, s)
+	defer nc.Close()
+
+	_, err := js.AddStream(&nats.StreamConfig{Name: "TEST", Subjects: []string{"foo"}})
+	expectOk(t, err)
+
+	// A deliver group on a pull consumer is rejected client side.
+	_, err = js.AddConsumer("TEST", &nats.ConsumerConfig{
+		Durable:      "pull",
+		AckPolicy:    nats.AckExplicitPolicy,
+		DeliverGroup: "workers",
+	})
+	if !errors.Is(err, nats.ErrInvalidConsumerConfig) {
+		t.Fatalf("Expected error %v, got %v", nats.ErrInvalidConsumerConfig, err)
+	}
+	_, err = js.UpdateConsumer("TEST", &nats.ConsumerConfig{
+		Durable:      "pull",
+		AckPolicy:    nats.AckExplicitPolicy,
+		DeliverGroup: "workers",
+	})
+	if !errors.Is(err, nats.ErrInvalidConsumerConfig) {
+		t.Fatalf("Expected error %v, got %v", nats.ErrInvalidConsumerConfig, err)
+	}
+
+	// With a deliver subject, the consumer is created.
+	ci, err := js.AddConsumer("TEST", &nats.ConsumerConfig{
+		Durable:        "push",
+		AckPolicy:      nats.AckExplicitPolicy,
+		DeliverSubject: "deliver",
+		DeliverGroup:   "workers",
+	})
+	expectOk(t, err)
+	if ci.Config.DeliverGroup != "workers" {
+		t.Fatalf("Expected deliver group %q, got %q", "workers", ci.Config.DeliverGroup)
+	}
+}
+
+func TestJetStreamRecreateStream(t *testing.T) {
+	s := RunBasicJetStreamServer()
+	defer shutdownJSServerAndRemoveStorage(t, s)
+
+	nc, js := jsClient(t, s)
+	defer nc.Close()
+
+	_, err := js.AddStream(&nats.StreamConfig{
+		Name:        "TEST",
+		Description: "test stream",
+		Subjects:    []string{"foo.*"},
+		MaxMsgs:     100,
+	})
+	expectOk(t, err)
+
+	for i := 0; i < 10; i++ {
+		_, err := js.Publish("foo.A", []byte("hello"))
+		expectOk(t, err)
+	}
+	_, err = js.AddConsumer("TEST", &nats.ConsumerConfig{Durable: "dlc", AckPolicy: nats.AckExplicitPolicy})
+	expectOk(t, err)
+
+	si, err := js.RecreateStream("TEST")
+	expectOk(t, err)
+	if si.State.Msgs != 0 || si.State.LastSeq != 0 {
+		t.Fatalf("Expected empty stream, got state: %+v", si.State)
+	}
+	if si.Config.Description != "test stream" || si.Config.MaxMsgs != 100 {
+		t.Fatalf("Expected config to be preserved, got: %+v", si.Config)
+	}
+	if _, err := js.ConsumerInfo("TEST", "dlc"); !errors.Is(err, nats.ErrConsumerNotFound) {
+		t.Fatalf("Expected error %v, got %v", nats.ErrConsumerNotFound, err)
+	}
+
+	ack, err := js.Publish("foo.B", []byte("hello"))
+	expectOk(t, err)
+	if ack.Sequence != 1 {
+		t.Fatalf("Expected sequence 1, got %d", ack.Sequence)
+	}
+
+	if _, err := js.RecreateStream("NOT-EXIST"); !errors.Is(err, nats.ErrStreamNotFound) {
+		t.Fatalf("Expected error %v, got %v", nats.ErrStreamNotFound, err)
+	}
+
+	// Requests are made with the API prefix of the call.
+	relayed := relayJSAPI(t, nc, "$JS.relay.API.")
+	_, err = js.RecreateStream("TEST", nats.APIPrefix("$JS.relay.API"))
+	expectOk(t, err)
+	if subjs := relayed(); len(subjs) != 3 {
+		t.Fatalf("Expected 3 requests with the API prefix, got %q", subjs)
+	}
+
+	// The configuration of the deleted stream is returned if it can not be
+	// created again.
+	_, err = nc.Subscribe("$JS.fail.API.>", func(m *nats.Msg) {
+		subj := strings.TrimPrefix(m.Subject, "$JS.fail.API.")
+		if strings.HasPrefix(subj, "STREAM.CREATE.") {
+			m.Respond([]byte(`{"type":"io.nats.jetstream.api.v1.stream_create_response","error":{"code":500,"err_code":10049,"description":"stream create failed"}}`))
+			return
+		}
+		resp, err := nc.Request("$JS.API."+subj, m.Data, time.Second)
+		if err != nil {
+			return
+		}
+		m.Respond(resp.Data)
+	})
+	expectOk(t, err)
+	_, err = js.RecreateStream("TEST", nats.APIPrefix("$JS.fail.API"))
+	var rerr *nats.StreamRecreateError
+	if !errors.As(err, &rerr) {
+		t.Fatalf("Expected stream recreate error, got %v", err)
+	}
+	if rerr.Config.Name != "TEST" || rerr.Config.MaxMsgs != 100 {
+		t.Fatalf("Expected config of the deleted stream, got: %+v", rerr.Config)
+	}
+	var apiErr *nats.APIError
+	if !errors.As(err, &apiErr) || apiErr.ErrorCode != 10049 {
+		t.Fatalf("Expected the create error, got %v", err)
+	}
+	if _, err := js.StreamInfo("TEST"); !errors.Is(err, nats.ErrStreamNotFound) {
+		t.Fatalf("Expected error %v, got %v", nats.ErrStreamNotFound, err)
+	}
+
+	if _, err := js.RecreateStream(""); !errors.Is(err, nats.ErrStreamNameRequired) {
+		t.Fatalf("Expected error %v, got %v", nats.ErrStreamNameRequired, err)
+	}
+}
+
+func TestJetStreamConsumerInfoPushDelivery(t *testing.T) {
+	s := RunBasicJetStreamServer()
+	defer shutdownJSServerAndRemoveStorage(t, s)
+
+	nc, js := jsClient(t, s)
+	defer nc.Close()
+
+	_, err := js.AddStream(&nats.StreamConfig{Name: "TEST", Subjects: []string{"foo"}})
+	expectOk(t, err)
+
+	sub, err := js.SubscribeSync("foo", nats.Durable("dlc"), nats.EnableFlowControl(), nats.IdleHeartbeat(time.Second))
+	expectOk(t, err)
+	defer sub.Unsubscribe()
+
+	ci, err := sub.ConsumerInfo()
+	expectOk(t, err)
+	if ci.Config.DeliverSubject == "" || ci.Config.DeliverSubject != sub.Subject {
+		t.Fatalf("Expected deliver subject %q, got %q", sub.Subject, ci.Config.DeliverSubject)
+	}
+	if !ci.Config.FlowControl {
+		t.Fatalf("Expected flow control to be enabled")
+	}
+	if !ci.PushBound {
+		t.Fatalf("Expected consumer to be push bound")
+	}
+
+	qsub, err := js.QueueSubscribeSync("foo", "workers")
+	expectOk(t, err)
+	defer qsub.Unsubscribe()
+
+	ci, err = qsub.ConsumerInfo()
+	expectOk(t, err)
+	if ci.Config.DeliverGroup != "workers" {
+		t.Fatalf("Expected deliver group %q, got %q", "workers", ci.Config.DeliverGroup)
+	}
+	if ci.Config.DeliverSubject != qsub.Subject {
+		t.Fatalf("Expected deliver subject %q, got %q", qsub.Subject, ci.Config.DeliverSubject)
+	}
+}
+
+func TestJetStreamSkipConsumerLookup(t *testing.T) {
+	conf := createConfFile(t, []byte(`
+		listen: 127.0.0.1:-1
+		jetstream: {max_mem_store: 64MB, max_file_store: 64MB}
+		accounts: {
+			A: {
+				jetstream: enabled
+				users: [
+					{user: admin, password: pwd},
+					{user: worker, password: pwd, permissions: { publish: { deny: ["$JS.API.CONSUMER.INFO.>"] } } }
+				]
+			}
+		}
+	`))
+	defer os.Remove(conf)
+
+	s, _ := RunServerWithConfig(conf)
+	defer shutdownJSServerAndRemoveStorage(t, s)
+
+	nc, js := jsClient(t, s, nats.UserInfo("admin", "pwd"))
+	defer nc.Close()
+
+	_, err := js.AddStream(&nats.StreamConfig{Name: "TEST", Subjects: []string{"foo"}})
+	expectOk(t, err)
+	_, err = js.AddConsumer("TEST", &nats.ConsumerConfig{Durable: "dlc", AckPolicy: nats.AckExplicitPolicy})
+	expectOk(t, err)
+	for i := 0; i < 5; i++ {
+		_, err := js.Publish("foo", []byte("hello"))
+		expectOk(t, err)
+	}
+
+	wnc, wjs := jsClient(t, s, nats.UserInfo("worker", "pwd"))
+	defer wnc.Close()
+
+	if _, err := wjs.ConsumerInfo("TEST", "dlc", nats.MaxWait(250*time.Millisecond)); err == nil {
+		t.Fatalf("Expected consumer info to be denied")
+	}
+
+	start := time.Now()
+	sub, err := wjs.PullSubscribe("foo", "", nats.Bind("TEST", "dlc"), nats.SkipConsumerLookup())
+	expectOk(t, err)
+	defer sub.Unsubscribe()
+	if elapsed := time.Since(start); elapsed > time.Second {
+		t.Fatalf("Expected subscribe not to wait for consumer lookup, took %v", elapsed)
+	}
+
+	msgs, err := sub.Fetch(5, nats.MaxWait(2*time.Second))
+	expectOk(t, err)
+	if len(msgs) != 5 {
+		t.Fatalf("Expected 5 messages, got %d", len(msgs))
+	}
+	for _, msg := range msgs {
+		expectOk(t, msg.AckSync())
+	}
+
+	// Binding to a push consumer requires the deliver subject.
+	_, err = wjs.SubscribeSync("foo", nats.Bind("TEST", "push"), nats.SkipConsumerLookup())
+	if err == nil {
+		t.Fatalf("Expected error when binding to a push consumer without deliver subject")
+	}
+}
+
+func TestJetStreamStreamAndConsumerExists(t *testing.T) {
+	s := RunBasicJetStreamServer()
+	defer shutdownJSServerAndRemoveStorage(t, s)
+
+	nc, js := jsClient(t, s)
+	defer nc.Close()
+
+	ok, err := js.StreamExists("TEST")
+	expectOk(t, err)
+	if ok {
+		t.Fatalf("Expected stream not to exist")
+	}
+	ok, err = js.ConsumerExists("TEST", "dlc")
+	expectOk(t, err)
+	if ok {
+		t.Fatalf("Expected consumer not to exist")
+	}
+
+	_, err = js.AddStream(&nats.StreamConfig{Name: "TEST", Subjects: []string{"foo"}})
+	expectOk(t, err)
+
+	ok, err = js.StreamExists("TEST")
+	expectOk(t, err)
+	if !ok {
+		t.Fatalf("Expected stream to exist")
+	}
+	ok, err = js.ConsumerExists("TEST", "dlc")
+	expectOk(t, err)
+	if ok {
+		t.Fatalf("Expected consumer not to exist")
+	}
+
+	_, err = js.AddConsumer("TEST", &nats.ConsumerConfig{Durable: "dlc", AckPolicy: nats.AckExplicitPolicy})
+	expectOk(t, err)
+	ok, err = js.ConsumerExists("TEST", "dlc")
+	expectOk(t, err)
+	if !ok {
+		t.Fatalf("Expected consumer to exist")
+	}
+
+	// Invalid names and transport errors are still reported.
+	if _, err := js.StreamExists("A.B"); !errors.Is(err, nats.ErrInvalidStreamName) {
+		t.Fatalf("Expected error %v, got %v", nats.ErrInvalidStreamName, err)
+	}
+	if _, err := js.ConsumerExists("TEST", ""); !errors.Is(err, nats.ErrConsumerNameRequired) {
+		t.Fatalf("Expected error %v, got %v", nats.ErrConsumerNameRequired, err)
+	}
+	nc.Close()
+	if _, err := js.StreamExists("TEST"); err == nil {
+		t.Fatalf("Expected error on closed connection")
+	}
+}
+
+func TestJetStreamConsumerNamePrefix(t *testing.T) {
+	s := RunBasicJetStreamServer()
+	defer shutdownJSServerAndRemoveStorage(t, s)
+
+	nc, js := jsClient(t, s)
+	defer nc.Close()
+
+	_, err := js.AddStream(&nats.StreamConfig{Name: "TEST", Subjects: []string{"foo"}})
+	expectOk(t, err)
+	_, err = js.Publish("foo", []byte("hello"))
+	expectOk(t, err)
+
+	checkName := func(sub *nats.Subscription) string {
+		t.Helper()
+		ci, err := sub.ConsumerInfo()
+		expectOk(t, err)
+		if !strings.HasPrefix(ci.Name, "ingest-") || len(ci.Name) == len("ingest-") {
+			t.Fatalf("Expected consumer name with prefix %q, got %q", "ingest-", ci.Name)
+		}
+		if ci.Config.Durable != "" {
+			t.Fatalf("Expected ephemeral consumer, got durable %q", ci.Config.Durable)
+		}
+		return ci.Name
+	}
+
+	sub1, err := js.SubscribeSync("foo", nats.ConsumerNamePrefix("ingest-"))
+	expectOk(t, err)
+	name1 := checkName(sub1)
+	if _, err := sub1.NextMsg(time.Second); err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+
+	sub2, err := js.PullSubscribe("foo", "", nats.ConsumerNamePrefix("ingest-"))
+	expectOk(t, err)
+	name2 := checkName(sub2)
+	if name1 == name2 {
+		t.Fatalf("Expected unique consumer names, got %q twice", name1)
+	}
+	msgs, err := sub2.Fetch(1)
+	expectOk(t, err)
+	if len(msgs) != 1 {
+		t.Fatalf("Expected 1 message, got %d", len(msgs))
+	}
+
+	// Consumers created by the library are removed on unsubscribe.
+	expectOk(t, sub1.Unsubscribe())
+	if _, err := js.ConsumerInfo("TEST", name1); !errors.Is(err, nats.ErrConsumerNotFound) {
+		t.Fatalf("Expected error %v, got %v", nats.ErrConsumerNotFound, err)
+	}
+
+	if _, err := js.SubscribeSync("foo", nats.ConsumerNamePrefix("in.gest")); !errors.Is(err, nats.ErrInvalidConsumerName) {
+		t.Fatalf("Expected error %v, got %v", nats.ErrInvalidConsumerName, err)
+	}
+	if _, err := js.SubscribeSync("foo", nats.OrderedConsumer(), nats.ConsumerNamePrefix("ingest-")); err == nil {
+		t.Fatalf("Expected error for ordered consumer with name prefix")
+	}
+}
+
+func TestJetStreamGetLastMsgsForSubjects(t *testing.T) {
+	// Batched direct gets are served by the stream, emulate the
+	// responses here to check how the client assembles them.
+	s := RunServerOnPort(-1)
+	defer s.Shutdown()
+
+	nc, js := jsClient(t, s)
+	defer nc.Close()
+
+	stored := map[string]string{"foo.A": "a", "foo.B": "b"}
+	_, err := nc.Subscribe("$JS.API.DIRECT.GET.TEST", func(m *nats.Msg) {
+		var req struct {
+			MultiLast []string `json:"multi_last"`
+		}
+		if err := json.Unmarshal(m.Data, &req); err != nil {
+			t.Errorf("Unexpected error: %v", err)
+			return
+		}
+		var seq int
+		for _, subj := range req.MultiLast {
+			data, ok := stored[subj]
+			if !ok {
+				continue
+			}
+			seq++
+			resp := nats.NewMsg(m.Reply)
+			resp.Header.Set(nats.JSStream, "TEST")
+			resp.Header.Set(nats.JSSubject, subj)
+			resp.Header.Set(nats.JSSequence, strconv.Itoa(seq))
+			resp.Header.Set(nats.JSTimeStamp, time.Now().UTC().Format(time.RFC3339Nano))
+			resp.Data = []byte(data)
+			nc.PublishMsg(resp)
+		}
+		eob := nats.NewMsg(m.Reply)
+		eob.Header.Set("Status", "204")
+		eob.Header.Set("Description", "EOB")
+		nc.PublishMsg(eob)
+	})
+	expectOk(t, err)
+
+	msgs, err := js.GetLastMsgsForSubjects("TEST", []string{"foo.A", "foo.B", "foo.C"})
+	expectOk(t, err)
+	if len(msgs) != 2 {
+		t.Fatalf("Expected 2 messages, got %d", len(msgs))
+	}
+	for subj, data := range stored {
+		msg, ok := msgs[subj]
+		if !ok {
+			t.Fatalf("Expected message for subject %q", subj)
+		}
+		if string(msg.Data) != data {
+			t.Fatalf("Expected data %q, got %q", data, msg.Data)
+		}
+	}
+
+	msgs, err = js.GetLastMsgsForSubjects("TEST", []string{"foo.C"})
+	expectOk(t, err)
+	if len(msgs) != 0 {
+		t.Fatalf("Expected no messages, got %d", len(msgs))
+	}
+
+	if _, err := js.GetLastMsgsForSubjects("TEST", nil); !errors.Is(err, nats.ErrInvalidArg) {
+		t.Fatalf("Expected error %v, got %v", nats.ErrInvalidArg, err)
+	}
+	if _, err := js.GetLastMsgsForSubjects("OTHER", []string{"foo.A"}); !errors.Is(err, nats.ErrNoResponders) {
+		t.Fatalf("Expected error %v, got %v", nats.ErrNoResponders, err)
+	}
+}
+
+func TestJetStreamSubscribeLastError(t *testing.T) {
+	s := RunBasicJetStreamServer()
+	defer shutdownJSServerAndRemoveStorage(t, s)
+
+	errCh := make(chan error, 10)
+	nc, js := jsClient(t, s, nats.ErrorHandler(func(_ *nats.Conn, _ *nats.Subscription, err error) {
+		errCh <- err
+	}))
+	defer nc.Close()
+
+	_, err := js.AddStream(&nats.StreamConfig{Name: "TEST", Subjects: []string{"foo"}})
+	expectOk(t, err)
+
+	cfg := &nats.ConsumerConfig{
+		Durable:        "dlc",
+		AckPolicy:      nats.AckExplicitPolicy,
+		DeliverSubject: "deliver",
+		Heartbeat:      100 * time.Millisecond,
+	}
+	_, err = js.AddConsumer("TEST", cfg)
+	expectOk(t, err)
+
+	sub, err := js.SubscribeSync("foo", nats.Bind("TEST", "dlc"))
+	expectOk(t, err)
+	defer sub.Unsubscribe()
+
+	if err := sub.LastError(); err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+
+	// Deleting the consumer stops heartbeats.
+	expectOk(t, js.DeleteConsumer("TEST", "dlc"))
+	select {
+	case err := <-errCh:
+		if !errors.Is(err, nats.ErrConsumerNotActive) {
+			t.Fatalf("Expected error %v, got %v", nats.ErrConsumerNotActive, err)
+		}
+	case <-time.After(2 * time.Second):
+		t.Fatalf("Did not receive missed heartbeats error")
+	}
+	err = sub.LastError()
+	if !errors.Is(err, nats.ErrConsumerNotActive) {
+		t.Fatalf("Expected error %v, got %v", nats.ErrConsumerNotActive, err)
+	}
+	var subErr *nats.SubscriptionError
+	if !errors.As(err, &subErr) || subErr.Time.IsZero() {
+		t.Fatalf("Expected error with timestamp, got %v", err)
+	}
+
+	// Once messages are delivered again, the error is cleared.
+	_, err = js.AddConsumer("TEST", cfg)
+	expectOk(t, err)
+	_, err = js.Publish("foo", []byte("hello"))
+	expectOk(t, err)
+	msg, err := sub.NextMsg(2 * time.Second)
+	expectOk(t, err)
+	expectOk(t, msg.Ack())
+	if err := sub.LastError(); err != nil {
+		t.Fatalf("Expected error to be cleared, got %v", err)
+	}
+}
+
+func TestJetStreamConsumeInactiveThreshold(t *testing.T) {
+	s := RunBasicJetStreamServer()
+	defer shutdownJSServerAndRemoveStorage(t, s)
+
+	nc, js := jsClient(t, s)
+	defer nc.Close()
+
+	_, err := js.AddStream(&nats.StreamConfig{Name: "TEST", Subjects: []string{"foo"}})
+	expectOk(t, err)
+
+	// Consumers created by subscribe calls are left to the server defaults.
+	creates, err := nc.SubscribeSync("$JS.API.CONSUMER.CREATE.>")
+	expectOk(t, err)
+	sub, err := js.PullSubscribe("foo", "")
+	expectOk(t, err)
+	defer sub.Unsubscribe()
+	req, err := creates.NextMsg(time.Second)
+	expectOk(t, err)
+	if strings.Contains(string(req.Data), "inactive_threshold") {
+		t.Fatalf("Expected no inactive threshold to be requested, got %s", req.Data)
+	}
+	creates.Unsubscribe()
+
+	// An ephemeral consumer recreated by Consume is removed once inactive.
+	nc2, js2 := jsClient(t, s)
+	sub2, err := js2.Consume("TEST", "eph", func(m *nats.Msg) {},
+		nats.ConsumeWaitForReady(2*time.Second),
+		nats.ConsumeRecreateOnDelete(nats.ConsumerConfig{Name: "eph", AckPolicy: nats.AckExplicitPolicy}))
+	expectOk(t, err)
+	defer sub2.Unsubscribe()
+	ci, err := js.ConsumerInfo("TEST", "eph")
+	expectOk(t, err)
+	if ci.Config.InactiveThreshold != 5*time.Second {
+		t.Fatalf("Expected default inactive threshold of 5s, got %v", ci.Config.InactiveThreshold)
+	}
+
+	// Unless another threshold is given.
+	sub3, err := js.Consume("TEST", "eph2", func(m *nats.Msg) {},
+		nats.ConsumeWaitForReady(2*time.Second),
+		nats.ConsumeRecreateOnDelete(nats.ConsumerConfig{Name: "eph2", AckPolicy: nats.AckExplicitPolicy, InactiveThreshold: time.Minute}))
+	expectOk(t, err)
+	defer sub3.Unsubscribe()
+	ci, err = js.ConsumerInfo("TEST", "eph2")
+	expectOk(t, err)
+	if ci.Config.InactiveThreshold != time.Minute {
+		t.Fatalf("Expected inactive threshold of 1m, got %v", ci.Config.InactiveThreshold)
+	}
+
+	// Durable consumers are not affected.
+	sub4, err := js.Consume("TEST", "dlc", func(m *nats.Msg) {},
+		nats.ConsumeWaitForReady(2*time.Second),
+		nats.ConsumeRecreateOnDelete(nats.ConsumerConfig{AckPolicy: nats.AckExplicitPolicy}))
+	expectOk(t, err)
+	defer sub4.Unsubscribe()
+	ci, err = js.ConsumerInfo("TEST", "dlc")
+	expectOk(t, err)
+	if ci.Config.InactiveThreshold != 0 {
+		t.Fatalf("Expected no inactive threshold for durable, got %v", ci.Config.InactiveThreshold)
+	}
+
+	// The abandoned ephemeral is reaped by the server.
+	nc2.Close()
+	checkFor(t, 10*time.Second, 100*time.Millisecond, func() error {
+		if _, err := js.ConsumerInfo("TEST", "eph"); !errors.Is(err, nats.ErrConsumerNotFound) {
+			return fmt.Errorf("expected consumer to be removed, got %v", err)
+		}
+		return nil
+	})
+}
+
+func TestJetStreamStreamOfflineError(t *testing.T) {
+	// Emulate responses of a stream whose replicas are all offline.
+	s := RunServerOnPort(-1)
+	defer s.Shutdown()
+
+	nc, js := jsClient(t, s)
+	defer nc.Close()
+
+	offline := []byte(`{"error":{"code":500,"err_code":10118,"description":"stream is offline"}}`)
+	_, err := nc.Subscribe("$JS.API.STREAM.INFO.TEST", func(m *nats.Msg) { m.Respond(offline) })
+	expectOk(t, err)
+	_, err = nc.Subscribe("$JS.API.CONSUMER.INFO.TEST.dlc", func(m *nats.Msg) { m.Respond(offline) })
+	expectOk(t, err)
+
+	_, err = js.StreamInfo("TEST")
+	if !errors.Is(err, nats.ErrStreamOffline) {
+		t.Fatalf("Expected error %v, got %v", nats.ErrStreamOffline, err)
+	}
+	if errors.Is(err, nats.ErrStreamNotFound) {
+		t.Fatalf("Offline error should not match %v", nats.ErrStreamNotFound)
+	}
+	if ok, err := js.StreamExists("TEST"); ok || !errors.Is(err, nats.ErrStreamOffline) {
+		t.Fatalf("Expected error %v, got %v", nats.ErrStreamOffline, err)
+	}
+
+	_, err = js.ConsumerInfo("TEST", "dlc")
+	if !errors.Is(err, nats.ErrStreamOffline) {
+		t.Fatalf("Expected error %v, got %v", nats.ErrStreamOffline, err)
+	}
+}
+
+func TestJetStreamConsumerProgress(t *testing.T) {
+	s := RunBasicJetStreamServer()
+	defer shutdownJSServerAndRemoveStorage(t, s)
+
+	nc, js := jsClient(t, s)
+	defer nc.Close()
+
+	_, err := js.AddStream(&nats.StreamConfig{Name: "TEST", Subjects: []string{"foo"}})
+	expectOk(t, err)
+	for i := 0; i < 10; i++ {
+		_, err := js.Publish("foo", []byte("hello"))
+		expectOk(t, err)
+	}
+
+	sub, err := js.PullSubscribe("foo", "dlc")
+	expectOk(t, err)
+	defer sub.Unsubscribe()
+
+	msgs, err := sub.Fetch(4)
+	expectOk(t, err)
+	for _, msg := range msgs[:3] {
+		expectOk(t, msg.AckSync())
+	}
+
+	p, err := sub.ConsumerProgress()
+	expectOk(t, err)
+	if p.Delivered.Stream != 4 || p.AckFloor.Stream != 3 {
+		t.Fatalf("Unexpected sequences, delivered: %+v, ack floor: %+v", p.Delivered, p.AckFloor)
+	}
+	if p.NumAckPending != 1 || p.NumPending != 6 {
+		t.Fatalf("Unexpected pending counts: %+v", p)
+	}
+	if lag := p.Lag(); lag != 7 {
+		t.Fatalf("Expected lag of 7, got %d", lag)
+	}
+
+	nsub, err := nc.SubscribeSync("bar")
+	expectOk(t, err)
+	if _, err := nsub.ConsumerProgress(); !errors.Is(err, nats.ErrTypeSubscription) {
+		t.Fatalf("Expected error %v, got %v", nats.ErrTypeSubscription, err)
+	}
+}
+
+func TestJetStreamConsumerFilterSubjectsValidation(t *testing.T) {
+	s := RunBasicJetStreamServer()
+	defer shutdownJSServerAndRemoveStorage(t, s)
+
+	nc, js := jsClient(t, s)
+	defer nc.Close()
+
+	_, err := js.AddStream(&nats.StreamConfig{Name: "TEST", Subjects: []string{"foo.*"}})
+	expectOk(t, err)
+
+	tests := []struct {
+		name string
+		cfg  *nats.ConsumerConfig
+	}{
+		{
+			name: "filter subject and filter subjects",
+			cfg: &nats.ConsumerConfig{
+				Durable:        "dlc",
+				AckPolicy:      nats.AckExplicitPolicy,
+				FilterSubject:  "foo.A",
+				FilterSubjects: []string{"foo.B"},
+			},
+		},
+		{
+			name: "empty filter subject in list",
+			cfg: &nats.ConsumerConfig{
+				Durable:        "dlc",
+				AckPolicy:      nats.AckExplicitPolicy,
+				FilterSubjects: []string{"foo.A", ""},
+			},
+		},
+		{
+			name: "last per subject without filter",
+			cfg: &nats.ConsumerConfig{
+				Durable:       "dlc",
+				AckPolicy:     nats.AckExplicitPolicy,
+				DeliverPolicy: nats.DeliverLastPerSubjectPolicy,
+			},
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			if _, err := js.AddConsumer("TEST", test.cfg); !errors.Is(err, nats.ErrInvalidConsumerConfig) {
+				t.Fatalf("Expected error %v, got %v", nats.ErrInvalidConsumerConfig, err)
+			}
+			if _, err := js.UpdateConsumer("TEST", test.cfg); !errors.Is(err, nats.ErrInvalidConsumerConfig) {
+				t.Fatalf("Expected error %v, got %v", nats.ErrInvalidConsumerConfig, err)
+			}
+		})
+	}
+}
+
+func TestJetStreamSubscribeMaxConsecutiveErrors(t *testing.T) {
+	s := RunBasicJetStreamServer()
+	defer shutdownJSServerAndRemoveStorage(t, s)
+
+	var errs int32
+	nc, js := jsClient(t, s, nats.ErrorHandler(func(_ *nats.Conn, _ *nats.Subscription, err error) {
+		atomic.AddInt32(&errs, 1)
+	}))
+	defer nc.Close()
+
+	_, err := js.AddStream(&nats.StreamConfig{Name: "TEST", Subjects: []string{"foo"}})
+	expectOk(t, err)
+
+	if _, err := js.SubscribeSync("foo", nats.MaxConsecutiveErrors(0)); err == nil {
+		t.Fatalf("Expected error for invalid MaxConsecutiveErrors value")
+	}
+
+	_, err = js.AddConsumer("TEST", &nats.ConsumerConfig{
+		Durable:        "dlc",
+		AckPolicy:      nats.AckExplicitPolicy,
+		DeliverSubject: "deliver",
+		Heartbeat:      50 * time.Millisecond,
+	})
+	expectOk(t, err)
+
+	sub, err := js.SubscribeSync("foo", nats.Bind("TEST", "dlc"), nats.MaxConsecutiveErrors(3))
+	expectOk(t, err)
+	defer sub.Unsubscribe()
+
+	// Deleting the consumer stops heartbeats, the subscription
+	// gives up after 3 consecutive missed heartbeats.
+	expectOk(t, js.DeleteConsumer("TEST", "dlc"))
+	checkFor(t, 2*time.Second, 50*time.Millisecond, func() error {
+		if sub.IsValid() {
+			return fmt.Errorf("subscription still valid")
+		}
+		return nil
+	})
+	if n := atomic.LoadInt32(&errs); n < 3 {
+		t.Fatalf("Expected at least 3 errors, got %d", n)
+	}
+	if err := sub.LastError(); !errors.Is(err, nats.ErrConsumerNotActive) {
+		t.Fatalf("Expected error %v, got %v", nats.ErrConsumerNotActive, err)
+	}
+
+	// A pull subscription gives up after 3 consecutive failed pulls.
+	_, err = js.AddConsumer("TEST", &nats.ConsumerConfig{Durable: "pull", AckPolicy: nats.AckExplicitPolicy})
+	expectOk(t, err)
+	psub, err := js.PullSubscribe("foo", "pull", nats.MaxConsecutiveErrors(3))
+	expectOk(t, err)
+	defer psub.Unsubscribe()
+
+	// Pulls expiring without messages are not failures.
+	for i := 0; i < 3; i++ {
+		if _, err := psub.Fetch(1, nats.MaxWait(100*time.Millisecond)); err != nats.ErrTimeout {
+			t.Fatalf("Expected error %v, got %v", nats.ErrTimeout, err)
+		}
+	}
+	if !psub.IsValid() || psub.LastError() != nil {
+		t.Fatalf("Expected subscription to be valid, got %v", psub.LastError())
+	}
+
+	expectOk(t, js.DeleteConsumer("TEST", "pull"))
+	for i := 0; i < 3; i++ {
+		if _, err := psub.Fetch(1, nats.MaxWait(500*time.Millisecond)); err == nil || err == nats.ErrTimeout {
+			t.Fatalf("Expected pull to fail, got %v", err)
+		}
+	}
+	checkFor(t, 2*time.Second, 50*time.Millisecond, func() error {
+		if psub.IsValid() {
+			return fmt.Errorf("subscription still valid")
+		}
+		return nil
+	})
+	if err := psub.LastError(); err == nil {
+		t.Fatal("Expected the last pull error to be recorded")
+	}
+}
+
+func TestJetStreamAckBySubject(t *testing.T) {
+	s := RunBasicJetStreamServer()
+	defer shutdownJSServerAndRemoveStorage(t, s)
+
+	nc, js := jsClient(t, s)
+	defer nc.Close()
+
+	_, err := js.AddStream(&nats.StreamConfig{Name: "TEST", Subjects: []string{"foo"}})
+	expectOk(t, err)
+
+	for i := 0; i < 2; i++ {
+		_, err = js.Publish("foo", []byte("hello"))
+		expectOk(t, err)
+	}
+
+	sub, err := js.PullSubscribe("foo", "dlc")
+	expectOk(t, err)
+	defer sub.Unsubscribe()
+
+	msgs, err := sub.Fetch(2)
+	expectOk(t, err)
+	if len(msgs) != 2 {
+		t.Fatalf("Expected 2 messages, got %d", len(msgs))
+	}
+
+	var subjects []string
+	for _, msg := range msgs {
+		subj, err := msg.AckSubject()
+		expectOk(t, err)
+		if subj != msg.Reply {
+			t.Fatalf("Expected ack subject %q, got %q", msg.Reply, subj)
+		}
+		subjects = append(subjects, subj)
+	}
+
+	// Ack from a different connection.
+	nc2, js2 := jsClient(t, s)
+	defer nc2.Close()
+
+	t.Run("invalid ack subject", func(t *testing.T) {
+		if err := js2.AckBySubject("foo.bar"); !errors.Is(err, nats.ErrNotJSMessage) {
+			t.Fatalf("Expected error %v, got %v", nats.ErrNotJSMessage, err)
+		}
+	})
+
+	t.Run("context and timeout", func(t *testing.T) {
+		ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+		defer cancel()
+		err := js2.AckBySubject(subjects[0], nats.Context(ctx), nats.AckWait(time.Second))
+		if !errors.Is(err, nats.ErrContextAndTimeout) {
+			t.Fatalf("Expected error %v, got %v", nats.ErrContextAndTimeout, err)
+		}
+	})
+
+	expectOk(t, js2.AckBySubject(subjects[0], nats.AckWait(time.Second)))
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+	expectOk(t, js2.AckBySubject(subjects[1], nats.Context(ctx)))
+
+	ci, err := js.ConsumerInfo("TEST", "dlc")
+	expectOk(t, err)
+	if ci.NumAckPending != 0 || ci.AckFloor.Stream != 2 {
+		t.Fatalf("Expected all messages to be acked, got pending %d and ack floor %d",
+			ci.NumAckPending, ci.AckFloor.Stream)
+	}
+
+	if _, err := (&nats.Msg{Subject: "foo", Sub: sub}).AckSubject(); !errors.Is(err, nats.ErrMsgNoReply) {
+		t.Fatalf("Expected error %v, got %v", nats.ErrMsgNoReply, err)
+	}
+}
+
+func TestJetStreamAckSyncRetries(t *testing.T) {
+	s := RunBasicJetStreamServer()
+	defer shutdownJSServerAndRemoveStorage(t, s)
+
+	nc, js := jsClient(t, s)
+	defer nc.Close()
+
+	// Only used to bind test messages to a subscription.
+	sub, err := nc.SubscribeSync("bar")
+	expectOk(t, err)
+
+	// Mock ack responder which drops the first request for each message.
+	const ackSubj = "$JS.ACK.TEST.dlc.1.%d.%d.1667000000000000000.0"
+	var mu sync.Mutex
+	received := make(map[string]int)
+	_, err = nc.Subscribe("$JS.ACK.TEST.dlc.>", func(m *nats.Msg) {
+		mu.Lock()
+		received[m.Subject]++
+		n := received[m.Subject]
+		mu.Unlock()
+		if n > 1 {
+			m.Respond(nil)
+		}
+	})
+	expectOk(t, err)
+	expectOk(t, nc.Flush())
+
+	newMsg := func(seq int) *nats.Msg {
+		return &nats.Msg{Subject: "foo", Reply: fmt.Sprintf(ackSubj, seq, seq), Sub: sub}
+	}
+	attempts := func(msg *nats.Msg) int {
+		mu.Lock()
+		defer mu.Unlock()
+		return received[msg.Reply]
+	}
+
+	t.Run("invalid retries", func(t *testing.T) {
+		if err := newMsg(1).AckSync(nats.AckSyncRetries(-1)); !errors.Is(err, nats.ErrInvalidArg) {
+			t.Fatalf("Expected error %v, got %v", nats.ErrInvalidArg, err)
+		}
+	})
+
+	t.Run("no retries", func(t *testing.T) {
+		msg := newMsg(2)
+		if err := msg.AckSync(nats.AckWait(100 * time.Millisecond)); err != nats.ErrTimeout {
+			t.Fatalf("Expected error %v, got %v", nats.ErrTimeout, err)
+		}
+	})
+
+	t.Run("with ack wait", func(t *testing.T) {
+		msg := newMsg(3)
+		expectOk(t, msg.AckSync(nats.AckWait(100*time.Millisecond), nats.AckSyncRetries(2)))
+		if n := attempts(msg); n != 2 {
+			t.Fatalf("Expected 2 attempts, got %d", n)
+		}
+		// Acking again is reported as a success when using retries.
+		expectOk(t, msg.AckSync(nats.AckSyncRetries(1)))
+		if err := msg.AckSync(); err != nats.ErrMsgAlreadyAckd {
+			t.Fatalf("Expected error %v, got %v", nats.ErrMsgAlreadyAckd, err)
+		}
+	})
+
+	t.Run("with context", func(t *testing.T) {
+		msg := newMsg(4)
+		ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+		defer cancel()
+		expectOk(t, msg.AckSync(nats.Context(ctx), nats.AckSyncRetries(2)))
+		if n := attempts(msg); n != 2 {
+			t.Fatalf("Expected 2 attempts, got %d", n)
+		}
+	})
+
+	t.Run("nak is not an ack", func(t *testing.T) {
+		msg := newMsg(5)
+		expectOk(t, msg.Nak())
+		if err := msg.AckSync(nats.AckSyncRetries(1)); err != nats.ErrMsgAlreadyAckd {
+			t.Fatalf("Expected error %v, got %v", nats.ErrMsgAlreadyAckd, err)
+		}
+	})
+
+	t.Run("ack by subject", func(t *testing.T) {
+		msg := newMsg(6)
+		expectOk(t, js.AckBySubject(msg.Reply, nats.AckWait(100*time.Millisecond), nats.AckSyncRetries(1)))
+		if n := attempts(msg); n != 2 {
+			t.Fatalf("Expected 2 attempts, got %d", n)
+		}
+	})
+}
+
+func TestJetStreamPullMaxWaitingExceeded(t *testing.T) {
+	s := RunBasicJetStreamServer()
+	defer shutdownJSServerAndRemoveStorage(t, s)
+
+	nc, js := jsClient(t, s)
+	defer nc.Close()
+
+	_, err := js.AddStream(&nats.StreamConfig{Name: "TEST", Subjects: []string{"foo"}})
+	expectOk(t, err)
+
+	t.Run("invalid max waiting", func(t *testing.T) {
+		if _, err := js.PullSubscribe("foo", "bad", nats.PullMaxWaiting(0)); !errors.Is(err, nats.ErrInvalidArg) {
+			t.Fatalf("Expected error %v, got %v", nats.ErrInvalidArg, err)
+		}
+		_, err := js.AddConsumer("TEST", &nats.ConsumerConfig{Durable: "bad", MaxWaiting: -1})
+		if !errors.Is(err, nats.ErrInvalidConsumerConfig) {
+			t.Fatalf("Expected error %v, got %v", nats.ErrInvalidConsumerConfig, err)
+		}
+		_, err = js.AddConsumer("TEST", &nats.ConsumerConfig{Durable: "bad", MaxWaiting: 1, DeliverSubject: "bar"})
+		if !errors.Is(err, nats.ErrInvalidConsumerConfig) {
+			t.Fatalf("Expected error %v, got %v", nats.ErrInvalidConsumerConfig, err)
+		}
+	})
+
+	sub1, err := js.PullSubscribe("foo", "dlc", nats.PullMaxWaiting(1))
+	expectOk(t, err)
+	defer sub1.Unsubscribe()
+	sub2, err := js.PullSubscribe("foo", "dlc", nats.PullMaxWaiting(1))
+	expectOk(t, err)
+	defer sub2.Unsubscribe()
+
+	errCh := make(chan error, 1)
+	go func() {
+		_, err := sub1.Fetch(1, nats.MaxWait(time.Second))
+		errCh <- err
+	}()
+	time.Sleep(200 * time.Millisecond)
+
+	if _, err := sub2.Fetch(1, nats.MaxWait(500*time.Millisecond)); !errors.Is(err, nats.ErrMaxWaitingExceeded) {
+		t.Fatalf("Expected error %v, got %v", nats.ErrMaxWaitingExceeded, err)
+	}
+	if err := <-errCh; err != nats.ErrTimeout {
+		t.Fatalf("Expected error %v, got %v", nats.ErrTimeout, err)
+	}
+}
+
+func TestJetStreamContextDrain(t *testing.T) {
+	s := RunBasicJetStreamServer()
+	defer shutdownJSServerAndRemoveStorage(t, s)
+
+	nc, js := jsClient(t, s)
+	defer nc.Close()
+
+	_, err := js.AddStream(&nats.StreamConfig{Name: "TEST", Subjects: []string{"foo"}})
+	expectOk(t, err)
+
+	var received int32
+	sub1, err := js.Subscribe("foo", func(m *nats.Msg) {
+		atomic.AddInt32(&received, 1)
+		m.Ack()
+	})
+	expectOk(t, err)
+	sub2, err := js.PullSubscribe("foo", "dlc")
+	expectOk(t, err)
+
+	// A subscription created through another context is not affected.
+	js2, err := nc.JetStream()
+	expectOk(t, err)
+	sub3, err := js2.SubscribeSync("foo")
+	expectOk(t, err)
+	defer sub3.Unsubscribe()
+
+	for i := 0; i < 10; i++ {
+		_, err := js.PublishAsync("foo", []byte("hello"))
+		expectOk(t, err)
+	}
+
+	expectOk(t, js.Drain(nats.MaxWait(2*time.Second)))
+
+	if sub1.IsValid() || sub2.IsValid() {
+		t.Fatalf("Expected subscriptions to be closed")
+	}
+	if !sub3.IsValid() {
+		t.Fatalf("Expected subscription from another context to still be valid")
+	}
+	if n := js.PublishAsyncPending(); n != 0 {
+		t.Fatalf("Expected no pending async publishes, got %d", n)
+	}
+	if !nc.IsConnected() {
+		t.Fatalf("Expected connection to remain open")
+	}
+
+	// Nothing left to drain.
+	expectOk(t, js.Drain())
+}
+
+func TestJetStreamFetchResendOnReconnect(t *testing.T) {
+	s := RunBasicJetStreamServer()
+	defer func() { shutdownJSServerAndRemoveStorage(t, s) }()
+
+	reconnected := make(chan struct{}, 1)
+	nc, js := jsClient(t, s,
+		nats.ReconnectWait(50*time.Millisecond),
+		nats.MaxReconnects(-1),
+		nats.ReconnectHandler(func(_ *nats.Conn) {
+			reconnected <- struct{}{}
+		}))
+	defer nc.Close()
+
+	_, err := js.AddStream(&nats.StreamConfig{Name: "TEST", Subjects: []string{"foo"}})
+	expectOk(t, err)
+
+	sub, err := js.PullSubscribe("foo", "dlc")
+	expectOk(t, err)
+
+	t.Run("fetch", func(t *testing.T) {
+		type result struct {
+			msgs []*nats.Msg
+			err  error
+		}
+		resCh := make(chan result, 1)
+		go func() {
+			msgs, err := sub.Fetch(1, nats.MaxWait(5*time.Second))
+			resCh <- result{msgs, err}
+		}()
+		time.Sleep(100 * time.Millisecond)
+
+		s = restartBasicJSServer(t, s)
+		select {
+		case <-reconnected:
+		case <-time.After(5 * time.Second):
+			t.Fatalf("Did not reconnect")
+		}
+		_, err := js.Publish("foo", []byte("hello"))
+		expectOk(t, err)
+
+		res := <-resCh
+		expectOk(t, res.err)
+		if len(res.msgs) != 1 || string(res.msgs[0].Data) != "hello" {
+			t.Fatalf("Unexpected messages: %v", res.msgs)
+		}
+	})
+
+	t.Run("fetch batch", func(t *testing.T) {
+		batch, err := sub.FetchBatch(2, nats.MaxWait(5*time.Second))
+		expectOk(t, err)
+		time.Sleep(100 * time.Millisecond)
+
+		s = restartBasicJSServer(t, s)
+		select {
+		case <-reconnected:
+		case <-time.After(5 * time.Second):
+			t.Fatalf("Did not reconnect")
+		}
+		for i := 0; i < 2; i++ {
+			_, err := js.Publish("foo", []byte("hello"))
+			expectOk(t, err)
+		}
+
+		var received int
+		for range batch.Messages() {
+			received++
+		}
+		expectOk(t, batch.Error())
+		if received != 2 {
+			t.Fatalf("Expected 2 messages, got %d", received)
+		}
+	})
+}
+
+func TestJetStreamResubscribeHandler(t *testing.T) {
+	s := RunBasicJetStreamServer()
+	defer func() { shutdownJSServerAndRemoveStorage(t, s) }()
+
+	nc, js := jsClient(t, s, nats.ReconnectWait(50*time.Millisecond), nats.MaxReconnects(-1))
+	defer nc.Close()
+
+	_, err := js.AddStream(&nats.StreamConfig{Name: "TEST", Subjects: []string{"foo"}})
+	expectOk(t, err)
+
+	resubscribed := make(chan *nats.Subscription, 2)
+	handler := nats.ResubscribeHandler(func(sub *nats.Subscription) {
+		resubscribed <- sub
+	})
+
+	pushSub, err := js.SubscribeSync("foo", nats.Durable("push"), handler)
+	expectOk(t, err)
+	pullSub, err := js.PullSubscribe("foo", "pull", handler)
+	expectOk(t, err)
+	// Not notified without the option.
+	_, err = js.SubscribeSync("foo")
+	expectOk(t, err)
+
+	s = restartBasicJSServer(t, s)
+
+	subs := make(map[*nats.Subscription]bool)
+	for i := 0; i < 2; i++ {
+		select {
+		case sub := <-resubscribed:
+			subs[sub] = true
+		case <-time.After(5 * time.Second):
+			t.Fatalf("Did not receive resubscribe notification")
+		}
+	}
+	if !subs[pushSub] || !subs[pullSub] {
+		t.Fatalf("Expected notifications for both subscriptions, got %v", subs)
+	}
+	select {
+	case sub := <-resubscribed:
+		t.Fatalf("Unexpected notification for %v", sub.Subject)
+	case <-time.After(100 * time.Millisecond):
+	}
+}
+
+func TestJetStreamPullMaxAckPendingCapacity(t *testing.T) {
+	s := RunBasicJetStreamServer()
+	defer shutdownJSServerAndRemoveStorage(t, s)
+
+	nc, js := jsClient(t, s)
+	defer nc.Close()
+
+	_, err := js.AddStream(&nats.StreamConfig{Name: "TEST", Subjects: []string{"foo"}})
+	expectOk(t, err)
+
+	t.Run("invalid max ack pending", func(t *testing.T) {
+		if _, err := js.PullSubscribe("foo", "bad", nats.MaxAckPending(-2)); !errors.Is(err, nats.ErrInvalidArg) {
+			t.Fatalf("Expected error %v, got %v", nats.ErrInvalidArg, err)
+		}
+		_, err := js.AddConsumer("TEST", &nats.ConsumerConfig{Durable: "bad", MaxAckPending: -2})
+		if !errors.Is(err, nats.ErrInvalidConsumerConfig) {
+			t.Fatalf("Expected error %v, got %v", nats.ErrInvalidConsumerConfig, err)
+		}
+	})
+
+	for i := 0; i < 5; i++ {
+		_, err := js.Publish("foo", []byte("hello"))
+		expectOk(t, err)
+	}
+
+	// Without PullAckPendingLimit, the server enforces the limit alone.
+	usub, err := js.PullSubscribe("foo", "unlimited", nats.MaxAckPending(0))
+	expectOk(t, err)
+	if n, err := usub.AckPending(); err != nil || n != 0 {
+		t.Fatalf("Expected no messages pending ack, got %d (%v)", n, err)
+	}
+	expectOk(t, usub.Unsubscribe())
+
+	sub, err := js.PullSubscribe("foo", "dlc", nats.MaxAckPending(2), nats.PullAckPendingLimit())
+	expectOk(t, err)
+	defer sub.Unsubscribe()
+
+	msgs, err := sub.Fetch(5)
+	expectOk(t, err)
+	if len(msgs) != 2 {
+		t.Fatalf("Expected 2 messages, got %d", len(msgs))
+	}
+	if n, err := sub.AckPending(); err != nil || n != 2 {
+		t.Fatalf("Expected 2 messages pending ack, got %d (%v)", n, err)
+	}
+
+	// No capacity left until a message is acknowledged.
+	if _, err := sub.Fetch(1, nats.MaxWait(200*time.Millisecond)); err != nats.ErrTimeout {
+		t.Fatalf("Expected error %v, got %v", nats.ErrTimeout, err)
+	}
+
+	type result struct {
+		msgs []*nats.Msg
+		err  error
+	}
+	resCh := make(chan result, 1)
+	go func() {
+		msgs, err := sub.Fetch(5, nats.MaxWait(2*time.Second))
+		resCh <- result{msgs, err}
+	}()
+	time.Sleep(100 * time.Millisecond)
+	expectOk(t, msgs[0].AckSync())
+
+	res := <-resCh
+	expectOk(t, res.err)
+	if len(res.msgs) != 1 {
+		t.Fatalf("Expected 1 message, got %d", len(res.msgs))
+	}
+	if n, err := sub.AckPending(); err != nil || n != 2 {
+		t.Fatalf("Expected 2 messages pending ack, got %d (%v)", n, err)
+	}
+
+	// Messages can also be received using FetchBatch.
+	expectOk(t, msgs[1].Nak())
+	expectOk(t, res.msgs[0].Term())
+	batch, err := sub.FetchBatch(5, nats.MaxWait(500*time.Millisecond))
+	expectOk(t, err)
+	var received int
+	for msg := range batch.Messages() {
+		received++
+		expectOk(t, msg.Ack())
+	}
+	if received != 2 {
+		t.Fatalf("Expected 2 messages, got %d", received)
+	}
+	if n, err := sub.AckPending(); err != nil || n != 0 {
+		t.Fatalf("Expected no messages pending ack, got %d (%v)", n, err)
+	}
+
+	// Messages left unacknowledged stop using capacity once their ack wait
+	// elapsed, since the server redelivers them.
+	for i := 0; i < 2; i++ {
+		_, err := js.Publish("foo", []byte("hello"))
+		expectOk(t, err)
+	}
+	wsub, err := js.PullSubscribe("foo", "wait", nats.MaxAckPending(1), nats.AckWait(300*time.Millisecond), nats.PullAckPendingLimit())
+	expectOk(t, err)
+	defer wsub.Unsubscribe()
+	msgs, err = wsub.Fetch(1)
+	expectOk(t, err)
+	msgs, err = wsub.Fetch(1, nats.MaxWait(2*time.Second))
+	expectOk(t, err)
+	if len(msgs) != 1 {
+		t.Fatalf("Expected 1 message, got %d", len(msgs))
+	}
+
+	nsub, err := nc.SubscribeSync("bar")
+	expectOk(t, err)
+	if _, err := nsub.AckPending(); err != nats.ErrTypeSubscription {
+		t.Fatalf("Expected error %v, got %v", nats.ErrTypeSubscription, err)
+	}
+}
+
+func TestJetStreamConsumerFilteredLag(t *testing.T) {
+	s := RunBasicJetStreamServer()
+	defer shutdownJSServerAndRemoveStorage(t, s)
+
+	nc, js := jsClient(t, s)
+	defer nc.Close()
+
+	_, err := js.AddStream(&nats.StreamConfig{Name: "TEST", Subjects: []string{"foo.*"}})
+	expectOk(t, err)
+	for i := 0; i < 10; i++ {
+		subj := "foo.a"
+		if i%2 == 0 {
+			subj = "foo.b"
+		}
+		_, err := js.Publish(subj, []byte("hello"))
+		expectOk(t, err)
+	}
+
+	sub, err := js.PullSubscribe("foo.a", "dlc")
+	expectOk(t, err)
+	defer sub.Unsubscribe()
+
+	msgs, err := sub.Fetch(2)
+	expectOk(t, err)
+	for _, msg := range msgs {
+		expectOk(t, msg.AckSync())
+	}
+
+	p, err := sub.ConsumerProgress()
+	expectOk(t, err)
+	// Only messages on "foo.a" are accounted for.
+	if lag := p.FilteredLag(); lag != 3 {
+		t.Fatalf("Expected filtered lag of 3, got %d", lag)
+	}
+	if !p.LagExceeds(2) {
+		t.Fatalf("Expected lag to exceed 2")
+	}
+	if p.LagExceeds(3) {
+		t.Fatalf("Expected lag not to exceed 3")
+	}
+}
+
+func TestJetStreamBindDurable(t *testing.T) {
+	s := RunBasicJetStreamServer()
+	defer shutdownJSServerAndRemoveStorage(t, s)
+
+	nc, js := jsClient(t, s)
+	defer nc.Close()
+
+	_, err := js.AddStream(&nats.StreamConfig{Name: "TEST", Subjects: []string{"foo"}})
+	expectOk(t, err)
+
+	_, err = js.AddConsumer("TEST", &nats.ConsumerConfig{Durable: "dlc", AckPolicy: nats.AckExplicitPolicy})
+	expectOk(t, err)
+	// A named ephemeral consumer.
+	_, err = js.AddConsumer("TEST", &nats.ConsumerConfig{
+		Name:              "eph",
+		AckPolicy:         nats.AckExplicitPolicy,
+		InactiveThreshold: time.Minute,
+	})
+	expectOk(t, err)
+
+	sub, err := js.PullSubscribe("foo", "dlc", nats.BindDurable("TEST", "dlc"))
+	expectOk(t, err)
+	sub.Unsubscribe()
+
+	if _, err := js.PullSubscribe("foo", "", nats.BindDurable("TEST", "eph")); !errors.Is(err, nats.ErrConsumerMismatch) {
+		t.Fatalf("Expected error %v, got %v", nats.ErrConsumerMismatch, err)
+	}
+	if _, err := js.PullSubscribe("foo", "", nats.BindDurable("TEST", "missing")); !errors.Is(err, nats.ErrConsumerNotFound) {
+		t.Fatalf("Expected error %v, got %v", nats.ErrConsumerNotFound, err)
+	}
+	if _, err := js.PullSubscribe("foo", "other", nats.BindDurable("TEST", "dlc")); err == nil {
+		t.Fatalf("Expected error for mismatched durable names")
+	}
+	if _, err := js.PullSubscribe("foo", "", nats.BindDurable("TEST", "dlc"), nats.SkipConsumerLookup()); err == nil {
+		t.Fatalf("Expected error when skipping the consumer lookup")
+	}
+}
+
+func TestJetStreamSubscribeRedeliveryHandler(t *testing.T) {
+	s := RunBasicJetStreamServer()
+	defer shutdownJSServerAndRemoveStorage(t, s)
+
+	nc, js := jsClient(t, s)
+	defer nc.Close()
+
+	_, err := js.AddStream(&nats.StreamConfig{Name: "TEST", Subjects: []string{"foo"}})
+	expectOk(t, err)
+
+	handler := nats.RedeliveryHandler(func(_ *nats.Msg, _ int) {})
+	if _, err := js.SubscribeSync("foo", handler); err == nil {
+		t.Fatalf("Expected error using a redelivery handler without message handler")
+	}
+
+	var delivered int32
+	attempts := make(chan int, 10)
+	sub, err := js.Subscribe("foo", func(m *nats.Msg) {
+		atomic.AddInt32(&delivered, 1)
+		m.Nak()
+	}, nats.ManualAck(), nats.RedeliveryHandler(func(m *nats.Msg, attempt int) {
+		attempts <- attempt
+		if attempt < 3 {
+			m.Nak()
+			return
+		}
+		m.Term()
+	}))
+	expectOk(t, err)
+	defer sub.Unsubscribe()
+
+	_, err = js.Publish("foo", []byte("hello"))
+	expectOk(t, err)
+
+	for _, expected := range []int{2, 3} {
+		select {
+		case attempt := <-attempts:
+			if attempt != expected {
+				t.Fatalf("Expected attempt %d, got %d", expected, attempt)
+			}
+		case <-time.After(2 * time.Second):
+			t.Fatalf("Did not receive redelivery")
+		}
+	}
+	if n := atomic.LoadInt32(&delivered); n != 1 {
+		t.Fatalf("Expected message handler to be called once, got %d", n)
+	}
+	expectOk(t, sub.Unsubscribe())
+
+	// Without ManualAck(), only the messages passed to the message handler
+	// are acknowledged automatically.
+	attempts = make(chan int, 10)
+	sub, err = js.Subscribe("foo", func(m *nats.Msg) {
+		m.Nak()
+	}, nats.DeliverNew(), nats.AckWait(250*time.Millisecond), nats.RedeliveryHandler(func(m *nats.Msg, attempt int) {
+		attempts <- attempt
+		if attempt >= 3 {
+			m.Ack()
+		}
+	}))
+	expectOk(t, err)
+	defer sub.Unsubscribe()
+
+	_, err = js.Publish("foo", []byte("hello"))
+	expectOk(t, err)
+	for _, expected := range []int{2, 3} {
+		select {
+		case attempt := <-attempts:
+			if attempt != expected {
+				t.Fatalf("Expected attempt %d, got %d", expected, attempt)
+			}
+		case <-time.After(2 * time.Second):
+			t.Fatalf("Did not receive redelivery")
+		}
+	}
+}
+
+func TestJetStreamStreamInfoNumSubjects(t *testing.T) {
+	s := RunBasicJetStreamServer()
+	defer shutdownJSServerAndRemoveStorage(t, s)
+
+	nc, js := jsClient(t, s)
+	defer nc.Close()
+
+	_, err := js.AddStream(&nats.StreamConfig{Name: "foo", Subjects: []string{"foo.*"}})
+	expectOk(t, err)
+
+	for _, subj := range []string{"foo.A", "foo.B", "foo.C", "foo.A"} {
+		_, err := js.Publish(subj, []byte("hello"))
+		expectOk(t, err)
+	}
+
+	// The number of subjects is reported without a subjects filter.
+	si, err := js.StreamInfo("foo")
+	expectOk(t, err)
+	if si.State.NumSubjects != 3 {
+		t.Fatalf("Expected 3 subjects, got %d", si.State.NumSubjects)
+	}
+	if len(si.State.Subjects) != 0 {
+		t.Fatalf("Expected no subjects details, got %v", si.State.Subjects)
+	}
+
+	// The number of keys of a bucket, deleted ones included.
+	kv, err := js.CreateKeyValue(&nats.KeyValueConfig{Bucket: "TEST"})
+	expectOk(t, err)
+	for _, key := range []string{"A", "B", "A"} {
+		_, err := kv.PutString(key, "value")
+		expectOk(t, err)
+	}
+	expectOk(t, kv.Delete("B"))
+	status, err := kv.Status()
+	expectOk(t, err)
+	if n := status.(*nats.KeyValueBucketStatus).NumKeys(); n != 2 {
+		t.Fatalf("Expected 2 keys, got %d", n)
+	}
+}
+
+func TestJetStreamDeleteMsgRange(t *testing.T) {
+	s := RunBasicJetStreamServer()
+	defer shutdownJSServerAndRemoveStorage(t, s)
+
+	nc, js := jsClient(t, s)
+	defer nc.Close()
+
+	_, err := js.AddStream(&nats.StreamConfig{Name: "TEST", Subjects: []string{"foo"}})
+	expectOk(t, err)
+	for i := 0; i < 100; i++ {
+		_, err := js.PublishAsync("foo", []byte("hello"))
+		expectOk(t, err)
+	}
+	select {
+	case <-js.PublishAsyncComplete():
+	case <-time.After(5 * time.Second):
+		t.Fatalf("Did not receive completion signal")
+	}
+
+	// Sequences without a message are skipped.
+	expectOk(t, js.DeleteMsg("TEST", 50))
+
+	n, err := js.DeleteMsgRange("TEST", 10, 60)
+	expectOk(t, err)
+	if n != 50 {
+		t.Fatalf("Expected 50 deleted messages, got %d", n)
+	}
+	si, err := js.StreamInfo("TEST")
+	expectOk(t, err)
+	if si.State.Msgs != 49 {
+		t.Fatalf("Expected 49 messages left, got %d", si.State.Msgs)
+	}
+
+	if _, err := js.DeleteMsgRange("TEST", 10, 5); !errors.Is(err, nats.ErrInvalidArg) {
+		t.Fatalf("Expected error %v, got %v", nats.ErrInvalidArg, err)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	if _, err := js.DeleteMsgRange("TEST", 61, 100, nats.Context(ctx)); err != context.Canceled {
+		t.Fatalf("Expected error %v, got %v", context.Canceled, err)
+	}
+
+	// Sequences before the first and after the last message are skipped.
+	n, err = js.DeleteMsgRange("TEST", 1, 200)
+	expectOk(t, err)
+	if n != 49 {
+		t.Fatalf("Expected 49 deleted messages, got %d", n)
+	}
+	n, err = js.DeleteMsgRange("TEST", 101, 200)
+	expectOk(t, err)
+	if n != 0 {
+		t.Fatalf("Expected no deleted messages, got %d", n)
+	}
+
+	if _, err := js.DeleteMsgRange("MISSING", 1, 3); !errors.Is(err, nats.ErrStreamNotFound) {
+		t.Fatalf("Expected error %v, got %v", nats.ErrStreamNotFound, err)
+	}
+
+	// Failed deletes are reported per sequence.
+	_, err = js.AddStream(&nats.StreamConfig{Name: "DENY", Subjects: []string{"bar"}, DenyDelete: true})
+	expectOk(t, err)
+	for i := 0; i < 3; i++ {
+		_, err := js.Publish("bar", []byte("hello"))
+		expectOk(t, err)
+	}
+	_, err = js.DeleteMsgRange("DENY", 1, 3)
+	var rangeErr *nats.DeleteMsgRangeError
+	if !errors.As(err, &rangeErr) {
+		t.Fatalf("Expected error of type %T, got %v", rangeErr, err)
+	}
+	if len(rangeErr.Errors) != 3 {
+		t.Fatalf("Unexpected errors: %v", rangeErr.Errors)
+	}
+}
+
+func TestJetStreamConsumerRateLimitValidation(t *testing.T) {
+	s := RunBasicJetStreamServer()
+	defer shutdownJSServerAndRemoveStorage(t, s)
+
+	nc, js := jsClient(t, s)
+	defer nc.Close()
+
+	_, err := js.AddStream(&nats.StreamConfig{Name: "TEST", Subjects: []string{"foo"}})
+	expectOk(t, err)
+
+	_, err = js.AddConsumer("TEST", &nats.ConsumerConfig{Durable: "pull", RateLimit: 1024})
+	if !errors.Is(err, nats.ErrInvalidConsumerConfig) {
+		t.Fatalf("Expected error %v, got %v", nats.ErrInvalidConsumerConfig, err)
+	}
+	if _, err := js.PullSubscribe("foo", "pull", nats.RateLimit(1024)); !errors.Is(err, nats.ErrInvalidConsumerConfig) {
+		t.Fatalf("Expected error %v, got %v", nats.ErrInvalidConsumerConfig, err)
+	}
+
+	ci, err := js.AddConsumer("TEST", &nats.ConsumerConfig{
+		Durable:        "push",
+		DeliverSubject: "bar",
+		RateLimit:      1024,
+	})
+	expectOk(t, err)
+	if ci.Config.RateLimit != 1024 {
+		t.Fatalf("Expected rate limit of 1024, got %d", ci.Config.RateLimit)
+	}
+}
+
+func TestJetStreamConsumerNextSubject(t *testing.T) {
+	s := RunBasicJetStreamServer()
+	defer shutdownJSServerAndRemoveStorage(t, s)
+
+	nc, js := jsClient(t, s)
+	defer nc.Close()
+
+	_, err := js.AddStream(&nats.StreamConfig{Name: "TEST", Subjects: []string{"foo"}})
+	expectOk(t, err)
+	_, err = js.AddConsumer("TEST", &nats.ConsumerConfig{Durable: "dlc", AckPolicy: nats.AckExplicitPolicy})
+	expectOk(t, err)
+	_, err = js.Publish("foo", []byte("hello"))
+	expectOk(t, err)
+
+	subj, err := js.ConsumerNextSubject("TEST", "dlc")
+	expectOk(t, err)
+	if subj != "$JS.API.CONSUMER.MSG.NEXT.TEST.dlc" {
+		t.Fatalf("Unexpected subject: %q", subj)
+	}
+
+	// The subject can be used to pull messages directly.
+	msg, err := nc.Request(subj, []byte(`{"batch":1}`), time.Second)
+	expectOk(t, err)
+	if string(msg.Data) != "hello" {
+		t.Fatalf("Unexpected message data: %q", msg.Data)
+	}
+
+	for _, test := range []struct {
+		name     string
+		opt      nats.JSOpt
+		expected string
+	}{
+		{"domain", nats.Domain("hub"), "$JS.hub.API.CONSUMER.MSG.NEXT.TEST.dlc"},
+		{"api prefix", nats.APIPrefix("$JS.from.API"), "$JS.from.API.CONSUMER.MSG.NEXT.TEST.dlc"},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			js, err := nc.JetStream(test.opt)
+			expectOk(t, err)
+			subj, err := js.ConsumerNextSubject("TEST", "dlc")
+			expectOk(t, err)
+			if subj != test.expected {
+				t.Fatalf("Expected subject %q, got %q", test.expected, subj)
+			}
+		})
+	}
+
+	if _, err := js.ConsumerNextSubject("TEST", "a.b"); !errors.Is(err, nats.ErrInvalidConsumerName) {
+		t.Fatalf("Expected error %v, got %v", nats.ErrInvalidConsumerName, err)
+	}
+}
+
+func TestJetStreamPublishVerifyStored(t *testing.T) {
+	s := RunBasicJetStreamServer()
+	defer shutdownJSServerAndRemoveStorage(t, s)
+
+	nc, js := jsClient(t, s)
+	defer nc.Close()
+
+	_, err := js.AddStream(&nats.StreamConfig{Name: "TEST", Subjects: []string{"foo"}})
+	expectOk(t, err)
+
+	pa, err := js.Publish("foo", []byte("first"), nats.VerifyStored(), nats.MsgId("1"))
+	expectOk(t, err)
+	if pa.Sequence != 1 || pa.Duplicate {
+		t.Fatalf("Unexpected ack: %+v", pa)
+	}
+	_, err = js.Publish("foo", []byte("second"), nats.VerifyStored(), nats.ExpectStream("TEST"))
+	expectOk(t, err)
+
+	// A duplicate points to the originally stored message.
+	pa, err = js.Publish("foo", []byte("dup"), nats.VerifyStored(), nats.MsgId("1"))
+	expectOk(t, err)
+	if pa.Sequence != 1 || !pa.Duplicate {
+		t.Fatalf("Unexpected ack: %+v", pa)
+	}
+	msg, err := js.GetMsg(pa.Stream, pa.Sequence)
+	expectOk(t, err)
+	if string(msg.Data) != "first" {
+		t.Fatalf("Unexpected stored message: %q", msg.Data)
+	}
+
+	if _, err := js.PublishAsync("foo", []byte("async"), nats.VerifyStored()); err == nil {
+		t.Fatalf("Expected error using verify stored with async publish")
+	}
+
+	// Mock a response without a stream sequence.
+	_, err = nc.Subscribe("bar", func(m *nats.Msg) {
+		m.Respond([]byte(`{"stream":"TEST"}`))
+	})
+	expectOk(t, err)
+	if _, err := js.Publish("bar", []byte("hello"), nats.VerifyStored()); !errors.Is(err, nats.ErrInvalidJSAck) {
+		t.Fatalf("Expected error %v, got %v", nats.ErrInvalidJSAck, err)
+	}
+	if _, err := js.Publish("bar", []byte("hello")); err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+}
+
+func TestJetStreamConsumerInfoIdleFor(t *testing.T) {
+	s := RunBasicJetStreamServer()
+	defer shutdownJSServerAndRemoveStorage(t, s)
+
+	nc, js := jsClient(t, s)
+	defer nc.Close()
+
+	_, err := js.AddStream(&nats.StreamConfig{Name: "TEST", Subjects: []string{"foo"}})
+	expectOk(t, err)
+	_, err = js.Publish("foo", []byte("hello"))
+	expectOk(t, err)
+
+	sub, err := js.PullSubscribe("foo", "dlc")
+	expectOk(t, err)
+	defer sub.Unsubscribe()
+
+	msgs, err := sub.Fetch(1)
+	expectOk(t, err)
+	expectOk(t, msgs[0].AckSync())
+
+	time.Sleep(200 * time.Millisecond)
+	ci, err := sub.ConsumerInfo()
+	expectOk(t, err)
+	if ci.Delivered.Last == nil || ci.AckFloor.Last == nil {
+		t.Fatalf("Expected last activity times to be set: %+v, %+v", ci.Delivered, ci.AckFloor)
+	}
+	if idle := ci.IdleFor(); idle < 200*time.Millisecond || idle > 5*time.Second {
+		t.Fatalf("Unexpected idle duration: %v", idle)
+	}
+
+	now := time.Now()
+	delivered, acked := now.Add(-2*time.Minute), now.Add(-time.Minute)
+	ci = &nats.ConsumerInfo{
+		Created:   now.Add(-time.Hour),
+		Delivered: nats.SequenceInfo{Last: &delivered},
+		AckFloor:  nats.SequenceInfo{Last: &acked},
+		TimeStamp: now,
+	}
+	if idle := ci.IdleFor(); idle != time.Minute {
+		t.Fatalf("Expected idle for a minute, got %v", idle)
+	}
+	ci = &nats.ConsumerInfo{Created: now.Add(-time.Hour), TimeStamp: now}
+	if idle := ci.IdleFor(); idle != time.Hour {
+		t.Fatalf("Expected idle for an hour, got %v", idle)
+	}
+}
+
+type countingCodec struct {
+	marshaled   int32
+	unmarshaled int32
+}
+
+func (c *countingCodec) Marshal(v interface{}) ([]byte, error) {
+	atomic.AddInt32(&c.marshaled, 1)
+	return json.Marshal(v)
+}
+
+func (c *countingCodec) Unmarshal(data []byte, v interface{}) error {
+	atomic.AddInt32(&c.unmarshaled, 1)
+	return json.Unmarshal(data, v)
+}
+
+func TestJetStreamAPICodec(t *testing.T) {
+	s := RunBasicJetStreamServer()
+	defer shutdownJSServerAndRemoveStorage(t, s)
+
+	nc, err := nats.Connect(s.ClientURL())
+	expectOk(t, err)
+	defer nc.Close()
+
+	if _, err := nc.JetStream(nats.UseAPICodec(nil)); !errors.Is(err, nats.ErrInvalidArg) {
+		t.Fatalf("Expected error %v, got %v", nats.ErrInvalidArg, err)
+	}
+
+	codec := &countingCodec{}
+	js, err := nc.JetStream(nats.UseAPICodec(codec))
+	expectOk(t, err)
+
+	_, err = js.AddStream(&nats.StreamConfig{Name: "TEST", Subjects: []string{"foo"}})
+	expectOk(t, err)
+	_, err = js.Publish("foo", []byte("hello"))
+	expectOk(t, err)
+	si, err := js.StreamInfo("TEST")
+	expectOk(t, err)
+	if si.State.Msgs != 1 {
+		t.Fatalf("Expected 1 message, got %d", si.State.Msgs)
+	}
+
+	// Stream create request, stream create, publish and stream info responses.
+	if n := atomic.LoadInt32(&codec.marshaled); n != 1 {
+		t.Fatalf("Expected 1 marshaled request, got %d", n)
+	}
+	if n := atomic.LoadInt32(&codec.unmarshaled); n != 3 {
+		t.Fatalf("Expected 3 unmarshaled responses, got %d", n)
+	}
+
+	// The codec is also used when listing streams.
+	var names []string
+	for name := range js.StreamNames() {
+		names = append(names, name)
+	}
+	if len(names) != 1 {
+		t.Fatalf("Expected 1 stream, got %v", names)
+	}
+	if n := atomic.LoadInt32(&codec.unmarshaled); n != 4 {
+		t.Fatalf("Expected 4 unmarshaled responses, got %d", n)
+	}
+}
+
+func TestJetStreamListPages(t *testing.T) {
+	s := RunBasicJetStreamServer()
+	defer shutdownJSServerAndRemoveStorage(t, s)
+
+	nc, js := jsClient(t, s)
+	defer nc.Close()
+
+	for i := 0; i < 3; i++ {
+		name := fmt.Sprintf("S%d", i)
+		_, err := js.AddStream(&nats.StreamConfig{Name: name, Subjects: []string{name}})
+		expectOk(t, err)
+		_, err = js.AddConsumer("S0", &nats.ConsumerConfig{Durable: fmt.Sprintf("C%d", i)})
+		expectOk(t, err)
+	}
+
+	sp, err := js.StreamsPage(0)
+	expectOk(t, err)
+	if sp.Total != 3 || sp.Offset != 0 || sp.Limit == 0 || len(sp.Streams) != 3 {
+		t.Fatalf("Unexpected page: %+v", sp.ListPage)
+	}
+	sp, err = js.StreamsPage(2)
+	expectOk(t, err)
+	if sp.Total != 3 || sp.Offset != 2 || len(sp.Streams) != 1 {
+		t.Fatalf("Unexpected page: %+v", sp.ListPage)
+	}
+
+	cp, err := js.ConsumersPage("S0", 1)
+	expectOk(t, err)
+	if cp.Total != 3 || cp.Offset != 1 || len(cp.Consumers) != 2 {
+		t.Fatalf("Unexpected page: %+v", cp.ListPage)
+	}
+
+	if _, err := js.StreamsPage(-1); !errors.Is(err, nats.ErrInvalidArg) {
+		t.Fatalf("Expected error %v, got %v", nats.ErrInvalidArg, err)
+	}
+	if _, err := js.ConsumersPage("S0", -1); !errors.Is(err, nats.ErrInvalidArg) {
+		t.Fatalf("Expected error %v, got %v", nats.ErrInvalidArg, err)
+	}
+	if _, err := js.ConsumersPage("MISSING", 0); !errors.Is(err, nats.ErrStreamNotFound) {
+		t.Fatalf("Expected error %v, got %v", nats.ErrStreamNotFound, err)
+	}
+}
+
+func TestJetStreamStreamPlacement(t *testing.T) {
+	s := RunDefaultServer()
+	defer s.Shutdown()
+
+	nc, err := nats.Connect(s.ClientURL())
+	expectOk(t, err)
+	defer nc.Close()
+	js, err := nc.JetStream()
+	expectOk(t, err)
+
+	// Mock the stream API, storing the config on create/update and
+	// reporting the resolved cluster in the info.
+	var cfg json.RawMessage
+	_, err = nc.Subscribe("$JS.API.STREAM.*.TEST", func(m *nats.Msg) {
+		if !strings.HasPrefix(m.Subject, "$JS.API.STREAM.INFO.") {
+			cfg = append(json.RawMessage(nil), m.Data...)
+		}
+		m.Respond([]byte(fmt.Sprintf(`{"config":%s,"cluster":{"name":"east","leader":"S1"}}`, cfg)))
+	})
+	expectOk(t, err)
+
+	checkPlacement := func(si *nats.StreamInfo, tags ...string) {
+		t.Helper()
+		p := si.Config.Placement
+		if p == nil || p.Cluster != "east" || !reflect.DeepEqual(p.Tags, tags) {
+			t.Fatalf("Unexpected placement: %+v", p)
+		}
+		if si.Cluster == nil || si.Cluster.Name != "east" {
+			t.Fatalf("Unexpected cluster info: %+v", si.Cluster)
+		}
+	}
+
+	si, err := js.AddStream(&nats.StreamConfig{
+		Name:      "TEST",
+		Placement: &nats.Placement{Cluster: "east", Tags: []string{"eu"}},
+	})
+	expectOk(t, err)
+	checkPlacement(si, "eu")
+
+	si, err = js.UpdateStream(&nats.StreamConfig{
+		Name:      "TEST",
+		Placement: &nats.Placement{Cluster: "east", Tags: []string{"eu", "ssd"}},
+	})
+	expectOk(t, err)
+	checkPlacement(si, "eu", "ssd")
+
+	si, err = js.StreamInfo("TEST")
+	expectOk(t, err)
+	checkPlacement(si, "eu", "ssd")
+
+	// An empty placement is the same as no placement.
+	si, err = js.UpdateStream(&nats.StreamConfig{Name: "TEST", Placement: &nats.Placement{}})
+	expectOk(t, err)
+	if si.Config.Placement != nil {
+		t.Fatalf("Unexpected placement: %+v", si.Config.Placement)
+	}
+
+	for _, p := range []*nats.Placement{
+		{Tags: []string{}},
+		{Cluster: "east", Tags: []string{}},
+		{Tags: []string{"eu", ""}},
+	} {
+		_, err := js.AddStream(&nats.StreamConfig{Name: "TEST", Placement: p})
+		if !errors.Is(err, nats.ErrInvalidPlacement) {
+			t.Fatalf("Expected error %v for %+v, got %v", nats.ErrInvalidPlacement, p, err)
+		}
+		_, err = js.UpdateStream(&nats.StreamConfig{Name: "TEST", Placement: p})
+		if !errors.Is(err, nats.ErrInvalidPlacement) {
+			t.Fatalf("Expected error %v for %+v, got %v", nats.ErrInvalidPlacement, p, err)
+		}
+	}
+}
+
+func TestJetStreamSubscribeParentContextCancel(t *testing.T) {
+	s := RunBasicJetStreamServer()
+	defer shutdownJSServerAndRemoveStorage(t, s)
+
+	nc, js := jsClient(t, s)
+	defer nc.Close()
+
+	_, err := js.AddStream(&nats.StreamConfig{Name: "TEST", Subjects: []string{"foo"}})
+	expectOk(t, err)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	var received int32
+	subs := make([]*nats.Subscription, 0, 2)
+	for i := 0; i < 2; i++ {
+		sub, err := js.Subscribe("foo", func(m *nats.Msg) {
+			atomic.AddInt32(&received, 1)
+		}, nats.Context(ctx))
+		expectOk(t, err)
+		subs = append(subs, sub)
+	}
+
+	_, err = js.Publish("foo", []byte("hello"))
+	expectOk(t, err)
+	checkFor(t, time.Second, 15*time.Millisecond, func() error {
+		if n := atomic.LoadInt32(&received); n != 2 {
+			return fmt.Errorf("Expected 2 messages, got %d", n)
+		}
+		return nil
+	})
+
+	// Cancelling the parent context stops all subscriptions.
+	cancel()
+	checkFor(t, time.Second, 15*time.Millisecond, func() error {
+		for _, sub := range subs {
+			if sub.IsValid() {
+				return fmt.Errorf("Expected subscription to be stopped")
+			}
+		}
+		return nil
+	})
+
+	_, err = js.Publish("foo", []byte("hello"))
+	expectOk(t, err)
+	time.Sleep(100 * time.Millisecond)
+	if n := atomic.LoadInt32(&received); n != 2 {
+		t.Fatalf("Expected no more messages after cancel, got %d", n)
+	}
+}
+
+func TestJetStreamSubscribeSequenceGapHandler(t *testing.T) {
+	s := RunBasicJetStreamServer()
+	defer shutdownJSServerAndRemoveStorage(t, s)
+
+	nc, js := jsClient(t, s)
+	defer nc.Close()
+
+	_, err := js.AddStream(&nats.StreamConfig{Name: "TEST", Subjects: []string{"foo"}})
+	expectOk(t, err)
+
+	type gap struct{ expected, actual uint64 }
+	gaps := make(chan gap, 10)
+	received := make(chan *nats.Msg, 10)
+	sub, err := js.Subscribe("foo", func(m *nats.Msg) {
+		received <- m
+	}, nats.Durable("dlc"), nats.ManualAck(), nats.SequenceGapHandler(func(_ *nats.Subscription, expected, actual uint64) {
+		gaps <- gap{expected, actual}
+	}))
+	expectOk(t, err)
+	defer sub.Unsubscribe()
+
+	for i := 0; i < 2; i++ {
+		_, err = js.Publish("foo", []byte("hello"))
+		expectOk(t, err)
+		select {
+		case <-received:
+		case <-time.After(time.Second):
+			t.Fatalf("Did not receive message")
+		}
+	}
+
+	// Simulate a delivery skipping consumer sequences 3 and 4.
+	err = nc.PublishRequest(sub.Subject, "$JS.ACK.TEST.dlc.1.5.5.1000000000.0", []byte("gap"))
+	expectOk(t, err)
+	select {
+	case g := <-gaps:
+		if g.expected != 3 || g.actual != 5 {
+			t.Fatalf("Unexpected gap: %+v", g)
+		}
+	case <-time.After(time.Second):
+		t.Fatalf("Sequence gap handler was not invoked")
+	}
+	select {
+	case g := <-gaps:
+		t.Fatalf("Unexpected gap: %+v", g)
+	case <-time.After(100 * time.Millisecond):
+	}
+
+	_, err = js.PullSubscribe("foo", "pull", nats.SequenceGapHandler(func(*nats.Subscription, uint64, uint64) {}))
+	if err == nil {
+		t.Fatalf("Expected error using sequence gap handler with pull subscription")
+	}
+	_, err = js.QueueSubscribe("foo", "q", func(*nats.Msg) {}, nats.SequenceGapHandler(func(*nats.Subscription, uint64, uint64) {}))
+	if err == nil {
+		t.Fatalf("Expected error using sequence gap handler with queue subscription")
+	}
+}
+
+func TestJetStreamConsumerAckPolicyValidation(t *testing.T) {
+	s := RunBasicJetStreamServer()
+	defer shutdownJSServerAndRemoveStorage(t, s)
+
+	nc, js := jsClient(t, s)
+	defer nc.Close()
+
+	_, err := js.AddStream(&nats.StreamConfig{Name: "TEST", Subjects: []string{"foo"}})
+	expectOk(t, err)
+
+	tests := []struct {
+		name string
+		cfg  *nats.ConsumerConfig
+	}{
+		{
+			name: "ack none with max deliver",
+			cfg:  &nats.ConsumerConfig{Durable: "dlc", AckPolicy: nats.AckNonePolicy, MaxDeliver: 5},
+		},
+		{
+			name: "ack none with backoff",
+			cfg:  &nats.ConsumerConfig{Durable: "dlc", AckPolicy: nats.AckNonePolicy, BackOff: []time.Duration{time.Second}},
+		},
+		{
+			name: "ack none with max ack pending",
+			cfg:  &nats.ConsumerConfig{Durable: "dlc", AckPolicy: nats.AckNonePolicy, MaxAckPending: 10},
+		},
+		{
+			name: "ack all with deliver group",
+			cfg: &nats.ConsumerConfig{
+				Durable:        "dlc",
+				AckPolicy:      nats.AckAllPolicy,
+				DeliverSubject: "deliver",
+				DeliverGroup:   "q",
+			},
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			if _, err := js.AddConsumer("TEST", test.cfg); !errors.Is(err, nats.ErrInvalidConsumerConfig) {
+				t.Fatalf("Expected error %v, got %v", nats.ErrInvalidConsumerConfig, err)
+			}
+			if _, err := js.UpdateConsumer("TEST", test.cfg); !errors.Is(err, nats.ErrInvalidConsumerConfig) {
+				t.Fatalf("Expected error %v, got %v", nats.ErrInvalidConsumerConfig, err)
+			}
+		})
+	}
+
+	// Compatible combinations are accepted.
+	_, err = js.AddConsumer("TEST", &nats.ConsumerConfig{Durable: "none", AckPolicy: nats.AckNonePolicy, MaxDeliver: 1})
+	expectOk(t, err)
+	_, err = js.AddConsumer("TEST", &nats.ConsumerConfig{Durable: "explicit", AckPolicy: nats.AckExplicitPolicy, MaxDeliver: 5, MaxAckPending: 10})
+	expectOk(t, err)
+}
+
+func TestJetStreamNakWithBackoff(t *testing.T) {
+	s := RunBasicJetStreamServer()
+	defer shutdownJSServerAndRemoveStorage(t, s)
+
+	nc, js := jsClient(t, s)
+	defer nc.Close()
+
+	_, err := js.AddStream(&nats.StreamConfig{Name: "TEST", Subjects: []string{"foo", "bar"}})
+	expectOk(t, err)
+
+	backoff := []time.Duration{100 * time.Millisecond, 400 * time.Millisecond}
+	sub, err := js.SubscribeSync("foo", nats.BackOff(backoff), nats.MaxDeliver(5), nats.ManualAck())
+	expectOk(t, err)
+	defer sub.Unsubscribe()
+
+	_, err = js.Publish("foo", []byte("hello"))
+	expectOk(t, err)
+
+	msg, err := sub.NextMsg(time.Second)
+	expectOk(t, err)
+	for i, expected := range []time.Duration{backoff[0], backoff[1], backoff[1]} {
+		start := time.Now()
+		expectOk(t, msg.NakWithBackoff())
+		msg, err = sub.NextMsg(2 * time.Second)
+		expectOk(t, err)
+		meta, err := msg.Metadata()
+		expectOk(t, err)
+		if meta.NumDelivered != uint64(i+2) {
+			t.Fatalf("Expected delivery %d, got %d", i+2, meta.NumDelivered)
+		}
+		if elapsed := time.Since(start); elapsed < expected-20*time.Millisecond {
+			t.Fatalf("Expected redelivery after %v, got %v", expected, elapsed)
+		}
+	}
+	expectOk(t, msg.Ack())
+
+	// Without backoff, the message is redelivered right away.
+	sub2, err := js.SubscribeSync("bar", nats.AckWait(10*time.Second), nats.ManualAck())
+	expectOk(t, err)
+	defer sub2.Unsubscribe()
+	_, err = js.Publish("bar", []byte("hello"))
+	expectOk(t, err)
+	msg, err = sub2.NextMsg(time.Second)
+	expectOk(t, err)
+	expectOk(t, msg.NakWithBackoff())
+	if _, err := sub2.NextMsg(time.Second); err != nil {
+		t.Fatalf("Expected immediate redelivery, got %v", err)
+	}
+
+	if err := (&nats.Msg{Subject: "foo"}).NakWithBackoff(); !errors.Is(err, nats.ErrMsgNotBound) {
+		t.Fatalf("Expected error %v, got %v", nats.ErrMsgNotBound, err)
+	}
+}
+
+func TestJetStreamFetchConsumerGone(t *testing.T) {
+	s := RunBasicJetStreamServer()
+	defer shutdownJSServerAndRemoveStorage(t, s)
+
+	nc, js := jsClient(t, s)
+	defer nc.Close()
+
+	_, err := js.AddStream(&nats.StreamConfig{Name: "TEST", Subjects: []string{"foo"}})
+	expectOk(t, err)
+	_, err = js.AddConsumer("TEST", &nats.ConsumerConfig{Durable: "dlc", AckPolicy: nats.AckExplicitPolicy})
+	expectOk(t, err)
+
+	sub, err := js.PullSubscribe("foo", "dlc", nats.Bind("TEST", "dlc"))
+	expectOk(t, err)
+	defer sub.Unsubscribe()
+
+	expectOk(t, js.DeleteConsumer("TEST", "dlc"))
+
+	// With PullConsumerCheck() the fetch fails without
+	// waiting for the request to expire.
+	start := time.Now()
+	if _, err := sub.Fetch(5, nats.MaxWait(10*time.Second), nats.PullConsumerCheck(time.Second)); !errors.Is(err, nats.ErrConsumerNotFound) {
+		t.Fatalf("Expected error %v, got %v", nats.ErrConsumerNotFound, err)
+	}
+	if elapsed := time.Since(start); elapsed > 5*time.Second {
+		t.Fatalf("Expected fetch to fail quickly, took %v", elapsed)
+	}
+
+	if _, err := sub.Fetch(5, nats.PullConsumerCheck(0)); !errors.Is(err, nats.ErrInvalidArg) {
+		t.Fatalf("Expected error %v, got %v", nats.ErrInvalidArg, err)
+	}
+
+	start = time.Now()
+	batch, err := sub.FetchBatch(5, nats.MaxWait(10*time.Second), nats.PullConsumerCheck(time.Second))
+	expectOk(t, err)
+	for range batch.Messages() {
+		t.Fatalf("Unexpected message")
+	}
+	if err := batch.Error(); !errors.Is(err, nats.ErrConsumerNotFound) {
+		t.Fatalf("Expected error %v, got %v", nats.ErrConsumerNotFound, err)
+	}
+	if elapsed := time.Since(start); elapsed > 5*time.Second {
+		t.Fatalf("Expected fetch to fail quickly, took %v", elapsed)
+	}
+}
+
+func TestJetStreamConsumeMsgHeaders(t *testing.T) {
+	s := RunBasicJetStreamServer()
+	defer shutdownJSServerAndRemoveStorage(t, s)
+
+	nc, js := jsClient(t, s)
+	defer nc.Close()
+
+	_, err := js.AddStream(&nats.StreamConfig{Name: "TEST", Subjects: []string{"foo"}})
+	expectOk(t, err)
+
+	for i := 0; i < 2; i++ {
+		m := nats.NewMsg("foo")
+		m.Header.Set("Content-Type", "application/json")
+		m.Header.Add("Trace", "a")
+		m.Header.Add("Trace", "b")
+		m.Data = []byte(`{}`)
+		_, err = js.PublishMsg(m, nats.MsgId(fmt.Sprintf("id-%d", i)))
+		expectOk(t, err)
+	}
+
+	checkHeaders := func(t *testing.T, msg *nats.Msg) {
+		t.Helper()
+		if v := msg.Header.Get("Content-Type"); v != "application/json" {
+			t.Fatalf("Unexpected Content-Type header: %q", v)
+		}
+		if v := msg.Header.Values("Trace"); !reflect.DeepEqual(v, []string{"a", "b"}) {
+			t.Fatalf("Unexpected Trace header: %q", v)
+		}
+		if v := msg.Header.Get(nats.MsgIdHdr); !strings.HasPrefix(v, "id-") {
+			t.Fatalf("Unexpected %s header: %q", nats.MsgIdHdr, v)
+		}
+	}
+
+	t.Run("subscribe", func(t *testing.T) {
+		sub, err := js.SubscribeSync("foo")
+		expectOk(t, err)
+		defer sub.Unsubscribe()
+		for i := 0; i < 2; i++ {
+			msg, err := sub.NextMsg(time.Second)
+			expectOk(t, err)
+			checkHeaders(t, msg)
+		}
+	})
+
+	t.Run("fetch", func(t *testing.T) {
+		sub, err := js.PullSubscribe("foo", "fetch")
+		expectOk(t, err)
+		defer sub.Unsubscribe()
+		msgs, err := sub.Fetch(2)
+		expectOk(t, err)
+		if len(msgs) != 2 {
+			t.Fatalf("Expected 2 messages, got %d", len(msgs))
+		}
+		for _, msg := range msgs {
+			checkHeaders(t, msg)
+		}
+	})
+
+	t.Run("fetch batch", func(t *testing.T) {
+		sub, err := js.PullSubscribe("foo", "batch")
+		expectOk(t, err)
+		defer sub.Unsubscribe()
+		batch, err := sub.FetchBatch(2)
+		expectOk(t, err)
+		var n int
+		for msg := range batch.Messages() {
+			checkHeaders(t, msg)
+			n++
+		}
+		expectOk(t, batch.Error())
+		if n != 2 {
+			t.Fatalf("Expected 2 messages, got %d", n)
+		}
+	})
+}
+
+func TestJetStreamDirectGetFallback(t *testing.T) {
+	s := RunBasicJetStreamServer()
+	defer shutdownJSServerAndRemoveStorage(t, s)
+
+	nc, js := jsClient(t, s)
+	defer nc.Close()
+
+	_, err := js.AddStream(&nats.StreamConfig{Name: "TEST", Subjects: []string{"foo", "bar"}})
+	expectOk(t, err)
+	for _, subj := range []string{"foo", "bar", "foo"} {
+		_, err := js.Publish(subj, []byte(subj))
+		expectOk(t, err)
+	}
+
+	// A new context has no cached stream config, it looks it up
+	// and uses the regular get message API.
+	js2, err := nc.JetStream(nats.MaxWait(500 * time.Millisecond))
+	expectOk(t, err)
+
+	msg, err := js2.GetMsg("TEST", 2, nats.DirectGet())
+	expectOk(t, err)
+	if msg.Subject != "bar" || msg.Sequence != 2 {
+		t.Fatalf("Unexpected message: %+v", msg)
+	}
+	msg, err = js2.GetLastMsg("TEST", "foo", nats.DirectGet())
+	expectOk(t, err)
+	if msg.Subject != "foo" || msg.Sequence != 3 {
+		t.Fatalf("Unexpected message: %+v", msg)
+	}
+	msg, err = js2.GetMsg("TEST", 2, nats.DirectGetNext("foo"))
+	expectOk(t, err)
+	if msg.Subject != "foo" || msg.Sequence != 3 {
+		t.Fatalf("Unexpected message: %+v", msg)
+	}
+
+	if _, err := js2.GetMsg("MISSING", 1, nats.DirectGet()); !errors.Is(err, nats.ErrStreamNotFound) {
+		t.Fatalf("Expected error %v, got %v", nats.ErrStreamNotFound, err)
+	}
+
+	// Once the stream allows direct gets, they are used.
+	_, err = js2.UpdateStream(&nats.StreamConfig{Name: "TEST", Subjects: []string{"foo", "bar"}, AllowDirect: true})
+	expectOk(t, err)
+	sub, err := nc.SubscribeSync("$JS.API.DIRECT.GET.TEST.>")
+	expectOk(t, err)
+	defer sub.Unsubscribe()
+	msg, err = js2.GetLastMsg("TEST", "bar", nats.DirectGet())
+	expectOk(t, err)
+	if msg.Subject != "bar" || msg.Sequence != 2 {
+		t.Fatalf("Unexpected message: %+v", msg)
+	}
+	if _, err := sub.NextMsg(time.Second); err != nil {
+		t.Fatalf("Expected a direct get request: %v", err)
+	}
+
+	// The configuration cached for the stream is not used for the stream
+	// of the same name reached with another API prefix.
+	_, err = js.AddStream(&nats.StreamConfig{Name: "OTHER", Subjects: []string{"baz"}})
+	expectOk(t, err)
+	_, err = js.Publish("baz", []byte("baz"))
+	expectOk(t, err)
+	_, err = js2.GetMsg("OTHER", 1, nats.DirectGet())
+	expectOk(t, err)
+	relayed := relayJSAPI(t, nc, "$JS.relay.API.")
+	msg, err = js2.GetMsg("OTHER", 1, nats.DirectGet(), nats.APIPrefix("$JS.relay.API"))
+	expectOk(t, err)
+	if msg.Subject != "baz" {
+		t.Fatalf("Unexpected message: %+v", msg)
+	}
+	expected := []string{"$JS.relay.API.STREAM.INFO.OTHER", "$JS.relay.API.STREAM.MSG.GET.OTHER"}
+	if subjs := relayed(); !reflect.DeepEqual(subjs, expected) {
+		t.Fatalf("Expected requests %q, got %q", expected, subjs)
+	}
+}
+
+func TestJetStreamAddConsumerIdempotent(t *testing.T) {
+	s := RunBasicJetStreamServer()
+	defer shutdownJSServerAndRemoveStorage(t, s)
+
+	nc, js := jsClient(t, s)
+	defer nc.Close()
+
+	_, err := js.AddStream(&nats.StreamConfig{Name: "TEST", Subjects: []string{"foo"}})
+	expectOk(t, err)
+
+	cfg := &nats.ConsumerConfig{Durable: "dlc", AckPolicy: nats.AckExplicitPolicy, MaxDeliver: 5}
+	ci, err := js.AddConsumer("TEST", cfg)
+	expectOk(t, err)
+
+	// Creating again with the same configuration returns the existing consumer.
+	for i := 0; i < 3; i++ {
+		again, err := js.AddConsumer("TEST", cfg)
+		expectOk(t, err)
+		if again.Name != ci.Name || !again.Created.Equal(ci.Created) {
+			t.Fatalf("Expected existing consumer %+v, got %+v", ci, again)
+		}
+	}
+
+	_, err = js.AddConsumer("TEST", &nats.ConsumerConfig{Durable: "dlc", AckPolicy: nats.AckExplicitPolicy, MaxDeliver: 10})
+	if !errors.Is(err, nats.ErrConsumerExists) {
+		t.Fatalf("Expected error %v, got %v", nats.ErrConsumerExists, err)
+	}
+	if !strings.Contains(err.Error(), "max deliver") {
+		t.Fatalf("Expected error to describe the conflict, got %v", err)
+	}
+}
+
+func TestJetStreamCountMessages(t *testing.T) {
+	s := RunBasicJetStreamServer()
+	defer shutdownJSServerAndRemoveStorage(t, s)
+
+	nc, js := jsClient(t, s)
+	defer nc.Close()
+
+	_, err := js.AddStream(&nats.StreamConfig{Name: "TEST", Subjects: []string{"foo.*"}})
+	expectOk(t, err)
+	for i := 0; i < 10; i++ {
+		subj := "foo.A"
+		if i%2 == 1 {
+			subj = "foo.B"
+		}
+		_, err := js.Publish(subj, []byte("hello"))
+		expectOk(t, err)
+	}
+
+	for _, test := range []struct {
+		subject  string
+		since    uint64
+		expected uint64
+	}{
+		{"", 0, 10},
+		{"foo.*", 4, 7},
+		{"foo.A", 0, 5},
+		{"foo.B", 5, 3},
+		{"foo.A", 11, 0},
+		{"foo.C", 0, 0},
+	} {
+		n, err := js.CountMessages("TEST", test.subject, test.since)
+		expectOk(t, err)
+		if n != test.expected {
+			t.Fatalf("Expected %d messages for %q since %d, got %d", test.expected, test.subject, test.since, n)
+		}
+	}
+
+	// The ephemeral consumers are removed.
+	si, err := js.StreamInfo("TEST")
+	expectOk(t, err)
+	if si.State.Consumers != 0 {
+		t.Fatalf("Expected no consumers, got %d", si.State.Consumers)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	if _, err := js.CountMessages("TEST", "foo.A", 0, nats.Context(ctx)); !errors.Is(err, context.Canceled) {
+		t.Fatalf("Expected error %v, got %v", context.Canceled, err)
+	}
+	if _, err := js.CountMessages("MISSING", "foo.A", 0); !errors.Is(err, nats.ErrStreamNotFound) {
+		t.Fatalf("Expected error %v, got %v", nats.ErrStreamNotFound, err)
+	}
+}
+
+func TestJetStreamFetchPullNoWait(t *testing.T) {
+	s := RunBasicJetStreamServer()
+	defer shutdownJSServerAndRemoveStorage(t, s)
+
+	nc, js := jsClient(t, s)
+	defer nc.Close()
+
+	_, err := js.AddStream(&nats.StreamConfig{Name: "TEST", Subjects: []string{"foo"}})
+	expectOk(t, err)
+
+	sub, err := js.PullSubscribe("foo", "dlc", nats.AckNone())
+	expectOk(t, err)
+	defer sub.Unsubscribe()
+
+	publish := func(n int) {
+		t.Helper()
+		for i := 0; i < n; i++ {
+			_, err := js.Publish("foo", []byte("hello"))
+			expectOk(t, err)
+		}
+	}
+
+	publish(3)
+	start := time.Now()
+	msgs, err := sub.Fetch(10, nats.PullNoWait(), nats.MaxWait(5*time.Second))
+	expectOk(t, err)
+	if len(msgs) != 3 {
+		t.Fatalf("Expected 3 messages, got %d", len(msgs))
+	}
+	for _, batch := range []int{10, 1} {
+		msgs, err = sub.Fetch(batch, nats.PullNoWait(), nats.MaxWait(5*time.Second))
+		expectOk(t, err)
+		if len(msgs) != 0 {
+			t.Fatalf("Expected no messages, got %d", len(msgs))
+		}
+	}
+	if elapsed := time.Since(start); elapsed > 2*time.Second {
+		t.Fatalf("Expected no wait fetches to return right away, took %v", elapsed)
+	}
+
+	publish(3)
+	start = time.Now()
+	batch, err := sub.FetchBatch(10, nats.PullNoWait(), nats.PullMaxBytes(1024), nats.MaxWait(5*time.Second))
+	expectOk(t, err)
+	var n int
+	for range batch.Messages() {
+		n++
+	}
+	expectOk(t, batch.Error())
+	if n != 3 {
+		t.Fatalf("Expected 3 messages, got %d", n)
+	}
+	batch, err = sub.FetchBatch(10, nats.PullNoWait(), nats.MaxWait(5*time.Second))
+	expectOk(t, err)
+	for range batch.Messages() {
+		t.Fatalf("Unexpected message")
+	}
+	expectOk(t, batch.Error())
+	if elapsed := time.Since(start); elapsed > 2*time.Second {
+		t.Fatalf("Expected no wait fetches to return right away, took %v", elapsed)
+	}
+}
+
+func TestJetStreamRebindOnDeliverSubjectChange(t *testing.T) {
+	s := RunBasicJetStreamServer()
+	defer shutdownJSServerAndRemoveStorage(t, s)
+
+	nc, js := jsClient(t, s)
+	defer nc.Close()
+
+	_, err := js.AddStream(&nats.StreamConfig{Name: "TEST", Subjects: []string{"foo"}})
+	expectOk(t, err)
+	cfg := &nats.ConsumerConfig{Durable: "dlc", AckPolicy: nats.AckExplicitPolicy, DeliverSubject: "d1"}
+	_, err = js.AddConsumer("TEST", cfg)
+	expectOk(t, err)
+
+	sub, err := js.SubscribeSync("foo", nats.Bind("TEST", "dlc"))
+	expectOk(t, err)
+	defer sub.Unsubscribe()
+
+	checkReceive := func(deliver string) {
+		t.Helper()
+		if sub.Subject != deliver {
+			t.Fatalf("Expected subscription on %q, got %q", deliver, sub.Subject)
+		}
+		_, err := js.Publish("foo", []byte("hello"))
+		expectOk(t, err)
+		msg, err := sub.NextMsg(time.Second)
+		expectOk(t, err)
+		expectOk(t, msg.AckSync())
+	}
+	checkReceive("d1")
+
+	// Updated through the same context, the subscription is moved right away.
+	cfg.DeliverSubject = "d2"
+	_, err = js.UpdateConsumer("TEST", cfg)
+	expectOk(t, err)
+	checkReceive("d2")
+
+	// Updated by another client, the subscription is moved once
+	// the consumer info is looked up.
+	nc2, js2 := jsClient(t, s)
+	defer nc2.Close()
+	cfg.DeliverSubject = "d3"
+	_, err = js2.UpdateConsumer("TEST", cfg)
+	expectOk(t, err)
+	ci, err := sub.ConsumerInfo()
+	expectOk(t, err)
+	if ci.Config.DeliverSubject != "d3" {
+		t.Fatalf("Unexpected deliver subject: %q", ci.Config.DeliverSubject)
+	}
+	checkReceive("d3")
+}
+
+func TestJetStreamPublishNoStream(t *testing.T) {
+	s := RunBasicJetStreamServer()
+	defer shutdownJSServerAndRemoveStorage(t, s)
+
+	nc, js := jsClient(t, s)
+	defer nc.Close()
+
+	_, err := js.AddStream(&nats.StreamConfig{Name: "TEST", Subjects: []string{"foo"}})
+	expectOk(t, err)
+
+	// Without any interest, the publish fails right away.
+	if _, err := js.Publish("bar", []byte("hello"), nats.RetryAttempts(0)); err != nats.ErrNoStreamResponse {
+		t.Fatalf("Expected error %v, got %v", nats.ErrNoStreamResponse, err)
+	}
+
+	// A plain subscription receives the message but does not acknowledge
+	// it, the publish times out without any further lookup.
+	sub, err := nc.SubscribeSync("bar")
+	expectOk(t, err)
+	defer sub.Unsubscribe()
+	if _, err := js.Publish("bar", []byte("hello"), nats.AckWait(250*time.Millisecond)); err != nats.ErrTimeout {
+		t.Fatalf("Expected error %v, got %v", nats.ErrTimeout, err)
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 250*time.Millisecond)
+	defer cancel()
+	if _, err := js.Publish("bar", []byte("hello"), nats.Context(ctx)); err != context.DeadlineExceeded {
+		t.Fatalf("Expected error %v, got %v", context.DeadlineExceeded, err)
+	}
+
+	// With CheckStreamOnTimeout(), the stream of the subject is looked up.
+	if _, err := js.Publish("bar", []byte("hello"), nats.AckWait(250*time.Millisecond), nats.CheckStreamOnTimeout()); err != nats.ErrNoStreamResponse {
+		t.Fatalf("Expected error %v, got %v", nats.ErrNoStreamResponse, err)
+	}
+	ctx, cancel = context.WithTimeout(context.Background(), 250*time.Millisecond)
+	defer cancel()
+	if _, err := js.Publish("bar", []byte("hello"), nats.Context(ctx), nats.CheckStreamOnTimeout()); err != nats.ErrNoStreamResponse {
+		t.Fatalf("Expected error %v, got %v", nats.ErrNoStreamResponse, err)
+	}
+
+	// A stream captures the subject but does not answer in time.
+	if _, err := js.Publish("foo", []byte("hello"), nats.AckWait(time.Nanosecond), nats.CheckStreamOnTimeout()); err != nats.ErrTimeout {
+		t.Fatalf("Expected error %v, got %v", nats.ErrTimeout, err)
+	}
+}
+
+func TestJetStreamResetConsumer(t *testing.T) {
+	s := RunBasicJetStreamServer()
+	defer shutdownJSServerAndRemoveStorage(t, s)
+
+	nc, js := jsClient(t, s)
+	defer nc.Close()
+
+	_, err := js.AddStream(&nats.StreamConfig{Name: "TEST", Subjects: []string{"foo"}})
+	expectOk(t, err)
+
+	var mid time.Time
+	for i := 1; i <= 10; i++ {
+		if i == 6 {
+			time.Sleep(10 * time.Millisecond)
+			mid = time.Now()
+		}
+		_, err := js.Publish("foo", []byte(strconv.Itoa(i)))
+		expectOk(t, err)
+	}
+
+	sub, err := js.PullSubscribe("foo", "dlc", nats.AckExplicit())
+	expectOk(t, err)
+	defer sub.Unsubscribe()
+
+	// Older servers can not reset consumers.
+	if !versionAtLeast(nc.ConnectedServerVersion(), 2, 14, 0) {
+		if _, err := js.ResetConsumer("TEST", "dlc", 1); !errors.Is(err, nats.ErrFeatureNotSupported) {
+			t.Fatalf("Expected error %v, got %v", nats.ErrFeatureNotSupported, err)
+		}
+		if _, err := js.ResetConsumerToTime("TEST", "dlc", mid); !errors.Is(err, nats.ErrFeatureNotSupported) {
+			t.Fatalf("Expected error %v, got %v", nats.ErrFeatureNotSupported, err)
+		}
+		return
+	}
+
+	fetchAll := func(expected int, first uint64) {
+		t.Helper()
+		msgs, err := sub.Fetch(expected, nats.MaxWait(time.Second))
+		expectOk(t, err)
+		if len(msgs) != expected {
+			t.Fatalf("Expected %d messages, got %d", expected, len(msgs))
+		}
+		for i, m := range msgs {
+			meta, err := m.Metadata()
+			expectOk(t, err)
+			if meta.Sequence.Stream != first+uint64(i) {
+				t.Fatalf("Expected sequence %d, got %d", first+uint64(i), meta.Sequence.Stream)
+			}
+			m.Ack()
+		}
+	}
+	fetchAll(10, 1)
+
+	info, err := js.ResetConsumer("TEST", "dlc", 4)
+	expectOk(t, err)
+	if info.Name != "dlc" || info.Config.Durable != "dlc" {
+		t.Fatalf("Unexpected consumer info: %+v", info)
+	}
+	if info.NumPending != 7 {
+		t.Fatalf("Expected 7 pending messages, got %d", info.NumPending)
+	}
+	fetchAll(7, 4)
+
+	info, err = js.ResetConsumerToTime("TEST", "dlc", mid)
+	expectOk(t, err)
+	if info.NumPending != 5 {
+		t.Fatalf("Expected 5 pending messages, got %d", info.NumPending)
+	}
+	fetchAll(5, 6)
+
+	// Positions outside of the stream are rejected, and the consumer is kept.
+	if _, err := js.ResetConsumer("TEST", "dlc", 20); !errors.Is(err, nats.ErrInvalidStartPosition) {
+		t.Fatalf("Expected error %v, got %v", nats.ErrInvalidStartPosition, err)
+	}
+	if _, err := js.ResetConsumer("TEST", "dlc", 0); !errors.Is(err, nats.ErrInvalidStartPosition) {
+		t.Fatalf("Expected error %v, got %v", nats.ErrInvalidStartPosition, err)
+	}
+	if _, err := js.ResetConsumerToTime("TEST", "dlc", time.Now().Add(time.Hour)); !errors.Is(err, nats.ErrInvalidStartPosition) {
+		t.Fatalf("Expected error %v, got %v", nats.ErrInvalidStartPosition, err)
+	}
+	if _, err := js.ConsumerInfo("TEST", "dlc"); err != nil {
+		t.Fatalf("Expected consumer to still exist, got %v", err)
+	}
+
+	if _, err := js.ResetConsumer("TEST", "missing", 1); !errors.Is(err, nats.ErrConsumerNotFound) {
+		t.Fatalf("Expected error %v, got %v", nats.ErrConsumerNotFound, err)
+	}
+
+	// Requests are made with the API prefix of the call.
+	relayed := relayJSAPI(t, nc, "$JS.relay.API.")
+	_, err = js.ResetConsumer("TEST", "dlc", 1, nats.APIPrefix("$JS.relay.API"))
+	expectOk(t, err)
+	if subjs := relayed(); len(subjs) != 2 || subjs[1] != "$JS.relay.API.CONSUMER.RESET.TEST.dlc" {
+		t.Fatalf("Expected the reset request with the API prefix, got %q", subjs)
+	}
+}
+
+// versionAtLeast reports whether the server version is at least the given one.
+func versionAtLeast(version string, major, minor, patch int) bool {
+	var smajor, sminor, spatch int
+	fmt.Sscanf(version, "%d.%d.%d", &smajor, &sminor, &spatch)
+	if smajor != major {
+		return smajor > major
+	}
+	if sminor != minor {
+		return sminor > minor
+	}
+	return spatch >= patch
+}
+
+func TestJetStreamConsumerConfigPresets(t *testing.T) {
+	s := RunBasicJetStreamServer()
+	defer shutdownJSServerAndRemoveStorage(t, s)
+
+	nc, js := jsClient(t, s)
+	defer nc.Close()
+
+	_, err := js.AddStream(&nats.StreamConfig{Name: "TEST", Subjects: []string{"foo.*"}})
+	expectOk(t, err)
+	for i := 0; i < 3; i++ {
+		_, err := js.Publish("foo.a", []byte("hello"))
+		expectOk(t, err)
+	}
+
+	wq := nats.NewWorkQueueConsumerConfig("wq", "foo.a")
+	info, err := js.AddConsumer("TEST", wq)
+	expectOk(t, err)
+	if info.Config.AckPolicy != nats.AckExplicitPolicy || info.Config.MaxDeliver != 5 || len(info.Config.BackOff) != 3 {
+		t.Fatalf("Unexpected work queue consumer config: %+v", info.Config)
+	}
+	if info.NumPending != 3 {
+		t.Fatalf("Expected 3 pending messages, got %d", info.NumPending)
+	}
+
+	replay := nats.NewDurableReplayConfig("replay", "")
+	replay.FilterSubject = "foo.b"
+	info, err = js.AddConsumer("TEST", replay)
+	expectOk(t, err)
+	if info.Config.Durable != "replay" || info.Config.FilterSubject != "foo.b" || info.NumPending != 0 {
+		t.Fatalf("Unexpected replay consumer info: %+v", info)
+	}
+
+	tail := nats.NewEphemeralTailConfig()
+	tail.FilterSubject = "foo.a"
+	info, err = js.AddConsumer("TEST", tail)
+	expectOk(t, err)
+	if info.Config.Durable != "" || info.Config.DeliverPolicy != nats.DeliverNewPolicy || info.NumPending != 0 {
+		t.Fatalf("Unexpected tail consumer info: %+v", info)
+	}
+
+	// Each call returns a new configuration.
+	if nats.NewEphemeralTailConfig().FilterSubject != "" {
+		t.Fatalf("Expected presets not to be shared")
+	}
+}
+
+func TestJetStreamEphemeralPullSubscribe(t *testing.T) {
+	s := RunBasicJetStreamServer()
+	defer shutdownJSServerAndRemoveStorage(t, s)
+
+	nc, js := jsClient(t, s)
+	defer nc.Close()
+
+	_, err := js.AddStream(&nats.StreamConfig{Name: "TEST", Subjects: []string{"foo.*"}})
+	expectOk(t, err)
+	for _, subj := range []string{"foo.a", "foo.b", "foo.a"} {
+		_, err := js.Publish(subj, []byte("hello"))
+		expectOk(t, err)
+	}
+
+	sub, err := js.EphemeralPullSubscribe("TEST", "foo.a", nats.ConsumerMemoryStorage(), nats.ConsumerReplicas(1))
+	expectOk(t, err)
+	defer sub.Unsubscribe()
+
+	info, err := sub.ConsumerInfo()
+	expectOk(t, err)
+	if info.Config.Durable != "" || !info.Config.MemoryStorage || info.Config.Replicas != 1 {
+		t.Fatalf("Unexpected consumer config: %+v", info.Config)
+	}
+	if info.Config.InactiveThreshold != 5*time.Second {
+		t.Fatalf("Expected default inactive threshold, got %v", info.Config.InactiveThreshold)
+	}
+
+	msgs, err := sub.Fetch(10, nats.MaxWait(250*time.Millisecond))
+	expectOk(t, err)
+	if len(msgs) != 2 {
+		t.Fatalf("Expected 2 messages, got %d", len(msgs))
+	}
+	for _, m := range msgs {
+		if m.Subject != "foo.a" {
+			t.Fatalf("Unexpected subject %q", m.Subject)
+		}
+	}
+
+	if _, err := js.EphemeralPullSubscribe("TEST", "foo.a", nats.Durable("dlc")); err == nil {
+		t.Fatalf("Expected error with a durable name")
+	}
+	if _, err := js.EphemeralPullSubscribe("TEST", "foo.a", nats.Bind("TEST", "dlc")); err == nil {
+		t.Fatalf("Expected error with a bound consumer")
+	}
+	if _, err := js.EphemeralPullSubscribe("", "foo.a"); err != nats.ErrStreamNameRequired {
+		t.Fatalf("Expected error %v, got %v", nats.ErrStreamNameRequired, err)
+	}
+}
+
+func TestJetStreamMaxConsumersReached(t *testing.T) {
+	s := RunBasicJetStreamServer()
+	defer shutdownJSServerAndRemoveStorage(t, s)
+
+	nc, js := jsClient(t, s)
+	defer nc.Close()
+
+	_, err := js.AddStream(&nats.StreamConfig{Name: "TEST", Subjects: []string{"foo"}, MaxConsumers: 1})
+	expectOk(t, err)
+
+	_, err = js.AddConsumer("TEST", &nats.ConsumerConfig{Durable: "one", AckPolicy: nats.AckExplicitPolicy})
+	expectOk(t, err)
+
+	_, err = js.AddConsumer("TEST", &nats.ConsumerConfig{Durable: "two", AckPolicy: nats.AckExplicitPolicy})
+	if !errors.Is(err, nats.ErrMaxConsumersReached) {
+		t.Fatalf("Expected error %v, got %v", nats.ErrMaxConsumersReached, err)
+	}
+	if !strings.Contains(err.Error(), "allows 1 consumers") {
+		t.Fatalf("Expected the limit in the error, got %q", err)
+	}
+
+	// Consumers created when subscribing report the same error.
+	_, err = js.PullSubscribe("foo", "")
+	if !errors.Is(err, nats.ErrMaxConsumersReached) {
+		t.Fatalf("Expected error %v, got %v", nats.ErrMaxConsumersReached, err)
+	}
+}
+
+func TestJetStreamWorkQueueConsumer(t *testing.T) {
+	s := RunBasicJetStreamServer()
+	defer shutdownJSServerAndRemoveStorage(t, s)
+
+	nc, js := jsClient(t, s)
+	defer nc.Close()
+
+	_, err := js.AddStream(&nats.StreamConfig{Name: "JOBS", Subjects: []string{"jobs.>"}, Retention: nats.WorkQueuePolicy})
+	expectOk(t, err)
+	_, err = js.AddStream(&nats.StreamConfig{Name: "EVENTS", Subjects: []string{"events.>"}})
+	expectOk(t, err)
+
+	info, err := js.WorkQueueConsumer("JOBS", "jobs.a")
+	expectOk(t, err)
+	if info.Config.FilterSubject != "jobs.a" || info.Config.AckPolicy != nats.AckExplicitPolicy {
+		t.Fatalf("Unexpected consumer config: %+v", info.Config)
+	}
+
+	// The same filter binds to the existing consumer.
+	again, err := js.WorkQueueConsumer("JOBS", "jobs.a")
+	expectOk(t, err)
+	if again.Name != info.Name {
+		t.Fatalf("Expected consumer %q, got %q", info.Name, again.Name)
+	}
+
+	// Overlapping filters are rejected.
+	for _, filter := range []string{"jobs.*", "jobs.>", ""} {
+		if _, err := js.WorkQueueConsumer("JOBS", filter); !errors.Is(err, nats.ErrConsumerFilterOverlap) {
+			t.Fatalf("Expected error %v for %q, got %v", nats.ErrConsumerFilterOverlap, filter, err)
+		}
+	}
+
+	other, err := js.WorkQueueConsumer("JOBS", "jobs.b.*")
+	expectOk(t, err)
+	if other.Name == info.Name {
+		t.Fatalf("Expected a new consumer")
+	}
+
+	if _, err := js.WorkQueueConsumer("EVENTS", "events.a"); !errors.Is(err, nats.ErrInvalidArg) {
+		t.Fatalf("Expected error %v, got %v", nats.ErrInvalidArg, err)
+	}
+
+	_, err = js.Publish("jobs.a", []byte("work"))
+	expectOk(t, err)
+	sub, err := js.PullSubscribe("", "", nats.Bind("JOBS", info.Name))
+	expectOk(t, err)
+	defer sub.Unsubscribe()
+	msgs, err := sub.Fetch(1, nats.MaxWait(time.Second))
+	expectOk(t, err)
+	if len(msgs) != 1 || string(msgs[0].Data) != "work" {
+		t.Fatalf("Unexpected messages: %v", msgs)
+	}
+}
+
+func TestJetStreamConsumerFlowControlValidation(t *testing.T) {
+	s := RunBasicJetStreamServer()
+	defer shutdownJSServerAndRemoveStorage(t, s)
+
+	nc, js := jsClient(t, s)
+	defer nc.Close()
+
+	_, err := js.AddStream(&nats.StreamConfig{Name: "TEST", Subjects: []string{"foo"}})
+	expectOk(t, err)
+
+	for _, test := range []struct {
+		name string
+		cfg  *nats.ConsumerConfig
+	}{
+		{"flow control without heartbeat", &nats.ConsumerConfig{DeliverSubject: "d", FlowControl: true}},
+		{"flow control on pull", &nats.ConsumerConfig{Durable: "p", FlowControl: true, Heartbeat: time.Second}},
+		{"heartbeat on pull", &nats.ConsumerConfig{Durable: "p", Heartbeat: time.Second}},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			if _, err := js.AddConsumer("TEST", test.cfg); !errors.Is(err, nats.ErrInvalidConsumerConfig) {
+				t.Fatalf("Expected error %v, got %v", nats.ErrInvalidConsumerConfig, err)
+			}
+		})
+	}
+
+	if _, err := js.SubscribeSync("foo", nats.EnableFlowControl()); !errors.Is(err, nats.ErrInvalidConsumerConfig) {
+		t.Fatalf("Expected error %v, got %v", nats.ErrInvalidConsumerConfig, err)
+	}
+
+	// Flow control requests are answered by the subscription.
+	total := 2000
+	data := make([]byte, 1024)
+	for i := 0; i < total; i++ {
+		_, err := js.PublishAsync("foo", data)
+		expectOk(t, err)
+	}
+	select {
+	case <-js.PublishAsyncComplete():
+	case <-time.After(5 * time.Second):
+		t.Fatalf("Did not receive completion signal")
+	}
+
+	sub, err := js.SubscribeSync("foo", nats.EnableFlowControl(), nats.IdleHeartbeat(time.Second), nats.AckNone())
+	expectOk(t, err)
+	defer sub.Unsubscribe()
+	info, err := sub.ConsumerInfo()
+	expectOk(t, err)
+	if !info.Config.FlowControl {
+		t.Fatalf("Expected flow control to be enabled")
+	}
+	for i := 0; i < total; i++ {
+		if _, err := sub.NextMsg(2 * time.Second); err != nil {
+			t.Fatalf("Error receiving message %d: %v", i, err)
+		}
+	}
+}
+
+func TestJetStreamContextStats(t *testing.T) {
+	s := RunBasicJetStreamServer()
+	defer shutdownJSServerAndRemoveStorage(t, s)
+
+	nc, js := jsClient(t, s)
+	defer nc.Close()
+
+	if stats := js.Stats(); stats != (nats.JetStreamStats{}) {
+		t.Fatalf("Expected empty stats, got %+v", stats)
+	}
+
+	_, err := js.AddStream(&nats.StreamConfig{Name: "TEST", Subjects: []string{"foo"}})
+	expectOk(t, err)
+	if _, err := js.StreamInfo("MISSING"); !errors.Is(err, nats.ErrStreamNotFound) {
+		t.Fatalf("Expected error %v, got %v", nats.ErrStreamNotFound, err)
+	}
+
+	for i := 0; i < 3; i++ {
+		_, err := js.Publish("foo", []byte("hello"))
+		expectOk(t, err)
+	}
+	for i := 0; i < 2; i++ {
+		_, err := js.PublishAsync("foo", []byte("hello"))
+		expectOk(t, err)
+	}
+	select {
+	case <-js.PublishAsyncComplete():
+	case <-time.After(5 * time.Second):
+		t.Fatalf("Did not receive completion signal")
+	}
+
+	sub, err := js.SubscribeSync("foo")
+	expectOk(t, err)
+	defer sub.Unsubscribe()
+	for i := 0; i < 5; i++ {
+		m, err := sub.NextMsg(time.Second)
+		expectOk(t, err)
+		expectOk(t, m.Ack())
+	}
+
+	stats := js.Stats()
+	if stats.APIRequests < 3 {
+		t.Fatalf("Expected at least 3 API requests, got %d", stats.APIRequests)
+	}
+	if stats.APIErrors != 1 {
+		t.Fatalf("Expected 1 API error, got %d", stats.APIErrors)
+	}
+	if stats.Published != 5 || stats.Consumed != 5 || stats.Acks != 5 {
+		t.Fatalf("Unexpected stats: %+v", stats)
+	}
+	if stats.Reconnects != 0 {
+		t.Fatalf("Expected no reconnects, got %d", stats.Reconnects)
+	}
+}
+
+func TestJetStreamAckSamples(t *testing.T) {
+	s := RunBasicJetStreamServer()
+	defer shutdownJSServerAndRemoveStorage(t, s)
+
+	nc, js := jsClient(t, s)
+	defer nc.Close()
+
+	_, err := js.AddStream(&nats.StreamConfig{Name: "TEST", Subjects: []string{"foo"}})
+	expectOk(t, err)
+
+	if _, err := js.SubscribeSync("foo", nats.SampleFrequency("150%")); err == nil {
+		t.Fatalf("Expected error for an invalid sample frequency")
+	}
+
+	sub, err := js.SubscribeSync("foo", nats.Durable("dlc"), nats.SampleFrequency("100%"))
+	expectOk(t, err)
+	defer sub.Unsubscribe()
+
+	samples := make(chan *nats.ConsumerAckSample, 10)
+	ssub, err := js.AckSamples("TEST", "dlc", func(s *nats.ConsumerAckSample) {
+		samples <- s
+	})
+	expectOk(t, err)
+	defer ssub.Unsubscribe()
+	expectOk(t, nc.Flush())
+
+	_, err = js.Publish("foo", []byte("hello"))
+	expectOk(t, err)
+	m, err := sub.NextMsg(time.Second)
+	expectOk(t, err)
+	time.Sleep(20 * time.Millisecond)
+	expectOk(t, m.AckSync())
+
+	select {
+	case s := <-samples:
+		if s.Stream != "TEST" || s.Consumer != "dlc" || s.StreamSeq != 1 || s.Deliveries != 1 {
+			t.Fatalf("Unexpected sample: %+v", s)
+		}
+		if s.Delay < 20*time.Millisecond {
+			t.Fatalf("Expected a delay of at least 20ms, got %v", s.Delay)
+		}
+	case <-time.After(2 * time.Second):
+		t.Fatalf("Did not receive an ack sample")
+	}
+
+	if _, err := js.AckSamples("TEST", "dlc", nil); !errors.Is(err, nats.ErrInvalidArg) {
+		t.Fatalf("Expected error %v, got %v", nats.ErrInvalidArg, err)
+	}
+}
+
+func TestJetStreamAdvisories(t *testing.T) {
+	s := RunBasicJetStreamServer()
+	defer shutdownJSServerAndRemoveStorage(t, s)
+
+	nc, js := jsClient(t, s)
+	defer nc.Close()
+
+	advisories := make(chan *nats.Advisory, 100)
+	asub, err := js.Advisories("CONSUMER.>", func(a *nats.Advisory) {
+		advisories <- a
+	})
+	expectOk(t, err)
+	defer asub.Unsubscribe()
+	raw := make(chan *nats.Advisory, 100)
+	rsub, err := js.Advisories("", func(a *nats.Advisory) {
+		if a.Event == nil {
+			raw <- a
+		}
+	})
+	expectOk(t, err)
+	defer rsub.Unsubscribe()
+	expectOk(t, nc.Flush())
+
+	next := func(expected string) *nats.Advisory {
+		t.Helper()
+		for {
+			select {
+			case a := <-advisories:
+				if a.Type == expected {
+					return a
+				}
+			case <-time.After(2 * time.Second):
+				t.Fatalf("Did not receive advisory %q", expected)
+			}
+		}
+	}
+
+	_, err = js.AddStream(&nats.StreamConfig{Name: "TEST", Subjects: []string{"foo"}})
+	expectOk(t, err)
+	sub, err := js.SubscribeSync("foo", nats.Durable("dlc"), nats.AckWait(100*time.Millisecond), nats.MaxDeliver(1))
+	expectOk(t, err)
+	defer sub.Unsubscribe()
+
+	a := next(nats.ConsumerActionAdvisoryType)
+	if ca, ok := a.Event.(*nats.ConsumerActionAdvisory); !ok || ca.Stream != "TEST" || ca.Consumer != "dlc" || ca.Action != "create" {
+		t.Fatalf("Unexpected advisory: %+v", a.Event)
+	}
+	if !strings.HasPrefix(a.Subject, "$JS.EVENT.ADVISORY.CONSUMER.") || a.ID == "" || a.Time.IsZero() {
+		t.Fatalf("Unexpected advisory: %+v", a)
+	}
+
+	// Not acknowledged, the message exceeds its deliveries.
+	_, err = js.Publish("foo", []byte("one"))
+	expectOk(t, err)
+	_, err = sub.NextMsg(time.Second)
+	expectOk(t, err)
+	a = next(nats.MaxDeliveriesAdvisoryType)
+	if md, ok := a.Event.(*nats.MaxDeliveriesAdvisory); !ok || md.StreamSeq != 1 || md.Deliveries != 1 {
+		t.Fatalf("Unexpected advisory: %+v", a.Event)
+	}
+
+	_, err = js.Publish("foo", []byte("two"))
+	expectOk(t, err)
+	m, err := sub.NextMsg(time.Second)
+	expectOk(t, err)
+	expectOk(t, m.Term())
+	a = next(nats.MsgTerminatedAdvisoryType)
+	if mt, ok := a.Event.(*nats.MsgTerminatedAdvisory); !ok || mt.StreamSeq != 2 {
+		t.Fatalf("Unexpected advisory: %+v", a.Event)
+	}
+
+	// Other advisories, such as API audits, are delivered without a decoded event.
+	select {
+	case a := <-raw:
+		if a.Type == "" || len(a.Data) == 0 {
+			t.Fatalf("Unexpected advisory: %+v", a)
+		}
+	case <-time.After(2 * time.Second):
+		t.Fatalf("Did not receive a raw advisory")
+	}
+}
+
+func TestJetStreamOnMaxDeliveries(t *testing.T) {
+	s := RunBasicJetStreamServer()
+	defer shutdownJSServerAndRemoveStorage(t, s)
+
+	nc, js := jsClient(t, s)
+	defer nc.Close()
+
+	_, err := js.AddStream(&nats.StreamConfig{Name: "TEST", Subjects: []string{"foo"}})
+	expectOk(t, err)
+	_, err = js.AddStream(&nats.StreamConfig{Name: "DLQ", Subjects: []string{"dlq.>"}})
+	expectOk(t, err)
+
+	// Poison messages are moved to the DLQ stream.
+	moved := make(chan uint64, 10)
+	dsub, err := js.OnMaxDeliveries("TEST", "dlc", func(a *nats.MaxDeliveriesAdvisory) {
+		msg, err := js.GetMsg(a.Stream, a.StreamSeq)
+		if err != nil {
+			return
+		}
+		if _, err := js.Publish("dlq."+msg.Subject, msg.Data); err == nil {
+			moved <- a.StreamSeq
+		}
+	})
+	expectOk(t, err)
+	defer dsub.Unsubscribe()
+	// Advisories of other consumers are not delivered.
+	osub, err := js.OnMaxDeliveries("TEST", "other", func(a *nats.MaxDeliveriesAdvisory) {
+		t.Errorf("Unexpected advisory: %+v", a)
+	})
+	expectOk(t, err)
+	defer osub.Unsubscribe()
+	expectOk(t, nc.Flush())
+
+	sub, err := js.SubscribeSync("foo", nats.Durable("dlc"), nats.AckWait(100*time.Millisecond), nats.MaxDeliver(2))
+	expectOk(t, err)
+	defer sub.Unsubscribe()
+
+	_, err = js.Publish("foo", []byte("poison"))
+	expectOk(t, err)
+	for i := 0; i < 2; i++ {
+		m, err := sub.NextMsg(time.Second)
+		expectOk(t, err)
+		m.Nak()
+	}
+
+	select {
+	case seq := <-moved:
+		if seq != 1 {
+			t.Fatalf("Expected sequence 1, got %d", seq)
+		}
+	case <-time.After(2 * time.Second):
+		t.Fatalf("Did not receive the max deliveries advisory")
+	}
+	msg, err := js.GetLastMsg("DLQ", "dlq.foo")
+	expectOk(t, err)
+	if string(msg.Data) != "poison" {
+		t.Fatalf("Unexpected message: %q", msg.Data)
+	}
+
+	if _, err := js.OnMaxDeliveries("TEST", "dlc", nil); !errors.Is(err, nats.ErrInvalidArg) {
+		t.Fatalf("Expected error %v, got %v", nats.ErrInvalidArg, err)
+	}
+}
+
+func TestJetStreamApplyConfigs(t *testing.T) {
+	s := RunBasicJetStreamServer()
+	defer shutdownJSServerAndRemoveStorage(t, s)
+
+	nc, js := jsClient(t, s)
+	defer nc.Close()
+
+	_, err := js.AddStream(&nats.StreamConfig{Name: "B", Subjects: []string{"b"}})
+	expectOk(t, err)
+	_, err = js.AddStream(&nats.StreamConfig{Name: "C", Subjects: []string{"c"}})
+	expectOk(t, err)
+
+	results := js.ApplyStreamConfigs([]*nats.StreamConfig{
+		{Name: "A", Subjects: []string{"a"}},
+		{Name: "B", Subjects: []string{"b"}},
+		{Name: "C", Subjects: []string{"c"}, MaxMsgs: 10},
+		{Name: "D", Subjects: []string{"a"}},
+		nil,
+	})
+	expected := []nats.ApplyAction{nats.ApplyCreated, nats.ApplyUnchanged, nats.ApplyUpdated, nats.ApplyFailed, nats.ApplyFailed}
+	if len(results) != len(expected) {
+		t.Fatalf("Expected %d results, got %d", len(expected), len(results))
+	}
+	for i, r := range results {
+		if r.Action != expected[i] {
+			t.Fatalf("Expected %v for %q, got %v (%v)", expected[i], r.Name, r.Action, r.Err)
+		}
+		if (r.Err != nil) != (r.Action == nats.ApplyFailed) {
+			t.Fatalf("Unexpected error for %q: %v", r.Name, r.Err)
+		}
+	}
+	if results[0].Name != "A" || results[4].Err != nats.ErrStreamConfigRequired {
+		t.Fatalf("Unexpected results: %+v", results)
+	}
+	info, err := js.StreamInfo("C")
+	expectOk(t, err)
+	if info.Config.MaxMsgs != 10 {
+		t.Fatalf("Expected stream to be updated, got %+v", info.Config)
+	}
+
+	results = js.ApplyConsumerConfigs("A", []*nats.ConsumerConfig{
+		{Durable: "one", AckPolicy: nats.AckExplicitPolicy},
+		{Name: "two", AckPolicy: nats.AckExplicitPolicy},
+		{AckPolicy: nats.AckExplicitPolicy},
+	})
+	expected = []nats.ApplyAction{nats.ApplyCreated, nats.ApplyCreated, nats.ApplyFailed}
+	for i, r := range results {
+		if r.Action != expected[i] {
+			t.Fatalf("Expected %v for %q, got %v (%v)", expected[i], r.Name, r.Action, r.Err)
+		}
+	}
+	results = js.ApplyConsumerConfigs("A", []*nats.ConsumerConfig{
+		{Durable: "one", AckPolicy: nats.AckExplicitPolicy},
+		{Name: "two", AckPolicy: nats.AckExplicitPolicy, MaxAckPending: 10},
+	})
+	expected = []nats.ApplyAction{nats.ApplyUnchanged, nats.ApplyUpdated}
+	for i, r := range results {
+		if r.Action != expected[i] {
+			t.Fatalf("Expected %v for %q, got %v (%v)", expected[i], r.Name, r.Action, r.Err)
+		}
+	}
+
+	// Requests are made with the API prefix of the call.
+	relayed := relayJSAPI(t, nc, "$JS.relay.API.")
+	results = js.ApplyStreamConfigs([]*nats.StreamConfig{{Name: "E", Subjects: []string{"e"}}}, nats.APIPrefix("$JS.relay.API"))
+	if results[0].Action != nats.ApplyCreated {
+		t.Fatalf("Expected stream to be created, got %v (%v)", results[0].Action, results[0].Err)
+	}
+	results = js.ApplyConsumerConfigs("E", []*nats.ConsumerConfig{{Durable: "one", AckPolicy: nats.AckExplicitPolicy}}, nats.APIPrefix("$JS.relay.API"))
+	if results[0].Action != nats.ApplyCreated {
+		t.Fatalf("Expected consumer to be created, got %v (%v)", results[0].Action, results[0].Err)
+	}
+	if subjs := relayed(); len(subjs) != 4 {
+		t.Fatalf("Expected 4 requests with the API prefix, got %q", subjs)
+	}
+
+	// Resources not configured before the context is done are reported as failed.
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	cfgs := make([]*nats.StreamConfig, 20)
+	for i := range cfgs {
+		cfgs[i] = &nats.StreamConfig{Name: fmt.Sprintf("S%d", i)}
+	}
+	for _, r := range js.ApplyStreamConfigs(cfgs, nats.Context(ctx)) {
+		if r.Action != nats.ApplyFailed || r.Err == nil {
+			t.Fatalf("Expected %q to fail, got %v", r.Name, r.Action)
+		}
+	}
+}
+
+func TestJetStreamConsumerConfigMatches(t *testing.T) {
+	for _, test := range []struct {
+		subject string
+		filter  string
+		match   bool
+	}{
+		{"foo", "foo", true},
+		{"foo", "bar", false},
+		{"foo.bar", "foo.*", true},
+		{"foo.bar.baz", "foo.*", false},
+		{"foo", "foo.*", false},
+		{"foo.bar", "*.bar", true},
+		{"foo.bar.baz", "foo.>", true},
+		{"foo.bar", "foo.>", true},
+		{"foo", "foo.>", false},
+		{"foo.bar", ">", true},
+		{"foo.bar", "foo", false},
+		{"foo..bar", "foo.*.bar", false},
+		{"", ">", false},
+		{"foo", "", false},
+	} {
+		if got := nats.SubjectMatch(test.filter, test.subject); got != test.match {
+			t.Fatalf("Expected %q matching %q to be %v, got %v", test.subject, test.filter, test.match, got)
+		}
+	}
+
+	cfg := &nats.ConsumerConfig{}
+	if !cfg.Matches("foo.bar") {
+		t.Fatalf("Expected a consumer without filter to match all subjects")
+	}
+	cfg = &nats.ConsumerConfig{FilterSubject: "orders.*"}
+	if !cfg.Matches("orders.new") || cfg.Matches("orders.new.eu") {
+		t.Fatalf("Unexpected matches for filter subject %q", cfg.FilterSubject)
+	}
+	cfg = &nats.ConsumerConfig{FilterSubjects: []string{"orders.new", "payments.>"}}
+	if !cfg.Matches("orders.new") || !cfg.Matches("payments.eu.card") || cfg.Matches("orders.old") {
+		t.Fatalf("Unexpected matches for filter subjects %q", cfg.FilterSubjects)
+	}
+}
+
+func TestJetStreamConsumeRateLimit(t *testing.T) {
+	s := RunBasicJetStreamServer()
+	defer shutdownJSServerAndRemoveStorage(t, s)
+
+	nc, js := jsClient(t, s)
+	defer nc.Close()
+
+	_, err := js.AddStream(&nats.StreamConfig{Name: "TEST", Subjects: []string{"foo"}})
+	expectOk(t, err)
+
+	if _, err := js.Subscribe("foo", func(m *nats.Msg) {}, nats.ConsumeRateLimit(0)); err == nil {
+		t.Fatalf("Expected error for an invalid rate")
+	}
+	if _, err := js.SubscribeSync("foo", nats.ConsumeRateLimit(10)); err == nil {
+		t.Fatalf("Expected error for a sync subscription")
+	}
+	if _, err := js.PullSubscribe("foo", "dlc", nats.ConsumeRateLimit(10)); err == nil {
+		t.Fatalf("Expected error for a pull subscription")
+	}
+
+	for i := 0; i < 20; i++ {
+		_, err := js.Publish("foo", []byte("hello"))
+		expectOk(t, err)
+	}
+
+	received := make(chan time.Time, 20)
+	sub, err := js.Subscribe("foo", func(m *nats.Msg) {
+		received <- time.Now()
+	}, nats.ConsumeRateLimit(20))
+	expectOk(t, err)
+	defer sub.Unsubscribe()
+
+	info, err := sub.ConsumerInfo()
+	expectOk(t, err)
+	// Half of the messages which can be delivered within the default ack wait.
+	if info.Config.MaxAckPending != 300 {
+		t.Fatalf("Expected max ack pending of 300, got %d", info.Config.MaxAckPending)
+	}
+
+	var first, last time.Time
+	for i := 0; i < 10; i++ {
+		select {
+		case ts := <-received:
+			if i == 0 {
+				first = ts
+			}
+			last = ts
+		case <-time.After(time.Second):
+			t.Fatalf("Did not receive message %d", i)
+		}
+	}
+	if elapsed := last.Sub(first); elapsed < 400*time.Millisecond {
+		t.Fatalf("Expected messages to be throttled, received 10 in %v", elapsed)
+	}
+}
+
+func TestJetStreamSubscribeContextNextMsg(t *testing.T) {
+	s := RunBasicJetStreamServer()
+	defer shutdownJSServerAndRemoveStorage(t, s)
+
+	nc, js := jsClient(t, s)
+	defer nc.Close()
+
+	_, err := js.AddStream(&nats.StreamConfig{Name: "TEST", Subjects: []string{"foo"}})
+	expectOk(t, err)
+	_, err = js.Publish("foo", []byte("hello"))
+	expectOk(t, err)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	sub, err := js.SubscribeSync("foo", nats.Context(ctx))
+	expectOk(t, err)
+	info, err := sub.ConsumerInfo()
+	expectOk(t, err)
+	_, err = sub.NextMsg(time.Second)
+	expectOk(t, err)
+
+	// A blocked NextMsg returns once the context is canceled.
+	errCh := make(chan error, 1)
+	go func() {
+		_, err := sub.NextMsg(5 * time.Second)
+		errCh <- err
+	}()
+	time.Sleep(100 * time.Millisecond)
+	cancel()
+	select {
+	case err := <-errCh:
+		if err != context.Canceled {
+			t.Fatalf("Expected error %v, got %v", context.Canceled, err)
+		}
+	case <-time.After(2 * time.Second):
+		t.Fatalf("NextMsg did not return after cancel")
+	}
+	if _, err := sub.NextMsg(100 * time.Millisecond); err != context.Canceled {
+		t.Fatalf("Expected error %v, got %v", context.Canceled, err)
+	}
+
+	// The ephemeral consumer is removed.
+	checkFor(t, 2*time.Second, 15*time.Millisecond, func() error {
+		if _, err := js.ConsumerInfo("TEST", info.Name); !errors.Is(err, nats.ErrConsumerNotFound) {
+			return fmt.Errorf("Expected consumer to be deleted, got %v", err)
+		}
+		return nil
+	})
+
+	// Same for pull subscriptions.
+	pctx, pcancel := context.WithCancel(context.Background())
+	psub, err := js.PullSubscribe("foo", "", nats.Context(pctx))
+	expectOk(t, err)
+	pcancel()
+	checkFor(t, time.Second, 15*time.Millisecond, func() error {
+		if _, err := psub.Fetch(1, nats.MaxWait(100*time.Millisecond)); err != context.Canceled {
+			return fmt.Errorf("Expected error %v, got %v", context.Canceled, err)
+		}
+		return nil
+	})
+
+	// Unsubscribing without canceling the context reports the usual error.
+	sub, err = js.SubscribeSync("foo", nats.Context(context.Background()))
+	expectOk(t, err)
+	expectOk(t, sub.Unsubscribe())
+	if _, err := sub.NextMsg(100 * time.Millisecond); err != nats.ErrBadSubscription {
+		t.Fatalf("Expected error %v, got %v", nats.ErrBadSubscription, err)
+	}
+}
+
+func TestJetStreamFetchPullHeartbeat(t *testing.T) {
+	s := RunBasicJetStreamServer()
+	defer shutdownJSServerAndRemoveStorage(t, s)
+
+	nc, js := jsClient(t, s)
+	defer nc.Close()
+
+	_, err := js.AddStream(&nats.StreamConfig{Name: "TEST", Subjects: []string{"foo"}})
+	expectOk(t, err)
+
+	sub, err := js.PullSubscribe("foo", "dur")
+	expectOk(t, err)
+
+	if _, err := sub.Fetch(1, nats.PullHeartbeat(0)); !errors.Is(err, nats.ErrInvalidArg) {
+		t.Fatalf("Expected error %v, got %v", nats.ErrInvalidArg, err)
+	}
+	// The interval must be at most half of the expiration.
+	if _, err := sub.Fetch(1, nats.MaxWait(time.Second), nats.PullHeartbeat(time.Second)); !errors.Is(err, nats.ErrInvalidArg) {
+		t.Fatalf("Expected error %v, got %v", nats.ErrInvalidArg, err)
+	}
+	if _, err := sub.FetchBatch(1, nats.MaxWait(time.Second), nats.PullHeartbeat(time.Second)); !errors.Is(err, nats.ErrInvalidArg) {
+		t.Fatalf("Expected error %v, got %v", nats.ErrInvalidArg, err)
+	}
+
+	// Heartbeats keep the request alive until a message is available.
+	time.AfterFunc(500*time.Millisecond, func() { js.Publish("foo", []byte("hello")) })
+	msgs, err := sub.Fetch(1, nats.MaxWait(2*time.Second), nats.PullHeartbeat(100*time.Millisecond))
+	expectOk(t, err)
+	if len(msgs) != 1 || string(msgs[0].Data) != "hello" {
+		t.Fatalf("Unexpected messages: %v", msgs)
+	}
+	expectOk(t, msgs[0].Ack())
+
+	// Without messages, the request expires as usual.
+	if _, err := sub.Fetch(1, nats.MaxWait(500*time.Millisecond), nats.PullHeartbeat(100*time.Millisecond)); err != nats.ErrTimeout {
+		t.Fatalf("Expected error %v, got %v", nats.ErrTimeout, err)
+	}
+
+	time.AfterFunc(300*time.Millisecond, func() { js.Publish("foo", []byte("world")) })
+	res, err := sub.FetchBatch(1, nats.MaxWait(2*time.Second), nats.PullHeartbeat(100*time.Millisecond))
+	expectOk(t, err)
+	var got int
+	for msg := range res.Messages() {
+		got++
+		expectOk(t, msg.Ack())
+	}
+	if got != 1 || res.Error() != nil {
+		t.Fatalf("Expected 1 message and no error, got %d and %v", got, res.Error())
+	}
+}
+
+func TestJetStreamReplayFrom(t *testing.T) {
+	s := RunBasicJetStreamServer()
+	defer shutdownJSServerAndRemoveStorage(t, s)
+
+	nc, js := jsClient(t, s)
+	defer nc.Close()
+
+	_, err := js.AddStream(&nats.StreamConfig{Name: "TEST", Subjects: []string{"foo.*"}})
+	expectOk(t, err)
+	for _, subj := range []string{"foo.a", "foo.b"} {
+		_, err := js.Publish(subj, []byte("old"))
+		expectOk(t, err)
+	}
+	time.Sleep(100 * time.Millisecond)
+	start := time.Now()
+	for _, subj := range []string{"foo.a", "foo.b", "foo.a"} {
+		_, err := js.Publish(subj, []byte("new"))
+		expectOk(t, err)
+	}
+
+	sub, err := js.ReplayFrom("TEST", start, "foo.a")
+	expectOk(t, err)
+	defer sub.Unsubscribe()
+
+	info, err := sub.ConsumerInfo()
+	expectOk(t, err)
+	if info.Config.Durable != "" || info.Config.DeliverPolicy != nats.DeliverByStartTimePolicy ||
+		info.Config.OptStartTime == nil || !info.Config.OptStartTime.Equal(start) {
+		t.Fatalf("Unexpected consumer config: %+v", info.Config)
+	}
+
+	msgs, err := sub.Fetch(10, nats.MaxWait(250*time.Millisecond))
+	expectOk(t, err)
+	if len(msgs) != 2 {
+		t.Fatalf("Expected 2 messages, got %d", len(msgs))
+	}
+	for _, m := range msgs {
+		if m.Subject != "foo.a" || string(m.Data) != "new" {
+			t.Fatalf("Unexpected message %q on %q", m.Data, m.Subject)
+		}
+	}
+
+	// The deliver policy can not be overridden, other options apply.
+	dsub, err := js.ReplayFrom("TEST", start, "foo.b", nats.Durable("dlc"), nats.DeliverAll())
+	expectOk(t, err)
+	info, err = dsub.ConsumerInfo()
+	expectOk(t, err)
+	if info.Config.Durable != "dlc" || info.Config.DeliverPolicy != nats.DeliverByStartTimePolicy {
+		t.Fatalf("Unexpected consumer config: %+v", info.Config)
+	}
+
+	if _, err := js.ReplayFrom("TEST", time.Time{}, "foo.a"); !errors.Is(err, nats.ErrInvalidArg) {
+		t.Fatalf("Expected error %v, got %v", nats.ErrInvalidArg, err)
+	}
+	if _, err := js.ReplayFrom("", start, "foo.a"); err != nats.ErrStreamNameRequired {
+		t.Fatalf("Expected error %v, got %v", nats.ErrStreamNameRequired, err)
+	}
+}
+
+func TestJetStreamPublishAPIErrors(t *testing.T) {
+	s := RunBasicJetStreamServer()
+	defer shutdownJSServerAndRemoveStorage(t, s)
+
+	nc, js := jsClient(t, s)
+	defer nc.Close()
+
+	_, err := js.AddStream(&nats.StreamConfig{
+		Name:     "TEST",
+		Subjects: []string{"foo.*"},
+		MaxMsgs:  3,
+		Discard:  nats.DiscardNew,
+	})
+	expectOk(t, err)
+
+	_, err = js.Publish("foo.a", []byte("1"), nats.MsgId("one"))
+	expectOk(t, err)
+
+	expectAPIError := func(err error, expected nats.JetStreamError) {
+		t.Helper()
+		if !errors.Is(err, expected) {
+			t.Fatalf("Expected error %v, got %v", expected, err)
+		}
+		var apiErr *nats.APIError
+		if !errors.As(err, &apiErr) || apiErr.ErrorCode != expected.APIError().ErrorCode {
+			t.Fatalf("Expected API error with code %d, got %v", expected.APIError().ErrorCode, err)
+		}
+	}
+
+	_, err = js.Publish("foo.a", []byte("2"), nats.ExpectLastSequence(10))
+	expectAPIError(err, nats.ErrWrongLastSequence)
+	_, err = js.Publish("foo.a", []byte("2"), nats.ExpectLastSequencePerSubject(10))
+	expectAPIError(err, nats.ErrWrongLastSequence)
+	_, err = js.Publish("foo.a", []byte("2"), nats.ExpectLastMsgId("two"))
+	expectAPIError(err, nats.ErrWrongLastMsgID)
+	_, err = js.Publish("foo.a", []byte("2"), nats.ExpectStream("OTHER"))
+	expectAPIError(err, nats.ErrStreamNotMatch)
+	if !errors.Is(err, nats.ErrStreamWrongSubject) {
+		t.Fatalf("Expected error %v, got %v", nats.ErrStreamWrongSubject, err)
+	}
+	if errors.Is(err, nats.ErrWrongLastSequence) {
+		t.Fatalf("Did not expect error to match %v", nats.ErrWrongLastSequence)
+	}
+
+	// Optimistic concurrency with the right sequence succeeds.
+	_, err = js.Publish("foo.a", []byte("2"), nats.ExpectLastSequence(1))
+	expectOk(t, err)
+
+	// Asynchronous publishes report the same errors.
+	paf, err := js.PublishAsync("foo.a", []byte("3"), nats.ExpectLastSequence(1))
+	expectOk(t, err)
+	select {
+	case err := <-paf.Err():
+		expectAPIError(err, nats.ErrWrongLastSequence)
+	case <-time.After(2 * time.Second):
+		t.Fatalf("Did not receive the publish error")
+	}
+
+	// The stream is full and discards new messages.
+	_, err = js.Publish("foo.b", []byte("3"))
+	expectOk(t, err)
+	_, err = js.Publish("foo.b", []byte("4"))
+	expectAPIError(err, nats.ErrStreamStoreFailed)
+
+	// No stream captures the subject.
+	if _, err = js.Publish("bar", []byte("5")); !errors.Is(err, nats.ErrStreamNotFoundOnPublish) {
+		t.Fatalf("Expected error %v, got %v", nats.ErrStreamNotFoundOnPublish, err)
+	}
+}
+
+func TestJetStreamConsumeMulti(t *testing.T) {
+	s := RunBasicJetStreamServer()
+	defer shutdownJSServerAndRemoveStorage(t, s)
+
+	nc, js := jsClient(t, s)
+	defer nc.Close()
+
+	_, err := js.AddStream(&nats.StreamConfig{Name: "A", Subjects: []string{"a"}})
+	expectOk(t, err)
+	_, err = js.AddStream(&nats.StreamConfig{Name: "B", Subjects: []string{"b"}})
+	expectOk(t, err)
+	_, err = js.AddConsumer("A", &nats.ConsumerConfig{
+		Durable:        "push",
+		DeliverSubject: nats.NewInbox(),
+		AckPolicy:      nats.AckExplicitPolicy,
+	})
+	expectOk(t, err)
+	_, err = js.AddConsumer("B", &nats.ConsumerConfig{Durable: "pull", AckPolicy: nats.AckExplicitPolicy})
+	expectOk(t, err)
+
+	for i := 0; i < 5; i++ {
+		_, err := js.Publish("a", []byte("hello"))
+		expectOk(t, err)
+		_, err = js.Publish("b", []byte("hello"))
+		expectOk(t, err)
+	}
+
+	var (
+		mu       sync.Mutex
+		received = map[string]int{}
+		active   int32
+	)
+	ms, err := js.ConsumeMulti([]nats.ConsumerRef{
+		{Stream: "A", Consumer: "push"},
+		{Stream: "B", Consumer: "pull"},
+	}, func(m *nats.Msg) {
+		if atomic.AddInt32(&active, 1) != 1 {
+			t.Errorf("Handler called concurrently")
+		}
+		mu.Lock()
+		received[m.Subject]++
+		mu.Unlock()
+		atomic.AddInt32(&active, -1)
+	})
+	expectOk(t, err)
+	if subs := ms.Subscriptions(); len(subs) != 2 {
+		t.Fatalf("Expected 2 subscriptions, got %d", len(subs))
+	}
+
+	checkFor(t, 2*time.Second, 15*time.Millisecond, func() error {
+		mu.Lock()
+		defer mu.Unlock()
+		if received["a"] != 5 || received["b"] != 5 {
+			return fmt.Errorf("Unexpected messages received: %v", received)
+		}
+		return nil
+	})
+	if errs := ms.Errors(); len(errs) != 0 {
+		t.Fatalf("Unexpected errors: %v", errs)
+	}
+	// Messages of both consumers are acknowledged once handled.
+	checkFor(t, 2*time.Second, 15*time.Millisecond, func() error {
+		for _, ref := range []nats.ConsumerRef{{Stream: "A", Consumer: "push"}, {Stream: "B", Consumer: "pull"}} {
+			info, err := js.ConsumerInfo(ref.Stream, ref.Consumer)
+			if err != nil {
+				return err
+			}
+			if info.NumAckPending != 0 || info.AckFloor.Stream != 5 {
+				return fmt.Errorf("Unexpected state of consumer %q: %+v", ref.Consumer, info)
+			}
+		}
+		return nil
+	})
+
+	expectOk(t, ms.Unsubscribe())
+	if ms.IsValid() {
+		t.Fatalf("Expected subscriptions to be closed")
+	}
+
+	// All consumers must exist.
+	_, err = js.ConsumeMulti([]nats.ConsumerRef{
+		{Stream: "A", Consumer: "push"},
+		{Stream: "B", Consumer: "missing"},
+	}, func(m *nats.Msg) {})
+	if !errors.Is(err, nats.ErrConsumerNotFound) {
+		t.Fatalf("Expected error %v, got %v", nats.ErrConsumerNotFound, err)
+	}
+	if _, err := js.ConsumeMulti(nil, func(m *nats.Msg) {}); !errors.Is(err, nats.ErrInvalidArg) {
+		t.Fatalf("Expected error %v, got %v", nats.ErrInvalidArg, err)
+	}
+	if _, err := js.ConsumeMulti([]nats.ConsumerRef{{Stream: "A", Consumer: "push"}}, nil); !errors.Is(err, nats.ErrInvalidArg) {
+		t.Fatalf("Expected error %v, got %v", nats.ErrInvalidArg, err)
+	}
+}
+
+func TestJetStreamDeliverAfterLast(t *testing.T) {
+	s := RunBasicJetStreamServer()
+	defer shutdownJSServerAndRemoveStorage(t, s)
+
+	nc, js := jsClient(t, s)
+	defer nc.Close()
+
+	_, err := js.AddStream(&nats.StreamConfig{Name: "TEST", Subjects: []string{"foo", "bar"}})
+	expectOk(t, err)
+
+	// Empty stream.
+	sub, err := js.SubscribeSync("foo", nats.DeliverAfterLast())
+	expectOk(t, err)
+	info, err := sub.ConsumerInfo()
+	expectOk(t, err)
+	if info.Config.DeliverPolicy != nats.DeliverByStartSequencePolicy || info.Config.OptStartSeq != 1 {
+		t.Fatalf("Unexpected consumer config: %+v", info.Config)
+	}
+	expectOk(t, sub.Unsubscribe())
+
+	for _, subj := range []string{"foo", "bar", "foo"} {
+		_, err := js.Publish(subj, []byte("old"))
+		expectOk(t, err)
+	}
+
+	sub, err = js.SubscribeSync("foo", nats.DeliverAfterLast())
+	expectOk(t, err)
+	defer sub.Unsubscribe()
+	info, err = sub.ConsumerInfo()
+	expectOk(t, err)
+	if info.Config.OptStartSeq != 4 {
+		t.Fatalf("Expected start sequence 4, got %d", info.Config.OptStartSeq)
+	}
+	if _, err := sub.NextMsg(100 * time.Millisecond); err != nats.ErrTimeout {
+		t.Fatalf("Expected error %v, got %v", nats.ErrTimeout, err)
+	}
+	_, err = js.Publish("foo", []byte("new"))
+	expectOk(t, err)
+	msg, err := sub.NextMsg(time.Second)
+	expectOk(t, err)
+	if meta, _ := msg.Metadata(); string(msg.Data) != "new" || meta.Sequence.Stream != 4 {
+		t.Fatalf("Unexpected message %q", msg.Data)
+	}
+
+	// Same for pull subscriptions.
+	psub, err := js.PullSubscribe("foo", "dur", nats.DeliverAfterLast())
+	expectOk(t, err)
+	_, err = js.Publish("foo", []byte("newer"))
+	expectOk(t, err)
+	msgs, err := psub.Fetch(10, nats.MaxWait(250*time.Millisecond))
+	expectOk(t, err)
+	if len(msgs) != 1 || string(msgs[0].Data) != "newer" {
+		t.Fatalf("Unexpected messages: %v", msgs)
+	}
+
+	// A deliver policy given afterwards takes precedence.
+	sub, err = js.SubscribeSync("foo", nats.DeliverAfterLast(), nats.DeliverAll())
+	expectOk(t, err)
+	defer sub.Unsubscribe()
+	info, err = sub.ConsumerInfo()
+	expectOk(t, err)
+	if info.Config.DeliverPolicy != nats.DeliverAllPolicy {
+		t.Fatalf("Unexpected deliver policy: %v", info.Config.DeliverPolicy)
+	}
+}
+
+func TestJetStreamLastAttemptHandler(t *testing.T) {
+	s := RunBasicJetStreamServer()
+	defer shutdownJSServerAndRemoveStorage(t, s)
+
+	nc, js := jsClient(t, s)
+	defer nc.Close()
+
+	_, err := js.AddStream(&nats.StreamConfig{Name: "TEST", Subjects: []string{"foo"}})
+	expectOk(t, err)
+
+	var (
+		attempts int32
+		last     = make(chan *nats.Msg, 1)
+	)
+	sub, err := js.Subscribe("foo", func(m *nats.Msg) {
+		atomic.AddInt32(&attempts, 1)
+		m.Nak()
+	}, nats.ManualAck(), nats.MaxDeliver(3), nats.LastAttemptHandler(func(m *nats.Msg) {
+		last <- m
+		m.Ack()
+	}))
+	expectOk(t, err)
+	defer sub.Unsubscribe()
+
+	_, err = js.Publish("foo", []byte("hello"))
+	expectOk(t, err)
+
+	select {
+	case m := <-last:
+		meta, err := m.Metadata()
+		expectOk(t, err)
+		if meta.NumDelivered != 3 {
+			t.Fatalf("Expected last attempt to be the third delivery, got %d", meta.NumDelivered)
+		}
+	case <-time.After(2 * time.Second):
+		t.Fatalf("Last attempt handler was not invoked")
+	}
+	if n := atomic.LoadInt32(&attempts); n != 2 {
+		t.Fatalf("Expected 2 attempts passed to the message handler, got %d", n)
+	}
+
+	// Invalid configurations.
+	noop := func(m *nats.Msg) {}
+	if _, err := js.Subscribe("foo", noop, nats.LastAttemptHandler(noop)); err == nil {
+		t.Fatalf("Expected error without max deliver")
+	}
+	if _, err := js.Subscribe("foo", noop, nats.MaxDeliver(1), nats.AckNone(), nats.LastAttemptHandler(noop)); err == nil {
+		t.Fatalf("Expected error with ack policy none")
+	}
+	if _, err := js.SubscribeSync("foo", nats.MaxDeliver(2), nats.LastAttemptHandler(noop)); err == nil {
+		t.Fatalf("Expected error without message handler")
+	}
+	if _, err := js.Subscribe("foo", noop, nats.MaxDeliver(-2)); !errors.Is(err, nats.ErrInvalidArg) {
+		t.Fatalf("Expected error %v, got %v", nats.ErrInvalidArg, err)
+	}
+	sub, err = js.SubscribeSync("foo", nats.MaxDeliver(0))
+	expectOk(t, err)
+	expectOk(t, sub.Unsubscribe())
+	if _, err := js.AddConsumer("TEST", &nats.ConsumerConfig{Durable: "dlc", MaxDeliver: -2}); !errors.Is(err, nats.ErrInvalidConsumerConfig) {
+		t.Fatalf("Expected error %v, got %v", nats.ErrInvalidConsumerConfig, err)
+	}
+}
+
+func TestJetStreamConfigMarshalRequest(t *testing.T) {
+	s := RunDefaultServer()
+	defer s.Shutdown()
+
+	nc, err := nats.Connect(s.ClientURL())
+	expectOk(t, err)
+	defer nc.Close()
+	js, err := nc.JetStream()
+	expectOk(t, err)
+
+	// Mock the create endpoints, keeping the payloads sent by the client.
+	reqs := make(chan []byte, 2)
+	_, err = nc.Subscribe("$JS.API.STREAM.CREATE.TEST", func(m *nats.Msg) {
+		reqs <- m.Data
+		m.Respond([]byte(fmt.Sprintf(`{"config":%s}`, m.Data)))
+	})
+	expectOk(t, err)
+	_, err = nc.Subscribe("$JS.API.CONSUMER.CREATE.TEST.dlc", func(m *nats.Msg) {
+		reqs <- m.Data
+		m.Respond([]byte(`{"stream_name":"TEST","name":"dlc","config":{"durable_name":"dlc"}}`))
+	})
+	expectOk(t, err)
+
+	scfg := &nats.StreamConfig{
+		Name:   "TEST",
+		Mirror: &nats.StreamSource{Name: "ORIGIN", Domain: "hub"},
+	}
+	expected, err := scfg.MarshalRequest()
+	expectOk(t, err)
+	_, err = js.AddStream(scfg)
+	expectOk(t, err)
+	if sent := <-reqs; string(sent) != string(expected) {
+		t.Fatalf("Expected payload %s, got %s", expected, sent)
+	}
+	// The domain is converted in the payload only.
+	if scfg.Mirror.Domain != "hub" || scfg.Mirror.External != nil {
+		t.Fatalf("Unexpected change of the configuration: %+v", scfg.Mirror)
+	}
+	var decoded nats.StreamConfig
+	expectOk(t, json.Unmarshal(expected, &decoded))
+	if decoded.Mirror == nil || decoded.Mirror.External == nil || decoded.Mirror.External.APIPrefix != "$JS.hub.API" {
+		t.Fatalf("Unexpected decoded mirror: %+v", decoded.Mirror)
+	}
+
+	ccfg := &nats.ConsumerConfig{Durable: "dlc", AckPolicy: nats.AckExplicitPolicy, MaxDeliver: 5}
+	expected, err = ccfg.MarshalRequest("TEST")
+	expectOk(t, err)
+	_, err = js.UpdateConsumer("TEST", ccfg)
+	expectOk(t, err)
+	if sent := <-reqs; string(sent) != string(expected) {
+		t.Fatalf("Expected payload %s, got %s", expected, sent)
+	}
+
+	// Validation is the same as when creating.
+	if err := (&nats.StreamConfig{}).Validate(); err != nats.ErrStreamNameRequired {
+		t.Fatalf("Expected error %v, got %v", nats.ErrStreamNameRequired, err)
+	}
+	if _, err := (&nats.StreamConfig{Name: "TEST", Placement: &nats.Placement{}}).MarshalRequest(); !errors.Is(err, nats.ErrInvalidPlacement) {
+		t.Fatalf("Expected error %v, got %v", nats.ErrInvalidPlacement, err)
+	}
+	if err := (&nats.ConsumerConfig{MaxWaiting: -1}).Validate(); !errors.Is(err, nats.ErrInvalidConsumerConfig) {
+		t.Fatalf("Expected error %v, got %v", nats.ErrInvalidConsumerConfig, err)
+	}
+	if _, err := ccfg.MarshalRequest(""); err != nats.ErrStreamNameRequired {
+		t.Fatalf("Expected error %v, got %v", nats.ErrStreamNameRequired, err)
+	}
+}
+
+func TestJetStreamStreamSubjectsUpdate(t *testing.T) {
+	s := RunBasicJetStreamServer()
+	defer shutdownJSServerAndRemoveStorage(t, s)
+
+	nc, js := jsClient(t, s)
+	defer nc.Close()
+
+	_, err := js.AddStream(&nats.StreamConfig{Name: "TEST", Subjects: []string{"foo"}})
+	expectOk(t, err)
+	_, err = js.AddStream(&nats.StreamConfig{Name: "OTHER", Subjects: []string{"bar.*"}})
+	expectOk(t, err)
+
+	si, err := js.AddStreamSubjects("TEST", []string{"baz", "foo", "qux.>"})
+	expectOk(t, err)
+	if !reflect.DeepEqual(si.Config.Subjects, []string{"foo", "baz", "qux.>"}) {
+		t.Fatalf("Unexpected subjects: %v", si.Config.Subjects)
+	}
+
+	// Subjects already part of the stream leave it unchanged.
+	si, err = js.AddStreamSubjects("TEST", []string{"baz"})
+	expectOk(t, err)
+	if len(si.Config.Subjects) != 3 {
+		t.Fatalf("Unexpected subjects: %v", si.Config.Subjects)
+	}
+
+	_, err = js.AddStreamSubjects("TEST", []string{"bar.a"})
+	if !errors.Is(err, nats.ErrStreamSubjectsOverlap) || !strings.Contains(err.Error(), "OTHER") {
+		t.Fatalf("Expected error %v naming the other stream, got %v", nats.ErrStreamSubjectsOverlap, err)
+	}
+
+	si, err = js.RemoveStreamSubjects("TEST", []string{"foo", "qux.>"})
+	expectOk(t, err)
+	if !reflect.DeepEqual(si.Config.Subjects, []string{"baz"}) {
+		t.Fatalf("Unexpected subjects: %v", si.Config.Subjects)
+	}
+	if _, err := js.RemoveStreamSubjects("TEST", []string{"foo"}); !errors.Is(err, nats.ErrInvalidArg) {
+		t.Fatalf("Expected error %v, got %v", nats.ErrInvalidArg, err)
+	}
+	if _, err := js.RemoveStreamSubjects("TEST", []string{"baz"}); !errors.Is(err, nats.ErrInvalidArg) {
+		t.Fatalf("Expected error %v, got %v", nats.ErrInvalidArg, err)
+	}
+
+	if _, err := js.AddStreamSubjects("TEST", nil); !errors.Is(err, nats.ErrInvalidArg) {
+		t.Fatalf("Expected error %v, got %v", nats.ErrInvalidArg, err)
+	}
+	if _, err := js.AddStreamSubjects("TEST", []string{"foo..bar"}); !errors.Is(err, nats.ErrBadSubject) {
+		t.Fatalf("Expected error %v, got %v", nats.ErrBadSubject, err)
+	}
+	if _, err := js.AddStreamSubjects("MISSING", []string{"foo"}); err != nats.ErrStreamNotFound {
+		t.Fatalf("Expected error %v, got %v", nats.ErrStreamNotFound, err)
+	}
+}
+
+func TestJetStreamMsgFilter(t *testing.T) {
+	s := RunBasicJetStreamServer()
+	defer shutdownJSServerAndRemoveStorage(t, s)
+
+	nc, js := jsClient(t, s)
+	defer nc.Close()
+
+	_, err := js.AddStream(&nats.StreamConfig{Name: "TEST", Subjects: []string{"foo"}})
+	expectOk(t, err)
+
+	for i := 0; i < 6; i++ {
+		m := nats.NewMsg("foo")
+		m.Data = []byte(fmt.Sprintf("%d", i))
+		if i%2 == 0 {
+			m.Header.Set("Type", "keep")
+		}
+		_, err := js.PublishMsg(m)
+		expectOk(t, err)
+	}
+
+	keep := func(m *nats.Msg) bool { return m.Header.Get("Type") == "keep" }
+	for _, action := range []nats.FilterAction{nats.FilterAck, nats.FilterTerm} {
+		received := make(chan *nats.Msg, 10)
+		sub, err := js.Subscribe("foo", func(m *nats.Msg) {
+			received <- m
+		}, nats.MsgFilter(keep, action), nats.AckWait(time.Second))
+		expectOk(t, err)
+
+		for i := 0; i < 3; i++ {
+			select {
+			case m := <-received:
+				if !keep(m) {
+					t.Fatalf("Unexpected message %q", m.Data)
+				}
+			case <-time.After(2 * time.Second):
+				t.Fatalf("Did not receive message")
+			}
+		}
+		// Rejected messages were disposed of, nothing is pending.
+		checkFor(t, 2*time.Second, 15*time.Millisecond, func() error {
+			info, err := sub.ConsumerInfo()
+			if err != nil {
+				return err
+			}
+			if info.NumAckPending != 0 || info.AckFloor.Stream != 6 {
+				return fmt.Errorf("Unexpected consumer state: %+v", info)
+			}
+			return nil
+		})
+		select {
+		case m := <-received:
+			t.Fatalf("Unexpected message %q", m.Data)
+		case <-time.After(100 * time.Millisecond):
+		}
+		expectOk(t, sub.Unsubscribe())
+	}
+
+	if _, err := js.SubscribeSync("foo", nats.MsgFilter(keep, nats.FilterAck)); err == nil {
+		t.Fatalf("Expected error without message handler")
+	}
+	if _, err := js.Subscribe("foo", func(m *nats.Msg) {}, nats.MsgFilter(nil, nats.FilterAck)); !errors.Is(err, nats.ErrInvalidArg) {
+		t.Fatalf("Expected error %v, got %v", nats.ErrInvalidArg, err)
+	}
+	if _, err := js.Subscribe("foo", func(m *nats.Msg) {}, nats.MsgFilter(keep, nats.FilterAction(5))); !errors.Is(err, nats.ErrInvalidArg) {
+		t.Fatalf("Expected error %v, got %v", nats.ErrInvalidArg, err)
+	}
+}
+
+func TestJetStreamStreamSequenceRange(t *testing.T) {
+	s := RunBasicJetStreamServer()
+	defer shutdownJSServerAndRemoveStorage(t, s)
+
+	nc, js := jsClient(t, s)
+	defer nc.Close()
+
+	_, err := js.AddStream(&nats.StreamConfig{Name: "TEST", Subjects: []string{"foo"}, MaxMsgs: 3})
+	expectOk(t, err)
+
+	r, err := js.StreamSequenceRange("TEST")
+	expectOk(t, err)
+	if r.LastSeq != 0 || !r.LastTime.IsZero() {
+		t.Fatalf("Unexpected range for an empty stream: %+v", r)
+	}
+
+	start := time.Now()
+	for i := 0; i < 5; i++ {
+		_, err := js.Publish("foo", []byte("hello"))
+		expectOk(t, err)
+	}
+	r, err = js.StreamSequenceRange("TEST")
+	expectOk(t, err)
+	if r.FirstSeq != 3 || r.LastSeq != 5 {
+		t.Fatalf("Unexpected range: %+v", r)
+	}
+	if r.FirstTime.Before(start.Add(-time.Second)) || r.LastTime.Before(r.FirstTime) {
+		t.Fatalf("Unexpected times: %+v", r)
+	}
+
+	if _, err := js.StreamSequenceRange("MISSING"); err != nats.ErrStreamNotFound {
+		t.Fatalf("Expected error %v, got %v", nats.ErrStreamNotFound, err)
+	}
+}
+
+func TestJetStreamTail(t *testing.T) {
+	s := RunBasicJetStreamServer()
+	defer shutdownJSServerAndRemoveStorage(t, s)
+
+	nc, js := jsClient(t, s)
+	defer nc.Close()
+
+	_, err := js.AddStream(&nats.StreamConfig{Name: "TEST", Subjects: []string{"foo"}})
+	expectOk(t, err)
+	for i := 1; i <= 5; i++ {
+		_, err := js.Publish("foo", []byte(fmt.Sprintf("%d", i)))
+		expectOk(t, err)
+	}
+
+	tail := func(ctx context.Context, opts ...nats.SubOpt) chan string {
+		t.Helper()
+		received := make(chan string, 10)
+		opts = append(opts, nats.Context(ctx))
+		_, err := js.Tail("foo", func(m *nats.Msg) { received <- string(m.Data) }, opts...)
+		expectOk(t, err)
+		return received
+	}
+	expect := func(received chan string, data ...string) {
+		t.Helper()
+		for _, d := range data {
+			select {
+			case got := <-received:
+				if got != d {
+					t.Fatalf("Expected message %q, got %q", d, got)
+				}
+			case <-time.After(2 * time.Second):
+				t.Fatalf("Did not receive message %q", d)
+			}
+		}
+		select {
+		case got := <-received:
+			t.Fatalf("Unexpected message %q", got)
+		case <-time.After(100 * time.Millisecond):
+		}
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	live := tail(ctx)
+	last := tail(ctx, nats.DeliverLastN(2))
+	all := tail(ctx, nats.DeliverLastN(100))
+
+	_, err = js.Publish("foo", []byte("6"))
+	expectOk(t, err)
+
+	expect(live, "6")
+	expect(last, "4", "5", "6")
+	expect(all, "1", "2", "3", "4", "5", "6")
+
+	// The consumers are removed once the context is done.
+	cancel()
+	checkFor(t, 2*time.Second, 15*time.Millisecond, func() error {
+		si, err := js.StreamInfo("TEST")
+		if err != nil {
+			return err
+		}
+		if si.State.Consumers != 0 {
+			return fmt.Errorf("Expected consumers to be removed, got %d", si.State.Consumers)
+		}
+		return nil
+	})
+
+	if _, err := js.Tail("foo", nil); !errors.Is(err, nats.ErrInvalidArg) {
+		t.Fatalf("Expected error %v, got %v", nats.ErrInvalidArg, err)
+	}
+}
+
+func TestJetStreamConsumeWithoutLookup(t *testing.T) {
+	s := RunBasicJetStreamServer()
+	defer shutdownJSServerAndRemoveStorage(t, s)
+
+	nc, js := jsClient(t, s)
+	defer nc.Close()
+
+	_, err := js.AddStream(&nats.StreamConfig{Name: "TEST", Subjects: []string{"foo"}})
+	expectOk(t, err)
+	_, err = js.AddConsumer("TEST", &nats.ConsumerConfig{Durable: "dlc", AckPolicy: nats.AckExplicitPolicy})
+	expectOk(t, err)
+	for i := 0; i < 5; i++ {
+		_, err := js.Publish("foo", []byte("hello"))
+		expectOk(t, err)
+	}
+
+	// Monitor the info requests, none is expected.
+	var infos int32
+	_, err = nc.Subscribe("$JS.API.*.INFO.>", func(m *nats.Msg) {
+		atomic.AddInt32(&infos, 1)
+	})
+	expectOk(t, err)
+	expectOk(t, nc.Flush())
+
+	received := make(chan *nats.Msg, 10)
+	sub, err := js.Consume("TEST", "dlc", func(m *nats.Msg) { received <- m })
+	expectOk(t, err)
+	for i := 0; i < 5; i++ {
+		select {
+		case <-received:
+		case <-time.After(2 * time.Second):
+			t.Fatalf("Did not receive message")
+		}
+	}
+	expectOk(t, sub.Unsubscribe())
+	expectOk(t, nc.Flush())
+	if n := atomic.LoadInt32(&infos); n != 0 {
+		t.Fatalf("Expected no info requests, got %d", n)
+	}
+
+	// Messages were acknowledged.
+	checkFor(t, 2*time.Second, 15*time.Millisecond, func() error {
+		info, err := js.ConsumerInfo("TEST", "dlc")
+		if err != nil {
+			return err
+		}
+		if info.NumAckPending != 0 || info.AckFloor.Stream != 5 {
+			return fmt.Errorf("Unexpected consumer state: %+v", info)
+		}
+		return nil
+	})
+
+	if _, err := js.Consume("TEST", "dlc", nil); !errors.Is(err, nats.ErrInvalidArg) {
+		t.Fatalf("Expected error %v, got %v", nats.ErrInvalidArg, err)
+	}
+	if _, err := js.Consume("TEST", "", func(m *nats.Msg) {}); err != nats.ErrConsumerNameRequired {
+		t.Fatalf("Expected error %v, got %v", nats.ErrConsumerNameRequired, err)
+	}
+}
+
+func TestJetStreamAutoExtendAck(t *testing.T) {
+	s := RunBasicJetStreamServer()
+	defer shutdownJSServerAndRemoveStorage(t, s)
+
+	nc, js := jsClient(t, s)
+	defer nc.Close()
+
+	_, err := js.AddStream(&nats.StreamConfig{Name: "TEST", Subjects: []string{"foo"}})
+	expectOk(t, err)
+
+	// Count the in progress acks sent.
+	var progress int32
+	_, err = nc.Subscribe("$JS.ACK.TEST.>", func(m *nats.Msg) {
+		if string(m.Data) == "+WPI" {
+			atomic.AddInt32(&progress, 1)
+		}
+	})
+	expectOk(t, err)
+
+	var deliveries int32
+	done := make(chan struct{})
+	sub, err := js.Subscribe("foo", func(m *nats.Msg) {
+		if atomic.AddInt32(&deliveries, 1) == 1 {
+			// Run for more than twice the ack wait.
+			time.Sleep(1200 * time.Millisecond)
+			close(done)
+		}
+	}, nats.AckWait(500*time.Millisecond), nats.AutoExtendAck())
+	expectOk(t, err)
+	defer sub.Unsubscribe()
+
+	_, err = js.Publish("foo", []byte("hello"))
+	expectOk(t, err)
+
+	select {
+	case <-done:
+	case <-time.After(3 * time.Second):
+		t.Fatalf("Handler did not complete")
+	}
+	// Wait past the ack wait to make sure there is no redelivery.
+	time.Sleep(700 * time.Millisecond)
+	if n := atomic.LoadInt32(&deliveries); n != 1 {
+		t.Fatalf("Expected a single delivery, got %d", n)
+	}
+	if n := atomic.LoadInt32(&progress); n < 2 {
+		t.Fatalf("Expected in progress acks to be sent, got %d", n)
+	}
+	info, err := sub.ConsumerInfo()
+	expectOk(t, err)
+	if info.NumAckPending != 0 || info.NumRedelivered != 0 {
+		t.Fatalf("Unexpected consumer state: %+v", info)
+	}
+
+	noop := func(m *nats.Msg) {}
+	if _, err := js.SubscribeSync("foo", nats.AutoExtendAck()); err == nil {
+		t.Fatalf("Expected error without message handler")
+	}
+	if _, err := js.Subscribe("foo", noop, nats.AckNone(), nats.AutoExtendAck()); err == nil {
+		t.Fatalf("Expected error with ack policy none")
+	}
+	if _, err := js.Subscribe("foo", noop, nats.Bind("TEST", "dlc"), nats.SkipConsumerLookup(),
+		nats.DeliverSubject("bar"), nats.AutoExtendAck()); err == nil {
+		t.Fatalf("Expected error when the consumer lookup is skipped")
+	}
+}
+
+func TestJetStreamDedupWindowSubscribe(t *testing.T) {
+	s := RunBasicJetStreamServer()
+	defer shutdownJSServerAndRemoveStorage(t, s)
+
+	nc, js := jsClient(t, s)
+	defer nc.Close()
+
+	_, err := js.AddStream(&nats.StreamConfig{Name: "TEST", Subjects: []string{"foo"}})
+	expectOk(t, err)
+
+	received := make(chan *nats.Msg, 10)
+	sub, err := js.Subscribe("foo", func(m *nats.Msg) {
+		received <- m
+		// Negative acknowledgements are redelivered.
+		if string(m.Data) == "nak" {
+			if meta, _ := m.Metadata(); meta.NumDelivered == 1 {
+				m.Nak()
+				return
+			}
+		}
+		m.Ack()
+	}, nats.ManualAck(), nats.DedupWindow(time.Minute))
+	expectOk(t, err)
+	defer sub.Unsubscribe()
+
+	next := func() *nats.Msg {
+		t.Helper()
+		select {
+		case m := <-received:
+			return m
+		case <-time.After(2 * time.Second):
+			t.Fatalf("Did not receive message")
+		}
+		return nil
+	}
+
+	_, err = js.Publish("foo", []byte("hello"))
+	expectOk(t, err)
+	m := next()
+
+	// Simulate the redelivery of the acknowledged message.
+	expectOk(t, nc.PublishMsg(&nats.Msg{Subject: sub.Subject, Reply: m.Reply, Data: m.Data}))
+	expectOk(t, nc.Flush())
+
+	_, err = js.Publish("foo", []byte("nak"))
+	expectOk(t, err)
+	if m := next(); string(m.Data) != "nak" {
+		t.Fatalf("Expected the next message, got %q", m.Data)
+	}
+	if m := next(); string(m.Data) != "nak" {
+		t.Fatalf("Expected the redelivered message, got %q", m.Data)
+	}
+	select {
+	case m := <-received:
+		t.Fatalf("Unexpected message %q", m.Data)
+	case <-time.After(100 * time.Millisecond):
+	}
+
+	if _, err := js.Subscribe("foo", func(m *nats.Msg) {}, nats.DedupWindow(0)); !errors.Is(err, nats.ErrInvalidArg) {
+		t.Fatalf("Expected error %v, got %v", nats.ErrInvalidArg, err)
+	}
+	if _, err := js.SubscribeSync("foo", nats.DedupWindow(time.Second)); err == nil {
+		t.Fatalf("Expected error without message handler")
+	}
+}
+
+func TestJetStreamStreamInfoSubjectsOptions(t *testing.T) {
+	s := RunBasicJetStreamServer()
+	defer shutdownJSServerAndRemoveStorage(t, s)
+
+	nc, js := jsClient(t, s)
+	defer nc.Close()
+
+	_, err := js.AddStream(&nats.StreamConfig{Name: "TEST", Subjects: []string{"foo.*"}})
+	expectOk(t, err)
+	for _, subj := range []string{"foo.a", "foo.b", "foo.a"} {
+		_, err := js.Publish(subj, []byte("hello"))
+		expectOk(t, err)
+	}
+
+	// Subjects are not reported by default.
+	si, err := js.StreamInfo("TEST")
+	expectOk(t, err)
+	if si.State.Subjects != nil || si.State.NumSubjects != 2 {
+		t.Fatalf("Unexpected state: %+v", si.State)
+	}
+
+	si, err = js.StreamInfo("TEST", nats.StreamInfoSubjects("foo.a"))
+	expectOk(t, err)
+	if !reflect.DeepEqual(si.State.Subjects, map[string]uint64{"foo.a": 2}) {
+		t.Fatalf("Unexpected subjects: %v", si.State.Subjects)
+	}
+
+	// The last option wins.
+	si, err = js.StreamInfo("TEST", &nats.StreamInfoRequest{SubjectsFilter: ">"}, nats.StreamInfoNoSubjects())
+	expectOk(t, err)
+	if si.State.Subjects != nil {
+		t.Fatalf("Unexpected subjects: %v", si.State.Subjects)
+	}
+	si, err = js.StreamInfo("TEST", nats.StreamInfoNoSubjects(), nats.StreamInfoSubjects(">"))
+	expectOk(t, err)
+	if len(si.State.Subjects) != 2 {
+		t.Fatalf("Unexpected subjects: %v", si.State.Subjects)
+	}
+
+	if _, err := js.StreamInfo("TEST", nats.StreamInfoSubjects("")); !errors.Is(err, nats.ErrInvalidArg) {
+		t.Fatalf("Expected error %v, got %v", nats.ErrInvalidArg, err)
+	}
+}
+
+func TestJetStreamConfigRequiredFields(t *testing.T) {
+	s := RunBasicJetStreamServer()
+	defer shutdownJSServerAndRemoveStorage(t, s)
+
+	nc, js := jsClient(t, s)
+	defer nc.Close()
+
+	// Count API requests, none should be sent for invalid configurations.
+	var requests int32
+	_, err := nc.Subscribe("$JS.API.>", func(_ *nats.Msg) {
+		atomic.AddInt32(&requests, 1)
+	})
+	expectOk(t, err)
+	expectOk(t, nc.Flush())
+
+	for _, test := range []struct {
+		name string
+		cfg  *nats.StreamConfig
+		err  error
+	}{
+		{"nil config", nil, nats.ErrStreamConfigRequired},
+		{"no name", &nats.StreamConfig{Subjects: []string{"foo"}}, nats.ErrStreamNameRequired},
+		{"mirror without name", &nats.StreamConfig{Name: "M", Mirror: &nats.StreamSource{}}, nats.ErrInvalidStreamConfig},
+		{"mirror with subjects", &nats.StreamConfig{Name: "M", Subjects: []string{"foo"}, Mirror: &nats.StreamSource{Name: "O"}}, nats.ErrInvalidStreamConfig},
+		{"mirror with sources", &nats.StreamConfig{Name: "M", Mirror: &nats.StreamSource{Name: "O"}, Sources: []*nats.StreamSource{{Name: "S"}}}, nats.ErrInvalidStreamConfig},
+		{"source without name", &nats.StreamConfig{Name: "M", Sources: []*nats.StreamSource{{Name: "S"}, {}}}, nats.ErrInvalidStreamConfig},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			if _, err := js.AddStream(test.cfg); !errors.Is(err, test.err) {
+				t.Fatalf("Expected error %v, got %v", test.err, err)
+			}
+			if _, err := js.UpdateStream(test.cfg); !errors.Is(err, test.err) {
+				t.Fatalf("Expected error %v, got %v", test.err, err)
+			}
+		})
+	}
+
+	for _, test := range []struct {
+		name   string
+		stream string
+		cfg    *nats.ConsumerConfig
+		err    error
+	}{
+		{"no stream", "", &nats.ConsumerConfig{Durable: "dlc"}, nats.ErrStreamNameRequired},
+		{"name mismatch", "TEST", &nats.ConsumerConfig{Name: "a", Durable: "b"}, nats.ErrInvalidConsumerConfig},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			if _, err := js.AddConsumer(test.stream, test.cfg); !errors.Is(err, test.err) {
+				t.Fatalf("Expected error %v, got %v", test.err, err)
+			}
+			if _, err := js.UpdateConsumer(test.stream, test.cfg); !errors.Is(err, test.err) {
+				t.Fatalf("Expected error %v, got %v", test.err, err)
+			}
+		})
+	}
+	if _, err := js.UpdateConsumer("TEST", nil); err != nats.ErrConsumerConfigRequired {
+		t.Fatalf("Expected error %v, got %v", nats.ErrConsumerConfigRequired, err)
+	}
+	if _, err := js.UpdateConsumer("TEST", &nats.ConsumerConfig{}); err != nats.ErrConsumerNameRequired {
+		t.Fatalf("Expected error %v, got %v", nats.ErrConsumerNameRequired, err)
+	}
+
+	expectOk(t, nc.Flush())
+	if n := atomic.LoadInt32(&requests); n != 0 {
+		t.Fatalf("Expected no API requests, got %d", n)
+	}
+}
+
+func TestJetStreamEphemeralConsumerName(t *testing.T) {
+	s := RunBasicJetStreamServer()
+	defer shutdownJSServerAndRemoveStorage(t, s)
+
+	nc, js := jsClient(t, s)
+	defer nc.Close()
+
+	_, err := js.AddStream(&nats.StreamConfig{Name: "TEST", Subjects: []string{"foo"}})
+	expectOk(t, err)
+
+	info, err := js.AddConsumer("TEST", &nats.ConsumerConfig{AckPolicy: nats.AckExplicitPolicy})
+	expectOk(t, err)
+	if info.Name == "" || info.Stream != "TEST" {
+		t.Fatalf("Unexpected info: %+v", info)
+	}
+	if _, err := js.ConsumerInfo("TEST", info.Name); err != nil {
+		t.Fatalf("Unexpected error looking up consumer %q: %v", info.Name, err)
+	}
+
+	sub, err := js.SubscribeSync("foo")
+	expectOk(t, err)
+	defer sub.Unsubscribe()
+
+	// The name is known without looking the consumer up.
+	infoReqs, err := nc.SubscribeSync("$JS.API.CONSUMER.INFO.>")
+	expectOk(t, err)
+	name, err := sub.ConsumerName()
+	expectOk(t, err)
+	if name == "" || name == info.Name {
+		t.Fatalf("Unexpected consumer name %q", name)
+	}
+	expectOk(t, nc.Flush())
+	if n, _, _ := infoReqs.Pending(); n != 0 {
+		t.Fatalf("Expected no consumer info request, got %d", n)
+	}
+	ci, err := sub.ConsumerInfo()
+	expectOk(t, err)
+	if ci.Name != name {
+		t.Fatalf("Expected consumer name %q, got %q", name, ci.Name)
+	}
+
+	plain, err := nc.SubscribeSync("bar")
+	expectOk(t, err)
+	if _, err := plain.ConsumerName(); err != nats.ErrTypeSubscription {
+		t.Fatalf("Expected error %v, got %v", nats.ErrTypeSubscription, err)
+	}
+}
+
+func TestJetStreamConsumeRecreateOnDelete(t *testing.T) {
+	s := RunBasicJetStreamServer()
+	defer shutdownJSServerAndRemoveStorage(t, s)
+
+	errCh := make(chan error, 10)
+	nc, js := jsClient(t, s, nats.ErrorHandler(func(_ *nats.Conn, _ *nats.Subscription, err error) {
+		errCh <- err
+	}))
+	defer nc.Close()
+
+	_, err := js.AddStream(&nats.StreamConfig{Name: "TEST", Subjects: []string{"foo"}})
+	expectOk(t, err)
+	cfg := nats.ConsumerConfig{Durable: "dlc", AckPolicy: nats.AckExplicitPolicy, DeliverPolicy: nats.DeliverNewPolicy}
+	_, err = js.AddConsumer("TEST", &cfg)
+	expectOk(t, err)
+
+	received := make(chan *nats.Msg, 10)
+	sub, err := js.Consume("TEST", "dlc", func(m *nats.Msg) { received <- m }, nats.ConsumeRecreateOnDelete(cfg))
+	expectOk(t, err)
+	defer sub.Unsubscribe()
+
+	expectOk(t, js.DeleteConsumer("TEST", "dlc"))
+	select {
+	case err := <-errCh:
+		if err != nats.ErrConsumerRecreated {
+			t.Fatalf("Expected error %v, got %v", nats.ErrConsumerRecreated, err)
+		}
+	case <-time.After(10 * time.Second):
+		t.Fatal("Consumer was not recreated")
+	}
+	if _, err := js.ConsumerInfo("TEST", "dlc"); err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+
+	// Messages of the recreated consumer are received.
+	_, err = js.Publish("foo", []byte("hello"))
+	expectOk(t, err)
+	select {
+	case m := <-received:
+		if string(m.Data) != "hello" {
+			t.Fatalf("Unexpected message: %q", m.Data)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("Did not receive message")
+	}
+
+	// The configuration must be the one of the bound consumer.
+	_, err = js.Consume("TEST", "dlc", func(m *nats.Msg) {}, nats.ConsumeRecreateOnDelete(nats.ConsumerConfig{Durable: "other"}))
+	if !errors.Is(err, nats.ErrInvalidArg) {
+		t.Fatalf("Expected error %v, got %v", nats.ErrInvalidArg, err)
+	}
+	_, err = js.Consume("TEST", "dlc", func(m *nats.Msg) {}, nats.ConsumeRecreateOnDelete(nats.ConsumerConfig{DeliverSubject: "bar"}))
+	if !errors.Is(err, nats.ErrInvalidArg) {
+		t.Fatalf("Expected error %v, got %v", nats.ErrInvalidArg, err)
+	}
+	_, err = js.ConsumeMulti([]nats.ConsumerRef{{Stream: "TEST", Consumer: "dlc"}}, func(m *nats.Msg) {}, nats.ConsumeRecreateOnDelete(cfg))
+	if err == nil {
+		t.Fatal("Expected error, got none")
+	}
+}
+
+func TestJetStreamWaitForConsumerLag(t *testing.T) {
+	s := RunBasicJetStreamServer()
+	defer shutdownJSServerAndRemoveStorage(t, s)
+
+	nc, js := jsClient(t, s)
+	defer nc.Close()
+
+	_, err := js.AddStream(&nats.StreamConfig{Name: "TEST", Subjects: []string{"foo"}})
+	expectOk(t, err)
+	for i := 0; i < 10; i++ {
+		_, err := js.Publish("foo", []byte("hello"))
+		expectOk(t, err)
+	}
+	sub, err := js.PullSubscribe("foo", "dlc")
+	expectOk(t, err)
+
+	pending, err := js.WaitForConsumerLag("TEST", "dlc", 5, nats.MaxWait(250*time.Millisecond))
+	if err == nil || pending != 10 {
+		t.Fatalf("Expected error with 10 pending messages, got %d and %v", pending, err)
+	}
+
+	go func() {
+		time.Sleep(100 * time.Millisecond)
+		msgs, err := sub.Fetch(6)
+		if err != nil {
+			return
+		}
+		for _, m := range msgs {
+			m.Ack()
+		}
+	}()
+	pending, err = js.WaitForConsumerLag("TEST", "dlc", 5, nats.MaxWait(5*time.Second))
+	expectOk(t, err)
+	if pending != 4 {
+		t.Fatalf("Expected 4 pending messages, got %d", pending)
+	}
+
+	if _, err := js.WaitForConsumerLag("TEST", "dlc", 0); !errors.Is(err, nats.ErrInvalidArg) {
+		t.Fatalf("Expected error %v, got %v", nats.ErrInvalidArg, err)
+	}
+	if _, err := js.WaitForConsumerLag("TEST", "missing", 5); !errors.Is(err, nats.ErrConsumerNotFound) {
+		t.Fatalf("Expected error %v, got %v", nats.ErrConsumerNotFound, err)
+	}
+
+	// The consumer is polled with the API prefix of the call.
+	relayed := relayJSAPI(t, nc, "$JS.relay.API.")
+	pending, err = js.WaitForConsumerLag("TEST", "dlc", 5, nats.APIPrefix("$JS.relay.API"))
+	expectOk(t, err)
+	if pending != 4 {
+		t.Fatalf("Expected 4 pending messages, got %d", pending)
+	}
+	if subjs := relayed(); len(subjs) != 1 || subjs[0] != "$JS.relay.API.CONSUMER.INFO.TEST.dlc" {
+		t.Fatalf("Expected the consumer info request with the API prefix, got %q", subjs)
+	}
+}
+
+func TestJetStreamResourceCacheLookups(t *testing.T) {
+	s := RunBasicJetStreamServer()
+	defer shutdownJSServerAndRemoveStorage(t, s)
+
+	nc, err := nats.Connect(s.ClientURL())
+	expectOk(t, err)
+	defer nc.Close()
+
+	if _, err := nc.JetStream(nats.ResourceCache(0, 10)); !errors.Is(err, nats.ErrInvalidArg) {
+		t.Fatalf("Expected error %v, got %v", nats.ErrInvalidArg, err)
+	}
+	js, err := nc.JetStream(nats.ResourceCache(time.Minute, 10))
+	expectOk(t, err)
+
+	_, err = js.AddStream(&nats.StreamConfig{Name: "TEST", Subjects: []string{"foo"}})
+	expectOk(t, err)
+	_, err = js.AddConsumer("TEST", &nats.ConsumerConfig{Durable: "dlc"})
+	expectOk(t, err)
+
+	var requests int32
+	_, err = nc.Subscribe("$JS.API.>", func(_ *nats.Msg) {
+		atomic.AddInt32(&requests, 1)
+	})
+	expectOk(t, err)
+	expectOk(t, nc.Flush())
+	expectRequests := func(expected int32) {
+		t.Helper()
+		expectOk(t, nc.Flush())
+		if n := atomic.SwapInt32(&requests, 0); n != expected {
+			t.Fatalf("Expected %d API requests, got %d", expected, n)
+		}
+	}
+
+	for i := 0; i < 3; i++ {
+		ok, err := js.StreamExists("TEST")
+		expectOk(t, err)
+		if !ok {
+			t.Fatal("Expected stream to exist")
+		}
+		ok, err = js.ConsumerExists("TEST", "dlc")
+		expectOk(t, err)
+		if !ok {
+			t.Fatal("Expected consumer to exist")
+		}
+		stream, err := js.StreamNameBySubject("foo")
+		expectOk(t, err)
+		if stream != "TEST" {
+			t.Fatalf("Unexpected stream %q", stream)
+		}
+	}
+	expectRequests(3)
+
+	// Lookups with the API prefix of another domain are not answered from
+	// the cache.
+	other := nats.APIPrefix("$JS.other.API")
+	if ok, err := js.StreamExists("TEST", other); err == nil || ok {
+		t.Fatalf("Expected lookup error, got %v, %v", ok, err)
+	}
+	if ok, err := js.ConsumerExists("TEST", "dlc", other); err == nil || ok {
+		t.Fatalf("Expected lookup error, got %v, %v", ok, err)
+	}
+	if stream, err := js.StreamNameBySubject("foo", other); err == nil {
+		t.Fatalf("Expected lookup error, got %q", stream)
+	}
+	expectRequests(0)
+
+	// Deleted resources are not cached anymore.
+	expectOk(t, js.DeleteConsumer("TEST", "dlc"))
+	if ok, err := js.ConsumerExists("TEST", "dlc"); err != nil || ok {
+		t.Fatalf("Expected consumer not to exist, got %v, %v", ok, err)
+	}
+	expectOk(t, js.DeleteStream("TEST"))
+	if ok, err := js.StreamExists("TEST"); err != nil || ok {
+		t.Fatalf("Expected stream not to exist, got %v, %v", ok, err)
+	}
+	if _, err := js.StreamNameBySubject("foo"); err != nats.ErrNoMatchingStream {
+		t.Fatalf("Expected error %v, got %v", nats.ErrNoMatchingStream, err)
+	}
+	expectRequests(5)
+}
+
+func TestJetStreamConsumeAckBatch(t *testing.T) {
+	s := RunBasicJetStreamServer()
+	defer shutdownJSServerAndRemoveStorage(t, s)
+
+	nc, js := jsClient(t, s)
+	defer nc.Close()
+
+	_, err := js.AddStream(&nats.StreamConfig{Name: "TEST", Subjects: []string{"foo"}})
+	expectOk(t, err)
+	_, err = js.AddConsumer("TEST", &nats.ConsumerConfig{Durable: "dlc", AckPolicy: nats.AckAllPolicy})
+	expectOk(t, err)
+	publish := func(n int) {
+		t.Helper()
+		for i := 0; i < n; i++ {
+			_, err := js.Publish("foo", []byte("hello"))
+			expectOk(t, err)
+		}
+	}
+	var acks int32
+	_, err = nc.Subscribe("$JS.ACK.TEST.dlc.>", func(_ *nats.Msg) {
+		atomic.AddInt32(&acks, 1)
+	})
+	expectOk(t, err)
+	expectOk(t, nc.Flush())
+	checkAckFloor := func(expected uint64) {
+		t.Helper()
+		checkFor(t, 2*time.Second, 15*time.Millisecond, func() error {
+			info, err := js.ConsumerInfo("TEST", "dlc")
+			if err != nil {
+				return err
+			}
+			if info.AckFloor.Stream != expected || info.NumAckPending != 0 {
+				return fmt.Errorf("Unexpected consumer state: %+v", info)
+			}
+			return nil
+		})
+	}
+
+	// A full batch and a batch flushed on the timer.
+	publish(5)
+	received := make(chan *nats.Msg, 10)
+	sub, err := js.Consume("TEST", "dlc", func(m *nats.Msg) { received <- m }, nats.ConsumeAckBatch(3, 100*time.Millisecond))
+	expectOk(t, err)
+	checkAckFloor(5)
+	if n := atomic.LoadInt32(&acks); n != 2 {
+		t.Fatalf("Expected 2 acks, got %d", n)
+	}
+	expectOk(t, sub.Unsubscribe())
+
+	// Pending acks are sent on unsubscribe.
+	atomic.StoreInt32(&acks, 0)
+	sub, err = js.Consume("TEST", "dlc", func(m *nats.Msg) { received <- m }, nats.ConsumeAckBatch(10, time.Hour))
+	expectOk(t, err)
+	publish(2)
+	for i := 0; i < 7; i++ {
+		select {
+		case <-received:
+		case <-time.After(2 * time.Second):
+			t.Fatal("Did not receive message")
+		}
+	}
+	time.Sleep(50 * time.Millisecond)
+	if n := atomic.LoadInt32(&acks); n != 0 {
+		t.Fatalf("Expected no ack, got %d", n)
+	}
+	expectOk(t, sub.Unsubscribe())
+	checkAckFloor(7)
+	if n := atomic.LoadInt32(&acks); n != 1 {
+		t.Fatalf("Expected 1 ack, got %d", n)
+	}
+
+	// Pending acks are sent when the connection is drained.
+	nc2, js2 := jsClient(t, s)
+	defer nc2.Close()
+	_, err = js2.Consume("TEST", "dlc", func(m *nats.Msg) { received <- m }, nats.ConsumeAckBatch(10, time.Hour))
+	expectOk(t, err)
+	publish(2)
+	for i := 0; i < 2; i++ {
+		select {
+		case <-received:
+		case <-time.After(2 * time.Second):
+			t.Fatal("Did not receive message")
+		}
+	}
+	expectOk(t, nc2.Drain())
+	checkAckFloor(9)
+
+	_, err = js.Consume("TEST", "dlc", func(m *nats.Msg) {}, nats.ConsumeAckBatch(10, time.Second), nats.ManualAck())
+	if err == nil {
+		t.Fatal("Expected error, got none")
+	}
+	if _, err := js.Consume("TEST", "dlc", func(m *nats.Msg) {}, nats.ConsumeAckBatch(0, time.Second)); !errors.Is(err, nats.ErrInvalidArg) {
+		t.Fatalf("Expected error %v, got %v", nats.ErrInvalidArg, err)
+	}
+
+	// Only consumers with the AckAll policy are accepted.
+	_, err = js.AddConsumer("TEST", &nats.ConsumerConfig{Durable: "explicit", AckPolicy: nats.AckExplicitPolicy})
+	expectOk(t, err)
+	if _, err := js.Consume("TEST", "explicit", func(m *nats.Msg) {}, nats.ConsumeAckBatch(10, time.Second)); !errors.Is(err, nats.ErrInvalidArg) {
+		t.Fatalf("Expected error %v, got %v", nats.ErrInvalidArg, err)
+	}
+	if _, err := js.Consume("TEST", "missing", func(m *nats.Msg) {}, nats.ConsumeAckBatch(10, time.Second)); !errors.Is(err, nats.ErrConsumerNotFound) {
+		t.Fatalf("Expected error %v, got %v", nats.ErrConsumerNotFound, err)
+	}
+}
+
+func TestJetStreamCachedStreamConfig(t *testing.T) {
+	s := RunBasicJetStreamServer()
+	defer shutdownJSServerAndRemoveStorage(t, s)
+
+	nc, js := jsClient(t, s)
+	defer nc.Close()
+
+	if _, ok := js.CachedStreamConfig("TEST"); ok {
+		t.Fatal("Expected no cached configuration")
+	}
+	info, err := js.AddStream(&nats.StreamConfig{Name: "TEST", Subjects: []string{"foo"}})
+	expectOk(t, err)
+	// The server fills in the defaults.
+	if info.Config.Duplicates != 2*time.Minute || info.Config.Replicas != 1 || info.Config.MaxMsgs != -1 {
+		t.Fatalf("Unexpected configuration: %+v", info.Config)
+	}
+
+	var requests int32
+	_, err = nc.Subscribe("$JS.API.>", func(_ *nats.Msg) {
+		atomic.AddInt32(&requests, 1)
+	})
+	expectOk(t, err)
+	cfg, ok := js.CachedStreamConfig("TEST")
+	if !ok || !reflect.DeepEqual(*cfg, info.Config) {
+		t.Fatalf("Expected configuration %+v, got %+v", info.Config, cfg)
+	}
+	// The cached configuration is a copy.
+	cfg.MaxMsgs = 10
+	if cfg, _ := js.CachedStreamConfig("TEST"); cfg.MaxMsgs != -1 {
+		t.Fatalf("Unexpected change of the cached configuration: %+v", cfg)
+	}
+	expectOk(t, nc.Flush())
+	if n := atomic.LoadInt32(&requests); n != 0 {
+		t.Fatalf("Expected no API requests, got %d", n)
+	}
+
+	ncfg := info.Config
+	ncfg.MaxMsgs = 10
+	_, err = js.UpdateStream(&ncfg)
+	expectOk(t, err)
+	if cfg, _ := js.CachedStreamConfig("TEST"); cfg.MaxMsgs != 10 {
+		t.Fatalf("Expected updated configuration, got %+v", cfg)
+	}
+
+	expectOk(t, js.DeleteStream("TEST"))
+	if _, ok := js.CachedStreamConfig("TEST"); ok {
+		t.Fatal("Expected no cached configuration")
+	}
+}
+
+func TestJetStreamPullStatusErrors(t *testing.T) {
+	s := RunBasicJetStreamServer()
+	defer shutdownJSServerAndRemoveStorage(t, s)
+
+	nc, js := jsClient(t, s)
+	defer nc.Close()
+
+	_, err := js.AddStream(&nats.StreamConfig{Name: "TEST", Subjects: []string{"foo"}})
+	expectOk(t, err)
+	_, err = js.Publish("foo", make([]byte, 100))
+	expectOk(t, err)
+
+	sub, err := js.PullSubscribe("foo", "dlc", nats.MaxRequestBatch(2))
+	expectOk(t, err)
+	_, err = sub.Fetch(5, nats.MaxWait(time.Second))
+	if !errors.Is(err, nats.ErrMaxRequestBatchExceeded) {
+		t.Fatalf("Expected error %v, got %v", nats.ErrMaxRequestBatchExceeded, err)
+	}
+	var perr *nats.PullStatusError
+	if !errors.As(err, &perr) || perr.Code != 409 || !strings.Contains(perr.Description, "MaxRequestBatch of 2") {
+		t.Fatalf("Unexpected status error: %+v", perr)
+	}
+
+	batch, err := sub.FetchBatch(1, nats.PullMaxBytes(10), nats.MaxWait(time.Second))
+	expectOk(t, err)
+	for range batch.Messages() {
+		t.Fatal("Did not expect a message")
+	}
+	if !errors.Is(batch.Error(), nats.ErrMsgSizeExceedsMaxBytes) {
+		t.Fatalf("Expected error %v, got %v", nats.ErrMsgSizeExceedsMaxBytes, batch.Error())
+	}
+	if !errors.As(batch.Error(), &perr) || perr.Code != 409 {
+		t.Fatalf("Unexpected status error: %+v", perr)
+	}
+}
+
+func TestJetStreamConsumePartitionBySubject(t *testing.T) {
+	s := RunBasicJetStreamServer()
+	defer shutdownJSServerAndRemoveStorage(t, s)
+
+	nc, js := jsClient(t, s)
+	defer nc.Close()
+
+	_, err := js.AddStream(&nats.StreamConfig{Name: "TEST", Subjects: []string{"ev.*"}})
+	expectOk(t, err)
+	_, err = js.AddConsumer("TEST", &nats.ConsumerConfig{Durable: "dlc", AckPolicy: nats.AckExplicitPolicy})
+	expectOk(t, err)
+	for i := 0; i < 20; i++ {
+		for _, subj := range []string{"ev.a", "ev.b", "ev.c"} {
+			_, err := js.Publish(subj, []byte(strconv.Itoa(i)))
+			expectOk(t, err)
+		}
+	}
+
+	var mu sync.Mutex
+	handled := make(map[string][]int)
+	done := make(chan struct{})
+	sub, err := js.Consume("TEST", "dlc", func(m *nats.Msg) {
+		n, _ := strconv.Atoi(string(m.Data))
+		mu.Lock()
+		defer mu.Unlock()
+		handled[m.Subject] = append(handled[m.Subject], n)
+		if len(handled["ev.a"])+len(handled["ev.b"])+len(handled["ev.c"]) == 60 {
+			close(done)
+		}
+	}, nats.ConsumePartitionBySubject(4))
+	expectOk(t, err)
+	defer sub.Unsubscribe()
+
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatal("Did not handle all messages")
+	}
+	mu.Lock()
+	for subj, seqs := range handled {
+		for i, n := range seqs {
+			if n != i {
+				t.Fatalf("Messages of %q handled out of order: %v", subj, seqs)
+			}
+		}
+	}
+	mu.Unlock()
+
+	// Messages are acknowledged by the workers.
+	checkFor(t, 2*time.Second, 15*time.Millisecond, func() error {
+		info, err := js.ConsumerInfo("TEST", "dlc")
+		if err != nil {
+			return err
+		}
+		if info.AckFloor.Stream != 60 {
+			return fmt.Errorf("Unexpected consumer state: %+v", info)
+		}
+		return nil
+	})
+
+	_, err = js.Consume("TEST", "dlc", func(m *nats.Msg) {}, nats.ConsumePartitionBySubject(2), nats.ConsumeAckBatch(10, time.Second))
+	if err == nil {
+		t.Fatal("Expected error, got none")
+	}
+	if _, err := js.Consume("TEST", "dlc", func(m *nats.Msg) {}, nats.ConsumePartitionBySubject(0)); !errors.Is(err, nats.ErrInvalidArg) {
+		t.Fatalf("Expected error %v, got %v", nats.ErrInvalidArg, err)
+	}
+}
+
+func TestJetStreamAllConsumers(t *testing.T) {
+	s := RunBasicJetStreamServer()
+	defer shutdownJSServerAndRemoveStorage(t, s)
+
+	nc, js := jsClient(t, s)
+	defer nc.Close()
+
+	_, err := js.AddStream(&nats.StreamConfig{Name: "TEST", Subjects: []string{"foo"}})
+	expectOk(t, err)
+	for i := 0; i < 5; i++ {
+		_, err := js.AddConsumer("TEST", &nats.ConsumerConfig{Durable: fmt.Sprintf("C%d", i)})
+		expectOk(t, err)
+	}
+
+	var lists, infos int32
+	sub, err := nc.Subscribe("$JS.API.CONSUMER.>", func(m *nats.Msg) {
+		switch {
+		case strings.HasPrefix(m.Subject, "$JS.API.CONSUMER.LIST."):
+			atomic.AddInt32(&lists, 1)
+		case strings.HasPrefix(m.Subject, "$JS.API.CONSUMER.INFO."):
+			atomic.AddInt32(&infos, 1)
+		}
+	})
+	expectOk(t, err)
+	defer sub.Unsubscribe()
+	expectOk(t, nc.Flush())
+
+	all, err := js.AllConsumers("TEST")
+	expectOk(t, err)
+	if len(all) != 5 {
+		t.Fatalf("Expected 5 consumers, got %d", len(all))
+	}
+	names := make(map[string]bool)
+	for _, ci := range all {
+		names[ci.Name] = true
+	}
+	for i := 0; i < 5; i++ {
+		if name := fmt.Sprintf("C%d", i); !names[name] {
+			t.Fatalf("Consumer %q missing from %v", name, names)
+		}
+	}
+	expectOk(t, nc.Flush())
+	if n := atomic.LoadInt32(&lists); n != 1 {
+		t.Fatalf("Expected 1 list request, got %d", n)
+	}
+	if n := atomic.LoadInt32(&infos); n != 0 {
+		t.Fatalf("Expected no info requests, got %d", n)
+	}
+
+	if _, err := js.AllConsumers("MISSING"); !errors.Is(err, nats.ErrStreamNotFound) {
+		t.Fatalf("Expected error %v, got %v", nats.ErrStreamNotFound, err)
+	}
+}
+
+func TestJetStreamParseRePublishHeaders(t *testing.T) {
+	s := RunBasicJetStreamServer()
+	defer shutdownJSServerAndRemoveStorage(t, s)
+
+	nc, js := jsClient(t, s)
+	defer nc.Close()
+
+	_, err := js.AddStream(&nats.StreamConfig{
+		Name:      "TEST",
+		Subjects:  []string{"foo.>"},
+		RePublish: &nats.RePublish{Source: "foo.>", Destination: "rp.>"},
+	})
+	expectOk(t, err)
+
+	sub, err := nc.SubscribeSync("rp.>")
+	expectOk(t, err)
+	defer sub.Unsubscribe()
+	expectOk(t, nc.Flush())
+
+	for _, subj := range []string{"foo.a", "foo.b", "foo.a"} {
+		_, err := js.Publish(subj, []byte("hello"))
+		expectOk(t, err)
+	}
+
+	expected := []nats.RePublishMeta{
+		{Stream: "TEST", Subject: "foo.a", Sequence: 1, LastSequence: 0, Size: -1},
+		{Stream: "TEST", Subject: "foo.b", Sequence: 2, LastSequence: 0, Size: -1},
+		{Stream: "TEST", Subject: "foo.a", Sequence: 3, LastSequence: 1, Size: -1},
+	}
+	for _, exp := range expected {
+		m, err := sub.NextMsg(time.Second)
+		expectOk(t, err)
+		meta, err := nats.ParseRePublishHeaders(m)
+		expectOk(t, err)
+		if *meta != exp {
+			t.Fatalf("Expected %+v, got %+v", exp, *meta)
+		}
+	}
+
+	m := nats.NewMsg("rp.foo.a")
+	if _, err := nats.ParseRePublishHeaders(m); err == nil {
+		t.Fatal("Expected error, got none")
+	}
+	m.Header.Set(nats.JSStream, "TEST")
+	m.Header.Set(nats.JSSubject, "foo.a")
+	m.Header.Set(nats.JSSequence, "abc")
+	if _, err := nats.ParseRePublishHeaders(m); err == nil || !strings.Contains(err.Error(), "invalid") {
+		t.Fatalf("Expected invalid sequence error, got %v", err)
+	}
+}
+
+func TestJetStreamConsumeRefreshConfig(t *testing.T) {
+	s := RunBasicJetStreamServer()
+	defer shutdownJSServerAndRemoveStorage(t, s)
+
+	nc, js := jsClient(t, s)
+	defer nc.Close()
+
+	_, err := js.AddStream(&nats.StreamConfig{Name: "TEST", Subjects: []string{"foo"}})
+	expectOk(t, err)
+	cfg := &nats.ConsumerConfig{
+		Durable:         "dlc",
+		AckPolicy:       nats.AckExplicitPolicy,
+		MaxRequestBatch: 2,
+		MaxAckPending:   5,
+	}
+	_, err = js.AddConsumer("TEST", cfg)
+	expectOk(t, err)
+	publish := func() {
+		t.Helper()
+		for i := 0; i < 10; i++ {
+			_, err := js.Publish("foo", []byte("hello"))
+			expectOk(t, err)
+		}
+	}
+	expectReceived := func(received *int32, expected int32) {
+		t.Helper()
+		checkFor(t, 10*time.Second, 15*time.Millisecond, func() error {
+			if n := atomic.LoadInt32(received); n != expected {
+				return fmt.Errorf("Expected %d messages, got %d", expected, n)
+			}
+			return nil
+		})
+	}
+
+	// Pull requests exceeding MaxRequestBatch make Consume() pick up the limits.
+	publish()
+	var received int32
+	sub, err := js.Consume("TEST", "dlc", func(m *nats.Msg) {
+		atomic.AddInt32(&received, 1)
+	})
+	expectOk(t, err)
+	expectReceived(&received, 10)
+	sub.Unsubscribe()
+
+	// Raising MaxAckPending applies while consuming.
+	publish()
+	atomic.StoreInt32(&received, 0)
+	sub, err = js.Consume("TEST", "dlc", func(m *nats.Msg) {
+		atomic.AddInt32(&received, 1)
+	}, nats.ManualAck(), nats.ConsumeRefreshConfig(time.Hour))
+	expectOk(t, err)
+	defer sub.Unsubscribe()
+	expectReceived(&received, 5)
+	cfg.MaxAckPending = 10
+	_, err = js.UpdateConsumer("TEST", cfg)
+	expectOk(t, err)
+	expectOk(t, sub.RefreshConsumerConfig())
+	expectReceived(&received, 10)
+
+	if _, err := js.Consume("TEST", "dlc", func(m *nats.Msg) {}, nats.ConsumeRefreshConfig(0)); !errors.Is(err, nats.ErrInvalidArg) {
+		t.Fatalf("Expected error %v, got %v", nats.ErrInvalidArg, err)
+	}
+	if _, err := js.Consume("TEST", "missing", func(m *nats.Msg) {}, nats.ConsumeRefreshConfig(time.Second)); !errors.Is(err, nats.ErrConsumerNotFound) {
+		t.Fatalf("Expected error %v, got %v", nats.ErrConsumerNotFound, err)
+	}
+}
+
+func TestJetStreamFetchFirst(t *testing.T) {
+	s := RunBasicJetStreamServer()
+	defer shutdownJSServerAndRemoveStorage(t, s)
+
+	nc, js := jsClient(t, s)
+	defer nc.Close()
+
+	_, err := js.AddStream(&nats.StreamConfig{Name: "TEST", Subjects: []string{"foo"}})
+	expectOk(t, err)
+	sub, err := js.PullSubscribe("foo", "dlc")
+	expectOk(t, err)
+	defer sub.Unsubscribe()
+
+	go func() {
+		time.Sleep(100 * time.Millisecond)
+		js.Publish("foo", []byte("hello"))
+	}()
+	start := time.Now()
+	msgs, err := sub.FetchFirst(10, nats.MaxWait(5*time.Second))
+	expectOk(t, err)
+	if len(msgs) != 1 {
+		t.Fatalf("Expected 1 message, got %d", len(msgs))
+	}
+	if elapsed := time.Since(start); elapsed > 2*time.Second {
+		t.Fatalf("Expected FetchFirst to return on the first message, took %v", elapsed)
+	}
+	// No pull request is left open on the server.
+	info, err := sub.ConsumerInfo()
+	expectOk(t, err)
+	if info.NumWaiting != 0 {
+		t.Fatalf("Expected no waiting pull request, got %d", info.NumWaiting)
+	}
+
+	// Messages published later are returned by the next calls.
+	for i := 0; i < 3; i++ {
+		_, err := js.Publish("foo", []byte("hello"))
+		expectOk(t, err)
+	}
+	var received int
+	for received < 3 {
+		msgs, err := sub.FetchFirst(10, nats.MaxWait(time.Second))
+		expectOk(t, err)
+		if len(msgs) > 3-received {
+			t.Fatalf("Expected at most %d messages, got %d", 3-received, len(msgs))
+		}
+		received += len(msgs)
+	}
+
+	if _, err := sub.FetchFirst(10, nats.MaxWait(250*time.Millisecond)); err != nats.ErrTimeout {
+		t.Fatalf("Expected error %v, got %v", nats.ErrTimeout, err)
+	}
+}
+
+func TestJetStreamConsumerBackOffValidation(t *testing.T) {
+	s := RunBasicJetStreamServer()
+	defer shutdownJSServerAndRemoveStorage(t, s)
+
+	errCh := make(chan error, 10)
+	nc, err := nats.Connect(s.ClientURL(), nats.ErrorHandler(func(_ *nats.Conn, _ *nats.Subscription, err error) {
+		errCh <- err
+	}))
+	expectOk(t, err)
+	defer nc.Close()
+	js, err := nc.JetStream()
+	expectOk(t, err)
+
+	_, err = js.AddStream(&nats.StreamConfig{Name: "TEST", Subjects: []string{"foo"}})
+	expectOk(t, err)
+
+	backoff := []time.Duration{time.Second, 5 * time.Second, 30 * time.Second}
+
+	// Negative backoff values are rejected.
+	cfg := &nats.ConsumerConfig{Durable: "dlc", AckPolicy: nats.AckExplicitPolicy, BackOff: []time.Duration{time.Second, -time.Second}, MaxDeliver: 5}
+	if _, err := js.AddConsumer("TEST", cfg); !errors.Is(err, nats.ErrInvalidConsumerConfig) {
+		t.Fatalf("Expected error %v, got %v", nats.ErrInvalidConsumerConfig, err)
+	}
+	if _, err := js.UpdateConsumer("TEST", cfg); !errors.Is(err, nats.ErrInvalidConsumerConfig) {
+		t.Fatalf("Expected error %v, got %v", nats.ErrInvalidConsumerConfig, err)
+	}
+
+	// An ack wait smaller than the largest backoff value is accepted, but
+	// reported to the asynchronous error handler.
+	info, err := js.AddConsumer("TEST", &nats.ConsumerConfig{Durable: "small", AckPolicy: nats.AckExplicitPolicy, AckWait: 500 * time.Millisecond, BackOff: backoff, MaxDeliver: 5})
+	expectOk(t, err)
+	if info.Config.AckWait != time.Second {
+		t.Fatalf("Expected ack wait of %v, got %v", time.Second, info.Config.AckWait)
+	}
+	select {
+	case err := <-errCh:
+		if !errors.Is(err, nats.ErrAckWaitBelowBackOff) {
+			t.Fatalf("Expected error %v, got %v", nats.ErrAckWaitBelowBackOff, err)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("Did not get the warning")
+	}
+
+	// The server derives the ack wait from the first backoff value.
+	info, err = js.AddConsumer("TEST", &nats.ConsumerConfig{Durable: "unset", AckPolicy: nats.AckExplicitPolicy, BackOff: backoff, MaxDeliver: 5})
+	expectOk(t, err)
+	if info.Config.AckWait != time.Second {
+		t.Fatalf("Expected ack wait of %v, got %v", time.Second, info.Config.AckWait)
+	}
+	_, err = js.AddConsumer("TEST", &nats.ConsumerConfig{Durable: "large", AckPolicy: nats.AckExplicitPolicy, AckWait: time.Minute, BackOff: backoff, MaxDeliver: 5})
+	expectOk(t, err)
+	select {
+	case err := <-errCh:
+		t.Fatalf("Unexpected error: %v", err)
+	case <-time.After(100 * time.Millisecond):
+	}
+}
+
+func TestJetStreamMsgDecodeJSON(t *testing.T) {
+	s := RunBasicJetStreamServer()
+	defer shutdownJSServerAndRemoveStorage(t, s)
+
+	nc, js := jsClient(t, s)
+	defer nc.Close()
+
+	_, err := js.AddStream(&nats.StreamConfig{Name: "TEST", Subjects: []string{"foo"}})
+	expectOk(t, err)
+
+	type order struct {
+		ID    int    `json:"id"`
+		Item  string `json:"item"`
+		Count int    `json:"count"`
+	}
+	_, err = js.Publish("foo", []byte(`{"id":1,"item":"apple","count":3}`))
+	expectOk(t, err)
+	_, err = js.Publish("foo", []byte(`not json`))
+	expectOk(t, err)
+
+	sub, err := js.SubscribeSync("foo", nats.ManualAck(), nats.AckWait(500*time.Millisecond))
+	expectOk(t, err)
+	defer sub.Unsubscribe()
+
+	msg, err := sub.NextMsg(time.Second)
+	expectOk(t, err)
+	var o order
+	expectOk(t, msg.DecodeJSON(&o, nats.TermOnDecodeError()))
+	if o != (order{ID: 1, Item: "apple", Count: 3}) {
+		t.Fatalf("Unexpected order: %+v", o)
+	}
+	expectOk(t, msg.Ack())
+
+	msg, err = sub.NextMsg(time.Second)
+	expectOk(t, err)
+	var poisoned *nats.Msg
+	err = msg.DecodeJSON(&o, nats.TermOnDecodeError(), nats.DecodeErrorHandler(func(m *nats.Msg, err error) {
+		poisoned = m
+	}))
+	if !errors.Is(err, nats.ErrMsgDecodeFailed) {
+		t.Fatalf("Expected error %v, got %v", nats.ErrMsgDecodeFailed, err)
+	}
+	if poisoned != msg {
+		t.Fatal("Expected the decode error handler to be invoked with the message")
+	}
+
+	// The terminated message is not redelivered.
+	if _, err := sub.NextMsg(time.Second); err != nats.ErrTimeout {
+		t.Fatalf("Expected error %v, got %v", nats.ErrTimeout, err)
+	}
+}
+
+func TestJetStreamConsumeSubjectTransform(t *testing.T) {
+	s := RunBasicJetStreamServer()
+	defer shutdownJSServerAndRemoveStorage(t, s)
+
+	nc, js := jsClient(t, s)
+	defer nc.Close()
+
+	_, err := js.AddStream(&nats.StreamConfig{Name: "TEST", Subjects: []string{"orders.>", "other"}})
+	expectOk(t, err)
+	_, err = js.AddConsumer("TEST", &nats.ConsumerConfig{Durable: "dlc", AckPolicy: nats.AckExplicitPolicy})
+	expectOk(t, err)
+	for _, subj := range []string{"orders.eu.1", "other", "orders.us.2"} {
+		_, err := js.Publish(subj, []byte("hello"))
+		expectOk(t, err)
+	}
+
+	subjects := make(chan string, 3)
+	sub, err := js.Consume("TEST", "dlc", func(m *nats.Msg) {
+		subjects <- m.Subject
+	}, nats.ConsumeSubjectTransform("orders.*.*", "bridge.$2.$1"))
+	expectOk(t, err)
+	defer sub.Unsubscribe()
+
+	for _, expected := range []string{"bridge.1.eu", "other", "bridge.2.us"} {
+		select {
+		case subj := <-subjects:
+			if subj != expected {
+				t.Fatalf("Expected subject %q, got %q", expected, subj)
+			}
+		case <-time.After(2 * time.Second):
+			t.Fatal("Did not receive message")
+		}
+	}
+
+	// Messages are acknowledged as usual.
+	checkFor(t, 2*time.Second, 15*time.Millisecond, func() error {
+		info, err := js.ConsumerInfo("TEST", "dlc")
+		if err != nil {
+			return err
+		}
+		if info.AckFloor.Stream != 3 {
+			return fmt.Errorf("Unexpected consumer state: %+v", info)
+		}
+		return nil
+	})
+
+	if _, err := js.Consume("TEST", "dlc", func(m *nats.Msg) {}, nats.ConsumeSubjectTransform("orders.*", "bridge.*.*")); !errors.Is(err, nats.ErrInvalidArg) {
+		t.Fatalf("Expected error %v, got %v", nats.ErrInvalidArg, err)
+	}
+}
+
+func TestJetStreamNakTermBatch(t *testing.T) {
+	s := RunBasicJetStreamServer()
+	defer shutdownJSServerAndRemoveStorage(t, s)
+
+	nc, js := jsClient(t, s)
+	defer nc.Close()
+
+	_, err := js.AddStream(&nats.StreamConfig{Name: "TEST", Subjects: []string{"foo"}})
+	expectOk(t, err)
+	for i := 0; i < 5; i++ {
+		_, err := js.Publish("foo", []byte(strconv.Itoa(i)))
+		expectOk(t, err)
+	}
+	sub, err := js.PullSubscribe("foo", "dlc", nats.AckWait(10*time.Second))
+	expectOk(t, err)
+	defer sub.Unsubscribe()
+
+	msgs, err := sub.Fetch(5)
+	expectOk(t, err)
+	if len(msgs) != 5 {
+		t.Fatalf("Expected 5 messages, got %d", len(msgs))
+	}
+	expectOk(t, nats.TermBatch(msgs[:3]))
+
+	// Already terminated messages are reported, the others are nak'ed.
+	err = nats.NakBatch([]*nats.Msg{msgs[3], msgs[0], msgs[4]}, 100*time.Millisecond)
+	var batchErr *nats.AckBatchError
+	if !errors.As(err, &batchErr) {
+		t.Fatalf("Expected AckBatchError, got %v", err)
+	}
+	if len(batchErr.Errs) != 3 || batchErr.Errs[0] != nil || batchErr.Errs[1] != nats.ErrMsgAlreadyAckd || batchErr.Errs[2] != nil {
+		t.Fatalf("Unexpected errors: %v", batchErr.Errs)
+	}
+	if !errors.Is(err, nats.ErrMsgAlreadyAckd) {
+		t.Fatalf("Expected error %v, got %v", nats.ErrMsgAlreadyAckd, err)
+	}
+
+	// Only the nak'ed messages are redelivered.
+	var redelivered []string
+	for len(redelivered) < 2 {
+		msgs, err := sub.Fetch(5, nats.MaxWait(2*time.Second))
+		expectOk(t, err)
+		for _, m := range msgs {
+			redelivered = append(redelivered, string(m.Data))
+			expectOk(t, m.Ack())
+		}
+	}
+	if len(redelivered) != 2 || redelivered[0] != "3" || redelivered[1] != "4" {
+		t.Fatalf("Unexpected redeliveries: %v", redelivered)
+	}
+}
+
+func TestJetStreamConsumerStartSkipped(t *testing.T) {
+	s := RunBasicJetStreamServer()
+	defer shutdownJSServerAndRemoveStorage(t, s)
+
+	nc, js := jsClient(t, s)
+	defer nc.Close()
+
+	_, err := js.AddStream(&nats.StreamConfig{Name: "TEST", Subjects: []string{"foo"}})
+	expectOk(t, err)
+	for i := 0; i < 10; i++ {
+		_, err := js.Publish("foo", []byte("hello"))
+		expectOk(t, err)
+	}
+	expectOk(t, js.PurgeStream("TEST", &nats.StreamPurgeRequest{Sequence: 6}))
+
+	// Messages 3 to 5 were purged, the consumer starts at 6.
+	info, err := js.AddConsumer("TEST", &nats.ConsumerConfig{
+		Durable:       "purged",
+		AckPolicy:     nats.AckExplicitPolicy,
+		DeliverPolicy: nats.DeliverByStartSequencePolicy,
+		OptStartSeq:   3,
+	})
+	expectOk(t, err)
+	if start, ok := info.StartSequence(); !ok || start != 6 {
+		t.Fatalf("Expected start sequence 6, got %d (%v)", start, ok)
+	}
+	if n := info.StartSkipped(); n != 3 {
+		t.Fatalf("Expected 3 skipped sequences, got %d", n)
+	}
+
+	info, err = js.AddConsumer("TEST", &nats.ConsumerConfig{
+		Durable:       "available",
+		AckPolicy:     nats.AckExplicitPolicy,
+		DeliverPolicy: nats.DeliverByStartSequencePolicy,
+		OptStartSeq:   8,
+	})
+	expectOk(t, err)
+	if start, ok := info.StartSequence(); !ok || start != 8 {
+		t.Fatalf("Expected start sequence 8, got %d (%v)", start, ok)
+	}
+	if n := info.StartSkipped(); n != 0 {
+		t.Fatalf("Expected no skipped sequences, got %d", n)
+	}
+
+	// The start is unknown once messages were delivered.
+	sub, err := js.PullSubscribe("foo", "available", nats.Bind("TEST", "available"))
+	expectOk(t, err)
+	defer sub.Unsubscribe()
+	_, err = sub.Fetch(1)
+	expectOk(t, err)
+	info, err = js.ConsumerInfo("TEST", "available")
+	expectOk(t, err)
+	if _, ok := info.StartSequence(); ok {
+		t.Fatal("Expected start sequence to be unknown")
+	}
+}
+
+func TestJetStreamConsumeWaitForReady(t *testing.T) {
+	s := RunBasicJetStreamServer()
+	defer shutdownJSServerAndRemoveStorage(t, s)
+
+	nc, js := jsClient(t, s)
+	defer nc.Close()
+
+	_, err := js.AddStream(&nats.StreamConfig{Name: "TEST", Subjects: []string{"foo"}})
+	expectOk(t, err)
+	for i := 0; i < 2; i++ {
+		_, err := js.Publish("foo", []byte("hello"))
+		expectOk(t, err)
+	}
+
+	// The consumer does not exist, so no pull request succeeds.
+	start := time.Now()
+	_, err = js.Consume("TEST", "dlc", func(m *nats.Msg) {}, nats.ConsumeWaitForReady(500*time.Millisecond))
+	if err == nil {
+		t.Fatal("Expected error, got none")
+	}
+	if elapsed := time.Since(start); elapsed < 250*time.Millisecond || elapsed > 2*time.Second {
+		t.Fatalf("Unexpected wait for the consumer: %v", elapsed)
+	}
+
+	_, err = js.AddConsumer("TEST", &nats.ConsumerConfig{Durable: "dlc", AckPolicy: nats.AckExplicitPolicy})
+	expectOk(t, err)
+	var received int32
+	sub, err := js.Consume("TEST", "dlc", func(m *nats.Msg) {
+		atomic.AddInt32(&received, 1)
+	}, nats.ConsumeWaitForReady(time.Second))
+	expectOk(t, err)
+	defer sub.Unsubscribe()
+	checkFor(t, 2*time.Second, 15*time.Millisecond, func() error {
+		if n := atomic.LoadInt32(&received); n != 2 {
+			return fmt.Errorf("Expected 2 messages, got %d", n)
+		}
+		return nil
+	})
+
+	// A missing consumer is created if it can be recreated.
+	sub2, err := js.Consume("TEST", "new", func(m *nats.Msg) {},
+		nats.ConsumeWaitForReady(2*time.Second),
+		nats.ConsumeRecreateOnDelete(nats.ConsumerConfig{AckPolicy: nats.AckExplicitPolicy}))
+	expectOk(t, err)
+	defer sub2.Unsubscribe()
+	_, err = js.ConsumerInfo("TEST", "new")
+	expectOk(t, err)
+
+	// The configuration is only refreshed once the consumer is ready.
+	sub3, err := js.Consume("TEST", "refreshed", func(m *nats.Msg) {},
+		nats.ConsumeWaitForReady(2*time.Second),
+		nats.ConsumeRefreshConfig(time.Minute),
+		nats.ConsumeRecreateOnDelete(nats.ConsumerConfig{AckPolicy: nats.AckExplicitPolicy}))
+	expectOk(t, err)
+	defer sub3.Unsubscribe()
+
+	if _, err := js.Consume("TEST", "dlc", func(m *nats.Msg) {}, nats.ConsumeWaitForReady(0)); !errors.Is(err, nats.ErrInvalidArg) {
+		t.Fatalf("Expected error %v, got %v", nats.ErrInvalidArg, err)
+	}
+}
+
+func TestJetStreamDeleteAllConsumers(t *testing.T) {
+	s := RunBasicJetStreamServer()
+	defer shutdownJSServerAndRemoveStorage(t, s)
+
+	nc, js := jsClient(t, s)
+	defer nc.Close()
+
+	_, err := js.AddStream(&nats.StreamConfig{Name: "TEST", Subjects: []string{"foo"}})
+	expectOk(t, err)
+	_, err = js.AddStream(&nats.StreamConfig{Name: "OTHER", Subjects: []string{"bar"}})
+	expectOk(t, err)
+	for i := 0; i < 20; i++ {
+		_, err := js.AddConsumer("TEST", &nats.ConsumerConfig{Durable: fmt.Sprintf("C%d", i), AckPolicy: nats.AckExplicitPolicy})
+		expectOk(t, err)
+	}
+	_, err = js.AddConsumer("OTHER", &nats.ConsumerConfig{Durable: "C0", AckPolicy: nats.AckExplicitPolicy})
+	expectOk(t, err)
+
+	results, err := js.DeleteAllConsumers("TEST")
+	expectOk(t, err)
+	if len(results) != 20 {
+		t.Fatalf("Expected 20 results, got %d", len(results))
+	}
+	for _, res := range results {
+		if res.Action != nats.ApplyDeleted || res.Err != nil {
+			t.Fatalf("Unexpected result for %q: %v %v", res.Name, res.Action, res.Err)
+		}
+	}
+	if all, err := js.AllConsumers("TEST"); err != nil || len(all) != 0 {
+		t.Fatalf("Expected no consumers, got %d (%v)", len(all), err)
+	}
+	// Consumers of other streams are kept.
+	_, err = js.ConsumerInfo("OTHER", "C0")
+	expectOk(t, err)
+
+	results, err = js.DeleteAllConsumers("TEST")
+	expectOk(t, err)
+	if len(results) != 0 {
+		t.Fatalf("Expected no results, got %d", len(results))
+	}
+
+	if _, err := js.DeleteAllConsumers("MISSING"); !errors.Is(err, nats.ErrStreamNotFound) {
+		t.Fatalf("Expected error %v, got %v", nats.ErrStreamNotFound, err)
+	}
+
+	// Consumers are listed and deleted with the API prefix of the call.
+	relayed := relayJSAPI(t, nc, "$JS.relay.API.")
+	for i := 0; i < 2; i++ {
+		_, err := js.AddConsumer("TEST", &nats.ConsumerConfig{Durable: fmt.Sprintf("C%d", i), AckPolicy: nats.AckExplicitPolicy})
+		expectOk(t, err)
+	}
+	results, err = js.DeleteAllConsumers("TEST", nats.APIPrefix("$JS.relay.API"))
+	expectOk(t, err)
+	if len(results) != 2 {
+		t.Fatalf("Expected 2 results, got %d", len(results))
+	}
+	var deletes int
+	for _, subj := range relayed() {
+		if strings.HasPrefix(subj, "$JS.relay.API.CONSUMER.DELETE.TEST.") {
+			deletes++
+		}
+	}
+	if deletes != 2 {
+		t.Fatalf("Expected 2 deletes with the API prefix, got %d", deletes)
+	}
+
+	// Consumers not deleted before the context is done are reported.
+	_, err = js.AddConsumer("TEST", &nats.ConsumerConfig{Durable: "C0", AckPolicy: nats.AckExplicitPolicy})
+	expectOk(t, err)
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	if _, err := js.DeleteAllConsumers("TEST", nats.Context(ctx)); err == nil {
+		t.Fatal("Expected error, got none")
+	}
+	_, err = js.ConsumerInfo("TEST", "C0")
+	expectOk(t, err)
+}
+
+func TestJetStreamConsumeLatencyHandler(t *testing.T) {
+	s := RunBasicJetStreamServer()
+	defer shutdownJSServerAndRemoveStorage(t, s)
+
+	nc, js := jsClient(t, s)
+	defer nc.Close()
+
+	_, err := js.AddStream(&nats.StreamConfig{Name: "TEST", Subjects: []string{"foo"}})
+	expectOk(t, err)
+	_, err = js.AddConsumer("TEST", &nats.ConsumerConfig{Durable: "dlc", AckPolicy: nats.AckExplicitPolicy})
+	expectOk(t, err)
+
+	var mu sync.Mutex
+	var latencies []nats.DeliveryLatency
+	handled := make(chan struct{}, 3)
+	sub, err := js.Consume("TEST", "dlc", func(m *nats.Msg) {
+		handled <- struct{}{}
+	}, nats.ConsumeLatencyHandler(func(m *nats.Msg, l nats.DeliveryLatency) {
+		mu.Lock()
+		latencies = append(latencies, l)
+		mu.Unlock()
+	}))
+	expectOk(t, err)
+	defer sub.Unsubscribe()
+
+	time.Sleep(100 * time.Millisecond)
+	for i := 0; i < 3; i++ {
+		_, err := js.Publish("foo", []byte("hello"))
+		expectOk(t, err)
+	}
+	for i := 0; i < 3; i++ {
+		select {
+		case <-handled:
+		case <-time.After(2 * time.Second):
+			t.Fatal("Did not receive message")
+		}
+	}
+
+	mu.Lock()
+	defer mu.Unlock()
+	if len(latencies) != 3 {
+		t.Fatalf("Expected 3 latencies, got %d", len(latencies))
+	}
+	// The first message was published while the pull request was waiting.
+	if l := latencies[0]; l.Pull < 100*time.Millisecond || l.Pull > 5*time.Second {
+		t.Fatalf("Unexpected pull latency: %v", l.Pull)
+	}
+	for _, l := range latencies {
+		if l.Publish < 0 || l.Publish > time.Second {
+			t.Fatalf("Unexpected publish latency: %v", l.Publish)
+		}
+	}
+
+	if _, err := js.Consume("TEST", "dlc", func(m *nats.Msg) {}, nats.ConsumeLatencyHandler(nil)); !errors.Is(err, nats.ErrInvalidArg) {
+		t.Fatalf("Expected error %v, got %v", nats.ErrInvalidArg, err)
+	}
+}
+
+// relayJSAPI forwards the API requests made with the prefix pre to the
+// JetStream API, and returns a function listing the subjects relayed so far.
+func relayJSAPI(t *testing.T, nc *nats.Conn, pre string) func() []string {
+	t.Helper()
+	var mu sync.Mutex
+	var subjs []string
+	_, err := nc.Subscribe(pre+">", func(m *nats.Msg) {
+		mu.Lock()
+		subjs = append(subjs, m.Subject)
+		mu.Unlock()
+		resp, err := nc.Request("$JS.API."+strings.TrimPrefix(m.Subject, pre), m.Data, time.Second)
+		if err != nil {
+			return
+		}
+		m.Respond(resp.Data)
+	})
+	expectOk(t, err)
+	return func() []string {
+		mu.Lock()
+		defer mu.Unlock()
+		return append([]string(nil), subjs...)
+	}
+}